@@ -1,15 +1,21 @@
 package ast
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prequel-dev/prequel-compiler/pkg/internal/pool"
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-logmatch/pkg/match"
 	"github.com/rs/zerolog/log"
@@ -28,10 +34,17 @@ var (
 	ErrMultipleOrigin          = errors.New("multiple origin events")
 	ErrInvalidAnchor           = errors.New("invalid negate anchor")
 	ErrNoTermIdx               = errors.New("no term idx")
+	ErrInvalidAddress          = errors.New("invalid node address")
 )
 
 type AstT struct {
 	Nodes []*AstNodeT `json:"nodes"`
+
+	// Per-rule parse and build time keyed by rule hash. Only populated WithTiming()
+	Timings map[string]time.Duration `json:"-"`
+
+	// Statistics of the build. Only populated WithStats()
+	Stats *BuildStatsT `json:"-"`
 }
 
 type AstNodeAddressT struct {
@@ -49,28 +62,80 @@ type AstNodeT struct {
 	Object   any          `json:"object"`   // Object for the node (e.g. log matcher, state machine, descriptor, etc.)
 }
 
+// Window returns the node's effective window: the window of a log matcher or
+// state machine, or the 'for' duration of a PromQL node. Returns false for
+// node types without a window.
+func (n *AstNodeT) Window() (time.Duration, bool) {
+	switch o := n.Object.(type) {
+	case *AstLogMatcherT:
+		return o.Window, true
+	case *AstSeqMatcherT:
+		return o.Window, true
+	case *AstSetMatcherT:
+		return o.Window, true
+	case *AstPromQL:
+		return o.For, true
+	case *AstNodeT:
+		// Machine nodes wrap their PromQL node
+		return o.Window()
+	}
+	return 0, false
+}
+
 type AstMetadataT struct {
-	Type          schema.NodeTypeT `json:"type"`           // Type of the node
-	Address       *AstNodeAddressT `json:"address"`        // Address of this node in the rule tree. Must be globally unique in the tree
-	ParentAddress *AstNodeAddressT `json:"parent_address"` // Address of the parent node
-	NegateOpts    *AstNegateOptsT  `json:"negate_opts"`    // Optional egate options for the node
-	RuleId        string           `json:"rule_id"`        // Consistent identifier for the rule that remains consistent through rule logic changes
-	Scope         string           `json:"scope"`          // Scope can be an individual node, a cluster, or a set of clusters
-	NegIdx        int              `json:"neg_idx"`        // Index into children where negative conditions begin. Equals -1 if no children or no negative conditions
+	Type          schema.NodeTypeT `json:"type"`                   // Type of the node
+	Address       *AstNodeAddressT `json:"address"`                // Address of this node in the rule tree. Must be globally unique in the tree
+	ParentAddress *AstNodeAddressT `json:"parent_address"`         // Address of the parent node
+	NegateOpts    *AstNegateOptsT  `json:"negate_opts"`            // Optional egate options for the node
+	RuleId        string           `json:"rule_id"`                // Consistent identifier for the rule that remains consistent through rule logic changes
+	Scope         string           `json:"scope"`                  // Scope can be an individual node, a cluster, or a set of clusters
+	NegIdx        int              `json:"neg_idx"`                // Index into children where negative conditions begin. Equals -1 if no children or no negative conditions
+	Repeat        *AstRepeatT      `json:"repeat,omitempty"`       // Repetition of this node as a step of its parent sequence
+	MaxGap        time.Duration    `json:"max_gap,omitempty"`      // Maximum time since the previous step of its parent sequence
+	Optional      bool             `json:"optional,omitempty"`     // Step of its parent sequence that may be skipped
+	ScopeBridge   *AstScopeBridgeT `json:"scope_bridge,omitempty"` // Machine nodes whose terms are in more than one scope
+	Pos           pqerr.Pos        `json:"-"`                      // Position of the term the node was built from
+
+	// Root only
+	Sources           []string `json:"sources,omitempty"`             // Event sources referenced by the rule
+	RequireAllSources bool     `json:"require_all_sources,omitempty"` // Skip the rule unless every source in Sources is collected
+	Priority          int      `json:"priority,omitempty"`            // Higher priority rules take precedence when several fire on the same event
 }
 
 // NegateOptsT contains optional negate settings for the matcher object
 type AstNegateOptsT struct {
 	Window   time.Duration `json:"window"`
 	Slide    time.Duration `json:"slide"`
-	Anchor   uint32        `json:"anchor"`
+	Anchor   uint32        `json:"anchor"` // Index of the match field, not of the runtime terms a counted field expands to
 	Absolute bool          `json:"absolute"`
+	Count    int           `json:"count,omitempty"` // Suppress only once the negate occurs this many times in the window
+
+	AnchorName string `json:"anchor_name,omitempty"` // Term the anchor was resolved from, if named; for debugging only
+
+	// Negation ends when the step at index Until of the sequence matches. Zero if not set.
+	Until     uint32 `json:"until,omitempty"`
+	UntilName string `json:"until_name,omitempty"`
+}
+
+// AstStepRefT is a dependency of a sequence term on the value extracted by an
+// earlier term. The ${step.extract} reference is left in the term's condition.
+type AstStepRefT struct {
+	Term    int    `json:"term"`
+	Step    int    `json:"step"`
+	Extract string `json:"extract"`
 }
 
 type AstExtractT struct {
-	Name       string `json:"name"`
-	JqValue    string `json:"jq_value,omitempty"`
-	RegexValue string `json:"regex_value,omitempty"`
+	Name       string              `json:"name"`
+	JqValue    string              `json:"jq_value,omitempty"`
+	RegexValue string              `json:"regex_value,omitempty"`
+	Type       schema.ExtractTypeT `json:"type,omitempty"`       // Raw string if empty
+	Transforms []AstTransformT     `json:"transforms,omitempty"` // Applied in order before the type
+}
+
+type AstTransformT struct {
+	Op   schema.TransformOpT `json:"op"`
+	Args []int               `json:"args,omitempty"`
 }
 
 type AstFieldT struct {
@@ -78,6 +143,134 @@ type AstFieldT struct {
 	TermValue  match.TermT     `json:"term_value"`
 	NegateOpts *AstNegateOptsT `json:"negate_opts"`
 	Extracts   []AstExtractT   `json:"extracts"`
+	Primary    bool            `json:"primary,omitempty"`     // Condition that best describes the alert
+	Repeat     *AstRepeatT     `json:"repeat,omitempty"`      // Sequence steps only
+	MaxGap     time.Duration   `json:"max_gap,omitempty"`     // Sequence steps only; maximum time since the previous step
+	Optional   bool            `json:"optional,omitempty"`    // Sequence steps only; the step may be skipped
+	Count      int             `json:"count,omitempty"`       // Times the condition must match, expanded into copies by the compiler; zero is once
+	CountRange *AstCountRangeT `json:"count_range,omitempty"` // Sequence steps only; bounds the times the condition must match
+	IPCidr     *AstIPCidrT     `json:"ip_cidr,omitempty"`     // Replaces TermValue; matches the field against CIDR blocks
+	Glob       *AstGlobT       `json:"glob,omitempty"`        // TermValue holds the equivalent regex
+
+	Annotations map[string]string `json:"annotations,omitempty"` // Included in events emitted for this condition
+}
+
+// Occurrences returns the number of times the condition must match: its count, or one
+func (f AstFieldT) Occurrences() int {
+	return max(f.Count, 1)
+}
+
+// AstIPCidrT matches when the IP address in a field of a structured (JSON) event
+// is within any of the CIDR blocks
+type AstIPCidrT struct {
+	Prefixes []netip.Prefix `json:"prefixes"`
+}
+
+// Contains reports whether addr is an IP address within any of the blocks.
+// IPv4-mapped IPv6 addresses match IPv4 blocks.
+func (c *AstIPCidrT) Contains(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range c.Prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AstGlobT matches a glob against the whole value. Globs made of literals and
+// '*' only are matched by searching for the literal segments in order; others
+// use the equivalent regex.
+type AstGlobT struct {
+	Pattern  string   `json:"pattern"`
+	Segments []string `json:"segments,omitempty"` // Literals between '*'s, if the glob has no '?', class, or escape
+	Regex    string   `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+func newGlob(pattern string) (*AstGlobT, error) {
+
+	re, err := parser.GlobRegex(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &AstGlobT{Pattern: pattern, Regex: re}
+
+	if !strings.ContainsAny(pattern, `?[\`) {
+		g.Segments = strings.Split(pattern, "*")
+	} else if g.re, err = regexp.Compile(re); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Match reports whether the glob matches all of s
+func (g *AstGlobT) Match(s string) bool {
+
+	if g.Segments == nil {
+		re := g.re
+		if re == nil { // Decoded from JSON
+			re = regexp.MustCompile(g.Regex)
+		}
+		return re.MatchString(s)
+	}
+
+	var (
+		first = g.Segments[0]
+		last  = g.Segments[len(g.Segments)-1]
+	)
+
+	if len(g.Segments) == 1 {
+		return s == first
+	}
+
+	if !strings.HasPrefix(s, first) {
+		return false
+	}
+	s = s[len(first):]
+
+	for _, seg := range g.Segments[1 : len(g.Segments)-1] {
+		i := strings.Index(s, seg)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(seg):]
+	}
+
+	return strings.HasSuffix(s, last)
+}
+
+// AstRepeatT bounds how many consecutive times a sequence step may match. A Max of zero is unbounded.
+type AstRepeatT struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
+}
+
+// AstCountRangeT bounds how many times a sequence step must match. A Max of zero is unbounded.
+type AstCountRangeT struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
+}
+
+func newCountRange(r *parser.CountRangeT) *AstCountRangeT {
+	if r == nil {
+		return nil
+	}
+	return &AstCountRangeT{Min: r.Min, Max: r.Max}
+}
+
+func newRepeat(r *parser.RepeatT) *AstRepeatT {
+	if r == nil {
+		return nil
+	}
+	return &AstRepeatT{Min: r.Min, Max: r.Max}
 }
 
 type AstEventT struct {
@@ -89,6 +282,8 @@ type builderT struct {
 	CurrentNodeId uint32
 	CurrentDepth  uint32
 	OriginCnt     int
+
+	opts *buildOptsT
 }
 
 func NewBuilder() *builderT {
@@ -99,61 +294,392 @@ func NewBuilder() *builderT {
 	}
 }
 
-func (b *builderT) descendTree(fn func() error) error {
+func (b *builderT) descendTree(parserNode *parser.NodeT, fn func() error) error {
 	b.CurrentDepth++
 	defer func() { b.CurrentDepth-- }()
+	if b.opts != nil {
+		if err := b.opts.checkDepth(parserNode, b.CurrentDepth); err != nil {
+			return err
+		}
+	}
 	return fn()
 }
 
-func Build(data []byte) (*AstT, error) {
+type BuildOptT func(*buildOptsT)
+
+type buildOptsT struct {
+	parseOpts     []parser.ParseOptT
+	timing        bool
+	diagnostics   func(pqerr.Diagnostic)
+	minStepWindow time.Duration
+
+	strictSequences bool
+	scopePolicy     ScopePolicyT
+
+	skipValidations    []string
+	validationSeverity map[string]pqerr.Severity
+
+	ctx context.Context
+
+	maxDepth       int
+	maxRules       int
+	strictSources  bool
+	allowedSources []string
+	disabledTypes  []schema.NodeTypeT
+
+	stats               bool
+	verifyDeterministic bool
+	parallelism         int
+	cache               *CacheT
+}
+
+// WithTiming records the wall-clock time spent parsing and building each rule in AstT.Timings
+func WithTiming() BuildOptT {
+	return func(o *buildOptsT) {
+		o.timing = true
+	}
+}
+
+// WithParseOpts passes options (e.g. parser.WithDurationConstants) through to the parser
+func WithParseOpts(opts ...parser.ParseOptT) BuildOptT {
+	return func(o *buildOptsT) {
+		o.parseOpts = append(o.parseOpts, opts...)
+	}
+}
+
+// WithRuleFilter builds only the rules for which filter returns true, skipping the
+// others before they are parsed into trees. See parser.WithRuleFilter.
+func WithRuleFilter(filter func(parser.ParseRuleT) bool) BuildOptT {
+	return WithParseOpts(parser.WithRuleFilter(filter))
+}
+
+// WithParallelism parses and builds up to n rules at a time. The tree is the same
+// as a sequential build: rules keep their order, diagnostics are sent in rule
+// order from the calling goroutine, and when several rules fail, the error of the
+// first one is returned. Scope policies, registered passes and validations, and
+// value resolvers must be safe for concurrent use.
+func WithParallelism(n int) BuildOptT {
+	return func(o *buildOptsT) {
+		o.parallelism = n
+	}
+}
+
+func buildOpts(opts ...BuildOptT) *buildOptsT {
+	o := &buildOptsT{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *buildOptsT) parserOpts() []parser.ParseOptT {
+	var opts = slices.Clone(o.parseOpts)
+	if o.timing {
+		opts = append(opts, parser.WithTiming())
+	}
+	if o.parallelism > 1 {
+		opts = append(opts, parser.WithParallelism(o.parallelism))
+	}
+	if o.cache != nil {
+		opts = append(opts, parser.WithContentHash())
+	}
+	return opts
+}
+
+func Build(data []byte, opts ...BuildOptT) (*AstT, error) {
+	ast, _, err := BuildWithTree(data, opts...)
+	return ast, err
+}
+
+// BuildWithTree builds the AST and also returns the parser tree it was built from.
+// The tree is returned even if the AST build fails, to help diagnose the failure.
+func BuildWithTree(data []byte, opts ...BuildOptT) (*AstT, *parser.TreeT, error) {
 	var (
 		parseTree *parser.TreeT
+		ast       *AstT
+		o         = buildOpts(opts...)
 		err       error
 	)
 
-	if parseTree, err = parser.Parse(data); err != nil {
+	start := time.Now()
+
+	if parseTree, err = parser.Parse(data, o.parserOpts()...); err != nil {
 		log.Error().Any("err", err).Msg("Parser failed")
+		return nil, nil, err
+	}
+
+	parsed := time.Since(start)
+
+	if ast, err = BuildTree(parseTree, opts...); err != nil {
+		return nil, parseTree, err
+	}
+
+	if ast.Stats != nil {
+		ast.Stats.Phases[PhaseParse] += parsed
+	}
+
+	if o.verifyDeterministic {
+		if err = verifyDeterministic(ast, data, opts); err != nil {
+			return nil, parseTree, err
+		}
+	}
+
+	return ast, parseTree, nil
+}
+
+// BuildContext builds the AST like Build, checking ctx before parsing and between
+// rules. A ctx error is returned as is before parsing, and positioned at the rule
+// about to be built after, so that callers know how far the build got.
+func BuildContext(ctx context.Context, data []byte, opts ...BuildOptT) (*AstT, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	opts = append(slices.Clone(opts), func(o *buildOptsT) {
+		o.ctx = ctx
+	})
+
+	return Build(data, opts...)
+}
+
+// BuildFiles builds the rules and terms of several files as one bundle. Files are
+// read with parser.ReadFiles, so rule ids that collide across files are reported
+// with both locations.
+func BuildFiles(paths []string, opts ...BuildOptT) (*AstT, error) {
+	var (
+		config    *parser.RulesT
+		parseTree *parser.TreeT
+		o         = buildOpts(opts...)
+		err       error
+	)
+
+	start := time.Now()
+
+	if config, err = parser.ReadFiles(paths, o.parserOpts()...); err != nil {
+		return nil, err
+	}
+
+	if parseTree, err = parser.ParseRules(config, o.parserOpts()); err != nil {
+		return nil, err
+	}
+
+	parsed := time.Since(start)
+
+	ast, err := BuildTree(parseTree, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if ast.Stats != nil {
+		ast.Stats.Phases[PhaseParse] += parsed
+	}
+
+	return ast, nil
+}
+
+// BuildRuleById builds the AST for the single rule whose id, hash, or cre id matches id.
+// Returns parser.ErrRuleNotFound if no rule matches.
+func BuildRuleById(data []byte, id string, opts ...BuildOptT) (*AstNodeT, error) {
+	var (
+		node *parser.NodeT
+		tree *AstT
+		o    = buildOpts(opts...)
+		err  error
+	)
+
+	if node, err = parser.ParseRuleById(data, id, o.parserOpts()...); err != nil {
 		return nil, err
 	}
 
-	return BuildTree(parseTree)
+	if tree, err = BuildTree(&parser.TreeT{Nodes: []*parser.NodeT{node}}, opts...); err != nil {
+		return nil, err
+	}
+
+	return tree.Nodes[0], nil
 }
 
 // Build AST from the given parser node in pre-order DFS traversal
-func BuildTree(tree *parser.TreeT) (*AstT, error) {
+func BuildTree(tree *parser.TreeT, opts ...BuildOptT) (*AstT, error) {
 	var (
+		o   = buildOpts(opts...)
 		ast = &AstT{
 			Nodes: make([]*AstNodeT, 0),
 		}
 	)
 
-	for _, parserNode := range tree.Nodes {
+	if err := o.checkRules(tree); err != nil {
+		return nil, err
+	}
 
-		var (
-			rb      = NewBuilder()
-			err     error
-			termIdx = uint32(0)
-			rule    *AstNodeT
-		)
+	if o.timing {
+		ast.Timings = make(map[string]time.Duration, len(tree.Nodes))
+		maps.Copy(ast.Timings, tree.Timings)
+	}
 
-		// Recursively build tree
-		if rule, err = rb.buildTree(parserNode, nil, &termIdx); err != nil {
-			return nil, err
+	var (
+		results = make([]ruleBuildT, len(tree.Nodes))
+		workers = make([]buildWorkerT, max(o.parallelism, 1))
+	)
+
+	for i := range workers {
+		if o.stats {
+			workers[i].stats = newBuildStats()
 		}
+	}
+
+	err := pool.Run(o.parallelism, len(tree.Nodes), func(w, i int) error {
+		results[i].err = o.buildRule(tree.Nodes[i], &workers[w], &results[i])
+		return results[i].err
+	})
 
-		switch {
-		case rb.OriginCnt == 0:
-			return nil, parserNode.WrapError(ErrMissingOrigin)
-		case rb.OriginCnt > 1:
-			return nil, parserNode.WrapError(ErrMultipleOrigin)
+	// Diagnostics buffered by parallel workers or the cache are sent in rule order,
+	// up to the rule that failed, as a sequential build would have sent them
+	for _, res := range results {
+		o.sendDiagnostics(res.diags)
+		if res.err != nil {
+			break
 		}
+	}
 
-		ast.Nodes = append(ast.Nodes, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, res := range results {
+		if o.timing {
+			ast.Timings[tree.Nodes[i].Metadata.RuleHash] += res.spent
+		}
+		ast.Nodes = append(ast.Nodes, res.rule)
+	}
+
+	if o.stats {
+		ast.Stats = newBuildStats()
+		for _, w := range workers {
+			ast.Stats.merge(w.stats)
+		}
 	}
 
 	return ast, nil
 }
 
+// buildWorkerT is the state of a worker of a build. Each worker has its own
+// statistics, so that rules built in parallel share nothing but the options.
+type buildWorkerT struct {
+	stats *BuildStatsT
+}
+
+// ruleBuildT is the result of building one rule of a tree
+type ruleBuildT struct {
+	rule  *AstNodeT
+	spent time.Duration
+	diags []pqerr.Diagnostic // Buffered when rules are built in parallel or cached
+	err   error
+}
+
+func (o *buildOptsT) sendDiagnostics(diags []pqerr.Diagnostic) {
+	if o.diagnostics == nil {
+		return
+	}
+	for _, d := range diags {
+		o.diagnostics(d)
+	}
+}
+
+func (o *buildOptsT) buildRule(parserNode *parser.NodeT, w *buildWorkerT, res *ruleBuildT) error {
+
+	var (
+		rb      = NewBuilder()
+		start   time.Time
+		err     error
+		termIdx = uint32(0)
+		rule    *AstNodeT
+	)
+
+	if o.ctx != nil {
+		if err = o.ctx.Err(); err != nil {
+			return parserNode.WrapError(err)
+		}
+	}
+
+	if o.cache != nil {
+		if e, ok := o.cache.get(parserNode.Metadata.ContentHash); ok {
+			res.rule, res.diags = e.node, e.diags
+			w.stats.addRule(e.node)
+			w.stats.addCache(true)
+			return nil
+		}
+		w.stats.addCache(false)
+	}
+
+	if o.timing {
+		start = time.Now()
+	}
+
+	// Cached rules keep their diagnostics, even for builds that do not ask for them
+	if o.parallelism > 1 && o.diagnostics != nil || o.cache != nil {
+		ro := *o
+		ro.diagnostics = func(d pqerr.Diagnostic) {
+			res.diags = append(res.diags, d)
+		}
+		o = &ro
+	}
+
+	// Recursively build tree
+	rb.opts = o
+	mark := time.Now()
+
+	if rule, err = rb.buildTree(parserNode, nil, &termIdx); err != nil {
+		return err
+	}
+
+	mark = w.stats.lap(PhaseBuild, mark)
+
+	if rule, err = runPasses(parserNode, rule); err != nil {
+		return err
+	}
+
+	mark = w.stats.lap(PhasePasses, mark)
+
+	if err = resolveScopes(parserNode, rule); err != nil {
+		return err
+	}
+
+	w.stats.lap(PhaseScopes, mark)
+
+	switch {
+	case rb.OriginCnt == 0:
+		return parserNode.WrapError(ErrMissingOrigin)
+	case rb.OriginCnt > 1:
+		return parserNode.WrapError(ErrMultipleOrigin)
+	}
+
+	if o.strictSequences {
+		if err = validateSeqFirstSteps(parserNode); err != nil {
+			return err
+		}
+	}
+
+	o.lint(parserNode)
+
+	rule.Metadata.Sources = parserNode.Sources()
+	rule.Metadata.RequireAllSources = parserNode.Metadata.RequireAllSources
+	rule.Metadata.Priority = parserNode.Metadata.Priority
+
+	if o.timing {
+		res.spent = time.Since(start)
+	}
+
+	w.stats.addRule(rule)
+	res.rule = rule
+
+	if o.cache != nil {
+		o.cache.put(parserNode.Metadata.ContentHash, rule, res.diags)
+	}
+
+	return nil
+}
+
 func (b *builderT) buildTree(parserNode *parser.NodeT, parentMachineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
 
 	var (
@@ -164,6 +690,12 @@ func (b *builderT) buildTree(parserNode *parser.NodeT, parentMachineAddress *Ast
 		err              error
 	)
 
+	if b.opts != nil {
+		if err = b.opts.checkNode(parserNode); err != nil {
+			return nil, err
+		}
+	}
+
 	// Build children (either matcher children or nested machines)
 	if parserNode.IsMatcherNode() {
 		if matchNode, err = b.buildMatcherChildren(parserNode, machineAddress, termIdx); err != nil {
@@ -192,9 +724,14 @@ func (b *builderT) buildTree(parserNode *parser.NodeT, parentMachineAddress *Ast
 	return machineMatchNode, nil
 }
 
+// Version of the address format, formatted once for all addresses
+var addressVersion = "v" + strconv.FormatInt(int64(AstVersion), 10)
+
 func (b *builderT) newAstNodeAddress(ruleHash, name string, termIdx *uint32) *AstNodeAddressT {
-	var address = &AstNodeAddressT{
-		Version:  "v" + strconv.FormatInt(int64(AstVersion), 10),
+	var address = new(AstNodeAddressT)
+
+	*address = AstNodeAddressT{
+		Version:  addressVersion,
 		Name:     name,
 		RuleHash: ruleHash,
 		Depth:    b.CurrentDepth,
@@ -207,8 +744,10 @@ func (b *builderT) newAstNodeAddress(ruleHash, name string, termIdx *uint32) *As
 	return address
 }
 
-func newAstNode(parserNode *parser.NodeT, typ schema.NodeTypeT, scope string, parentAddress, address *AstNodeAddressT) *AstNodeT {
-	return &AstNodeT{
+func (b *builderT) newAstNode(parserNode *parser.NodeT, typ schema.NodeTypeT, scope string, parentAddress, address *AstNodeAddressT) *AstNodeT {
+	var node = new(AstNodeT)
+
+	*node = AstNodeT{
 		Metadata: AstMetadataT{
 			RuleId:        parserNode.Metadata.RuleId,
 			Address:       address,
@@ -216,8 +755,14 @@ func newAstNode(parserNode *parser.NodeT, typ schema.NodeTypeT, scope string, pa
 			NegIdx:        parserNode.NegIdx,
 			Type:          typ,
 			Scope:         scope,
+			Repeat:        newRepeat(parserNode.Metadata.Repeat),
+			MaxGap:        parserNode.Metadata.MaxGap,
+			Optional:      parserNode.Metadata.Optional,
+			Pos:           parserNode.Metadata.Pos,
 		},
 	}
+
+	return node
 }
 
 func (b *builderT) buildMatcherChildren(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
@@ -242,7 +787,7 @@ func (b *builderT) buildMatcherChildren(parserNode *parser.NodeT, machineAddress
 	b.OriginCnt++
 	parserNode.Metadata.Event.Origin = true
 
-	err = b.descendTree(func() error {
+	err = b.descendTree(parserNode, func() error {
 		if matchNode, err = b.buildMatcherNodes(parserNode, machineAddress, termIdx); err != nil {
 			return err
 		}
@@ -259,10 +804,16 @@ func (b *builderT) buildMatcherNodes(parserNode *parser.NodeT, machineAddress *A
 
 	// Validation
 	switch parserNode.Metadata.Type {
-	case schema.NodeTypeLogSeq:
-	case schema.NodeTypeLogSet:
+	case schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
+	case schema.NodeTypeLogSet, schema.NodeTypeTraceSet:
 	case schema.NodeTypePromQL:
 		return b.buildPromQLNode(parserNode, machineAddress, termIdx)
+	case schema.NodeTypeAgg:
+		return b.buildAggMatcherNode(parserNode, machineAddress, termIdx)
+	case schema.NodeTypeFlowSet:
+		return b.buildFlowMatcherNode(parserNode, machineAddress, termIdx)
+	case schema.NodeTypeK8sResource:
+		return b.buildK8sResourceNode(parserNode, machineAddress, termIdx)
 	default:
 		return nil, parserNode.WrapError(ErrInvalidNodeType)
 	}
@@ -299,11 +850,20 @@ func (b *builderT) buildMachineChildren(parserNode *parser.NodeT, machineAddress
 					Msg("Negate anchor is greater than the number of children")
 				return nil, parserNode.WrapError(ErrInvalidAnchor)
 			}
+
+			positives := len(parserNode.Children)
+			if parserNode.NegIdx >= 0 {
+				positives = parserNode.NegIdx
+			}
+
+			if err = validateNegateUntil(parserNode, negateOpts, positives); err != nil {
+				return nil, err
+			}
 		}
 
 		// Process nested state machine
 		if parserChildNode.Metadata.Event == nil {
-			err = b.descendTree(func() error {
+			err = b.descendTree(parserChildNode, func() error {
 				if matchNode, err = b.buildTree(parserChildNode, machineAddress, &termIdx); err != nil {
 					return err
 				}
@@ -330,7 +890,13 @@ func (b *builderT) buildMachineChildren(parserNode *parser.NodeT, machineAddress
 			return nil, parserChildNode.WrapError(ErrInvalidEventType)
 		}
 
-		err = b.descendTree(func() error {
+		if b.opts != nil {
+			if err = b.opts.checkNode(parserChildNode); err != nil {
+				return nil, err
+			}
+		}
+
+		err = b.descendTree(parserChildNode, func() error {
 			if matchNode, err = b.buildMatcherNodes(parserChildNode, machineAddress, &termIdx); err != nil {
 				return err
 			}
@@ -353,24 +919,28 @@ func addNegateOpts(assert *AstNodeT, negateOpts *parser.NegateOptsT) {
 	}
 
 	assert.Metadata.NegateOpts = &AstNegateOptsT{
-		Window:   negateOpts.Window,
-		Slide:    negateOpts.Slide,
-		Anchor:   negateOpts.Anchor,
-		Absolute: negateOpts.Absolute,
+		Window:     negateOpts.Window,
+		Slide:      negateOpts.Slide,
+		Anchor:     negateOpts.Anchor,
+		Absolute:   negateOpts.Absolute,
+		AnchorName: negateOpts.AnchorName,
+		Until:      negateOpts.UntilIdx,
+		UntilName:  negateOpts.Until,
 	}
 }
 
 func (b *builderT) buildStateMachine(parserNode *parser.NodeT, parentMachineAddress *AstNodeAddressT, machineAddress *AstNodeAddressT, children []*AstNodeT) (*AstNodeT, error) {
 
 	switch parserNode.Metadata.Type {
-	case schema.NodeTypeSeq, schema.NodeTypeLogSeq:
+	case schema.NodeTypeSeq, schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq, schema.NodeTypeMetricSeq:
 		if parserNode.Metadata.Window == 0 {
 			log.Error().
 				Any("address", machineAddress).
 				Msg("Window is required for sequences")
 			return nil, parserNode.WrapError(ErrInvalidWindow)
 		}
-	case schema.NodeTypeSet, schema.NodeTypeLogSet, schema.NodeTypePromQL:
+	case schema.NodeTypeSet, schema.NodeTypeLogSet, schema.NodeTypeTraceSet, schema.NodeTypePromQL:
+	case schema.NodeTypeAny, schema.NodeTypeAll:
 	default:
 		log.Error().
 			Any("address", machineAddress).
@@ -382,6 +952,13 @@ func (b *builderT) buildStateMachine(parserNode *parser.NodeT, parentMachineAddr
 	return b.buildMachineNode(parserNode, parentMachineAddress, machineAddress, children)
 }
 
+// String returns the canonical form of the address, which is stable across
+// compiler versions and safe to persist:
+//
+//	<version>.<name>.<rule hash>.d<depth>.n<node id>[.t<term idx>]
+//
+// e.g. "v1.log_seq.rdJLgqYgkEp8jg8Qks1qiq.d1.n2.t0". Names are node types and
+// rule hashes are base58, so neither contains a '.'. ParseAddress is the inverse.
 func (a *AstNodeAddressT) String() string {
 
 	var (
@@ -403,6 +980,54 @@ func (a *AstNodeAddressT) String() string {
 	return addressStr
 }
 
+// ParseAddress reconstructs an address from its canonical string form
+func ParseAddress(s string) (*AstNodeAddressT, error) {
+
+	var (
+		parts = strings.Split(s, ".")
+		a     = &AstNodeAddressT{}
+		err   error
+	)
+
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+
+	a.Version, a.Name, a.RuleHash = parts[0], parts[1], parts[2]
+
+	if _, err = addressField(parts[0], "v"); err != nil || a.Name == "" || a.RuleHash == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+
+	if a.Depth, err = addressField(parts[3], "d"); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+
+	if a.NodeId, err = addressField(parts[4], "n"); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+
+	if len(parts) == 6 {
+		termIdx, err := addressField(parts[5], "t")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+		}
+		a.TermIdx = &termIdx
+	}
+
+	return a, nil
+}
+
+// addressField parses a prefixed, unsigned decimal address component
+func addressField(part, prefix string) (uint32, error) {
+	digits, ok := strings.CutPrefix(part, prefix)
+	if !ok || digits == "" || (len(digits) > 1 && digits[0] == '0') {
+		return 0, ErrInvalidAddress
+	}
+	v, err := strconv.ParseUint(digits, 10, 32)
+	return uint32(v), err
+}
+
 func (a *AstNodeAddressT) GetTermIdx() (uint32, error) {
 	if a.TermIdx == nil {
 		return 0, ErrNoTermIdx
@@ -455,21 +1080,7 @@ func traverseTree(node *AstNodeT, wr io.Writer, depth int) error {
 	return nil
 }
 
+// DrawTree writes the tree to path in the format of its extension (see DrawFormat)
 func DrawTree(tree *AstT, path string) error {
-	var (
-		f   *os.File
-		err error
-	)
-
-	if f, err = os.Create(path); err != nil {
-		return err
-	}
-
-	for _, node := range tree.Nodes {
-		if err = traverseTree(node, f, 0); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return drawFile(tree, path)
 }
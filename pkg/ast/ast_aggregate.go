@@ -0,0 +1,82 @@
+package ast
+
+import (
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+// AstAggMatcherT fires when the aggregate of an extracted value over the events
+// matching Match within Window satisfies Op Threshold, e.g. sum(bytes) > 1GB over 5m.
+// Size thresholds are in bytes and duration thresholds in nanoseconds.
+type AstAggMatcherT struct {
+	Event     AstEventT
+	Match     []AstFieldT
+	Window    time.Duration
+	Func      schema.AggFuncT
+	Extract   string
+	Op        schema.AggOpT
+	Threshold float64
+	Field     bool // Extract names a number field of the events, such as the bytes of a flow record
+}
+
+func (b *builderT) buildAggMatcherNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
+
+	var (
+		agg         = parserNode.Metadata.Aggregate
+		matchFields = make([]AstFieldT, 0)
+	)
+
+	if agg == nil || parserNode.Metadata.Window == 0 {
+		log.Error().
+			Any("address", machineAddress).
+			Msg("Aggregate missing expression or window")
+		return nil, parserNode.WrapError(parser.ErrAggregate)
+	}
+
+	for _, child := range parserNode.Children {
+		match, ok := child.(*parser.MatcherT)
+		if !ok {
+			log.Error().Any("address", machineAddress).Msg("Expected scalar value")
+			return nil, parserNode.WrapError(ErrMissingScalar)
+		}
+
+		for _, field := range match.Match.Fields {
+			if err := validateExtracts(parserNode, field.Extract); err != nil {
+				return nil, err
+			}
+			if err := validateJq(parserNode, field); err != nil {
+				return nil, err
+			}
+			term, err := newMatchTerm(field)
+			if err != nil {
+				log.Error().Err(err).Any("address", machineAddress).Msg("Invalid match field term")
+				return nil, parserNode.WrapError(err)
+			}
+			matchFields = append(matchFields, term)
+		}
+	}
+
+	var (
+		address   = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
+		matchNode = b.newAstNode(parserNode, parserNode.Metadata.Type, b.scope(parserNode, schema.ScopeNode), machineAddress, address)
+	)
+
+	matchNode.Object = &AstAggMatcherT{
+		Event: AstEventT{
+			Origin: parserNode.Metadata.Event.Origin,
+			Source: intern(parserNode.Metadata.Event.Source),
+		},
+		Match:     matchFields,
+		Window:    parserNode.Metadata.Window,
+		Func:      agg.Func,
+		Extract:   agg.Extract,
+		Op:        agg.Op,
+		Threshold: agg.Threshold,
+		Field:     agg.Field,
+	}
+
+	return matchNode, nil
+}
@@ -0,0 +1,157 @@
+package ast
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+)
+
+// CacheT holds the built rules of a bundle by the parser.ContentHash of each rule,
+// so that a bundle recompiled with WithCache only builds the rules that changed.
+// Cached nodes are shared by the trees they are returned in and must not be
+// modified. A cache is safe for concurrent use, but must only be shared by builds
+// with the same options and registered passes and validations.
+type CacheT struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntryT
+	nodes   map[*AstNodeT]*cacheEntryT
+	stats   CacheStatsT
+}
+
+// CacheStatsT counts the rules served from a cache and the rules built, since the
+// cache was created. Rules without a content hash are built and counted as misses.
+type CacheStatsT struct {
+	Hits    int `json:"hits"`
+	Misses  int `json:"misses"`
+	Entries int `json:"entries"`
+}
+
+type cacheEntryT struct {
+	node  *AstNodeT
+	diags []pqerr.Diagnostic // Sent again on each hit
+	data  json.RawMessage    // Encoding of node, once it is marshaled
+	used  bool               // Hit or stored since the last Prune
+}
+
+// NewCache returns an empty cache
+func NewCache() *CacheT {
+	return &CacheT{
+		entries: make(map[string]*cacheEntryT),
+		nodes:   make(map[*AstNodeT]*cacheEntryT),
+	}
+}
+
+// WithCache builds rules through a cache. Rules whose content hash is cached are
+// not built again; their diagnostics are sent again from the cache.
+func WithCache(c *CacheT) BuildOptT {
+	return func(o *buildOptsT) {
+		o.cache = c
+	}
+}
+
+// Stats returns the hit and miss counts of the cache
+func (c *CacheT) Stats() CacheStatsT {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Prune removes the rules that were not hit or stored since the last Prune, such
+// as the previous versions of changed rules, and returns how many were removed
+func (c *CacheT) Prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	for key, e := range c.entries {
+		if !e.used {
+			delete(c.entries, key)
+			delete(c.nodes, e.node)
+			n++
+		}
+		e.used = false
+	}
+	return n
+}
+
+// MarshalTree encodes a tree as json.Marshal does, reusing the encoding of the
+// rules served from or stored in the cache
+func (c *CacheT) MarshalTree(tree *AstT) ([]byte, error) {
+
+	var nodes []json.RawMessage
+	if tree.Nodes != nil {
+		nodes = make([]json.RawMessage, 0, len(tree.Nodes))
+	}
+
+	for _, node := range tree.Nodes {
+		data, err := c.marshalNode(node)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, data)
+	}
+
+	return json.Marshal(struct {
+		Nodes []json.RawMessage `json:"nodes"`
+	}{nodes})
+}
+
+func (c *CacheT) marshalNode(node *AstNodeT) (json.RawMessage, error) {
+
+	c.mu.Lock()
+	e, ok := c.nodes[node]
+	if ok && e.data != nil {
+		c.mu.Unlock()
+		return e.data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(node)
+	if err != nil || !ok {
+		return data, err
+	}
+
+	c.mu.Lock()
+	e.data = data
+	c.mu.Unlock()
+
+	return data, nil
+}
+
+// get returns the entry of a key, counting a hit or a miss
+func (c *CacheT) get(key string) (*cacheEntryT, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if ok {
+		e.used = true
+		c.stats.Hits++
+		return e, true
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *CacheT) put(key string, node *AstNodeT, diags []pqerr.Diagnostic) {
+
+	if key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		delete(c.nodes, old.node)
+	}
+
+	e := &cacheEntryT{node: node, diags: diags, used: true}
+	c.entries[key] = e
+	c.nodes[node] = e
+}
@@ -0,0 +1,182 @@
+package ast
+
+import (
+	"cmp"
+	"math"
+	"regexp/syntax"
+	"slices"
+	"time"
+
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+// Relative costs of evaluating a condition against one event
+const (
+	costRaw      = 1.0
+	costRegex    = 2.0  // Plus a tenth of the instructions of the compiled program
+	costJq       = 10.0 // Events are decoded and the query is run
+	costExtract  = 2.0  // Plus the cost of its jq or regex
+	costSelector = 5.0  // Each vector selector of a promql query
+)
+
+// NodeCostT is the estimated cost of a node. Match is the cost of evaluating its
+// conditions against an event, including expanded counts and extracts. Window is
+// the cost of the state held for its terms, which grows with the log of the window.
+type NodeCostT struct {
+	Address string  `json:"address"`
+	Type    string  `json:"type"`
+	Match   float64 `json:"match"`
+	Window  float64 `json:"window"`
+	Cost    float64 `json:"cost"` // Match + Window
+}
+
+// RuleCostT is the estimated cost of a rule and its nodes, costliest first
+type RuleCostT struct {
+	RuleId   string      `json:"rule_id"`
+	RuleHash string      `json:"rule_hash"`
+	Cost     float64     `json:"cost"`
+	Nodes    []NodeCostT `json:"nodes"`
+}
+
+// CostReportT is the estimated cost of the rules of a bundle, costliest first.
+// Costs are relative: they rank rules and nodes, not predict CPU time.
+type CostReportT struct {
+	Rules []RuleCostT `json:"rules"`
+	Total float64     `json:"total"`
+}
+
+// EstimateCost scores each node of the tree by its regex complexity, jq usage,
+// window size, and count expansion, so that expensive rules can be found before
+// they are shipped to the runtime
+func EstimateCost(tree *AstT) *CostReportT {
+
+	var report = &CostReportT{}
+
+	for _, root := range tree.Nodes {
+
+		rule := RuleCostT{RuleId: root.Metadata.RuleId}
+		if root.Metadata.Address != nil {
+			rule.RuleHash = root.Metadata.Address.RuleHash
+		}
+
+		WalkNode(root, func(node, _ *AstNodeT, order WalkOrderT) error {
+			if order == WalkPre {
+				c := nodeCost(node)
+				rule.Nodes = append(rule.Nodes, c)
+				rule.Cost += c.Cost
+			}
+			return nil
+		})
+
+		slices.SortStableFunc(rule.Nodes, func(a, b NodeCostT) int {
+			return cmp.Compare(b.Cost, a.Cost)
+		})
+
+		report.Rules = append(report.Rules, rule)
+		report.Total += rule.Cost
+	}
+
+	slices.SortStableFunc(report.Rules, func(a, b RuleCostT) int {
+		return cmp.Compare(b.Cost, a.Cost)
+	})
+
+	return report
+}
+
+func nodeCost(node *AstNodeT) NodeCostT {
+
+	var c = NodeCostT{Type: node.Metadata.Type.String()}
+
+	if node.Metadata.Address != nil {
+		c.Address = node.Metadata.Address.String()
+	}
+
+	switch o := node.Object.(type) {
+	case *AstLogMatcherT:
+		c.Match = fieldsCost(o.Match) + fieldsCost(o.Negate)
+		c.Window = windowCost(o.Window, occurrences(o.Match)+len(o.Negate))
+	case *AstAggMatcherT:
+		c.Match = fieldsCost(o.Match)
+		c.Window = windowCost(o.Window, 1)
+	case *AstFlowMatcherT:
+		c.Match = float64(len(o.Match)+len(o.Negate)) * costRaw
+		c.Window = windowCost(o.Window, len(o.Match))
+	case *AstPromQL:
+		c.Match = float64(max(len(o.Selectors), 1)) * costSelector
+	case *AstK8sResourceT:
+		c.Match = costRaw
+	case *AstSeqMatcherT:
+		c.Window = windowCost(o.Window, len(node.Children))
+	case *AstSetMatcherT:
+		c.Window = windowCost(o.Window, len(node.Children))
+	}
+
+	c.Cost = c.Match + c.Window
+
+	return c
+}
+
+func fieldsCost(fields []AstFieldT) float64 {
+
+	var total float64
+
+	for _, f := range fields {
+
+		var cost float64
+
+		switch f.TermValue.Type {
+		case match.TermRegex:
+			cost = regexCost(f.TermValue.Value)
+		case match.TermJqJson, match.TermJqYaml:
+			cost = costJq
+		default:
+			cost = costRaw
+		}
+
+		for _, e := range f.Extracts {
+			cost += costExtract
+			switch {
+			case e.JqValue != "":
+				cost += costJq
+			case e.RegexValue != "":
+				cost += regexCost(e.RegexValue)
+			}
+		}
+
+		// The runtime matches a counted field once per occurrence
+		total += cost * float64(f.Occurrences())
+	}
+
+	return total
+}
+
+func regexCost(expr string) float64 {
+
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return costRegex
+	}
+
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return costRegex
+	}
+
+	return costRegex + float64(len(prog.Inst))/10
+}
+
+func occurrences(fields []AstFieldT) int {
+	var n int
+	for _, f := range fields {
+		n += f.Occurrences()
+	}
+	return n
+}
+
+// windowCost grows with the number of terms held and the log of the window
+func windowCost(window time.Duration, terms int) float64 {
+	if window <= 0 {
+		return 0
+	}
+	return float64(terms) * math.Log2(1+window.Seconds())
+}
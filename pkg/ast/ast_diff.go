@@ -0,0 +1,136 @@
+package ast
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+)
+
+type DiffKindT string
+
+const (
+	DiffAdded   DiffKindT = "added"
+	DiffRemoved DiffKindT = "removed"
+	DiffChanged DiffKindT = "changed"
+)
+
+// AstDiffT is a node that was added, removed, or changed between two builds. A
+// change is semantic if it changes what the node matches: its matcher or machine,
+// window, type, scope, or step options. Other changes, such as the rule id or
+// priority, are metadata-only and do not require the runtime to rebuild the node.
+type AstDiffT struct {
+	Address  string    `json:"address"`
+	Kind     DiffKindT `json:"kind"`
+	Semantic bool      `json:"semantic"` // Always true for added and removed nodes
+	Old      *AstNodeT `json:"-"`        // Nil for added nodes
+	New      *AstNodeT `json:"-"`        // Nil for removed nodes
+}
+
+// Diff compares the nodes of two builds by address, so that the runtime can update
+// only the nodes that changed when a bundle is republished. Addresses are stable
+// while the rule hash and the shape of the rule are unchanged. The diffs are
+// sorted by address.
+func Diff(old, new *AstT) []AstDiffT {
+
+	var (
+		oldNodes = indexNodes(old)
+		newNodes = indexNodes(new)
+		diffs    []AstDiffT
+	)
+
+	for addr, o := range oldNodes {
+		n, ok := newNodes[addr]
+		switch {
+		case !ok:
+			diffs = append(diffs, AstDiffT{Address: addr, Kind: DiffRemoved, Semantic: true, Old: o})
+		case !semanticEqual(o, n):
+			diffs = append(diffs, AstDiffT{Address: addr, Kind: DiffChanged, Semantic: true, Old: o, New: n})
+		case !metadataEqual(o, n):
+			diffs = append(diffs, AstDiffT{Address: addr, Kind: DiffChanged, Old: o, New: n})
+		}
+	}
+
+	for addr, n := range newNodes {
+		if _, ok := oldNodes[addr]; !ok {
+			diffs = append(diffs, AstDiffT{Address: addr, Kind: DiffAdded, Semantic: true, New: n})
+		}
+	}
+
+	slices.SortFunc(diffs, func(a, b AstDiffT) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return diffs
+}
+
+func indexNodes(tree *AstT) map[string]*AstNodeT {
+
+	var nodes = make(map[string]*AstNodeT)
+
+	if tree == nil {
+		return nodes
+	}
+
+	Walk(tree, func(node, _ *AstNodeT, order WalkOrderT) error {
+		if order == WalkPre && node.Metadata.Address != nil {
+			nodes[node.Metadata.Address.String()] = node
+		}
+		return nil
+	})
+
+	return nodes
+}
+
+func semanticEqual(a, b *AstNodeT) bool {
+
+	var ma, mb = a.Metadata, b.Metadata
+
+	return ma.Type == mb.Type &&
+		ma.Scope == mb.Scope &&
+		ma.NegIdx == mb.NegIdx &&
+		ma.MaxGap == mb.MaxGap &&
+		ma.Optional == mb.Optional &&
+		reflect.DeepEqual(ma.Repeat, mb.Repeat) &&
+		reflect.DeepEqual(ma.NegateOpts, mb.NegateOpts) &&
+		reflect.DeepEqual(ma.ScopeBridge, mb.ScopeBridge) &&
+		reflect.DeepEqual(semanticObject(a.Object), semanticObject(b.Object))
+}
+
+func metadataEqual(a, b *AstNodeT) bool {
+
+	var ma, mb = a.Metadata, b.Metadata
+
+	return ma.RuleId == mb.RuleId &&
+		ma.RequireAllSources == mb.RequireAllSources &&
+		ma.Priority == mb.Priority &&
+		slices.Equal(ma.Sources, mb.Sources)
+}
+
+// semanticObject returns the object of a node with the descriptors of the children
+// of machines reduced to their addresses, so that a change to a child is reported
+// on the child alone
+func semanticObject(obj any) any {
+
+	switch o := obj.(type) {
+	case *AstSeqMatcherT:
+		c := *o
+		c.Order, c.Negate = descAddresses(o.Order), descAddresses(o.Negate)
+		return c
+	case *AstSetMatcherT:
+		c := *o
+		c.Match, c.Negate = descAddresses(o.Match), descAddresses(o.Negate)
+		return c
+	case *AstGroupMatcherT:
+		return AstGroupMatcherT{Terms: descAddresses(o.Terms)}
+	}
+
+	return obj
+}
+
+func descAddresses(descs []*AstMetadataT) []*AstMetadataT {
+	var addrs = make([]*AstMetadataT, 0, len(descs))
+	for _, d := range descs {
+		addrs = append(addrs, &AstMetadataT{Address: d.Address})
+	}
+	return addrs
+}
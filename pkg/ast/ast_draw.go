@@ -0,0 +1,303 @@
+package ast
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrRenderer = errors.New("rendering svg or png requires the graphviz 'dot' command")
+)
+
+type DrawFormatT string
+
+const (
+	DrawText    DrawFormatT = "text" // Indented addresses, one node per line
+	DrawDot     DrawFormatT = "dot"
+	DrawMermaid DrawFormatT = "mermaid"
+	DrawSVG     DrawFormatT = "svg" // Rendered from DOT with graphviz
+	DrawPNG     DrawFormatT = "png" // Rendered from DOT with graphviz
+)
+
+// Terms listed in a label before the rest are summarized
+const drawMaxTerms = 4
+
+// Longest term shown in a label
+const drawMaxTermLen = 40
+
+// DrawFormat returns the format of a file by its extension: .dot or .gv for DOT,
+// .mmd or .mermaid for Mermaid, .svg, .png, and text for any other
+func DrawFormat(path string) DrawFormatT {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".dot", ".gv":
+		return DrawDot
+	case ".mmd", ".mermaid":
+		return DrawMermaid
+	case ".svg":
+		return DrawSVG
+	case ".png":
+		return DrawPNG
+	}
+	return DrawText
+}
+
+// WriteTree writes the tree in a format. Node labels include the type, scope,
+// source, window, and a summary of the match and negate terms with their anchors.
+func WriteTree(tree *AstT, wr io.Writer, format DrawFormatT) error {
+
+	switch format {
+	case DrawText:
+		for _, node := range tree.Nodes {
+			if err := traverseTree(node, wr, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	case DrawDot:
+		return writeDot(tree, wr)
+	case DrawMermaid:
+		return writeMermaid(tree, wr)
+	case DrawSVG, DrawPNG:
+		return renderDot(tree, wr, format)
+	}
+
+	return fmt.Errorf("unknown draw format %q", format)
+}
+
+type drawEdgeT struct {
+	from, to int
+	negate   bool
+}
+
+// drawGraph numbers the nodes of the tree in pre-order and returns their labels
+// and edges
+func drawGraph(tree *AstT) ([][]string, []drawEdgeT) {
+
+	var (
+		labels [][]string
+		edges  []drawEdgeT
+		ids    = make(map[*AstNodeT]int)
+	)
+
+	Walk(tree, func(node, parent *AstNodeT, order WalkOrderT) error {
+		if order != WalkPre {
+			return nil
+		}
+		id := len(labels)
+		ids[node] = id
+		labels = append(labels, nodeLabel(node))
+		if parent != nil {
+			idx := slices.Index(parent.Children, node)
+			edges = append(edges, drawEdgeT{
+				from:   ids[parent],
+				to:     id,
+				negate: parent.Metadata.NegIdx > 0 && idx >= parent.Metadata.NegIdx,
+			})
+		}
+		return nil
+	})
+
+	return labels, edges
+}
+
+func nodeLabel(node *AstNodeT) []string {
+
+	var (
+		md    = node.Metadata
+		lines = []string{fmt.Sprintf("%s (%s)", md.Type, md.Scope)}
+	)
+
+	if w, ok := node.Window(); ok && w > 0 {
+		lines = append(lines, "window "+w.String())
+	}
+
+	switch o := node.Object.(type) {
+	case *AstLogMatcherT:
+		lines = append(lines, "source "+o.Event.Source)
+		lines = append(lines, fieldLines("match", o.Match)...)
+		lines = append(lines, fieldLines("negate", o.Negate)...)
+	case *AstAggMatcherT:
+		lines = append(lines, "source "+o.Event.Source, fmt.Sprintf("%s(%s) %s %g", o.Func, o.Extract, o.Op, o.Threshold))
+		lines = append(lines, fieldLines("match", o.Match)...)
+	case *AstFlowMatcherT:
+		lines = append(lines, "source "+o.Event.Source, fmt.Sprintf("%d match, %d negate", len(o.Match), len(o.Negate)))
+	case *AstPromQL:
+		lines = append(lines, "expr "+truncate(o.Expr))
+	case *AstK8sResourceT:
+		lines = append(lines, fmt.Sprintf("%s %s", o.GVK.Kind, o.Field))
+	case *AstSeqMatcherT:
+		lines = append(lines, fmt.Sprintf("%d ordered, %d negate", len(o.Order), len(o.Negate)))
+	case *AstSetMatcherT:
+		lines = append(lines, fmt.Sprintf("%d match, %d negate", len(o.Match), len(o.Negate)))
+	}
+
+	if n := md.NegateOpts; n != nil {
+		lines = append(lines, negateLine(n))
+	}
+
+	if b := md.ScopeBridge; b != nil {
+		lines = append(lines, "bridges "+strings.Join(b.Scopes, ", "))
+	}
+
+	return lines
+}
+
+func fieldLines(kind string, fields []AstFieldT) []string {
+
+	var lines []string
+
+	for i, f := range fields {
+		if i == drawMaxTerms {
+			lines = append(lines, fmt.Sprintf("%s +%d more", kind, len(fields)-i))
+			break
+		}
+		term := truncate(f.TermValue.Value)
+		if f.Field != "" {
+			term = f.Field + ": " + term
+		}
+		line := kind + " " + term
+		if f.Count > 1 {
+			line += fmt.Sprintf(" x%d", f.Count)
+		}
+		if f.NegateOpts != nil {
+			line += " [" + negateLine(f.NegateOpts) + "]"
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func negateLine(n *AstNegateOptsT) string {
+
+	anchor := fmt.Sprintf("anchor %d", n.Anchor)
+	if n.AnchorName != "" {
+		anchor = "anchor " + n.AnchorName
+	}
+
+	var parts = []string{anchor}
+	if n.Window > 0 {
+		parts = append(parts, "window "+n.Window.String())
+	}
+	if n.Slide != 0 {
+		parts = append(parts, "slide "+n.Slide.String())
+	}
+	if n.Absolute {
+		parts = append(parts, "absolute")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func truncate(s string) string {
+	if len(s) > drawMaxTermLen {
+		return s[:drawMaxTermLen-3] + "..."
+	}
+	return s
+}
+
+func writeDot(tree *AstT, wr io.Writer) error {
+
+	var (
+		labels, edges = drawGraph(tree)
+		sb            strings.Builder
+	)
+
+	sb.WriteString("digraph ast {\n  node [shape=box, fontname=\"monospace\"];\n")
+
+	for id, lines := range labels {
+		for i := range lines {
+			lines[i] = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(lines[i])
+		}
+		fmt.Fprintf(&sb, "  n%d [label=\"%s\\l\"];\n", id, strings.Join(lines, `\l`))
+	}
+
+	for _, e := range edges {
+		style := ""
+		if e.negate {
+			style = " [style=dashed, label=\"negate\"]"
+		}
+		fmt.Fprintf(&sb, "  n%d -> n%d%s;\n", e.from, e.to, style)
+	}
+
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(wr, sb.String())
+	return err
+}
+
+func writeMermaid(tree *AstT, wr io.Writer) error {
+
+	var (
+		labels, edges = drawGraph(tree)
+		sb            strings.Builder
+		escape        = strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	)
+
+	sb.WriteString("flowchart TD\n")
+
+	for id, lines := range labels {
+		for i := range lines {
+			lines[i] = escape.Replace(lines[i])
+		}
+		fmt.Fprintf(&sb, "  n%d[\"%s\"]\n", id, strings.Join(lines, "<br/>"))
+	}
+
+	for _, e := range edges {
+		arrow := "-->"
+		if e.negate {
+			arrow = "-.->|negate|"
+		}
+		fmt.Fprintf(&sb, "  n%d %s n%d\n", e.from, arrow, e.to)
+	}
+
+	_, err := io.WriteString(wr, sb.String())
+	return err
+}
+
+func renderDot(tree *AstT, wr io.Writer, format DrawFormatT) error {
+
+	path, err := exec.LookPath("dot")
+	if err != nil {
+		return ErrRenderer
+	}
+
+	var src bytes.Buffer
+	if err = writeDot(tree, &src); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "-T"+string(format))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &src, wr, &stderr
+
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// drawFile writes the tree to a file in the format of its extension
+func drawFile(tree *AstT, path string) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteTree(tree, f, DrawFormat(path)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
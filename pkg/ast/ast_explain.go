@@ -0,0 +1,234 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+// Explain describes each rule of the tree in English, one line per rule, such as
+// "fires when X is seen, followed within 5m by Y, unless Z occurs". It reads the
+// AST rather than the YAML, so it describes what the runtime will match.
+func Explain(tree *AstT) string {
+
+	var sb strings.Builder
+
+	for _, node := range tree.Nodes {
+		fmt.Fprintf(&sb, "%s: fires when %s.\n", node.Metadata.RuleId, explainNode(node))
+	}
+
+	return sb.String()
+}
+
+func explainNode(node *AstNodeT) string {
+
+	switch o := node.Object.(type) {
+	case *AstSeqMatcherT:
+		if len(node.Children) == 1 && len(o.Negate) == 0 {
+			return explainNode(node.Children[0])
+		}
+		return explainSeq(explainChildren(node, len(o.Order)), o.Window) + explainUnless(node.Children[len(o.Order):])
+	case *AstSetMatcherT:
+		if len(node.Children) == 1 && len(o.Negate) == 0 {
+			return explainNode(node.Children[0])
+		}
+		return explainSet(explainChildren(node, len(o.Match)), o.Require, o.Window) + explainUnless(node.Children[len(o.Match):])
+	case *AstGroupMatcherT:
+		conj := " and "
+		if node.Metadata.Type == schema.NodeTypeAny {
+			conj = " or "
+		}
+		return "(" + strings.Join(explainChildren(node, len(node.Children)), conj) + ")"
+	case *AstLogMatcherT:
+		return explainLog(node.Metadata.Type, o)
+	case *AstAggMatcherT:
+		return fmt.Sprintf("%s(%s) of %s %s %s %g over %s", o.Func, o.Extract, explainTerms(o.Match, " and "), inSource(o.Event.Source), o.Op, o.Threshold, explainWindow(o.Window))
+	case *AstFlowMatcherT:
+		return fmt.Sprintf("%d flow conditions are met %s", len(o.Match), inSource(o.Event.Source))
+	case *AstPromQL:
+		if o.For > 0 {
+			return fmt.Sprintf("the query `%s` holds for %s", o.Expr, explainWindow(o.For))
+		}
+		return fmt.Sprintf("the query `%s` returns a result", o.Expr)
+	case *AstMetricSeqT:
+		var steps []string
+		for _, step := range o.Steps {
+			steps = append(steps, explainNode(&AstNodeT{Object: step}))
+		}
+		return explainSeq(steps, o.Window)
+	case *AstK8sResourceT:
+		return fmt.Sprintf("%s of a %s changes to %s", o.Field, o.GVK.Kind, explainState(o.To))
+	case *AstNodeT:
+		return explainNode(o)
+	}
+
+	return "a " + node.Metadata.Type.String() + " matches"
+}
+
+func explainChildren(node *AstNodeT, n int) []string {
+	var parts []string
+	for _, child := range node.Children[:min(n, len(node.Children))] {
+		parts = append(parts, explainNode(child))
+	}
+	return parts
+}
+
+func explainSeq(steps []string, window time.Duration) string {
+
+	if len(steps) == 0 {
+		return "nothing"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(steps[0])
+
+	for i, step := range steps[1:] {
+		switch {
+		case i == 0 && window > 0:
+			fmt.Fprintf(&sb, ", followed within %s by %s", explainWindow(window), step)
+		case i == 0:
+			fmt.Fprintf(&sb, ", followed by %s", step)
+		default:
+			fmt.Fprintf(&sb, ", then %s", step)
+		}
+	}
+
+	return sb.String()
+}
+
+func explainSet(terms []string, require int, window time.Duration) string {
+
+	var s string
+
+	switch {
+	case len(terms) == 1:
+		s = terms[0]
+	case require > 0 && require < len(terms):
+		s = fmt.Sprintf("at least %d of %s", require, strings.Join(terms, "; "))
+	default:
+		s = strings.Join(terms, " and ")
+	}
+
+	if len(terms) > 1 && window > 0 {
+		s += " within " + explainWindow(window)
+	}
+
+	return s
+}
+
+func explainUnless(negates []*AstNodeT) string {
+
+	if len(negates) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, n := range negates {
+		parts = append(parts, explainNode(n))
+	}
+
+	return ", unless " + strings.Join(parts, " or ")
+}
+
+func explainLog(typ schema.NodeTypeT, o *AstLogMatcherT) string {
+
+	var (
+		source = inSource(o.Event.Source)
+		s      string
+	)
+
+	switch typ {
+	case schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
+		steps := termRuns(o.Match)
+		if len(steps) > 0 {
+			steps[0] += " " + source
+		}
+		s = explainSeq(steps, o.Window)
+	default:
+		s = explainSet(termRuns(o.Match), 0, o.Window) + " " + source
+		if cd := o.CountDistinct; cd != nil {
+			s += fmt.Sprintf(" with %d distinct values of %s", cd.Threshold, cd.Field)
+		}
+	}
+
+	if len(o.Negate) > 0 {
+		s += ", unless " + explainTerms(o.Negate, " or ") + " occurs"
+	}
+
+	return s
+}
+
+// termRuns describes the terms of a sequence with their counts
+func termRuns(fields []AstFieldT) []string {
+
+	var runs []string
+
+	for _, f := range fields {
+		run := explainTerm(f)
+		switch {
+		case f.CountRange != nil && f.CountRange.Max > 0:
+			run += fmt.Sprintf(" %d to %d times", f.CountRange.Min, f.CountRange.Max)
+		case f.CountRange != nil:
+			run += fmt.Sprintf(" at least %d times", f.CountRange.Min)
+		case f.Count > 1:
+			run += fmt.Sprintf(" %d times", f.Count)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs
+}
+
+func explainTerms(fields []AstFieldT, conj string) string {
+	var terms []string
+	for _, f := range fields {
+		terms = append(terms, explainTerm(f))
+	}
+	return strings.Join(terms, conj)
+}
+
+func explainTerm(f AstFieldT) string {
+
+	var v = f.TermValue.Value
+
+	switch f.TermValue.Type {
+	case match.TermRegex:
+		if f.Field != "" {
+			return fmt.Sprintf("%s matching /%s/", f.Field, v)
+		}
+		return fmt.Sprintf("a line matching /%s/", v)
+	case match.TermJqJson, match.TermJqYaml:
+		return fmt.Sprintf("an event where `%s`", v)
+	}
+
+	if f.Field != "" {
+		return fmt.Sprintf("%s %q", f.Field, v)
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+func explainState(s AstResourceStateT) string {
+	if s.Op != "" {
+		return fmt.Sprintf("a value %s %g", s.Op, s.Number)
+	}
+	return fmt.Sprintf("%q", s.Value)
+}
+
+func inSource(source string) string {
+	return "in " + source + " events"
+}
+
+// explainWindow formats a window without zero units, e.g. 5m instead of 5m0s
+func explainWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,68 @@
+package ast
+
+// Features returns the features a node uses beyond terms, windows, set
+// requirements, and negates, such as correlations, repeats, or count ranges, in
+// the order they are checked. Backends refuse nodes using features they cannot
+// express.
+func Features(node *AstNodeT) []string {
+
+	var (
+		md       = node.Metadata
+		features []string
+	)
+
+	add := func(ok bool, feature string) {
+		if ok {
+			features = append(features, feature)
+		}
+	}
+
+	add(md.Repeat != nil, "repeat")
+	add(md.MaxGap > 0, "max_gap")
+	add(md.Optional, "optional")
+	features = append(features, negateFeatures(md.NegateOpts)...)
+
+	switch o := node.Object.(type) {
+	case *AstLogMatcherT:
+		add(len(o.Correlations) > 0, "correlations")
+		add(o.CorrelationWindow > 0, "correlation_window")
+		add(o.OrderTolerance > 0, "order_tolerance")
+		add(o.CountDistinct != nil, "count_distinct")
+		add(len(o.NegateGroups) > 0, "negate groups")
+		add(len(o.StepRefs) > 0, "step references")
+		for _, f := range o.Match {
+			add(f.CountRange != nil, "count range")
+			add(f.IPCidr != nil, "ip_cidr")
+			add(f.Repeat != nil, "repeat")
+			add(f.MaxGap > 0, "max_gap")
+			add(f.Optional, "optional")
+		}
+		for _, f := range o.Negate {
+			add(f.IPCidr != nil, "ip_cidr")
+			features = append(features, negateFeatures(f.NegateOpts)...)
+		}
+	case *AstSeqMatcherT:
+		add(len(o.Correlations) > 0, "correlations")
+		add(o.CorrelationWindow > 0, "correlation_window")
+		add(o.OrderTolerance > 0, "order_tolerance")
+		add(len(o.JoinKeys) > 0, "join keys")
+		add(len(o.StepRefs) > 0, "step references")
+	case *AstSetMatcherT:
+		add(len(o.Correlations) > 0, "correlations")
+		add(o.CorrelationWindow > 0, "correlation_window")
+		add(len(o.JoinKeys) > 0, "join keys")
+	}
+
+	return features
+}
+
+func negateFeatures(n *AstNegateOptsT) []string {
+	switch {
+	case n == nil:
+	case n.Count > 0:
+		return []string{"negate count"}
+	case n.Until > 0:
+		return []string{"until"}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ast
+
+import (
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+// AstFlowMatcherT fires when each of the Match conditions is met by a flow record
+// within Window, and no record meets a Negate condition
+type AstFlowMatcherT struct {
+	Event  AstEventT
+	Match  []AstFlowCondT
+	Negate []AstFlowCondT
+	Window time.Duration
+}
+
+// AstFlowCondT is a condition on a field of a flow record. The field equals one of
+// Values, or compares with Number when Op is set, or is an address within IPCidr.
+// Protocols are IANA numbers.
+type AstFlowCondT struct {
+	Field  string
+	Values []string
+	Op     string
+	Number float64
+	IPCidr *AstIPCidrT
+}
+
+func (b *builderT) buildFlowMatcherNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
+
+	var (
+		obj = &AstFlowMatcherT{
+			Event: AstEventT{
+				Origin: parserNode.Metadata.Event.Origin,
+				Source: intern(parserNode.Metadata.Event.Source),
+			},
+			Match:  make([]AstFlowCondT, 0),
+			Negate: make([]AstFlowCondT, 0),
+			Window: parserNode.Metadata.Window,
+		}
+		err error
+	)
+
+	for _, child := range parserNode.Children {
+		match, ok := child.(*parser.MatcherT)
+		if !ok {
+			log.Error().Any("address", machineAddress).Msg("Expected scalar value")
+			return nil, parserNode.WrapError(ErrMissingScalar)
+		}
+
+		for _, field := range match.Match.Fields {
+			if obj.Match, err = appendFlowCond(parserNode, obj.Match, field); err != nil {
+				return nil, err
+			}
+		}
+		for _, field := range match.Negate.Fields {
+			if obj.Negate, err = appendFlowCond(parserNode, obj.Negate, field); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = b.validate(parserNode, len(obj.Match)); err != nil {
+		return nil, err
+	}
+
+	var (
+		address   = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
+		matchNode = b.newAstNode(parserNode, parserNode.Metadata.Type, b.scope(parserNode, schema.ScopeNode), machineAddress, address)
+	)
+
+	matchNode.Object = obj
+
+	return matchNode, nil
+}
+
+func appendFlowCond(n *parser.NodeT, conds []AstFlowCondT, field parser.FieldT) ([]AstFlowCondT, error) {
+
+	var cond = AstFlowCondT{Field: field.Field}
+
+	switch {
+	case field.Compare != nil:
+		cond.Op, cond.Number = compareOps[field.Compare.Op], field.Compare.Value
+	case len(field.IPCidr) > 0:
+		c, err := newIPCidr(field.IPCidr)
+		if err != nil {
+			return nil, wrapPos(n, field.Pos, err)
+		}
+		cond.IPCidr = c
+	case field.StrValue != "":
+		cond.Values = []string{field.StrValue}
+	case len(field.Values) > 0:
+		cond.Values = field.Values
+	default:
+		log.Error().Str("field", field.Field).Msg("Flow condition without a value")
+		return nil, wrapPos(n, field.Pos, parser.ErrFlowCondition)
+	}
+
+	return append(conds, cond), nil
+}
@@ -0,0 +1,14 @@
+package ast
+
+import (
+	"unique"
+)
+
+// intern returns the canonical copy of a string, so that the field names, values,
+// and sources repeated across the rules of a bundle are held once by the tree
+func intern(s string) string {
+	if s == "" {
+		return s
+	}
+	return unique.Make(s).Value()
+}
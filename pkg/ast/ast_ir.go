@@ -0,0 +1,181 @@
+package ast
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ir"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+var (
+	ErrIRUnsupported = errors.New("not expressible in the IR")
+)
+
+// EmitIR lowers the tree to an ir.ProgramT, which a runtime can interpret without
+// linking the compiler. The IR covers log and trace matchers and the machines that
+// join them, with their terms, windows, set requirements, and negates. A rule
+// using anything else, such as correlations, repeats, or promql, is refused with
+// ErrIRUnsupported positioned at the node that uses it.
+func EmitIR(tree *AstT) (*ir.ProgramT, error) {
+
+	var e = irEmitterT{
+		p:       &ir.ProgramT{Version: ir.Version},
+		strings: make(map[string]int64),
+	}
+
+	for _, root := range tree.Nodes {
+
+		rule := ir.RuleT{Id: root.Metadata.RuleId}
+		if root.Metadata.Address != nil {
+			rule.Hash = root.Metadata.Address.RuleHash
+		}
+
+		e.code, e.nodes = nil, 0
+
+		if _, err := e.emitNode(root, true); err != nil {
+			return nil, err
+		}
+
+		rule.Code = e.code
+		e.p.Rules = append(e.p.Rules, rule)
+	}
+
+	return e.p, nil
+}
+
+type irEmitterT struct {
+	p       *ir.ProgramT
+	strings map[string]int64
+	code    []ir.InstrT
+	nodes   int64
+}
+
+// emitNode emits the blocks of the children of a node, then its own, and returns
+// the number of the node
+func (e *irEmitterT) emitNode(node *AstNodeT, root bool) (int64, error) {
+
+	var (
+		md   = node.Metadata
+		refs []int64
+	)
+
+	for _, child := range node.Children {
+		ref, err := e.emitNode(child, false)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, ref)
+	}
+
+	if feature := irUnsupported(node); feature != "" {
+		return 0, pqerr.Wrap(md.Pos, md.RuleId, md.Address.RuleHash, "", ErrIRUnsupported, feature)
+	}
+
+	e.emit(ir.OpNode, e.str(md.Type.String()), e.str(md.Scope), e.str(md.Address.String()))
+
+	switch o := node.Object.(type) {
+	case *AstLogMatcherT:
+		e.emit(ir.OpSource, e.str(o.Event.Source))
+		e.emitWindow(o.Window)
+		for _, f := range o.Match {
+			e.emit(ir.OpMatch, irTermKind(f.TermValue.Type), e.str(f.Field), e.str(f.TermValue.Value), int64(max(f.Count, 1)))
+		}
+		for _, f := range o.Negate {
+			args := []int64{irTermKind(f.TermValue.Type), e.str(f.Field), e.str(f.TermValue.Value)}
+			e.emit(ir.OpNegate, append(args, irNegateOpts(f.NegateOpts)...)...)
+		}
+	case *AstSeqMatcherT:
+		e.emitWindow(o.Window)
+		e.emitChildren(node, refs, len(o.Order))
+	case *AstSetMatcherT:
+		e.emitWindow(o.Window)
+		if o.Require > 0 {
+			e.emit(ir.OpRequire, int64(o.Require))
+		}
+		e.emitChildren(node, refs, len(o.Match))
+	case *AstGroupMatcherT:
+		e.emitChildren(node, refs, len(refs))
+	}
+
+	if root {
+		e.emit(ir.OpDetect)
+	} else {
+		e.emit(ir.OpEmit)
+	}
+
+	e.nodes++
+	return e.nodes - 1, nil
+}
+
+// emitChildren emits the first n children as match terms and the rest as negates
+func (e *irEmitterT) emitChildren(node *AstNodeT, refs []int64, n int) {
+	for i, ref := range refs {
+		if i < n {
+			e.emit(ir.OpMatchNode, ref)
+			continue
+		}
+		e.emit(ir.OpNegateNode, append([]int64{ref}, irNegateOpts(node.Children[i].Metadata.NegateOpts)...)...)
+	}
+}
+
+func (e *irEmitterT) emitWindow(w time.Duration) {
+	if w > 0 {
+		e.emit(ir.OpWindow, w.Nanoseconds())
+	}
+}
+
+func (e *irEmitterT) emit(op ir.OpT, args ...int64) {
+	e.code = append(e.code, ir.InstrT{Op: op, Args: args})
+}
+
+// str returns the index of a string in the table of the program
+func (e *irEmitterT) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.p.Strings))
+	e.p.Strings = append(e.p.Strings, s)
+	e.strings[s] = i
+	return i
+}
+
+func irTermKind(t match.TermTypeT) int64 {
+	switch t {
+	case match.TermRegex:
+		return int64(ir.TermRegex)
+	case match.TermJqJson:
+		return int64(ir.TermJqJson)
+	case match.TermJqYaml:
+		return int64(ir.TermJqYaml)
+	}
+	return int64(ir.TermRaw)
+}
+
+// irNegateOpts returns the window, slide, anchor, and absolute args of a negate
+func irNegateOpts(n *AstNegateOptsT) []int64 {
+	if n == nil {
+		return []int64{0, 0, 0, 0}
+	}
+	var absolute int64
+	if n.Absolute {
+		absolute = 1
+	}
+	return []int64{n.Window.Nanoseconds(), n.Slide.Nanoseconds(), int64(n.Anchor), absolute}
+}
+
+// irUnsupported returns the first feature of a node that the IR cannot express
+func irUnsupported(node *AstNodeT) string {
+
+	if features := Features(node); len(features) > 0 {
+		return features[0]
+	}
+
+	switch node.Object.(type) {
+	case *AstLogMatcherT, *AstSeqMatcherT, *AstSetMatcherT, *AstGroupMatcherT:
+		return ""
+	}
+
+	return node.Metadata.Type.String() + " node"
+}
@@ -0,0 +1,69 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/itchyny/gojq"
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidJq = errors.New("invalid jq expression")
+)
+
+// validateJq compiles the jq condition and jq extracts of a field, so that a
+// syntax error or an unknown function is reported with its position when the
+// rule is built rather than when it first runs. Conditions with step references
+// are substituted by the runtime and are compiled there.
+func validateJq(n *parser.NodeT, field parser.FieldT) error {
+
+	if field.JqValue != "" && len(field.StepRefs) == 0 {
+		if err := compileJq(n, field.JqValue, field.Pos); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range field.Extract {
+		if e.JqValue == "" {
+			continue
+		}
+		pos := e.Pos
+		if pos == (pqerr.Pos{}) {
+			pos = field.Pos
+		}
+		if err := compileJq(n, e.JqValue, pos); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compileJq(n *parser.NodeT, expr string, pos pqerr.Pos) error {
+
+	query, err := gojq.Parse(expr)
+	if err == nil {
+		_, err = gojq.Compile(query)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+
+	var perr *gojq.ParseError
+	if errors.As(err, &perr) {
+		msg = fmt.Sprintf("offset=%d: %s", perr.Offset, msg)
+	}
+
+	log.Error().
+		Err(err).
+		Str("jq", expr).
+		Msg("Invalid jq expression")
+
+	return pqerr.Wrap(pos, n.Metadata.RuleId, n.Metadata.RuleHash, n.Metadata.CreId, ErrInvalidJq, msg)
+}
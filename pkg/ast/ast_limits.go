@@ -0,0 +1,90 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+)
+
+var (
+	ErrMaxDepth           = errors.New("rule nests too deeply")
+	ErrMaxRules           = errors.New("too many rules")
+	ErrSourceNotAllowed   = errors.New("event source not allowed")
+	ErrNodeTypeNotAllowed = errors.New("node type not allowed")
+)
+
+// WithMaxDepth fails rules with nodes more than depth levels below their root, as
+// given by the depth of node addresses. Zero is unbounded.
+func WithMaxDepth(depth int) BuildOptT {
+	return func(o *buildOptsT) {
+		o.maxDepth = depth
+	}
+}
+
+// WithMaxRules fails bundles with more than n rules before any rule is built.
+// Zero is unbounded.
+func WithMaxRules(n int) BuildOptT {
+	return func(o *buildOptsT) {
+		o.maxRules = n
+	}
+}
+
+// WithStrictSources fails matchers whose event source is not one of sources, or
+// not registered with schema.RegisterSource when no sources are given
+func WithStrictSources(sources ...string) BuildOptT {
+	return func(o *buildOptsT) {
+		o.strictSources = true
+		o.allowedSources = append(o.allowedSources, sources...)
+	}
+}
+
+// WithDisabledNodeTypes fails rules that use any of the node types
+func WithDisabledNodeTypes(types ...schema.NodeTypeT) BuildOptT {
+	return func(o *buildOptsT) {
+		o.disabledTypes = append(o.disabledTypes, types...)
+	}
+}
+
+func (o *buildOptsT) checkRules(tree *parser.TreeT) error {
+	if o.maxRules > 0 && len(tree.Nodes) > o.maxRules {
+		return tree.Nodes[o.maxRules].WrapError(fmt.Errorf("%w: %d exceeds the limit of %d", ErrMaxRules, len(tree.Nodes), o.maxRules))
+	}
+	return nil
+}
+
+func (o *buildOptsT) checkDepth(parserNode *parser.NodeT, depth uint32) error {
+	if o.maxDepth > 0 && depth > uint32(o.maxDepth) {
+		return parserNode.WrapError(fmt.Errorf("%w: depth %d exceeds the limit of %d", ErrMaxDepth, depth, o.maxDepth))
+	}
+	return nil
+}
+
+// checkNode checks the type of a node and, for matchers, its event source
+func (o *buildOptsT) checkNode(parserNode *parser.NodeT) error {
+
+	if slices.Contains(o.disabledTypes, parserNode.Metadata.Type) {
+		return parserNode.WrapError(fmt.Errorf("%w: %s", ErrNodeTypeNotAllowed, parserNode.Metadata.Type))
+	}
+
+	if !o.strictSources || parserNode.Metadata.Event == nil {
+		return nil
+	}
+
+	var source = parserNode.Metadata.Event.Source
+
+	if len(o.allowedSources) > 0 {
+		if !slices.Contains(o.allowedSources, source) {
+			return parserNode.WrapError(fmt.Errorf("%w: %s", ErrSourceNotAllowed, source))
+		}
+		return nil
+	}
+
+	if _, ok := schema.LookupSource(source); !ok {
+		return parserNode.WrapError(fmt.Errorf("%w: %s is not registered", ErrSourceNotAllowed, source))
+	}
+
+	return nil
+}
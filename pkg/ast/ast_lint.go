@@ -0,0 +1,94 @@
+package ast
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+)
+
+// Diagnostic codes emitted by the lint pass
+const (
+	DiagWindowPerStep = "window-per-step"
+)
+
+// WithDiagnostics receives non-fatal lint diagnostics for rules that build successfully,
+// and the findings of validations below error severity
+func WithDiagnostics(fn func(pqerr.Diagnostic)) BuildOptT {
+	return func(o *buildOptsT) {
+		o.diagnostics = fn
+	}
+}
+
+// WithMinStepWindow warns when a sequence window divided by its positive step count is below d.
+// Disabled when d is zero (the default).
+func WithMinStepWindow(d time.Duration) BuildOptT {
+	return func(o *buildOptsT) {
+		o.minStepWindow = d
+	}
+}
+
+func (o *buildOptsT) lint(parserNode *parser.NodeT) {
+
+	if o.diagnostics == nil || o.minStepWindow <= 0 {
+		return
+	}
+
+	o.lintWindowPerStep(parserNode)
+}
+
+func (o *buildOptsT) lintWindowPerStep(parserNode *parser.NodeT) {
+
+	switch parserNode.Metadata.Type {
+	case schema.NodeTypeSeq, schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq, schema.NodeTypeMetricSeq:
+		var (
+			steps  = positiveSteps(parserNode)
+			window = parserNode.Metadata.Window
+		)
+
+		if steps > 0 && window > 0 && window/time.Duration(steps) < o.minStepWindow {
+			o.diagnostics(pqerr.Diagnostic{
+				Pos:      parserNode.Metadata.WindowPos,
+				RuleId:   parserNode.Metadata.RuleId,
+				RuleHash: parserNode.Metadata.RuleHash,
+				CreId:    parserNode.Metadata.CreId,
+				Code:     DiagWindowPerStep,
+				Severity: pqerr.SeverityWarning,
+				Msg: fmt.Sprintf("window %s for %d ordered steps is less than %s per step; double-check the window",
+					window, steps, o.minStepWindow),
+			})
+		}
+	}
+
+	for _, child := range parserNode.Children {
+		if c, ok := child.(*parser.NodeT); ok {
+			o.lintWindowPerStep(c)
+		}
+	}
+}
+
+// positiveSteps counts the positive conditions of a node, expanding counts on matcher fields
+func positiveSteps(parserNode *parser.NodeT) int {
+
+	if !parserNode.IsMatcherNode() {
+		if parserNode.NegIdx >= 0 {
+			return parserNode.NegIdx
+		}
+		return len(parserNode.Children)
+	}
+
+	var steps int
+	for _, child := range parserNode.Children {
+		for _, field := range child.(*parser.MatcherT).Match.Fields {
+			if field.CountRange != nil {
+				steps += field.CountRange.Min
+				continue
+			}
+			steps += max(field.Count, 1)
+		}
+	}
+
+	return steps
+}
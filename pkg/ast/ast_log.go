@@ -1,12 +1,20 @@
 package ast
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
 	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -14,21 +22,61 @@ var (
 	ErrSeqPosConditions = errors.New("sequences require two or more positive conditions")
 	ErrMissingScalar    = errors.New("missing string, jq, or regex condition")
 	ErrExtractTerm      = errors.New("invalid extract (must have name and one of jq or regex)")
-	ErrNegateCount      = errors.New("negate fields cannot have count > 1")
 	ErrExtractNegate    = errors.New("negate fields cannot have extracts")
+	ErrExtractType      = errors.New("invalid extract type (must be one of int, float, duration, timestamp, or bool)")
+	ErrExtractTransform = errors.New("invalid extract transform (must be one of lowercase, trim, hash, or substring(start[, end]))")
+	ErrExistsValue      = errors.New("exists cannot be combined with a string, jq, or regex condition")
+	ErrExistsField      = errors.New("exists requires a top-level field name")
+	ErrExistsSource     = errors.New("exists requires a source of structured events (registered with schema.RegisterSource)")
+	ErrMultiplePrimary  = errors.New("at most one primary condition is allowed")
+	ErrPrimaryNegate    = errors.New("negate fields cannot be primary")
+	ErrDelimiter        = errors.New("delimiter must be a single character")
+	ErrValueSetValue    = errors.New("value set cannot be combined with a string, jq, or regex condition")
+	ErrDelimitedTerm    = errors.New("delimited fields require a field and one of string or regex condition")
+	ErrNegateUntil      = errors.New("negate 'until' requires a sequence and a step after the anchor")
+	ErrJqSourceTerm     = errors.New("condition cannot be matched on the fields of a JSON source")
+
+	// Deprecated: a count on a negate is the number of matches that cancel the
+	// match, so ErrNegateCount is no longer returned.
+	ErrNegateCount = errors.New("negate fields cannot have count > 1")
 )
 
 type AstLogMatcherT struct {
-	Event        AstEventT
-	Match        []AstFieldT
-	Negate       []AstFieldT
-	Correlations []string
-	Window       time.Duration
+	Event             AstEventT
+	Match             []AstFieldT
+	Negate            []AstFieldT
+	Correlations      []string
+	Window            time.Duration
+	CorrelationWindow time.Duration      // Horizon for correlations; zero uses Window
+	OrderTolerance    time.Duration      // Sequences only; events within the tolerance count as ordered
+	CountDistinct     *AstCountDistinctT // Sets only
+	NegateGroups      []AstNegateGroupT  // Negate fields outside a group suppress on their own
+	StepRefs          []AstStepRefT      // Sequences only; indexes into Match
 }
 
-func validateLogSeq(n *parser.NodeT, matches int) error {
+// AstNegateGroupT lists negate fields that suppress the match only when all of them occur
+type AstNegateGroupT struct {
+	Fields []int // Indexes into Negate
+}
+
+// AstCountDistinctT fires the set once Threshold distinct values of the extract
+// named Field are observed within the window
+type AstCountDistinctT struct {
+	Field     string
+	Threshold int
+}
+
+func validateLogSeq(in ValidateInputT) error {
+
+	var n = in.Node
 
-	if matches <= 1 {
+	switch n.Metadata.Type {
+	case schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
+	default:
+		return nil
+	}
+
+	if in.Matches <= 1 {
 		log.Error().
 			Any("node", n).
 			Msg("Sequences require two or more positive conditions")
@@ -45,10 +93,47 @@ func validateLogSeq(n *parser.NodeT, matches int) error {
 	return nil
 }
 
-func validateLogSet(n *parser.NodeT, matches int) error {
+// validateNegateUntil checks that a negate with 'until' ends on a later step of a
+// sequence. positives is the number of steps in the sequence.
+func validateNegateUntil(n *parser.NodeT, opts *parser.NegateOptsT, positives int) error {
+
+	if opts.Until == "" {
+		return nil
+	}
+
+	switch {
+	case n.Metadata.Type != schema.NodeTypeLogSeq && n.Metadata.Type != schema.NodeTypeTraceSeq && n.Metadata.Type != schema.NodeTypeSeq:
+	case opts.UntilIdx <= opts.Anchor:
+	case int(opts.UntilIdx) >= positives:
+	default:
+		return nil
+	}
+
+	log.Error().
+		Str("until", opts.Until).
+		Uint32("until_idx", opts.UntilIdx).
+		Uint32("anchor", opts.Anchor).
+		Str("type", n.Metadata.Type.String()).
+		Msg("Invalid negate until")
+
+	return n.WrapError(ErrNegateUntil)
+}
+
+func validateLogSet(in ValidateInputT) error {
 
-	// Only one positive condition with a window is not allowed
-	if matches == 1 && n.Metadata.Window != 0 {
+	var (
+		n       = in.Node
+		matches = in.Matches
+	)
+
+	switch n.Metadata.Type {
+	case schema.NodeTypeLogSet, schema.NodeTypeTraceSet, schema.NodeTypeFlowSet:
+	default:
+		return nil
+	}
+
+	// Only one positive condition with a window is not allowed, unless values are counted
+	if matches == 1 && n.Metadata.Window != 0 && n.Metadata.CountDistinct == nil {
 		log.Error().
 			Any("node", n).
 			Msg("Windows require two or more positive conditions")
@@ -69,10 +154,16 @@ func validateLogSet(n *parser.NodeT, matches int) error {
 func (b *builderT) buildLogMatcherNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
 
 	var (
-		matchFields  = make([]AstFieldT, 0)
-		negateFields = make([]AstFieldT, 0)
-		zlog         = log.With().Any("address", machineAddress).Logger()
-		err          error
+		nMatch, nNegate = matcherFieldCounts(parserNode)
+		matchFields     = make([]AstFieldT, 0, nMatch)
+		negateFields    = make([]AstFieldT, 0, nNegate)
+		negateGroups    []AstNegateGroupT
+		stepStart       []int // Index of the first match field of each child
+		primaries       int
+		matches         int
+		logError        = func() *zerolog.Event { return log.Error().Any("address", machineAddress) } // Address is only marshaled on error
+		source          = parserNode.Metadata.Event.Source
+		err             error
 	)
 
 	for _, child := range parserNode.Children {
@@ -82,33 +173,75 @@ func (b *builderT) buildLogMatcherNode(parserNode *parser.NodeT, machineAddress
 			ok    bool
 		)
 
+		stepStart = append(stepStart, len(matchFields))
+
 		// Children are expected to be scalar matcher values
 		if match, ok = child.(*parser.MatcherT); !ok {
-			zlog.Error().Msg("Expected scalar value")
+			logError().Msg("Expected scalar value")
 			return nil, parserNode.WrapError(ErrMissingScalar)
 		}
 
 		// Count match fields and remember values
 		for _, field := range match.Match.Fields {
-			for range max(field.Count, 1) {
-				if term, err = newMatchTerm(field); err != nil {
-					zlog.Error().Err(err).Msg("Invalid match field term")
-					return nil, parserNode.WrapError(err)
+			if err = sourceField(source, &field); err != nil {
+				return nil, wrapPos(parserNode, field.Pos, err)
+			}
+			if field.Primary {
+				if primaries++; primaries > 1 {
+					logError().Msg("Multiple primary conditions")
+					return nil, parserNode.WrapError(ErrMultiplePrimary)
 				}
-				matchFields = append(matchFields, term)
 			}
+			if err = validateExtracts(parserNode, field.Extract); err != nil {
+				return nil, err
+			}
+			if err = validateJq(parserNode, field); err != nil {
+				return nil, err
+			}
+			if term, err = newMatchTerm(field); err != nil {
+				logError().Err(err).Msg("Invalid match field term")
+				return nil, parserNode.WrapError(err)
+			}
+			// A fixed count stays on the field; the compiler expands it for the runtime
+			switch {
+			case field.CountRange != nil:
+				matches += field.CountRange.Min
+			case field.Count > 1:
+				term.Count = field.Count
+				matches += field.Count
+			default:
+				matches++
+			}
+			matchFields = append(matchFields, term)
+		}
+
+		if match.NegateAll {
+			group := AstNegateGroupT{Fields: make([]int, 0, len(match.Negate.Fields))}
+			for i := range match.Negate.Fields {
+				group.Fields = append(group.Fields, len(negateFields)+i)
+			}
+			negateGroups = append(negateGroups, group)
 		}
 
 		// Count negate fields and remember values
 		for _, field := range match.Negate.Fields {
-			if field.Count > 1 {
-				err = ErrNegateCount
-				zlog.Error().Err(err).Int("count", field.Count).Msg("Negate field with count > 1")
-				return nil, parserNode.WrapError(err)
-
+			if err = sourceField(source, &field); err != nil {
+				return nil, wrapPos(parserNode, field.Pos, err)
+			}
+			if field.Primary {
+				logError().Msg("Negate field marked primary")
+				return nil, parserNode.WrapError(ErrPrimaryNegate)
+			}
+			if err = validateJq(parserNode, field); err != nil {
+				return nil, err
 			}
-			if term, err = newNegateTerm(field, uint32(len(match.Negate.Fields))); err != nil {
-				zlog.Error().Err(err).Msg("Invalid negate field term")
+			if field.NegateOpts != nil {
+				if err = validateNegateUntil(parserNode, field.NegateOpts, len(matchFields)); err != nil {
+					return nil, err
+				}
+			}
+			if term, err = newNegateTerm(field, uint32(len(matchFields))); err != nil {
+				logError().Err(err).Msg("Invalid negate field term")
 				return nil, parserNode.WrapError(err)
 			}
 			negateFields = append(negateFields, term)
@@ -117,14 +250,7 @@ func (b *builderT) buildLogMatcherNode(parserNode *parser.NodeT, machineAddress
 	}
 
 	switch parserNode.Metadata.Type {
-	case schema.NodeTypeLogSet:
-		if err = validateLogSet(parserNode, len(matchFields)); err != nil {
-			return nil, err
-		}
-	case schema.NodeTypeLogSeq:
-		if err = validateLogSeq(parserNode, len(matchFields)); err != nil {
-			return nil, err
-		}
+	case schema.NodeTypeLogSet, schema.NodeTypeTraceSet, schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
 	default:
 		log.Error().
 			Any("type", parserNode.Metadata.Type.String()).
@@ -132,37 +258,365 @@ func (b *builderT) buildLogMatcherNode(parserNode *parser.NodeT, machineAddress
 		return nil, parserNode.WrapError(ErrInvalidNodeType)
 	}
 
-	return b.doBuildLogMatcherNode(parserNode, machineAddress, termIdx, matchFields, negateFields)
+	if err = b.validate(parserNode, matches); err != nil {
+		return nil, err
+	}
+
+	stepRefs := buildLogStepRefs(parserNode, stepStart)
+
+	return b.doBuildLogMatcherNode(parserNode, machineAddress, termIdx, matchFields, negateFields, negateGroups, stepRefs)
+}
+
+// matcherFieldCounts returns the number of match and negate fields of the matcher
+// children of a node, to size the fields of the AST once
+func matcherFieldCounts(parserNode *parser.NodeT) (nMatch, nNegate int) {
+	for _, child := range parserNode.Children {
+		if m, ok := child.(*parser.MatcherT); ok {
+			nMatch += len(m.Match.Fields)
+			nNegate += len(m.Negate.Fields)
+		}
+	}
+	return nMatch, nNegate
+}
+
+// buildLogStepRefs maps the step references of a log sequence to match field indexes
+func buildLogStepRefs(parserNode *parser.NodeT, stepStart []int) []AstStepRefT {
+	var refs []AstStepRefT
+	for i, child := range parserNode.Children {
+		for _, field := range child.(*parser.MatcherT).Match.Fields {
+			for _, ref := range field.StepRefs {
+				refs = append(refs, AstStepRefT{
+					Term:    stepStart[i],
+					Step:    stepStart[ref.Step],
+					Extract: ref.Extract,
+				})
+			}
+		}
+	}
+	return refs
 }
 
-func (b *builderT) doBuildLogMatcherNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32, matchFields []AstFieldT, negateFields []AstFieldT) (*AstNodeT, error) {
+func (b *builderT) doBuildLogMatcherNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32, matchFields []AstFieldT, negateFields []AstFieldT, negateGroups []AstNegateGroupT, stepRefs []AstStepRefT) (*AstNodeT, error) {
 	var (
-		address   = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
-		matchNode = newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeNode, machineAddress, address)
+		address = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
+		scope   = b.scope(parserNode, schema.ScopeNode)
 	)
 
+	matchNode := b.newAstNode(parserNode, parserNode.Metadata.Type, scope, machineAddress, address)
+
 	matchNode.Object = &AstLogMatcherT{
 		Event: AstEventT{
 			Origin: parserNode.Metadata.Event.Origin,
-			Source: parserNode.Metadata.Event.Source,
+			Source: intern(parserNode.Metadata.Event.Source),
 		},
-		Match:        matchFields,
-		Negate:       negateFields,
-		Window:       parserNode.Metadata.Window,
-		Correlations: parserNode.Metadata.Correlations,
+		Match:             matchFields,
+		Negate:            negateFields,
+		Window:            parserNode.Metadata.Window,
+		CorrelationWindow: parserNode.Metadata.CorrelationWindow,
+		OrderTolerance:    parserNode.Metadata.OrderTolerance,
+		Correlations:      parserNode.Metadata.Correlations,
+		NegateGroups:      negateGroups,
+		StepRefs:          stepRefs,
+	}
+
+	if cd := parserNode.Metadata.CountDistinct; cd != nil {
+		matchNode.Object.(*AstLogMatcherT).CountDistinct = &AstCountDistinctT{
+			Field:     cd.Field,
+			Threshold: cd.Threshold,
+		}
 	}
 
 	return matchNode, nil
 }
 
+// Keys of syslog event fields whose names differ in rules. Structured data
+// parameters are under structured_data.<SD-ID>.<param>.
+var syslogKeys = map[string]string{
+	"appname": "app_name",
+	"procid":  "proc_id",
+	"msgid":   "msg_id",
+}
+
+// Paths of Windows event fields in the JSON form of the event XML. Named values
+// of the event are under EventData.<name>.
+var winEventKeys = map[string]string{
+	"EventID":  "System.EventID",
+	"Channel":  "System.Channel",
+	"Provider": "System.Provider.Name",
+	"Level":    "System.Level",
+	"Message":  "RenderingInfo.Message",
+}
+
+// Sources of JSON records whose conditions compile to jq selectors, with the
+// fields of each that hold numbers
+var jqSources = map[string]map[string]bool{
+	schema.SourceWinEvent: {
+		"System.EventID": true,
+		"System.Level":   true,
+	},
+	schema.SourceCloudTrail: nil,
+	schema.SourceContainer: {
+		"exitCode": true,
+	},
+	schema.SourceAlerts: nil,
+	schema.SourceTraces: {
+		"duration": true,
+	},
+	// The JSON export of the journal holds every field, PRIORITY too, as a string
+	schema.SourceJournald: nil,
+	schema.SourceSyslog: {
+		"facility": true,
+		"severity": true,
+	},
+}
+
+// Paths of alert fields that are labels
+var alertKeys = map[string]string{
+	"alertname": "labels.alertname",
+	"severity":  "labels.severity",
+}
+
+// sourceField maps a condition to the events of its source: the field becomes the
+// key of the event, and conditions on JSON sources compile to jq selectors. The
+// runtime matches other conditions against the whole event, so those that cannot
+// be compiled are refused. The events of unregistered sources are raw text, which
+// has no fields to test for.
+func sourceField(source string, field *parser.FieldT) error {
+
+	if source == schema.SourceAlerts && field.Field == "selector" {
+		field.Field, field.JqValue, field.StrValue = "", alertSelectorJq(field.StrValue), ""
+		return nil
+	}
+
+	field.Field = eventKey(source, field.Field)
+
+	if numbers, ok := jqSources[source]; ok {
+		return fieldJq(field, eventPath(source, field.Field), numbers)
+	}
+
+	if _, ok := schema.LookupSource(source); !ok && field.Exists != nil {
+		log.Error().Str("source", source).Str("field", field.Field).Msg("Exists on a raw text source")
+		return ErrExistsSource
+	}
+
+	return nil
+}
+
+// eventPath returns the keys of the path of a field in events of the source. The
+// keys of span attributes and resource attributes may contain dots, so they are
+// one key of the attributes object.
+func eventPath(source, field string) []string {
+
+	if source == schema.SourceTraces {
+		for _, prefix := range []string{"attributes.", "resource."} {
+			if key, ok := strings.CutPrefix(field, prefix); ok {
+				return []string{strings.TrimSuffix(prefix, "."), key}
+			}
+		}
+	}
+
+	return strings.Split(field, ".")
+}
+
+// alertSelectorJq compiles the label selector of an alert into a jq selector. The
+// parser has validated the selector. As in PromQL, missing labels are empty and
+// regexes match the whole value.
+func alertSelectorJq(expr string) string {
+
+	var (
+		sel, _   = parser.AlertSelector(expr)
+		matchers = sel.Matchers
+		conds    []string
+	)
+
+	if sel.Metric != "" {
+		matchers = append([]parser.PromMatcherT{{Name: "alertname", Op: "=", Value: sel.Metric}}, matchers...)
+	}
+
+	for _, m := range matchers {
+		var (
+			label = fmt.Sprintf(`(.labels[%s] // "")`, jqString(m.Name))
+			re    = jqString("^(?:" + m.Value + ")$")
+		)
+		switch m.Op {
+		case "=":
+			conds = append(conds, label+" == "+jqString(m.Value))
+		case "!=":
+			conds = append(conds, label+" != "+jqString(m.Value))
+		case "=~":
+			conds = append(conds, fmt.Sprintf("(%s | test(%s))", label, re))
+		case "!~":
+			conds = append(conds, fmt.Sprintf("(%s | test(%s) | not)", label, re))
+		}
+	}
+
+	return "select(" + strings.Join(conds, " and ") + ")"
+}
+
+// eventKey maps the field of a condition to its key in events of the source
+func eventKey(source, field string) string {
+
+	switch source {
+	case schema.SourceSyslog:
+		if key, ok := syslogKeys[field]; ok {
+			return key
+		}
+		if sd, ok := strings.CutPrefix(field, "sd."); ok {
+			return "structured_data." + sd
+		}
+	case schema.SourceWinEvent:
+		if key, ok := winEventKeys[field]; ok {
+			return key
+		}
+	case schema.SourceAlerts:
+		if key, ok := alertKeys[field]; ok {
+			return key
+		}
+	}
+
+	return field
+}
+
+// fieldJq compiles a condition on a field of a JSON record, such as a Windows
+// event or a CloudTrail record, into a jq selector on the path of the field.
+// Values, strings, and the values of the fields in numbers compare with the whole
+// value of the field, as numbers for the latter; regexes, regex lists, and globs
+// are tested on it, with the flags of the match options. Delimited and CIDR
+// conditions are refused. Conditions that newMatchTerm refuses are left to it.
+func fieldJq(field *parser.FieldT, keys []string, numbers map[string]bool) error {
+
+	if field.Field == "" || field.JqValue != "" {
+		return nil
+	}
+
+	switch {
+	case field.Delimiter != "":
+		log.Error().Str("field", field.Field).Msg("Delimiter on a field of a JSON source")
+		return fmt.Errorf("%w: delimiter", ErrJqSourceTerm)
+	case len(field.IPCidr) > 0:
+		log.Error().Str("field", field.Field).Msg("CIDR blocks on a field of a JSON source")
+		return fmt.Errorf("%w: ip_cidr", ErrJqSourceTerm)
+	}
+
+	var (
+		values = 0
+		regex  string
+		conds  []string
+	)
+
+	for _, set := range []bool{field.StrValue != "", len(field.Values) > 0, field.RegexValue != "",
+		len(field.Regexes) > 0, field.Glob != "", field.Exists != nil, field.Compare != nil} {
+		if set {
+			values++
+		}
+	}
+
+	// Combined conditions are refused by newMatchTerm
+	if values != 1 {
+		return nil
+	}
+
+	var (
+		opts    = field.Options
+		literal = func(v string) string {
+			if numbers[field.Field] {
+				return v
+			}
+			return jqString(v)
+		}
+	)
+
+	switch {
+	case field.Exists != nil:
+		field.JqValue, field.Exists = existsJq(keys, *field.Exists), nil
+		return nil
+	case field.Compare != nil:
+		field.JqValue, field.Compare = newCompareTerm(keys, *field.Compare).Value, nil
+		return nil
+	case field.StrValue != "" && opts != nil:
+		regex = "^" + parser.ValueSetRegex([]string{field.StrValue}) + "$"
+	case field.StrValue != "":
+		conds = append(conds, ". == "+literal(field.StrValue))
+	case len(field.Values) > 0 && opts != nil:
+		regex = "^" + parser.ValueSetRegex(field.Values) + "$"
+	case len(field.Values) > 0:
+		for _, v := range field.Values {
+			conds = append(conds, ". == "+literal(v))
+		}
+	case field.RegexValue != "":
+		regex = field.RegexValue
+	case len(field.Regexes) > 0:
+		regex = parser.AnyRegex(field.Regexes)
+	case field.Glob != "":
+		var err error
+		if regex, err = parser.GlobRegex(field.Glob); err != nil {
+			return nil // Refused by newMatchTerm
+		}
+	}
+
+	if regex != "" {
+		if opts != nil {
+			regex = applyMatchOpts(match.TermT{Type: match.TermRegex, Value: regex}, *opts).Value
+		}
+		conds = append(conds, fmt.Sprintf(`type == "string" and test(%s)`, jqString(regex)))
+	}
+
+	field.JqValue = fmt.Sprintf("select(getpath(%s) | %s)", jqPath(keys), strings.Join(conds, " or "))
+	field.StrValue, field.Values, field.RegexValue, field.Regexes, field.Glob, field.Options = "", nil, "", nil, "", nil
+
+	return nil
+}
+
+// existsJq selects records that have, or do not have, the field at the path of
+// keys. A field set to null exists.
+func existsJq(keys []string, exists bool) string {
+
+	var (
+		parent = jqPath(keys[:len(keys)-1])
+		expr   = fmt.Sprintf(`(try getpath(%s) catch null) | type == "object" and has(%s)`, parent, jqString(keys[len(keys)-1]))
+	)
+
+	if !exists {
+		expr += " | not"
+	}
+
+	return "select(" + expr + ")"
+}
+
 func newMatchTerm(field parser.FieldT) (AstFieldT, error) {
 	var (
 		t     AstFieldT
 		count = 0
+		err   error
 	)
 
 	t = AstFieldT{
-		Field: field.Field,
+		Field:      field.Field,
+		Primary:    field.Primary,
+		Repeat:     newRepeat(field.Repeat),
+		MaxGap:     field.MaxGap,
+		Optional:   field.Optional,
+		CountRange: newCountRange(field.CountRange),
+
+		Annotations: field.Annotations,
+	}
+
+	// A value set matches any of its literals
+	if len(field.Values) > 0 {
+		if field.StrValue != "" || field.JqValue != "" || field.RegexValue != "" {
+			log.Error().Str("field", field.Field).Msg("Value set cannot be combined with a value")
+			return AstFieldT{}, ErrValueSetValue
+		}
+		field.RegexValue = parser.ValueSetRegex(field.Values)
+	}
+
+	// A regex list matches any of its regexes
+	if len(field.Regexes) > 0 {
+		if field.StrValue != "" || field.JqValue != "" || field.RegexValue != "" {
+			log.Error().Str("field", field.Field).Msg("Regex list cannot be combined with a value")
+			return AstFieldT{}, ErrValueSetValue
+		}
+		field.RegexValue = parser.AnyRegex(field.Regexes)
 	}
 
 	if len(field.Extract) > 0 {
@@ -195,16 +649,208 @@ func newMatchTerm(field parser.FieldT) (AstFieldT, error) {
 		}
 		count++
 	}
+	if field.Glob != "" {
+		if t.Glob, err = newGlob(field.Glob); err != nil {
+			log.Error().Err(err).Str("glob", field.Glob).Msg("Invalid glob")
+			return AstFieldT{}, parser.ErrGlob
+		}
+		t.TermValue = match.TermT{
+			Type:  match.TermRegex,
+			Value: t.Glob.Regex,
+		}
+		count++
+	}
 
 	if count > 1 {
-		log.Error().Msg("Only one of str, json, or regex value can be set")
+		log.Error().Msg("Only one of str, json, regex, or glob value can be set")
 		return AstFieldT{}, ErrInvalidNodeType
 	}
 
+	if field.Options != nil {
+		t.TermValue = applyMatchOpts(t.TermValue, *field.Options)
+	}
+
+	if field.Delimiter != "" {
+		if t.TermValue, err = newDelimitedTerm(field); err != nil {
+			return AstFieldT{}, err
+		}
+	}
+
+	if field.Exists != nil {
+		if count > 0 {
+			log.Error().Str("field", field.Field).Msg("Exists cannot be combined with a value")
+			return AstFieldT{}, ErrExistsValue
+		}
+
+		if t.TermValue, err = newExistsTerm(field.Field, *field.Exists); err != nil {
+			return AstFieldT{}, err
+		}
+	}
+
+	if len(field.IPCidr) > 0 {
+		if count > 0 || field.Exists != nil || field.Compare != nil {
+			log.Error().Str("field", field.Field).Msg("CIDR blocks cannot be combined with a value")
+			return AstFieldT{}, parser.ErrIPCidr
+		}
+
+		if t.IPCidr, err = newIPCidr(field.IPCidr); err != nil {
+			return AstFieldT{}, err
+		}
+	}
+
+	if field.Compare != nil {
+		if count > 0 || field.Exists != nil {
+			log.Error().Str("field", field.Field).Msg("Comparison cannot be combined with a value")
+			return AstFieldT{}, parser.ErrCompareField
+		}
+
+		t.TermValue = newCompareTerm(strings.Split(field.Field, "."), *field.Compare)
+	}
+
+	t.Field = intern(t.Field)
+	t.TermValue.Value = intern(t.TermValue.Value)
+
 	return t, nil
 
 }
 
+// applyMatchOpts folds match options into a raw or regex term. A raw term becomes
+// a regex if it is matched without case or on word boundaries.
+func applyMatchOpts(term match.TermT, opts parser.MatchOptsT) match.TermT {
+
+	var expr = term.Value
+
+	switch term.Type {
+	case match.TermRaw:
+		if !opts.CaseInsensitive && !opts.WordBoundary {
+			return term
+		}
+		expr = regexp.QuoteMeta(expr)
+	case match.TermRegex:
+	default:
+		return term
+	}
+
+	return match.TermT{
+		Type:  match.TermRegex,
+		Value: opts.Regex(expr),
+	}
+}
+
+// newExistsTerm matches on the presence or absence of a field in a structured (JSON) event.
+// Sources of raw text are refused by sourceField.
+func newExistsTerm(field string, exists bool) (match.TermT, error) {
+
+	if field == "" || strings.ContainsAny(field, ".[]") {
+		log.Error().Str("field", field).Msg("Exists requires a top-level field name")
+		return match.TermT{}, ErrExistsField
+	}
+
+	expr := fmt.Sprintf("select(has(%s))", jqString(field))
+	if !exists {
+		expr = fmt.Sprintf("select(has(%s) | not)", jqString(field))
+	}
+
+	return match.TermT{
+		Type:  match.TermJqJson,
+		Value: expr,
+	}, nil
+}
+
+// newDelimitedTerm matches a key=value pair in a flat, delimited (logfmt style) line.
+// The value may be bare or double quoted, e.g. `level=error msg="disk full"`.
+func newDelimitedTerm(field parser.FieldT) (match.TermT, error) {
+
+	if utf8.RuneCountInString(field.Delimiter) != 1 || field.Delimiter == "=" {
+		log.Error().Str("delimiter", field.Delimiter).Msg("Delimiter must be a single character")
+		return match.TermT{}, ErrDelimiter
+	}
+
+	if field.Field == "" || field.JqValue != "" || field.Exists != nil {
+		log.Error().Str("field", field.Field).Msg("Invalid delimited field")
+		return match.TermT{}, ErrDelimitedTerm
+	}
+
+	var value string
+	switch {
+	case field.StrValue != "":
+		value = regexp.QuoteMeta(field.StrValue)
+	case field.RegexValue != "":
+		value = "(?:" + field.RegexValue + ")"
+	default:
+		log.Error().Str("field", field.Field).Msg("Delimited field requires a value")
+		return match.TermT{}, ErrDelimitedTerm
+	}
+
+	var (
+		delim = regexp.QuoteMeta(field.Delimiter)
+		expr  = fmt.Sprintf(`(?:^|%s)%s=(?:%s|"%s")(?:%s|$)`,
+			delim, regexp.QuoteMeta(field.Field), value, value, delim)
+	)
+
+	if _, err := regexp.Compile(expr); err != nil {
+		log.Error().Err(err).Str("field", field.Field).Msg("Invalid delimited field regex")
+		return match.TermT{}, err
+	}
+
+	return match.TermT{
+		Type:  match.TermRegex,
+		Value: expr,
+	}, nil
+}
+
+var compareOps = map[parser.CompareOpT]string{
+	parser.CompareGt:  ">",
+	parser.CompareGte: ">=",
+	parser.CompareLt:  "<",
+	parser.CompareLte: "<=",
+	parser.CompareEq:  "==",
+}
+
+// newCompareTerm matches when the number at the path of a field of a structured
+// (JSON) event compares with the value. Strings are not converted, so "500" never
+// matches.
+func newCompareTerm(keys []string, cmp parser.CompareT) match.TermT {
+
+	expr := fmt.Sprintf(`select(getpath(%s) | type == "number" and . %s %s)`,
+		jqPath(keys), compareOps[cmp.Op], strconv.FormatFloat(cmp.Value, 'g', -1, 64))
+
+	return match.TermT{
+		Type:  match.TermJqJson,
+		Value: expr,
+	}
+}
+
+func newIPCidr(blocks []string) (*AstIPCidrT, error) {
+	var c = &AstIPCidrT{Prefixes: make([]netip.Prefix, 0, len(blocks))}
+	for _, b := range blocks {
+		p, err := netip.ParsePrefix(b)
+		if err != nil {
+			log.Error().Err(err).Str("cidr", b).Msg("Invalid CIDR block")
+			return nil, parser.ErrIPCidr
+		}
+		c.Prefixes = append(c.Prefixes, p)
+	}
+	return c, nil
+}
+
+// jqPath formats the keys of a path as a jq array of strings
+func jqPath(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = jqString(key)
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
+
+// jqString quotes s as a jq (JSON) string literal
+func jqString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// newNegateTerm returns the term of a negate field. Its anchor indexes the match
+// fields, of which there are anchors.
 func newNegateTerm(field parser.FieldT, anchors uint32) (AstFieldT, error) {
 
 	var (
@@ -223,41 +869,115 @@ func newNegateTerm(field parser.FieldT, anchors uint32) (AstFieldT, error) {
 
 	if field.NegateOpts != nil {
 
-		if field.NegateOpts.Anchor > anchors {
+		if a := field.NegateOpts.Anchor; a > 0 && a >= anchors {
+			log.Error().Uint32("anchor", a).Uint32("fields", anchors).Msg("Negate anchor is not the index of a match field")
 			return AstFieldT{}, ErrInvalidAnchor
 		}
 
 		t.NegateOpts = &AstNegateOptsT{
-			Window:   field.NegateOpts.Window,
-			Slide:    field.NegateOpts.Slide,
-			Anchor:   field.NegateOpts.Anchor,
-			Absolute: field.NegateOpts.Absolute,
+			Window:     field.NegateOpts.Window,
+			Slide:      field.NegateOpts.Slide,
+			Anchor:     field.NegateOpts.Anchor,
+			Absolute:   field.NegateOpts.Absolute,
+			AnchorName: field.NegateOpts.AnchorName,
+			Until:      field.NegateOpts.UntilIdx,
+			UntilName:  field.NegateOpts.Until,
 		}
 	}
 
+	// A count on a negate is an occurrence threshold, not copies of the field
+	if field.Count > 1 {
+		if t.NegateOpts == nil {
+			t.NegateOpts = &AstNegateOptsT{}
+		}
+		t.NegateOpts.Count = field.Count
+	}
+
 	return t, nil
 }
 
-func extractTerms(terms []parser.ExtractT) ([]AstExtractT, error) {
-	var extracts []AstExtractT
-	for _, term := range terms {
-		var (
-			cnt int
-			e   = AstExtractT{Name: term.Name}
-		)
+// validateExtracts checks the type and transforms of each extract, positioning
+// errors at the offending key
+func validateExtracts(n *parser.NodeT, extracts []parser.ExtractT) error {
+	for _, e := range extracts {
+		if !schema.ExtractTypeT(e.Type).Valid() {
+			log.Error().
+				Str("extract", e.Name).
+				Str("type", e.Type).
+				Msg("Invalid extract type")
+			return wrapPos(n, e.Pos, ErrExtractType)
+		}
+		for _, t := range e.Transforms {
+			if _, err := parseTransform(t.Expr); err != nil {
+				log.Error().
+					Str("extract", e.Name).
+					Str("transform", t.Expr).
+					Msg("Invalid extract transform")
+				return wrapPos(n, t.Pos, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTransform parses a transform of the form name or name(arg, ...)
+func parseTransform(expr string) (AstTransformT, error) {
+
+	var (
+		name, rest, hasArgs = strings.Cut(expr, "(")
+		t                   = AstTransformT{Op: schema.TransformOpT(strings.TrimSpace(name))}
+	)
 
-		if term.RegexValue != "" {
-			cnt++
-			e.RegexValue = term.RegexValue
+	if hasArgs {
+		args, ok := strings.CutSuffix(strings.TrimSpace(rest), ")")
+		if !ok {
+			return AstTransformT{}, ErrExtractTransform
 		}
-		if term.JqValue != "" {
-			cnt++
-			e.JqValue = term.JqValue
+		for _, arg := range strings.Split(args, ",") {
+			v, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || v < 0 {
+				return AstTransformT{}, ErrExtractTransform
+			}
+			t.Args = append(t.Args, v)
+		}
+	}
+
+	switch t.Op {
+	case schema.TransformLowercase, schema.TransformTrim, schema.TransformHash:
+		if len(t.Args) == 0 {
+			return t, nil
 		}
-		if cnt != 1 {
+	case schema.TransformSubstring:
+		if len(t.Args) == 1 || (len(t.Args) == 2 && t.Args[0] <= t.Args[1]) {
+			return t, nil
+		}
+	}
+
+	return AstTransformT{}, ErrExtractTransform
+}
+
+// newAstExtract converts an extract whose transforms have been validated
+func newAstExtract(e parser.ExtractT) AstExtractT {
+	var out = AstExtractT{
+		Name:       e.Name,
+		JqValue:    e.JqValue,
+		RegexValue: e.RegexValue,
+		Type:       schema.ExtractTypeT(e.Type),
+	}
+	for _, t := range e.Transforms {
+		xf, _ := parseTransform(t.Expr)
+		out.Transforms = append(out.Transforms, xf)
+	}
+	return out
+}
+
+func extractTerms(terms []parser.ExtractT) ([]AstExtractT, error) {
+	var extracts []AstExtractT
+	for _, term := range terms {
+		if (term.RegexValue == "") == (term.JqValue == "") {
 			return nil, ErrExtractTerm
 		}
-		extracts = append(extracts, e)
+		extracts = append(extracts, newAstExtract(term))
 	}
 	return extracts, nil
 }
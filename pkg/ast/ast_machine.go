@@ -9,39 +9,73 @@ import (
 )
 
 type AstSeqMatcherT struct {
-	Order        []*AstMetadataT
-	Negate       []*AstMetadataT
-	Correlations []string
-	Window       time.Duration
+	Order             []*AstMetadataT
+	Negate            []*AstMetadataT
+	Correlations      []string
+	Window            time.Duration
+	OrderTolerance    time.Duration // Children within the tolerance count as ordered
+	CorrelationWindow time.Duration // Horizon for correlations; zero uses Window
+	JoinKeys          []AstJoinKeyT // Children must agree on the values of these extracts
+	StepRefs          []AstStepRefT // Indexes into Order
 }
 
 type AstSetMatcherT struct {
-	Match        []*AstMetadataT
-	Negate       []*AstMetadataT
-	Correlations []string
-	Window       time.Duration
+	Match             []*AstMetadataT
+	Negate            []*AstMetadataT
+	Correlations      []string
+	Window            time.Duration
+	CorrelationWindow time.Duration // Horizon for correlations; zero uses Window
+	Require           int           // Minimum number of Match terms that fire the set; zero requires all
+	JoinKeys          []AstJoinKeyT // Children must agree on the values of these extracts
+}
+
+// AstJoinKeyT is one element of the ordered key that joins the children of a
+// machine node. Terms lists the children that supply it: every positive term, and
+// any negate term that also does. The extract may be named differently per term.
+type AstJoinKeyT struct {
+	Key   string
+	Terms []AstJoinTermT
+}
+
+type AstJoinTermT struct {
+	Term    int // Index into the children of the node
+	Extract AstExtractT
+}
+
+// AstGroupMatcherT matches when any (NodeTypeAny) or all (NodeTypeAll) of its
+// terms match. The group is evaluated within the window of its parent.
+type AstGroupMatcherT struct {
+	Terms []*AstMetadataT
 }
 
 func (b *builderT) buildMachineNode(parserNode *parser.NodeT, parentMachineAddress, machineAddress *AstNodeAddressT, children []*AstNodeT) (*AstNodeT, error) {
 	var (
-		matchNode = newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeCluster, parentMachineAddress, machineAddress)
+		matchNode = b.newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeCluster, parentMachineAddress, machineAddress)
 	)
 
 	switch parserNode.Metadata.Type {
-	case schema.NodeTypeSeq, schema.NodeTypeLogSeq:
+	case schema.NodeTypeSeq, schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
 		matchNode.Metadata.Type = schema.NodeTypeSeq
 		if seqMatcher, err := buildSeqMatcher(parserNode, children); err != nil {
 			return nil, err
 		} else {
 			matchNode.Object = seqMatcher
 		}
-	case schema.NodeTypeSet, schema.NodeTypeLogSet:
+	case schema.NodeTypeSet, schema.NodeTypeLogSet, schema.NodeTypeTraceSet:
 		matchNode.Metadata.Type = schema.NodeTypeSet
 		if setMatcher, err := buildSetMatcher(parserNode, children); err != nil {
 			return nil, err
 		} else {
 			matchNode.Object = setMatcher
 		}
+	case schema.NodeTypeAny, schema.NodeTypeAll:
+		matchNode.Object = buildGroupMatcher(children)
+	case schema.NodeTypeMetricSeq:
+		if metricSeq, err := buildMetricSeqMatcher(parserNode, children); err != nil {
+			return nil, err
+		} else {
+			matchNode.Object = metricSeq
+		}
 	case schema.NodeTypePromQL:
 		matchNode.Metadata.Type = schema.NodeTypePromQL
 		if promMatcher, err := b.buildPromQLNode(parserNode, machineAddress, nil); err != nil {
@@ -56,6 +90,14 @@ func (b *builderT) buildMachineNode(parserNode *parser.NodeT, parentMachineAddre
 		return nil, ErrInvalidNodeType
 	}
 
+	matchNode.Metadata.Scope = b.machineScope(parserNode, matchNode.Metadata.Type)
+
+	bridge, err := scopeBridge(parserNode, matchNode, children)
+	if err != nil {
+		return nil, err
+	}
+	matchNode.Metadata.ScopeBridge = bridge
+
 	return matchNode, nil
 }
 
@@ -63,8 +105,10 @@ func (b *builderT) buildMachineNode(parserNode *parser.NodeT, parentMachineAddre
 func buildSeqMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSeqMatcherT, error) {
 	var (
 		sm = &AstSeqMatcherT{
-			Correlations: make([]string, 0),
-			Window:       n.Metadata.Window,
+			Correlations:      make([]string, 0),
+			Window:            n.Metadata.Window,
+			OrderTolerance:    n.Metadata.OrderTolerance,
+			CorrelationWindow: n.Metadata.CorrelationWindow,
 		}
 	)
 
@@ -73,6 +117,8 @@ func buildSeqMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSeqMatcherT, er
 	}
 
 	sm.Order, sm.Negate = buildTermDescriptors(n, children)
+	sm.JoinKeys = buildJoinKeys(n)
+	sm.StepRefs = buildStepRefs(n)
 
 	return sm, nil
 }
@@ -82,8 +128,10 @@ func buildSetMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSetMatcherT, er
 
 	var (
 		sm = &AstSetMatcherT{
-			Correlations: make([]string, 0),
-			Window:       n.Metadata.Window,
+			Correlations:      make([]string, 0),
+			Window:            n.Metadata.Window,
+			CorrelationWindow: n.Metadata.CorrelationWindow,
+			Require:           n.Metadata.Require,
 		}
 	)
 
@@ -92,10 +140,45 @@ func buildSetMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSetMatcherT, er
 	}
 
 	sm.Match, sm.Negate = buildTermDescriptors(n, children)
+	sm.JoinKeys = buildJoinKeys(n)
 
 	return sm, nil
 }
 
+func buildStepRefs(n *parser.NodeT) []AstStepRefT {
+	var refs []AstStepRefT
+	for i, child := range n.Children {
+		if c, ok := child.(*parser.NodeT); ok {
+			for _, ref := range c.StepRefs() {
+				refs = append(refs, AstStepRefT{Term: i, Step: ref.Step, Extract: ref.Extract})
+			}
+		}
+	}
+	return refs
+}
+
+func buildJoinKeys(n *parser.NodeT) []AstJoinKeyT {
+	var keys []AstJoinKeyT
+	for _, ck := range n.Metadata.CorrelateOn {
+		key := AstJoinKeyT{Key: ck.Key}
+		for _, t := range ck.Terms {
+			key.Terms = append(key.Terms, AstJoinTermT{Term: t.Term, Extract: newAstExtract(t.Extract)})
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func buildGroupMatcher(children []*AstNodeT) *AstGroupMatcherT {
+	var gm = &AstGroupMatcherT{
+		Terms: make([]*AstMetadataT, 0, len(children)),
+	}
+	for _, child := range children {
+		gm.Terms = append(gm.Terms, &child.Metadata)
+	}
+	return gm
+}
+
 func buildTermDescriptors(parserNode *parser.NodeT, children []*AstNodeT) ([]*AstMetadataT, []*AstMetadataT) {
 	var (
 		match   = make([]*AstMetadataT, 0)
@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"errors"
 	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
@@ -8,11 +9,30 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	ErrMetricSeqWindow = errors.New("metric sequence window must be longer than the 'for' of each step")
+)
+
 type AstPromQL struct {
-	Expr     string
-	For      time.Duration
-	Interval time.Duration
-	Event    *AstEventT
+	Expr        string
+	For         time.Duration
+	Interval    time.Duration
+	Event       *AstEventT
+	Description string
+	Selectors   []AstPromSelectorT // Vector selectors of Expr, for checking metric availability
+}
+
+// AstPromSelectorT is a vector selector of a PromQL expression. Metric is empty for
+// selectors of the form {job="api"}.
+type AstPromSelectorT struct {
+	Metric   string
+	Matchers []AstPromMatcherT
+}
+
+type AstPromMatcherT struct {
+	Name  string
+	Op    string // One of =, !=, =~, or !~
+	Value string
 }
 
 func (b *builderT) buildPromQLNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
@@ -36,13 +56,23 @@ func (b *builderT) buildPromQLNode(parserNode *parser.NodeT, machineAddress *Ast
 		return nil, parserNode.WrapError(ErrMissingScalar)
 	}
 
+	// PromQL nodes are evaluated with For/Interval; a window would be silently ignored
+	if parserNode.Metadata.Window != 0 {
+		log.Error().
+			Dur("window", parserNode.Metadata.Window).
+			Msg("Window specified on PromQL node")
+		return nil, parserNode.WrapError(parser.ErrPromQLWindow)
+	}
+
 	pn := &AstPromQL{
-		Expr: promNode.Expr,
+		Expr:        promNode.Expr,
+		Description: promNode.Description,
+		Selectors:   newPromSelectors(promNode.Selectors),
 	}
 
 	if parserNode.Metadata.Event != nil {
 		pn.Event = &AstEventT{
-			Source: parserNode.Metadata.Event.Source,
+			Source: intern(parserNode.Metadata.Event.Source),
 			Origin: parserNode.Metadata.Event.Origin,
 		}
 	}
@@ -57,10 +87,59 @@ func (b *builderT) buildPromQLNode(parserNode *parser.NodeT, machineAddress *Ast
 
 	var (
 		address = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
-		node    = newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeCluster, machineAddress, address)
+		node    = b.newAstNode(parserNode, parserNode.Metadata.Type, b.scope(parserNode, schema.ScopeCluster), machineAddress, address)
 	)
 
 	node.Object = pn
 	return node, nil
 
 }
+
+func newPromSelectors(selectors []parser.PromSelectorT) []AstPromSelectorT {
+	var out []AstPromSelectorT
+	for _, s := range selectors {
+		sel := AstPromSelectorT{Metric: s.Metric}
+		for _, m := range s.Matchers {
+			sel.Matchers = append(sel.Matchers, AstPromMatcherT{Name: m.Name, Op: m.Op, Value: m.Value})
+		}
+		out = append(out, sel)
+	}
+	return out
+}
+
+// AstMetricSeqT fires when each promql step breaches, in order, within Window.
+// Steps are the objects of the children of the node.
+type AstMetricSeqT struct {
+	Window time.Duration
+	Steps  []*AstPromQL
+}
+
+// buildMetricSeqMatcher collects the promql steps of a metric sequence. A step
+// that must hold for the whole window leaves no time for the steps after it.
+func buildMetricSeqMatcher(n *parser.NodeT, children []*AstNodeT) (*AstMetricSeqT, error) {
+
+	ms := &AstMetricSeqT{
+		Window: n.Metadata.Window,
+		Steps:  make([]*AstPromQL, 0, len(children)),
+	}
+
+	for _, child := range children {
+		step, ok := child.Object.(*AstPromQL)
+		if !ok {
+			log.Error().Any("address", child.Metadata.Address).Msg("Metric sequence step is not promql")
+			return nil, n.WrapError(ErrInvalidNodeType)
+		}
+
+		if step.For >= ms.Window {
+			log.Error().
+				Dur("for", step.For).
+				Dur("window", ms.Window).
+				Msg("Metric sequence step holds for the whole window")
+			return nil, wrapPos(n, n.Metadata.WindowPos, ErrMetricSeqWindow)
+		}
+
+		ms.Steps = append(ms.Steps, step)
+	}
+
+	return ms, nil
+}
@@ -0,0 +1,198 @@
+package ast
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrPassName = errors.New("pass name is empty")
+	ErrPassNode = errors.New("rewrite pass returned no node")
+)
+
+// PassFuncT rewrites a node after the build. It returns the node to use in its
+// place, which may be the node itself changed in place.
+type PassFuncT func(node *AstNodeT) (*AstNodeT, error)
+
+type PassOptT func(*passT)
+
+type passT struct {
+	name  string
+	order int
+	seq   int
+	fn    PassFuncT
+}
+
+var (
+	passesMu sync.RWMutex
+	passes   []passT
+	passSeq  int
+)
+
+// WithPassOrder sets the order of a pass. Passes run in ascending order, and in the
+// order they were registered when equal. The default order is zero.
+func WithPassOrder(order int) PassOptT {
+	return func(p *passT) {
+		p.order = order
+	}
+}
+
+// RegisterPass adds a rewrite pass that runs on every rule built after it is
+// registered, e.g. to inject tenant-specific field filters or rename sources. The
+// pass visits each node after its children. Passes run before scopes are resolved.
+// Registering a name again replaces it.
+func RegisterPass(name string, fn PassFuncT, opts ...PassOptT) error {
+
+	if name == "" {
+		return ErrPassName
+	}
+
+	p := passT{name: name, fn: fn}
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	passesMu.Lock()
+	defer passesMu.Unlock()
+
+	passSeq++
+	p.seq = passSeq
+
+	passes = slices.DeleteFunc(passes, func(q passT) bool { return q.name == name })
+	passes = append(passes, p)
+
+	slices.SortStableFunc(passes, func(a, b passT) int {
+		if c := cmp.Compare(a.order, b.order); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	return nil
+}
+
+// UnregisterPass removes a pass, and reports whether it was registered
+func UnregisterPass(name string) bool {
+
+	passesMu.Lock()
+	defer passesMu.Unlock()
+
+	n := len(passes)
+	passes = slices.DeleteFunc(passes, func(p passT) bool { return p.name == name })
+
+	return len(passes) < n
+}
+
+// Passes returns the names of the registered passes in the order they run
+func Passes() []string {
+
+	passesMu.RLock()
+	defer passesMu.RUnlock()
+
+	names := make([]string, 0, len(passes))
+	for _, p := range passes {
+		names = append(names, p.name)
+	}
+
+	return names
+}
+
+// runPasses runs the registered passes over a rule and returns its root, which a
+// pass may have replaced. Errors are positioned at the term of the failing node.
+func runPasses(parserNode *parser.NodeT, rule *AstNodeT) (*AstNodeT, error) {
+
+	passesMu.RLock()
+	list := slices.Clone(passes)
+	passesMu.RUnlock()
+
+	for _, p := range list {
+
+		err := WalkNode(rule, func(node, parent *AstNodeT, order WalkOrderT) error {
+
+			if order != WalkPost {
+				return nil
+			}
+
+			out, err := p.fn(node)
+			switch {
+			case err != nil:
+				return passError(parserNode, node, p.name, err)
+			case out == nil:
+				return passError(parserNode, node, p.name, ErrPassNode)
+			case out == node:
+				return nil
+			case parent == nil:
+				rule = out
+			default:
+				replaceChild(parent, node, out)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// replaceChild swaps a child of a machine node, and its descriptor in the machine
+func replaceChild(parent, old, new *AstNodeT) {
+
+	if i := slices.Index(parent.Children, old); i >= 0 {
+		parent.Children[i] = new
+	}
+
+	var descs [][]*AstMetadataT
+
+	switch o := parent.Object.(type) {
+	case *AstSeqMatcherT:
+		descs = [][]*AstMetadataT{o.Order, o.Negate}
+	case *AstSetMatcherT:
+		descs = [][]*AstMetadataT{o.Match, o.Negate}
+	case *AstGroupMatcherT:
+		descs = [][]*AstMetadataT{o.Terms}
+	}
+
+	for _, list := range descs {
+		if i := slices.Index(list, &old.Metadata); i >= 0 {
+			list[i] = &new.Metadata
+		}
+	}
+}
+
+func passError(parserNode *parser.NodeT, node *AstNodeT, name string, err error) error {
+
+	// Keep the position of errors the pass positioned itself
+	if _, ok := pqerr.PosOf(err); ok {
+		return err
+	}
+
+	pos := node.Metadata.Pos
+	if pos == (pqerr.Pos{}) {
+		pos = parserNode.Metadata.Pos
+	}
+
+	log.Error().
+		Err(err).
+		Str("pass", name).
+		Any("address", node.Metadata.Address).
+		Msg("Rewrite pass failed")
+
+	return pqerr.Wrap(
+		pos,
+		parserNode.Metadata.RuleId,
+		parserNode.Metadata.RuleHash,
+		parserNode.Metadata.CreId,
+		err,
+		"pass="+name,
+	)
+}
@@ -0,0 +1,83 @@
+package ast
+
+import (
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+// AstK8sResourceT fires when Field of a Kubernetes object selected by GVK, and by
+// Namespace and Name when set, changes from a state matching From to one matching To.
+// A nil From matches any prior state.
+type AstK8sResourceT struct {
+	Event     AstEventT
+	GVK       AstGVKT
+	Namespace string
+	Name      string
+	Field     string // Dot-path in the object, e.g. status.availableReplicas
+	From      *AstResourceStateT
+	To        AstResourceStateT
+}
+
+// AstGVKT selects objects by API group, version, and kind. Group is empty for the core group.
+type AstGVKT struct {
+	Group   string
+	Version string
+	Kind    string
+}
+
+// AstResourceStateT matches a field equal to Value, or, when Op is set, a number
+// that satisfies Op Number. Op is one of >, >=, <, <=, or ==.
+type AstResourceStateT struct {
+	Value  string
+	Op     string
+	Number float64
+}
+
+func (b *builderT) buildK8sResourceNode(parserNode *parser.NodeT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
+
+	var res = parserNode.Metadata.Resource
+
+	if res == nil || parserNode.Metadata.Event == nil {
+		log.Error().
+			Any("address", machineAddress).
+			Msg("Resource missing selector or event")
+		return nil, parserNode.WrapError(parser.ErrResource)
+	}
+
+	var (
+		address   = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
+		matchNode = b.newAstNode(parserNode, parserNode.Metadata.Type, b.scope(parserNode, schema.ScopeCluster), machineAddress, address)
+		obj       = &AstK8sResourceT{
+			Event: AstEventT{
+				Origin: parserNode.Metadata.Event.Origin,
+				Source: intern(parserNode.Metadata.Event.Source),
+			},
+			GVK: AstGVKT{
+				Group:   res.Group,
+				Version: res.Version,
+				Kind:    res.Kind,
+			},
+			Namespace: res.Namespace,
+			Name:      res.Name,
+			Field:     res.Field,
+			To:        newResourceState(res.To),
+		}
+	)
+
+	if res.From != nil {
+		from := newResourceState(*res.From)
+		obj.From = &from
+	}
+
+	matchNode.Object = obj
+
+	return matchNode, nil
+}
+
+func newResourceState(s parser.StateT) AstResourceStateT {
+	if s.Compare == nil {
+		return AstResourceStateT{Value: s.Value}
+	}
+	return AstResourceStateT{Op: compareOps[s.Compare.Op], Number: s.Compare.Value}
+}
@@ -0,0 +1,199 @@
+package ast
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrUnknownScope = errors.New("unknown scope (register it with schema.RegisterScope)")
+	ErrCrossScope   = errors.New("correlated terms have no common scope")
+	ErrScopeBridge  = errors.New("terms in different scopes must declare their shared key with 'correlateOn'")
+)
+
+// AstScopeBridgeT marks a machine node whose terms match events of more than one
+// scope, such as cluster events and node logs. The matches of each scope are sent to
+// the scope of the machine and joined on Keys; a bridge without keys joins on time.
+type AstScopeBridgeT struct {
+	Scopes []string `json:"scopes"`
+	Keys   []string `json:"keys,omitempty"`
+}
+
+// ScopeInputT describes a node to a scope policy. Scope is where the node is placed
+// without a policy: the scope of its source for matchers, and cluster for machines.
+type ScopeInputT struct {
+	RuleId string
+	CreId  string
+	Type   schema.NodeTypeT
+	Source string // Empty for machine nodes
+	Scope  string
+}
+
+// ScopePolicyT returns the scope of a node, or an empty string to keep in.Scope
+type ScopePolicyT func(in ScopeInputT) string
+
+// WithScopePolicy places nodes in the scopes returned by policy, such as a tenant
+// or region registered with schema.RegisterScope. A machine node is widened to the
+// narrowest scope that contains its children; terms with no common scope fail with
+// ErrCrossScope.
+func WithScopePolicy(policy ScopePolicyT) BuildOptT {
+	return func(o *buildOptsT) {
+		o.scopePolicy = policy
+	}
+}
+
+// scope returns the scope of a matcher node: the scope of its event source, or def,
+// as changed by the policy of the build
+func (b *builderT) scope(parserNode *parser.NodeT, def string) string {
+
+	var in = ScopeInputT{
+		RuleId: parserNode.Metadata.RuleId,
+		CreId:  parserNode.Metadata.CreId,
+		Type:   parserNode.Metadata.Type,
+		Scope:  def,
+	}
+
+	if parserNode.Metadata.Event != nil {
+		in.Source = parserNode.Metadata.Event.Source
+		in.Scope = schema.SourceScope(in.Source, def)
+	}
+
+	return b.applyPolicy(in)
+}
+
+// machineScope returns the scope of a machine node before it is widened to
+// contain its children
+func (b *builderT) machineScope(parserNode *parser.NodeT, typ schema.NodeTypeT) string {
+	return b.applyPolicy(ScopeInputT{
+		RuleId: parserNode.Metadata.RuleId,
+		CreId:  parserNode.Metadata.CreId,
+		Type:   typ,
+		Scope:  schema.ScopeCluster,
+	})
+}
+
+func (b *builderT) applyPolicy(in ScopeInputT) string {
+
+	if b.opts != nil && b.opts.scopePolicy != nil {
+		if scope := b.opts.scopePolicy(in); scope != "" {
+			return scope
+		}
+	}
+
+	return in.Scope
+}
+
+// resolveScopes checks the scopes of a rule and widens each machine node to contain
+// the scopes of its children
+func resolveScopes(parserNode *parser.NodeT, node *AstNodeT) error {
+
+	for _, child := range node.Children {
+		if err := resolveScopes(parserNode, child); err != nil {
+			return err
+		}
+	}
+
+	if !schema.KnownScope(node.Metadata.Scope) {
+		return scopeError(parserNode, node, ErrUnknownScope, "scope="+node.Metadata.Scope)
+	}
+
+	for _, child := range node.Children {
+		scope, ok := schema.CommonScope(node.Metadata.Scope, child.Metadata.Scope)
+		if !ok {
+			return scopeError(parserNode, node, ErrCrossScope, "scopes="+node.Metadata.Scope+","+child.Metadata.Scope)
+		}
+		node.Metadata.Scope = scope
+	}
+
+	return nil
+}
+
+// scopeBridge returns the bridge of a machine node whose children match events of
+// more than one scope. Correlations of such a node must name the extract each term
+// supplies, as implicit keys such as hostname are not shared across scopes.
+func scopeBridge(parserNode *parser.NodeT, node *AstNodeT, children []*AstNodeT) (*AstScopeBridgeT, error) {
+
+	var scopes []string
+
+	for _, child := range children {
+		for _, scope := range leafScopes(child) {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	if len(scopes) < 2 {
+		return nil, nil
+	}
+
+	slices.Sort(scopes)
+
+	var (
+		correlations []string
+		joinKeys     []AstJoinKeyT
+	)
+
+	switch obj := node.Object.(type) {
+	case *AstSeqMatcherT:
+		correlations, joinKeys = obj.Correlations, obj.JoinKeys
+	case *AstSetMatcherT:
+		correlations, joinKeys = obj.Correlations, obj.JoinKeys
+	}
+
+	if len(correlations) > 0 && len(joinKeys) == 0 {
+		return nil, scopeError(parserNode, node, ErrScopeBridge, "scopes="+strings.Join(scopes, ",")+" correlations="+strings.Join(correlations, ","))
+	}
+
+	bridge := &AstScopeBridgeT{Scopes: scopes}
+	for _, key := range joinKeys {
+		bridge.Keys = append(bridge.Keys, key.Key)
+	}
+
+	return bridge, nil
+}
+
+// leafScopes returns the scopes of the matchers under a node
+func leafScopes(node *AstNodeT) []string {
+
+	var scopes []string
+
+	WalkNode(node, func(n, _ *AstNodeT, order WalkOrderT) error {
+		if order == WalkPre && len(n.Children) == 0 {
+			scopes = append(scopes, n.Metadata.Scope)
+		}
+		return nil
+	})
+
+	return scopes
+}
+
+// scopeError positions err at the node whose scope is invalid, or at the parser
+// node when the node has no position
+func scopeError(parserNode *parser.NodeT, node *AstNodeT, err error, reason string) error {
+
+	log.Error().
+		Any("address", node.Metadata.Address).
+		Str("reason", reason).
+		Msg("Invalid scope")
+
+	pos := node.Metadata.Pos
+	if pos.Line == 0 {
+		pos = pqerr.Pos{Line: parserNode.Metadata.Pos.Line, Col: parserNode.Metadata.Pos.Col}
+	}
+
+	return pqerr.Wrap(
+		pos,
+		parserNode.Metadata.RuleId,
+		parserNode.Metadata.RuleHash,
+		parserNode.Metadata.CreId,
+		err,
+		reason,
+	)
+}
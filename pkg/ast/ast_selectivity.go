@@ -0,0 +1,143 @@
+package ast
+
+import (
+	"cmp"
+	"slices"
+)
+
+// DefaultBroadRate is the default hit rate above which a positive term is broad
+const DefaultBroadRate = 0.2
+
+type SelectivityOptT func(*selectivityOptsT)
+
+type selectivityOptsT struct {
+	broadRate float64
+}
+
+// WithBroadRate sets the hit rate above which a positive term is flagged as broad
+func WithBroadRate(rate float64) SelectivityOptT {
+	return func(o *selectivityOptsT) {
+		o.broadRate = rate
+	}
+}
+
+// TermHitT is the hit rate of a condition of a matcher against a sample. Index is
+// the position of the condition in the Match or Negate list of the matcher.
+type TermHitT struct {
+	Address string  `json:"address"`
+	Source  string  `json:"source"`
+	Index   int     `json:"index"`
+	Negate  bool    `json:"negate,omitempty"`
+	Term    string  `json:"term"`
+	Hits    int     `json:"hits"`
+	Lines   int     `json:"lines"`
+	Rate    float64 `json:"rate"`
+	Broad   bool    `json:"broad,omitempty"` // Positive terms whose rate exceeds the broad rate
+}
+
+// SelectivityReportT lists the hit rates of the terms of a tree, most frequent first
+type SelectivityReportT struct {
+	Terms []TermHitT `json:"terms"`
+}
+
+// Broad returns the terms flagged as broad
+func (r *SelectivityReportT) Broad() []TermHitT {
+	var terms []TermHitT
+	for _, t := range r.Terms {
+		if t.Broad {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// EstimateSelectivity matches the conditions of the log matchers of a tree against
+// sample events, keyed by event source, to estimate how often each term hits. The
+// sample under the empty key is used for sources without their own. Terms that hit
+// a large share of the sample, such as a raw string found on 40% of lines, are
+// flagged as broad so that authors can tighten them and optimizers can order them last.
+func EstimateSelectivity(tree *AstT, samples map[string][]string, opts ...SelectivityOptT) (*SelectivityReportT, error) {
+
+	var (
+		o      = selectivityOptsT{broadRate: DefaultBroadRate}
+		report = &SelectivityReportT{}
+	)
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	err := Walk(tree, func(node, _ *AstNodeT, order WalkOrderT) error {
+
+		if order != WalkPre {
+			return nil
+		}
+
+		var (
+			event  AstEventT
+			fields [2][]AstFieldT
+		)
+
+		switch obj := node.Object.(type) {
+		case *AstLogMatcherT:
+			event, fields = obj.Event, [2][]AstFieldT{obj.Match, obj.Negate}
+		case *AstAggMatcherT:
+			event, fields = obj.Event, [2][]AstFieldT{obj.Match, nil}
+		default:
+			return nil
+		}
+
+		lines, ok := samples[event.Source]
+		if !ok {
+			lines = samples[""]
+		}
+		if len(lines) == 0 {
+			return nil
+		}
+
+		for neg, list := range fields {
+			for i, field := range list {
+				hit, err := termHit(field, lines)
+				if err != nil {
+					return err
+				}
+				hit.Address = node.Metadata.Address.String()
+				hit.Source = event.Source
+				hit.Index = i
+				hit.Negate = neg == 1
+				hit.Broad = !hit.Negate && hit.Rate > o.broadRate
+				report.Terms = append(report.Terms, hit)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(report.Terms, func(a, b TermHitT) int {
+		return cmp.Compare(b.Rate, a.Rate)
+	})
+
+	return report, nil
+}
+
+func termHit(field AstFieldT, lines []string) (TermHitT, error) {
+
+	m, err := field.TermValue.NewMatcher()
+	if err != nil {
+		return TermHitT{}, err
+	}
+
+	hit := TermHitT{Term: field.TermValue.Value, Lines: len(lines)}
+	for _, line := range lines {
+		if m(line) {
+			hit.Hits++
+		}
+	}
+	hit.Rate = float64(hit.Hits) / float64(len(lines))
+
+	return hit, nil
+}
@@ -0,0 +1,126 @@
+package ast
+
+import (
+	"time"
+)
+
+// Phases of a build timed in BuildStatsT
+const (
+	PhaseParse  = "parse"  // YAML to parser tree, when building from data
+	PhaseBuild  = "build"  // Parser tree to AST, including validations
+	PhasePasses = "passes" // Registered rewrite passes
+	PhaseScopes = "scopes" // Scope resolution and bridges
+)
+
+// BuildStatsT summarizes a build so that bundle pipelines can track its growth
+// and catch pathological rules. Terms counts the match and negate conditions of
+// matchers by value kind (raw, regex, jqJson, jqYaml), with counts expanded.
+// WindowSpan is the sum of the windows of all nodes, and MaxWindow the largest.
+// Phases are summed across the workers of a build WithParallelism.
+type BuildStatsT struct {
+	Rules      int                      `json:"rules"`
+	Nodes      map[string]int           `json:"nodes"`
+	Terms      map[string]int           `json:"terms"`
+	WindowSpan time.Duration            `json:"window_span"`
+	MaxWindow  time.Duration            `json:"max_window"`
+	Phases     map[string]time.Duration `json:"phases"`
+
+	// Rules served from and built into the cache of a build WithCache
+	CacheHits   int `json:"cache_hits,omitempty"`
+	CacheMisses int `json:"cache_misses,omitempty"`
+}
+
+// WithStats records statistics of the build in AstT.Stats
+func WithStats() BuildOptT {
+	return func(o *buildOptsT) {
+		o.stats = true
+	}
+}
+
+func newBuildStats() *BuildStatsT {
+	return &BuildStatsT{
+		Nodes:  make(map[string]int),
+		Terms:  make(map[string]int),
+		Phases: make(map[string]time.Duration),
+	}
+}
+
+// lap adds the time since mark to a phase and returns the new mark. Does nothing
+// but return the mark when stats are not recorded.
+func (s *BuildStatsT) lap(phase string, mark time.Time) time.Time {
+	if s == nil {
+		return mark
+	}
+	now := time.Now()
+	s.Phases[phase] += now.Sub(mark)
+	return now
+}
+
+// merge adds the statistics of another worker of the build
+func (s *BuildStatsT) merge(o *BuildStatsT) {
+
+	s.Rules += o.Rules
+	s.CacheHits += o.CacheHits
+	s.CacheMisses += o.CacheMisses
+	s.WindowSpan += o.WindowSpan
+	s.MaxWindow = max(s.MaxWindow, o.MaxWindow)
+
+	for k, v := range o.Nodes {
+		s.Nodes[k] += v
+	}
+	for k, v := range o.Terms {
+		s.Terms[k] += v
+	}
+	for k, v := range o.Phases {
+		s.Phases[k] += v
+	}
+}
+
+func (s *BuildStatsT) addCache(hit bool) {
+	switch {
+	case s == nil:
+	case hit:
+		s.CacheHits++
+	default:
+		s.CacheMisses++
+	}
+}
+
+func (s *BuildStatsT) addRule(rule *AstNodeT) {
+
+	if s == nil {
+		return
+	}
+
+	s.Rules++
+
+	WalkNode(rule, func(node, _ *AstNodeT, order WalkOrderT) error {
+
+		if order != WalkPre {
+			return nil
+		}
+
+		s.Nodes[node.Metadata.Type.String()]++
+
+		if w, ok := node.Window(); ok {
+			s.WindowSpan += w
+			s.MaxWindow = max(s.MaxWindow, w)
+		}
+
+		var fields [][]AstFieldT
+		switch o := node.Object.(type) {
+		case *AstLogMatcherT:
+			fields = [][]AstFieldT{o.Match, o.Negate}
+		case *AstAggMatcherT:
+			fields = [][]AstFieldT{o.Match}
+		}
+
+		for _, list := range fields {
+			for _, f := range list {
+				s.Terms[f.TermValue.Type.String()] += f.Occurrences()
+			}
+		}
+
+		return nil
+	})
+}
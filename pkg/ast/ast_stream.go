@@ -0,0 +1,53 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+)
+
+// Stream builds the rules of a bundle one at a time from parser.StreamTrees, so
+// that a bundle too large to hold in memory can be compiled rule by rule. Each
+// rule is built as BuildTree builds it. Options that describe the whole tree, such
+// as WithTiming, WithStats, WithVerifyDeterministic, and WithParallelism, do not
+// apply. Iteration stops at the first error, which is yielded with a nil node.
+func Stream(rdr io.Reader, opts ...BuildOptT) iter.Seq2[*AstNodeT, error] {
+	return func(yield func(*AstNodeT, error) bool) {
+
+		var (
+			o = buildOpts(opts...)
+			w buildWorkerT
+			n int
+		)
+
+		// Rules are built one at a time
+		o.timing, o.parallelism = false, 0
+
+		for parserNode, err := range parser.StreamTrees(rdr, o.parserOpts()...) {
+
+			var res ruleBuildT
+
+			if err == nil {
+				if n++; o.maxRules > 0 && n > o.maxRules {
+					err = parserNode.WrapError(fmt.Errorf("%w: more than %d", ErrMaxRules, o.maxRules))
+				}
+			}
+
+			if err == nil {
+				err = o.buildRule(parserNode, &w, &res)
+				o.sendDiagnostics(res.diags)
+			}
+
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(res.rule, nil) {
+				return
+			}
+		}
+	}
+}
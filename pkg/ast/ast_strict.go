@@ -0,0 +1,100 @@
+package ast
+
+import (
+	"errors"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrSeqFirstStep = errors.New("first step of a sequence must have an event source and be able to serve as origin")
+)
+
+// WithStrictSequences requires the first positive step of every sequence to be
+// origin-capable: it must have an event source, and cannot be an absence (exists: false).
+func WithStrictSequences() BuildOptT {
+	return func(o *buildOptsT) {
+		o.strictSequences = true
+	}
+}
+
+func validateSeqFirstSteps(parserNode *parser.NodeT) error {
+
+	switch parserNode.Metadata.Type {
+	case schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
+		if field, ok := firstField(parserNode); ok && field.Exists != nil && !*field.Exists {
+			log.Error().
+				Str("field", field.Field).
+				Msg("Sequence starts with an absence")
+			return wrapPos(parserNode, field.Pos, ErrSeqFirstStep)
+		}
+
+	case schema.NodeTypeSeq, schema.NodeTypeMetricSeq:
+		if len(parserNode.Children) > 0 {
+			first, ok := parserNode.Children[0].(*parser.NodeT)
+			if ok && !originCapable(first) {
+				log.Error().
+					Str("type", first.Metadata.Type.String()).
+					Msg("Sequence starts with a step that cannot be an origin")
+				return wrapPos(parserNode, first.Metadata.Pos, ErrSeqFirstStep)
+			}
+		}
+	}
+
+	for _, child := range parserNode.Children {
+		if c, ok := child.(*parser.NodeT); ok {
+			if err := validateSeqFirstSteps(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// originCapable reports whether events from the node's first step have a source
+func originCapable(n *parser.NodeT) bool {
+
+	if n.Metadata.Event != nil && n.Metadata.Event.Source != "" {
+		return true
+	}
+
+	if n.IsMatcherNode() || n.IsPromNode() || len(n.Children) == 0 {
+		return false
+	}
+
+	if n.Metadata.Type == schema.NodeTypeSeq {
+		first, ok := n.Children[0].(*parser.NodeT)
+		return ok && originCapable(first)
+	}
+
+	// Any positive condition of a set may start it
+	positives := len(n.Children)
+	if n.NegIdx > 0 {
+		positives = n.NegIdx
+	}
+
+	for _, child := range n.Children[:positives] {
+		if c, ok := child.(*parser.NodeT); ok && originCapable(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func firstField(n *parser.NodeT) (parser.FieldT, bool) {
+	for _, child := range n.Children {
+		if m, ok := child.(*parser.MatcherT); ok && len(m.Match.Fields) > 0 {
+			return m.Match.Fields[0], true
+		}
+	}
+	return parser.FieldT{}, false
+}
+
+func wrapPos(n *parser.NodeT, pos pqerr.Pos, err error) error {
+	return pqerr.Wrap(pos, n.Metadata.RuleId, n.Metadata.RuleHash, n.Metadata.CreId, err)
+}
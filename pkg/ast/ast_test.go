@@ -1,16 +1,32 @@
 package ast
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/prequel-dev/prequel-compiler/pkg/ir"
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
 	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
 	"github.com/rs/zerolog/log"
 )
 
@@ -73,6 +89,10 @@ func TestAstSuccess(t *testing.T) {
 			rule:              testdata.TestSuccessSimplePromQL,
 			expectedNodeTypes: []string{"machine_set", "promql", "log_set"},
 		},
+		"Success_SharedSubSequence": {
+			rule:              testdata.TestSuccessSharedSubSequence,
+			expectedNodeTypes: []string{"machine_seq", "log_seq", "log_set"},
+		},
 	}
 
 	for name, test := range tests {
@@ -179,18 +199,84 @@ func TestAstFail(t *testing.T) {
 			line: 14,
 			col:  11,
 		},
-		"Fail_TermsSemanticError5": {
-			rule: testdata.TestFailTermsSemanticError5,
-			err:  ErrInvalidAnchor,
-			line: 11,
-			col:  9,
-		},
 		"Fail_MultipleOrigin": {
 			rule: testdata.TestFailMultipleOrigin,
 			err:  ErrMultipleOrigin,
 			line: 11,
 			col:  17,
 		},
+		"Fail_FieldExistsValue": {
+			rule: testdata.TestFailFieldExistsValue,
+			err:  ErrExistsValue,
+			line: 11,
+			col:  9,
+		},
+		"Fail_Delimiter": {
+			rule: testdata.TestFailDelimiter,
+			err:  ErrDelimiter,
+			line: 11,
+			col:  9,
+		},
+		"Fail_DelimitedJq": {
+			rule: testdata.TestFailDelimitedJq,
+			err:  ErrDelimitedTerm,
+			line: 11,
+			col:  9,
+		},
+		"Fail_MultiplePrimary": {
+			rule: testdata.TestFailMultiplePrimary,
+			err:  ErrMultiplePrimary,
+			line: 11,
+			col:  17,
+		},
+		"Fail_PrimaryNegate": {
+			rule: testdata.TestFailPrimaryNegate,
+			err:  ErrPrimaryNegate,
+			line: 11,
+			col:  9,
+		},
+		"Fail_FieldExistsNoField": {
+			rule: testdata.TestFailFieldExistsNoField,
+			err:  ErrExistsField,
+			line: 11,
+			col:  9,
+		},
+		"Fail_FieldExistsRawText": {
+			rule: testdata.TestFailFieldExistsRawText,
+			err:  ErrExistsSource,
+			line: 15,
+			col:  13,
+		},
+		"Fail_ExtractTransform": {
+			rule: testdata.TestFailExtractTransform,
+			err:  ErrExtractTransform,
+			line: 20,
+			col:  21,
+		},
+		"Fail_ExtractType": {
+			rule: testdata.TestFailExtractType,
+			err:  ErrExtractType,
+			line: 18,
+			col:  23,
+		},
+		"Fail_MetricSeqWindow": {
+			rule: testdata.TestFailMetricSeqWindow,
+			err:  ErrMetricSeqWindow,
+			line: 11,
+			col:  17,
+		},
+		"Fail_JqSyntax": {
+			rule: testdata.TestFailJqSyntax,
+			err:  ErrInvalidJq,
+			line: 15,
+			col:  13,
+		},
+		"Fail_JqFunction": {
+			rule: testdata.TestFailJqFunction,
+			err:  ErrInvalidJq,
+			line: 14,
+			col:  13,
+		},
 	}
 
 	for name, test := range tests {
@@ -219,46 +305,3281 @@ func TestAstFail(t *testing.T) {
 	}
 }
 
-func TestSuccessExamples(t *testing.T) {
+func TestAstFieldExists(t *testing.T) {
 
-	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	tree, err := Build([]byte(testdata.TestSuccessFieldExists))
 	if err != nil {
-		t.Fatalf("Error finding CRE test files: %v", err)
+		t.Fatalf("Error building rule: %v", err)
 	}
 
-	for _, rule := range rules {
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
 
-		// Read the test file
-		testData, err := os.ReadFile(rule)
-		if err != nil {
-			t.Fatalf("Error reading test file %s: %v", rule, err)
+	var expected = []match.TermT{
+		{Type: match.TermJqJson, Value: `select(has("action"))`},
+		{Type: match.TermJqJson, Value: `select(has("reportingController") | not)`},
+		{Type: match.TermJqJson, Value: `select(has("reportingInstance"))`},
+	}
+
+	var actual []match.TermT
+	for _, field := range append(lm.Match, lm.Negate...) {
+		actual = append(actual, field.TermValue)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("terms = %v, want %v", actual, expected)
+	}
+}
+
+func TestAstFieldCompare(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessFieldCompare))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = []match.TermT{
+		{Type: match.TermJqJson, Value: `select(getpath(["response","latency_ms"]) | type == "number" and . > 500)`},
+		{Type: match.TermJqJson, Value: `select(getpath(["status"]) | type == "number" and . >= 500)`},
+		{Type: match.TermJqJson, Value: `select(getpath(["retry","attempt"]) | type == "number" and . == 0)`},
+	}
+
+	var actual []match.TermT
+	for _, field := range append(lm.Match, lm.Negate...) {
+		actual = append(actual, field.TermValue)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("terms = %v, want %v", actual, expected)
+	}
+
+	m, err := actual[0].NewMatcher()
+	if err != nil {
+		t.Fatalf("Error compiling term: %v", err)
+	}
+
+	var lines = []struct {
+		line  string
+		match bool
+	}{
+		{line: `{"response": {"latency_ms": 750}}`, match: true},
+		{line: `{"response": {"latency_ms": 500}}`, match: false},
+		{line: `{"response": {"latency_ms": "750"}}`, match: false},
+		{line: `{"response": 750}`, match: false},
+		{line: `{"status": 200}`, match: false},
+	}
+
+	for _, l := range lines {
+		if got := m(l.line); got != l.match {
+			t.Errorf("match(%s) = %v, want %v", l.line, got, l.match)
 		}
+	}
+}
 
-		_, err = Build(testData)
-		if err != nil {
-			t.Fatalf("Error building rule %s: %v", rule, err)
+func TestAstIPCidr(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessIPCidr))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = [][]netip.Prefix{
+		{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd00::/8")},
+		{netip.MustParsePrefix("203.0.113.0/24")},
+	}
+
+	var actual [][]netip.Prefix
+	for _, field := range lm.Match {
+		if field.IPCidr == nil {
+			t.Fatalf("Expected CIDR matcher on field %s", field.Field)
+		}
+		actual = append(actual, field.IPCidr.Prefixes)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("prefixes = %v, want %v", actual, expected)
+	}
+
+	var addrs = []struct {
+		addr  string
+		match bool
+	}{
+		{addr: "10.1.2.3", match: true},
+		{addr: "192.168.1.200", match: true},
+		{addr: "192.168.2.1", match: false},
+		{addr: "::ffff:10.0.0.1", match: true},
+		{addr: "fd12::1", match: true},
+		{addr: "not an ip", match: false},
+	}
+
+	for _, a := range addrs {
+		if got := lm.Match[0].IPCidr.Contains(a.addr); got != a.match {
+			t.Errorf("Contains(%s) = %v, want %v", a.addr, got, a.match)
 		}
 	}
 }
 
-func TestFailureExamples(t *testing.T) {
+func TestAstGlob(t *testing.T) {
 
-	rules, err := filepath.Glob(filepath.Join("../testdata", "failure_examples", "*.yaml"))
+	tree, err := Build([]byte(testdata.TestSuccessGlob))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	if segs := lm.Match[0].Glob.Segments; !reflect.DeepEqual(segs, []string{"", "timeout", "connect", ""}) {
+		t.Errorf("segments = %q", segs)
+	}
+
+	if lm.Match[1].Glob.Segments != nil {
+		t.Errorf("Expected regex glob, got segments %q", lm.Match[1].Glob.Segments)
+	}
+
+	var lines = []struct {
+		line  string
+		match [2]bool
+	}{
+		{line: "dial timeout while connecting to db", match: [2]bool{true, false}},
+		{line: "connect timeout", match: [2]bool{false, false}},
+		{line: "pod-1a.log", match: [2]bool{false, true}},
+		{line: "pod-12.log", match: [2]bool{false, false}},
+	}
+
+	for _, l := range lines {
+		for i, field := range lm.Match {
+			m, err := field.TermValue.NewMatcher()
+			if err != nil {
+				t.Fatalf("Error compiling term: %v", err)
+			}
+			if got := field.Glob.Match(l.line); got != l.match[i] || m(l.line) != l.match[i] {
+				t.Errorf("glob %q match(%q) = %v, term = %v, want %v", field.Glob.Pattern, l.line, got, m(l.line), l.match[i])
+			}
+		}
+	}
+}
+
+func TestAstMatchOpts(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessMatchOpts))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = []match.TermT{
+		{Type: match.TermRegex, Value: `(?i)connection reset`},
+		{Type: match.TermRegex, Value: `(?m)\b(?:^panic: .+)\b`},
+		{Type: match.TermRegex, Value: `(?i)\b(?:(?:oom|killed))\b`},
+		{Type: match.TermRaw, Value: `as is`},
+	}
+
+	var actual []match.TermT
+	for _, field := range lm.Match {
+		actual = append(actual, field.TermValue)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("terms = %v, want %v", actual, expected)
+	}
+
+	m, err := actual[2].NewMatcher()
+	if err != nil {
+		t.Fatalf("Error compiling term: %v", err)
+	}
+
+	for line, want := range map[string]bool{"Process OOM detected": true, "boomtown": false, "was Killed.": true} {
+		if got := m(line); got != want {
+			t.Errorf("match(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestAstDelimitedField(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessDelimitedField))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = []match.TermT{
+		{Type: match.TermRegex, Value: `(?:^| )level=(?:error|"error")(?: |$)`},
+		{Type: match.TermRegex, Value: `(?:^| )msg=(?:(?:disk (full|failure))|"(?:disk (full|failure))")(?: |$)`},
+	}
+
+	var actual []match.TermT
+	for _, field := range lm.Match {
+		actual = append(actual, field.TermValue)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("terms = %v, want %v", actual, expected)
+	}
+
+	var lines = []struct {
+		line  string
+		match [2]bool
+	}{
+		{line: `level=error msg="disk full"`, match: [2]bool{true, true}},
+		{line: `ts=1 level=error msg=disk`, match: [2]bool{true, false}},
+		{line: `level=errors msg="disk failure" x=1`, match: [2]bool{false, true}},
+		{line: `sublevel=error notmsg="disk full"`, match: [2]bool{false, false}},
+	}
+
+	for _, l := range lines {
+		for i, term := range actual {
+			if got := regexp.MustCompile(term.Value).MatchString(l.line); got != l.match[i] {
+				t.Errorf("term %d on %q = %v, want %v", i, l.line, got, l.match[i])
+			}
+		}
+	}
+}
+
+func TestBuildRuleById(t *testing.T) {
+
+	node, err := BuildRuleById([]byte(testdata.TestSuccessPriority), "TestPriorityLow")
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if node.Metadata.RuleId != "Bq8rEaVmVB9xK3H6y5jYUk" || node.Metadata.Priority != 5 {
+		t.Errorf("Expected rule Bq8rEaVmVB9xK3H6y5jYUk with priority 5, got %s/%d", node.Metadata.RuleId, node.Metadata.Priority)
+	}
+
+	if _, err = BuildRuleById([]byte(testdata.TestSuccessPriority), "missing"); !errors.Is(err, parser.ErrRuleNotFound) {
+		t.Errorf("Expected error %v, got %v", parser.ErrRuleNotFound, err)
+	}
+}
+
+func TestAstNodeWindow(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessNodeWindows))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var expected = map[schema.NodeTypeT]time.Duration{
+		schema.NodeTypeSet:    50 * time.Second,
+		schema.NodeTypePromQL: 2 * time.Minute,
+		schema.NodeTypeLogSeq: 10 * time.Second,
+		schema.NodeTypeLogSet: 0,
+	}
+
+	var seen = make(map[schema.NodeTypeT]bool)
+
+	var walk func(n *AstNodeT)
+	walk = func(n *AstNodeT) {
+		window, ok := n.Window()
+		if !ok {
+			t.Errorf("%s: expected a window", n.Metadata.Type)
+		} else if window != expected[n.Metadata.Type] {
+			t.Errorf("%s: window = %v, want %v", n.Metadata.Type, window, expected[n.Metadata.Type])
+		}
+		seen[n.Metadata.Type] = true
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(tree.Nodes[0])
+
+	for typ := range expected {
+		if !seen[typ] {
+			t.Errorf("Expected a %s node in the tree", typ)
+		}
+	}
+
+	if _, ok := (&AstNodeT{}).Window(); ok {
+		t.Errorf("Expected no window for a node without an object")
+	}
+}
+
+func TestAstRepeat(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessRepeat))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root = tree.Nodes[0]
+		seq  *AstLogMatcherT
+		set  *AstNodeT
+	)
+
+	for _, child := range root.Children {
+		switch child.Metadata.Type {
+		case schema.NodeTypeLogSeq:
+			seq = child.Object.(*AstLogMatcherT)
+		case schema.NodeTypeLogSet:
+			set = child
+		}
+	}
+
+	if seq == nil || set == nil {
+		t.Fatalf("Expected log_seq and log_set children")
+	}
+
+	var steps []*AstRepeatT
+	for _, field := range seq.Match {
+		steps = append(steps, field.Repeat)
+	}
+
+	if expected := []*AstRepeatT{nil, {Min: 1}, {Min: 2, Max: 2}}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("step repeats = %+v, want %+v", steps, expected)
+	}
+
+	if !reflect.DeepEqual(set.Metadata.Repeat, &AstRepeatT{Min: 2, Max: 5}) {
+		t.Errorf("set repeat = %+v, want 2-5", set.Metadata.Repeat)
+	}
+
+	// Descriptors handed to the sequence machine carry the repeat
+	machine := root.Object.(*AstSeqMatcherT)
+	if !reflect.DeepEqual(machine.Order[1].Repeat, &AstRepeatT{Min: 2, Max: 5}) {
+		t.Errorf("machine step repeat = %+v, want 2-5", machine.Order[1].Repeat)
+	}
+}
+
+func TestAstMaxGap(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessMaxGap))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root = tree.Nodes[0]
+		seq  *AstLogMatcherT
+		set  *AstNodeT
+	)
+
+	for _, child := range root.Children {
+		switch child.Metadata.Type {
+		case schema.NodeTypeLogSeq:
+			seq = child.Object.(*AstLogMatcherT)
+		case schema.NodeTypeLogSet:
+			set = child
+		}
+	}
+
+	if seq == nil || set == nil {
+		t.Fatalf("Expected log_seq and log_set children")
+	}
+
+	var gaps []time.Duration
+	for _, field := range seq.Match {
+		gaps = append(gaps, field.MaxGap)
+	}
+
+	if expected := []time.Duration{0, 5 * time.Second, 2 * time.Second}; !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("step gaps = %v, want %v", gaps, expected)
+	}
+
+	if set.Metadata.MaxGap != 10*time.Second {
+		t.Errorf("set gap = %v, want 10s", set.Metadata.MaxGap)
+	}
+}
+
+func TestAstOptional(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessOptional))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root     = tree.Nodes[0]
+		seq      = root.Children[0].Object.(*AstLogMatcherT)
+		steps    []bool
+		children []bool
+	)
+
+	for _, field := range seq.Match {
+		steps = append(steps, field.Optional)
+	}
+
+	for _, child := range root.Children {
+		children = append(children, child.Metadata.Optional)
+	}
+
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("optional steps = %v, want %v", steps, expected)
+	}
+
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(children, expected) {
+		t.Errorf("optional children = %v, want %v", children, expected)
+	}
+}
+
+func TestAstCountRange(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessCountRange))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	// The range and the fixed count are each a single field
+	var (
+		ranges []*AstCountRangeT
+		counts []int
+	)
+	for _, field := range lm.Match {
+		ranges = append(ranges, field.CountRange)
+		counts = append(counts, field.Count)
+	}
+
+	if expected := []*AstCountRangeT{nil, {Min: 2, Max: 5}, nil}; !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("count ranges = %+v, want %+v", ranges, expected)
+	}
+	if expected := []int{0, 0, 2}; !slices.Equal(counts, expected) {
+		t.Errorf("counts = %v, want %v", counts, expected)
+	}
+}
+
+func TestStrictSequences(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
 	if err != nil {
 		t.Fatalf("Error finding CRE test files: %v", err)
 	}
 
 	for _, rule := range rules {
-
-		// Read the test file
 		testData, err := os.ReadFile(rule)
 		if err != nil {
 			t.Fatalf("Error reading test file %s: %v", rule, err)
 		}
 
-		_, err = Build(testData)
-		if err == nil {
-			t.Fatalf("Expected error building rule %s", rule)
+		if _, err = Build(testData, WithStrictSequences()); err != nil {
+			t.Errorf("Error building rule %s in strict mode: %v", rule, err)
+		}
+	}
+
+	var tests = map[string]struct {
+		rule      string
+		line, col int
+	}{
+		"NoSource": {rule: testdata.TestFailSeqFirstStepNoSource, line: 13, col: 13},
+		"Absent":   {rule: testdata.TestFailSeqFirstStepAbsent, line: 16, col: 13},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Accepted unless strict
+			if _, err := Build([]byte(test.rule)); err != nil {
+				t.Fatalf("Error building rule: %v", err)
+			}
+
+			_, err := Build([]byte(test.rule), WithStrictSequences())
+			if !errors.Is(err, ErrSeqFirstStep) {
+				t.Fatalf("Expected error %v, got %v", ErrSeqFirstStep, err)
+			}
+
+			if pos, ok := pqerr.PosOf(err); !ok || pos.Line != test.line || pos.Col != test.col {
+				t.Errorf("Expected error position line=%d, col=%d, got %+v", test.line, test.col, pos)
+			}
+		})
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessComplexRule2))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var walk func(n *AstNodeT)
+	walk = func(n *AstNodeT) {
+		for _, addr := range []*AstNodeAddressT{n.Metadata.Address, n.Metadata.ParentAddress} {
+			if addr == nil {
+				continue
+			}
+			parsed, err := ParseAddress(addr.String())
+			if err != nil {
+				t.Fatalf("Error parsing address %s: %v", addr.String(), err)
+			}
+			if !reflect.DeepEqual(parsed, addr) {
+				t.Errorf("ParseAddress(%s) = %+v, want %+v", addr.String(), parsed, addr)
+			}
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(tree.Nodes[0])
+
+	// The string form is persisted; changing it breaks stored addresses
+	termIdx := uint32(3)
+	addr := &AstNodeAddressT{Version: "v1", Name: "log_seq", RuleHash: "rdJLgqYgkEp8jg8Qks1qiq", Depth: 1, NodeId: 12, TermIdx: &termIdx}
+	if got := addr.String(); got != "v1.log_seq.rdJLgqYgkEp8jg8Qks1qiq.d1.n12.t3" {
+		t.Errorf("String() = %s", got)
+	}
+
+	for _, bad := range []string{
+		"",
+		"v1.log_seq.hash.d1",
+		"v1.log_seq.hash.d1.n2.t3.x",
+		"1.log_seq.hash.d1.n2",
+		"v1..hash.d1.n2",
+		"v1.log_seq.hash.1.n2",
+		"v1.log_seq.hash.d1.nx",
+		"v1.log_seq.hash.d01.n2",
+		"v1.log_seq.hash.d1.n2.t",
+		"v1.log_seq.hash.d1.n99999999999",
+	} {
+		if _, err := ParseAddress(bad); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("ParseAddress(%q): expected error %v, got %v", bad, ErrInvalidAddress, err)
+		}
+	}
+}
+
+func TestAstPriority(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessPriority))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var actual []int
+	for _, node := range tree.Nodes {
+		actual = append(actual, node.Metadata.Priority)
+	}
+
+	if expected := []int{0, 10, 5, 10}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("priorities = %v, want %v", actual, expected)
+	}
+}
+
+func TestAstRequireSources(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessRequireSources))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if !root.Metadata.RequireAllSources {
+		t.Errorf("Expected root to require all sources")
+	}
+
+	expected := []string{"cre.log.nginx", "cre.prequel.k8s"}
+	if !reflect.DeepEqual(root.Metadata.Sources, expected) {
+		t.Errorf("sources = %v, want %v", root.Metadata.Sources, expected)
+	}
+
+	for _, child := range root.Children {
+		if child.Metadata.RequireAllSources || child.Metadata.Sources != nil {
+			t.Errorf("Expected source requirements on root only, got %s", child.Metadata.Address.String())
+		}
+	}
+}
+
+func TestAstPrimaryField(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessPrimaryField))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var primaries []bool
+	for _, field := range lm.Match {
+		primaries = append(primaries, field.Primary)
+	}
+
+	if expected := []bool{false, true}; !reflect.DeepEqual(primaries, expected) {
+		t.Errorf("primaries = %v, want %v", primaries, expected)
+	}
+}
+
+func TestAstPromQLDescription(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessDescribedPromQL))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	prom, ok := tree.Nodes[0].Children[0].Object.(*AstPromQL)
+	if !ok {
+		t.Fatalf("Expected promql object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	if expected := "Sustained 5xx error rate above 10 req/s per service"; prom.Description != expected {
+		t.Errorf("description = %q, want %q", prom.Description, expected)
+	}
+
+	expected := []AstPromSelectorT{{
+		Metric:   "http_requests_total",
+		Matchers: []AstPromMatcherT{{Name: "code", Op: "=~", Value: "5.."}},
+	}}
+
+	if !reflect.DeepEqual(prom.Selectors, expected) {
+		t.Errorf("selectors = %+v, want %+v", prom.Selectors, expected)
+	}
+}
+
+func TestAstOrderTolerance(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessOrderTolerance))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	seq, ok := tree.Nodes[0].Object.(*AstSeqMatcherT)
+	if !ok {
+		t.Fatalf("Expected seq matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	if seq.OrderTolerance != 2*time.Second {
+		t.Errorf("machine order tolerance = %v, want %v", seq.OrderTolerance, 2*time.Second)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	if lm.OrderTolerance != 500*time.Millisecond {
+		t.Errorf("log order tolerance = %v, want %v", lm.OrderTolerance, 500*time.Millisecond)
+	}
+}
+
+func TestLintWindowPerStep(t *testing.T) {
+
+	var tests = map[string]struct {
+		opts  []BuildOptT
+		diags int
+	}{
+		"Disabled": {
+			opts:  []BuildOptT{},
+			diags: 0,
+		},
+		"BelowThreshold": {
+			opts:  []BuildOptT{WithMinStepWindow(500 * time.Millisecond)},
+			diags: 1,
+		},
+		"AboveThreshold": {
+			opts:  []BuildOptT{WithMinStepWindow(100 * time.Millisecond)},
+			diags: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var diags []pqerr.Diagnostic
+
+			opts := append(test.opts, WithDiagnostics(func(d pqerr.Diagnostic) {
+				diags = append(diags, d)
+			}))
+
+			if _, err := Build([]byte(testdata.TestSuccessShortSeqWindow), opts...); err != nil {
+				t.Fatalf("Error building rule: %v", err)
+			}
+
+			if len(diags) != test.diags {
+				t.Fatalf("Expected %d diagnostics, got %d: %v", test.diags, len(diags), diags)
+			}
+
+			if test.diags == 0 {
+				return
+			}
+
+			if diags[0].Code != DiagWindowPerStep {
+				t.Errorf("Expected code %s, got %s", DiagWindowPerStep, diags[0].Code)
+			}
+
+			if diags[0].Pos.Line != 11 || diags[0].Pos.Col != 17 {
+				t.Errorf("Expected diagnostic position line=11, col=17, got %+v", diags[0].Pos)
+			}
+
+			if !strings.Contains(diags[0].Msg, "window 1s for 5 ordered steps") {
+				t.Errorf("Expected window and step count in message, got %q", diags[0].Msg)
+			}
+		})
+	}
+}
+
+func TestBuildTiming(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessSharedSubSequence))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if tree.Timings != nil {
+		t.Errorf("Expected no timings by default, got %v", tree.Timings)
+	}
+
+	if tree, err = Build([]byte(testdata.TestSuccessSharedSubSequence), WithTiming()); err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if len(tree.Timings) != len(tree.Nodes) {
+		t.Fatalf("Expected %d timings, got %d", len(tree.Nodes), len(tree.Timings))
+	}
+
+	for _, node := range tree.Nodes {
+		elapsed, ok := tree.Timings[node.Metadata.Address.RuleHash]
+		if !ok {
+			t.Errorf("Missing timing for rule hash %s", node.Metadata.Address.RuleHash)
+		}
+		if elapsed <= 0 {
+			t.Errorf("Expected positive timing for rule hash %s, got %v", node.Metadata.Address.RuleHash, elapsed)
+		}
+	}
+}
+
+func TestSuccessExamples(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+
+		// Read the test file
+		testData, err := os.ReadFile(rule)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+
+		_, err = Build(testData)
+		if err != nil {
+			t.Fatalf("Error building rule %s: %v", rule, err)
+		}
+	}
+}
+
+func TestFailureExamples(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "failure_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+
+		// Read the test file
+		testData, err := os.ReadFile(rule)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+
+		_, err = Build(testData)
+		if err == nil {
+			t.Fatalf("Expected error building rule %s", rule)
+		}
+	}
+}
+
+func TestAstValueSet(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessValueSet))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = match.TermT{Type: match.TermRegex, Value: `(?:OOMKilled|Error|Init:Error)`}
+	if actual := lm.Match[0].TermValue; actual != expected {
+		t.Fatalf("term = %v, want %v", actual, expected)
+	}
+}
+
+func TestAstValueList(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessValueList))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = []match.TermT{
+		{Type: match.TermRegex, Value: `(?:OOMKilled|Error)`},
+		{Type: match.TermRegex, Value: `(?:(?:exit code \d+)|(?:signal (9|15)))`},
+	}
+
+	var actual []match.TermT
+	for _, field := range lm.Match {
+		actual = append(actual, field.TermValue)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("terms = %v, want %v", actual, expected)
+	}
+}
+
+func TestBuildWithTree(t *testing.T) {
+
+	ast, tree, err := BuildWithTree([]byte(testdata.TestSuccessPriority))
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	if len(tree.Nodes) != len(ast.Nodes) {
+		t.Fatalf("Expected %d tree nodes, got %d", len(ast.Nodes), len(tree.Nodes))
+	}
+
+	for i, node := range tree.Nodes {
+		if node.Metadata.RuleHash != ast.Nodes[i].Metadata.Address.RuleHash {
+			t.Errorf("nodes[%d] rule hash = %s, want %s", i, node.Metadata.RuleHash, ast.Nodes[i].Metadata.Address.RuleHash)
+		}
+	}
+
+	if _, err = json.Marshal(tree); err != nil {
+		t.Errorf("Error marshaling tree: %v", err)
+	}
+
+	// A failed build still returns the parsed tree
+	_, tree, err = BuildWithTree([]byte(testdata.TestFailSeqFirstStepNoSource), WithStrictSequences())
+	if !errors.Is(err, ErrSeqFirstStep) || tree == nil || len(tree.Nodes) != 1 {
+		t.Errorf("Expected tree with error %v, got tree=%v err=%v", ErrSeqFirstStep, tree, err)
+	}
+}
+
+func TestAstAnnotations(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessAnnotations))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var runbooks []string
+	for _, child := range tree.Nodes[0].Children {
+		lm, ok := child.Object.(*AstLogMatcherT)
+		if !ok {
+			t.Fatalf("Expected log matcher object, got %T", child.Object)
+		}
+		for _, field := range append(lm.Match, lm.Negate...) {
+			runbooks = append(runbooks, field.Annotations["runbook"])
+		}
+	}
+
+	var expected = []string{
+		"https://runbooks.example.com/disk-full",
+		"https://runbooks.example.com/write-failed",
+		"https://runbooks.example.com/disk-cleanup",
+	}
+
+	if !reflect.DeepEqual(runbooks, expected) {
+		t.Errorf("runbooks = %v, want %v", runbooks, expected)
+	}
+}
+
+func TestAstGroups(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "44-any-of.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	anyOf := tree.Nodes[0].Children[1]
+	if anyOf.Metadata.Type != schema.NodeTypeAny {
+		t.Fatalf("Expected %s, got %s", schema.NodeTypeAny, anyOf.Metadata.Type)
+	}
+
+	gm, ok := anyOf.Object.(*AstGroupMatcherT)
+	if !ok || len(gm.Terms) != 3 {
+		t.Fatalf("Expected group matcher with 3 terms, got %#v", anyOf.Object)
+	}
+
+	var types []schema.NodeTypeT
+	for _, term := range gm.Terms {
+		types = append(types, term.Type)
+	}
+
+	var expected = []schema.NodeTypeT{schema.NodeTypeLogSet, schema.NodeTypeLogSet, schema.NodeTypeAll}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("types = %v, want %v", types, expected)
+	}
+
+	if allOf := anyOf.Children[2]; len(allOf.Children) != 2 {
+		t.Errorf("Expected allOf with 2 children, got %d", len(allOf.Children))
+	}
+}
+
+func TestAstCountDistinct(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "46-count-distinct.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = &AstCountDistinctT{Field: "pod", Threshold: 10}
+	if !reflect.DeepEqual(lm.CountDistinct, expected) {
+		t.Errorf("CountDistinct = %v, want %v", lm.CountDistinct, expected)
+	}
+}
+
+func TestAstSequenceSetStep(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "47-sequence-set-step.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	seq := tree.Nodes[0]
+	if seq.Metadata.Type != schema.NodeTypeSeq || seq.Metadata.NegIdx != 3 {
+		t.Fatalf("Expected %s with negate index 3, got %s/%d", schema.NodeTypeSeq, seq.Metadata.Type, seq.Metadata.NegIdx)
+	}
+
+	var (
+		windows []time.Duration
+		origins []bool
+	)
+
+	for _, child := range seq.Children {
+		lm, ok := child.Object.(*AstLogMatcherT)
+		if !ok {
+			t.Fatalf("Expected log matcher object, got %T", child.Object)
+		}
+		if lm.Event.Source != "cre.log.app" {
+			t.Errorf("Expected source cre.log.app, got %q", lm.Event.Source)
+		}
+		windows = append(windows, lm.Window)
+		origins = append(origins, lm.Event.Origin)
+	}
+
+	if expected := []time.Duration{0, 5 * time.Second, 0, 0}; !reflect.DeepEqual(windows, expected) {
+		t.Errorf("windows = %v, want %v", windows, expected)
+	}
+
+	if expected := []bool{true, false, false, false}; !reflect.DeepEqual(origins, expected) {
+		t.Errorf("origins = %v, want %v", origins, expected)
+	}
+}
+
+func TestAstQuorum(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "48-quorum.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	sm, ok := tree.Nodes[0].Object.(*AstSetMatcherT)
+	if !ok {
+		t.Fatalf("Expected set matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	if sm.Require != 2 || len(sm.Match) != 3 {
+		t.Errorf("Expected 2 of 3 match terms, got %d of %d", sm.Require, len(sm.Match))
+	}
+}
+
+func TestAstNegateGroups(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "49-negate-groups.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	if len(lm.Negate) != 4 {
+		t.Fatalf("Expected 4 negate fields, got %d", len(lm.Negate))
+	}
+
+	// Only the allOf group is kept; anyOf is the same as separate negates
+	var expected = []AstNegateGroupT{{Fields: []int{0, 1}}}
+	if !reflect.DeepEqual(lm.NegateGroups, expected) {
+		t.Errorf("NegateGroups = %v, want %v", lm.NegateGroups, expected)
+	}
+}
+
+func TestAstNegateCount(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "50-negate-count.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	if len(lm.Negate) != 1 {
+		t.Fatalf("Expected a single negate field, got %d", len(lm.Negate))
+	}
+
+	var expected = &AstNegateOptsT{Window: 30 * time.Second, Count: 3}
+	if !reflect.DeepEqual(lm.Negate[0].NegateOpts, expected) {
+		t.Errorf("NegateOpts = %+v, want %+v", lm.Negate[0].NegateOpts, expected)
+	}
+}
+
+func TestAstNegateAnchorName(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "51-negate-anchor-name.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = &AstNegateOptsT{Window: 10 * time.Second, Anchor: 1, AnchorName: "probe_failed"}
+	if !reflect.DeepEqual(lm.Negate[0].NegateOpts, expected) {
+		t.Errorf("NegateOpts = %+v, want %+v", lm.Negate[0].NegateOpts, expected)
+	}
+}
+
+func TestAstNegateUntil(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "52-negate-until.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = &AstNegateOptsT{
+		Anchor:     0,
+		AnchorName: "leader_lost",
+		Until:      1,
+		UntilName:  "leader_elected",
+	}
+	if !reflect.DeepEqual(lm.Negate[0].NegateOpts, expected) {
+		t.Errorf("NegateOpts = %+v, want %+v", lm.Negate[0].NegateOpts, expected)
+	}
+}
+
+func TestAstJoinKeys(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	sm, ok := tree.Nodes[0].Object.(*AstSeqMatcherT)
+	if !ok {
+		t.Fatalf("Expected sequence matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	// The negate does not extract the pod, so it is not joined
+	var (
+		pod      = AstExtractT{Name: "pod", JqValue: ".involvedObject.name"}
+		expected = []AstJoinKeyT{{Key: "pod", Terms: []AstJoinTermT{{Term: 0, Extract: pod}, {Term: 1, Extract: pod}}}}
+	)
+	if !reflect.DeepEqual(sm.JoinKeys, expected) {
+		t.Errorf("JoinKeys = %+v, want %+v", sm.JoinKeys, expected)
+	}
+}
+
+func TestAstJoinKeysComposite(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "54-correlate-composite.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	sm, ok := tree.Nodes[0].Object.(*AstSetMatcherT)
+	if !ok {
+		t.Fatalf("Expected set matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	// Keys keep their order; the k8s term supplies the pod from a differently named extract
+	var expected = []AstJoinKeyT{
+		{Key: "namespace", Terms: []AstJoinTermT{
+			{Term: 0, Extract: AstExtractT{Name: "namespace", JqValue: ".involvedObject.namespace"}},
+			{Term: 1, Extract: AstExtractT{Name: "namespace", RegexValue: `ns=(\S+)`}},
+		}},
+		{Key: "pod", Terms: []AstJoinTermT{
+			{Term: 0, Extract: AstExtractT{Name: "pod_name", JqValue: ".involvedObject.name"}},
+			{Term: 1, Extract: AstExtractT{Name: "pod", RegexValue: `pod=(\S+)`}},
+		}},
+	}
+	if !reflect.DeepEqual(sm.JoinKeys, expected) {
+		t.Errorf("JoinKeys = %+v, want %+v", sm.JoinKeys, expected)
+	}
+}
+
+func TestAstCorrelationWindow(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "55-correlation-window.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	sm, ok := tree.Nodes[0].Object.(*AstSeqMatcherT)
+	if !ok {
+		t.Fatalf("Expected sequence matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	if sm.Window != 30*time.Second || sm.CorrelationWindow != time.Hour {
+		t.Errorf("Window = %v, CorrelationWindow = %v, want 30s and 1h", sm.Window, sm.CorrelationWindow)
+	}
+}
+
+func TestAstExtractTypes(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "56-typed-extract.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var expected = []schema.ExtractTypeT{
+		schema.ExtractTypeDuration,
+		schema.ExtractTypeInt,
+		schema.ExtractTypeBool,
+		"",
+	}
+
+	extracts := lm.Match[0].Extracts
+	if len(extracts) != len(expected) {
+		t.Fatalf("Expected %d extracts, got %d", len(expected), len(extracts))
+	}
+	for i, e := range extracts {
+		if e.Type != expected[i] {
+			t.Errorf("Extract %s type = %q, want %q", e.Name, e.Type, expected[i])
+		}
+	}
+}
+
+func TestAstStepRefs(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "57-step-refs.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	sm, ok := tree.Nodes[0].Object.(*AstSeqMatcherT)
+	if !ok {
+		t.Fatalf("Expected sequence matcher object, got %T", tree.Nodes[0].Object)
+	}
+
+	var expected = []AstStepRefT{{Term: 1, Step: 0, Extract: "pod"}}
+	if !reflect.DeepEqual(sm.StepRefs, expected) {
+		t.Errorf("StepRefs = %+v, want %+v", sm.StepRefs, expected)
+	}
+}
+
+func TestAstLogStepRefs(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessStepRefs))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	// The counted step is a single condition, so the last step is at index 2
+	var expected = []AstStepRefT{{Term: 2, Step: 0, Extract: "holder"}}
+	if !reflect.DeepEqual(lm.StepRefs, expected) {
+		t.Errorf("StepRefs = %+v, want %+v", lm.StepRefs, expected)
+	}
+}
+
+func TestAstExtractTransforms(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "58-extract-transforms.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	var (
+		got      [][]AstTransformT
+		expected = [][]AstTransformT{
+			{{Op: schema.TransformTrim}, {Op: schema.TransformLowercase}},
+			{{Op: schema.TransformSubstring, Args: []int{0, 8}}, {Op: schema.TransformHash}},
+		}
+	)
+
+	for _, e := range lm.Match[0].Extracts {
+		got = append(got, e.Transforms)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Transforms = %+v, want %+v", got, expected)
+	}
+}
+
+func TestAstAggregate(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "59-aggregate.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		got      []AstAggMatcherT
+		expected = []AstAggMatcherT{
+			{Window: 5 * time.Minute, Func: schema.AggSum, Extract: "bytes", Op: schema.AggGt, Threshold: 1e9},
+			{Window: time.Minute, Func: schema.AggAvg, Extract: "latency", Op: schema.AggGe, Threshold: float64(2 * time.Second)},
+		}
+	)
+
+	for _, child := range tree.Nodes[0].Children {
+		am, ok := child.Object.(*AstAggMatcherT)
+		if !ok {
+			t.Fatalf("Expected aggregate matcher object, got %T", child.Object)
+		}
+		if child.Metadata.Type != schema.NodeTypeAgg {
+			t.Errorf("Type = %s, want %s", child.Metadata.Type, schema.NodeTypeAgg)
+		}
+		if len(am.Match) != 1 || len(am.Match[0].Extracts) != 1 {
+			t.Fatalf("Expected one match field with one extract, got %+v", am.Match)
+		}
+		got = append(got, AstAggMatcherT{Window: am.Window, Func: am.Func, Extract: am.Extract, Op: am.Op, Threshold: am.Threshold})
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Aggregates = %+v, want %+v", got, expected)
+	}
+}
+
+func TestAstMetricSeq(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "60-metric-sequence.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var root = tree.Nodes[0]
+
+	if root.Metadata.Type != schema.NodeTypeMetricSeq {
+		t.Errorf("Type = %s, want %s", root.Metadata.Type, schema.NodeTypeMetricSeq)
+	}
+
+	ms, ok := root.Object.(*AstMetricSeqT)
+	if !ok {
+		t.Fatalf("Expected metric sequence object, got %T", root.Object)
+	}
+
+	if ms.Window != 10*time.Minute || len(ms.Steps) != 2 {
+		t.Fatalf("Expected two steps in 10m, got %d in %v", len(ms.Steps), ms.Window)
+	}
+
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute} {
+		step := ms.Steps[i]
+		if step.For != expected {
+			t.Errorf("step %d for = %v, want %v", i, step.For, expected)
+		}
+		if step.Event == nil || step.Event.Source != "cre.metrics" || step.Event.Origin != (i == 0) {
+			t.Errorf("step %d event = %+v, want cre.metrics with origin on the first step", i, step.Event)
+		}
+		if root.Children[i].Object != step {
+			t.Errorf("step %d is not the object of child %d", i, i)
+		}
+	}
+}
+
+func TestAstMixedSequence(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "61-mixed-sequence.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root     = tree.Nodes[0]
+		expected = []struct {
+			typ    schema.NodeTypeT
+			scope  string
+			source string
+		}{
+			{schema.NodeTypePromQL, schema.ScopeCluster, "cre.metrics"},
+			{schema.NodeTypeLogSet, schema.ScopeNode, "cre.k8s"},
+			{schema.NodeTypeLogSet, schema.ScopeNode, "cre.k8s"},
+		}
+	)
+
+	if root.Metadata.Type != schema.NodeTypeSeq {
+		t.Errorf("Type = %s, want %s", root.Metadata.Type, schema.NodeTypeSeq)
+	}
+
+	if len(root.Children) != len(expected) {
+		t.Fatalf("Expected %d steps, got %d", len(expected), len(root.Children))
+	}
+
+	for i, exp := range expected {
+		var (
+			child  = root.Children[i]
+			source string
+			origin bool
+		)
+
+		switch obj := child.Object.(type) {
+		case *AstPromQL:
+			source, origin = obj.Event.Source, obj.Event.Origin
+		case *AstLogMatcherT:
+			source, origin = obj.Event.Source, obj.Event.Origin
+		default:
+			t.Fatalf("step %d: unexpected object %T", i, child.Object)
+		}
+
+		if child.Metadata.Type != exp.typ || child.Metadata.Scope != exp.scope || source != exp.source {
+			t.Errorf("step %d = %s/%s/%s, want %s/%s/%s", i,
+				child.Metadata.Type, child.Metadata.Scope, source, exp.typ, exp.scope, exp.source)
+		}
+
+		if origin != (i == 0) {
+			t.Errorf("step %d origin = %v, want %v", i, origin, i == 0)
+		}
+	}
+}
+
+func TestAstTraces(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "62-traces.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var root = tree.Nodes[0]
+
+	if len(root.Children) != 2 {
+		t.Fatalf("Expected 2 steps, got %d", len(root.Children))
+	}
+
+	for i, child := range root.Children {
+		if child.Metadata.Type != schema.NodeTypeTraceSet || child.Metadata.Scope != schema.ScopeCluster {
+			t.Errorf("step %d = %s/%s, want %s/%s", i, child.Metadata.Type, child.Metadata.Scope,
+				schema.NodeTypeTraceSet, schema.ScopeCluster)
+		}
+	}
+
+	// Every span field is matched at its path; attribute keys keep their dots
+	expected := [][]string{
+		{
+			`select(getpath(["attributes","http.route"]) | . == "/checkout")`,
+			`select(getpath(["duration"]) | type == "number" and . > 2e+09)`,
+		},
+		{
+			`select(getpath(["status","code"]) | . == "STATUS_CODE_ERROR")`,
+			`select(getpath(["service","name"]) | . == "payments")`,
+		},
+	}
+
+	for i, child := range root.Children {
+		lm, ok := child.Object.(*AstLogMatcherT)
+		if !ok {
+			t.Fatalf("Expected log matcher object, got %T", child.Object)
+		}
+		if len(lm.Match) != len(expected[i]) {
+			t.Fatalf("step %d: expected %d terms, got %d", i, len(expected[i]), len(lm.Match))
+		}
+		for j, f := range lm.Match {
+			want := match.TermT{Type: match.TermJqJson, Value: expected[i][j]}
+			if f.TermValue != want {
+				t.Errorf("step %d term %d = %+v, want %+v", i, j, f.TermValue, want)
+			}
+		}
+	}
+}
+
+func TestAstK8sResource(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "63-k8s-resource.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var root = tree.Nodes[0]
+
+	if len(root.Children) != 2 {
+		t.Fatalf("Expected 2 steps, got %d", len(root.Children))
+	}
+
+	step := root.Children[0]
+	if step.Metadata.Type != schema.NodeTypeK8sResource || step.Metadata.Scope != schema.ScopeCluster {
+		t.Errorf("step 0 = %s/%s, want %s/%s", step.Metadata.Type, step.Metadata.Scope,
+			schema.NodeTypeK8sResource, schema.ScopeCluster)
+	}
+
+	res, ok := step.Object.(*AstK8sResourceT)
+	if !ok {
+		t.Fatalf("Expected resource object, got %T", step.Object)
+	}
+
+	expected := AstK8sResourceT{
+		Event:     AstEventT{Source: schema.SourceK8sResource, Origin: true},
+		GVK:       AstGVKT{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Namespace: "payments",
+		Field:     "status.availableReplicas",
+		From:      &AstResourceStateT{Op: ">", Number: 0},
+		To:        AstResourceStateT{Op: "==", Number: 0},
+	}
+
+	if !reflect.DeepEqual(*res, expected) {
+		t.Errorf("resource = %+v, want %+v", *res, expected)
+	}
+}
+
+func TestAstJournald(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "64-journald.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	// Each condition matches its own field, priorities by their codes
+	expected := []match.TermT{
+		{Type: match.TermJqJson, Value: `select(getpath(["UNIT"]) | . == "kubelet.service")`},
+		{Type: match.TermJqJson, Value: `select(getpath(["PRIORITY"]) | . == "0" or . == "1" or . == "2" or . == "3")`},
+		{Type: match.TermJqJson, Value: `select(getpath(["MESSAGE"]) | type == "string" and test("PLEG is not healthy"))`},
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, f := range lm.Match {
+		if f.TermValue != expected[i] {
+			t.Errorf("term %d = %+v, want %+v", i, f.TermValue, expected[i])
+		}
+	}
+}
+
+func TestAstSyslog(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "65-syslog.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	expected := []struct {
+		field string
+		term  match.TermT
+	}{
+		{"facility", match.TermT{Type: match.TermJqJson, Value: `select(getpath(["facility"]) | . == 23)`}},
+		{"severity", match.TermT{Type: match.TermJqJson, Value: `select(getpath(["severity"]) | . == 2 or . == 3)`}},
+		{"app_name", match.TermT{Type: match.TermJqJson, Value: `select(getpath(["app_name"]) | . == "bgpd")`}},
+		{"structured_data.origin.software", match.TermT{Type: match.TermJqJson,
+			Value: `select(getpath(["structured_data","origin","software"]) | . == "FRRouting")`}},
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, e := range expected {
+		if lm.Match[i].Field != e.field || lm.Match[i].TermValue != e.term {
+			t.Errorf("term %d = %s %+v, want %s %+v", i, lm.Match[i].Field, lm.Match[i].TermValue, e.field, e.term)
+		}
+	}
+}
+
+func TestAstWinEvent(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "66-winevent.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	expected := []struct {
+		field string
+		jq    string
+	}{
+		{"System.Channel", `select(getpath(["System","Channel"]) | . == "Security")`},
+		{"System.EventID", `select(getpath(["System","EventID"]) | . == 4625 or . == 4771)`},
+		{"System.Level", `select(getpath(["System","Level"]) | . == 4)`},
+		{"RenderingInfo.Message", `select(getpath(["RenderingInfo","Message"]) | type == "string" and test("account name:\\s+admin"))`},
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, e := range expected {
+		term := match.TermT{Type: match.TermJqJson, Value: e.jq}
+		if lm.Match[i].Field != e.field || lm.Match[i].TermValue != term {
+			t.Errorf("term %d = %s %+v, want %s %+v", i, lm.Match[i].Field, lm.Match[i].TermValue, e.field, term)
+		}
+	}
+}
+
+func TestAstJqSourceTerms(t *testing.T) {
+
+	const rule = `rules:
+  - cre:
+      id: jq-source-terms
+    metadata:
+      id: Wv3NpK7xTc2QmR9bLs4Hfd
+      hash: Zt8MqB3wYe6KxN2rPc5Vgh
+    rule:
+      set:
+        event:
+          source: cre.winevent
+        match:
+          - %s
+`
+
+	const (
+		logon   = `{"System":{"Channel":"Security","EventID":4625,"Provider":{"Name":"Microsoft-Windows-Security-Auditing"}},"RenderingInfo":{"Message":"An account failed to log on. Account Name: admin"},"EventData":{"TargetUserName":"admin"}}`
+		cleared = `{"System":{"Channel":"Application","EventID":104,"Provider":{"Name":"Kerberos"}},"RenderingInfo":{"Message":"The security log was cleared by administrator"},"EventData":{"Note":"failed to log on"}}`
+	)
+
+	// Conditions match the selected field of the record, not its serialized text
+	var tests = map[string]struct {
+		cond  string
+		match []string
+		miss  []string
+	}{
+		"CaseInsensitive": {
+			cond:  `{field: Channel, value: SECURITY, options: {caseSensitive: false}}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"StringsCaseInsensitive": {
+			cond:  `{field: Channel, strings: [security, system], options: {caseSensitive: false}}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"WordBoundary": {
+			cond:  `{field: Message, regex: admin, options: {wordBoundary: true}}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"Regexes": {
+			cond:  `{field: Provider, regexes: ["^Microsoft-Windows-Security", "^Netlogon$"]}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"Glob": {
+			cond:  `{field: Message, glob: "*failed to log on*"}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"Exists": {
+			cond:  `{field: EventData.TargetUserName, exists: true}`,
+			match: []string{logon},
+			miss:  []string{cleared},
+		},
+		"NotExists": {
+			cond:  `{field: EventData.TargetUserName, exists: false}`,
+			match: []string{cleared},
+			miss:  []string{logon},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			tree, err := Build([]byte(fmt.Sprintf(rule, test.cond)))
+			if err != nil {
+				t.Fatalf("Error building rule: %v", err)
+			}
+
+			term := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT).Match[0].TermValue
+			if term.Type != match.TermJqJson {
+				t.Fatalf("Expected a jq term, got %+v", term)
+			}
+
+			m, err := term.NewMatcher()
+			if err != nil {
+				t.Fatalf("Error compiling term %s: %v", term.Value, err)
+			}
+
+			for _, event := range test.match {
+				if !m(event) {
+					t.Errorf("Expected %s to match %s", term.Value, event)
+				}
+			}
+			for _, event := range test.miss {
+				if m(event) {
+					t.Errorf("Expected %s not to match %s", term.Value, event)
+				}
+			}
+		})
+	}
+
+	// Conditions on the text of a line cannot select a field
+	for name, cond := range map[string]string{
+		"Delimiter": `{field: Message, value: admin, delimiter: " "}`,
+		"IPCidr":    `{field: EventData.IpAddress, ipCidr: [10.0.0.0/8]}`,
+	} {
+		_, err := Build([]byte(fmt.Sprintf(rule, cond)))
+		if !errors.Is(err, ErrJqSourceTerm) {
+			t.Errorf("%s: expected %v, got %v", name, ErrJqSourceTerm, err)
+			continue
+		}
+
+		if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 12 || pos.Col != 13 {
+			t.Errorf("%s: position = %+v, want 12:13", name, pos)
+		}
+	}
+}
+
+func TestAstCloudTrail(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "67-cloudtrail.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var node = tree.Nodes[0].Children[0]
+
+	if node.Metadata.Scope != schema.ScopeCluster {
+		t.Errorf("scope = %s, want %s", node.Metadata.Scope, schema.ScopeCluster)
+	}
+
+	lm, ok := node.Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", node.Object)
+	}
+
+	expected := []string{
+		`select(getpath(["eventSource"]) | . == "iam.amazonaws.com")`,
+		`select(getpath(["eventName"]) | . == "CreateAccessKey" or . == "AttachUserPolicy")`,
+		`select(getpath(["userIdentity","arn"]) | type == "string" and test(":assumed-role/ci-"))`,
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, jq := range expected {
+		term := match.TermT{Type: match.TermJqJson, Value: jq}
+		if lm.Match[i].TermValue != term {
+			t.Errorf("term %d = %+v, want %+v", i, lm.Match[i].TermValue, term)
+		}
+	}
+}
+
+func TestAstContainer(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "68-container.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	expected := []string{
+		`select(getpath(["action"]) | . == "oom")`,
+		`select(getpath(["exitCode"]) | . == 137 or . == 139)`,
+		`select(getpath(["action"]) | . == "restart")`,
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, jq := range expected {
+		term := match.TermT{Type: match.TermJqJson, Value: jq}
+		if lm.Match[i].TermValue != term {
+			t.Errorf("term %d = %+v, want %+v", i, lm.Match[i].TermValue, term)
+		}
+	}
+}
+
+func TestAstNetFlow(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "69-netflow.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var root = tree.Nodes[0]
+
+	if len(root.Children) != 2 {
+		t.Fatalf("Expected 2 terms, got %d", len(root.Children))
+	}
+
+	fm, ok := root.Children[0].Object.(*AstFlowMatcherT)
+	if !ok {
+		t.Fatalf("Expected flow matcher object, got %T", root.Children[0].Object)
+	}
+
+	if root.Children[0].Metadata.Type != schema.NodeTypeFlowSet {
+		t.Errorf("type = %s, want %s", root.Children[0].Metadata.Type, schema.NodeTypeFlowSet)
+	}
+
+	if len(fm.Match) != 3 || len(fm.Negate) != 1 {
+		t.Fatalf("Expected 3 match and 1 negate conditions, got %d and %d", len(fm.Match), len(fm.Negate))
+	}
+
+	if c := fm.Match[1]; c.Field != "protocol" || !reflect.DeepEqual(c.Values, []string{"6"}) {
+		t.Errorf("protocol = %+v, want tcp as 6", c)
+	}
+
+	if c := fm.Match[2]; c.IPCidr == nil || !c.IPCidr.Contains("10.1.2.3") {
+		t.Errorf("src_ip = %+v, want 10.0.0.0/8", c)
+	}
+
+	if c := fm.Negate[0]; c.IPCidr == nil || !c.IPCidr.Contains("192.168.1.1") || c.IPCidr.Contains("8.8.8.8") {
+		t.Errorf("dst_ip = %+v, want private blocks", c)
+	}
+
+	agg, ok := root.Children[1].Object.(*AstAggMatcherT)
+	if !ok {
+		t.Fatalf("Expected aggregate object, got %T", root.Children[1].Object)
+	}
+
+	if !agg.Field || agg.Extract != "bytes" || agg.Threshold != 1e9 {
+		t.Errorf("aggregate = %+v, want sum of the bytes field over 1e9", agg)
+	}
+}
+
+func TestAstAlerts(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "70-alerts.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lm, ok := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT)
+	if !ok {
+		t.Fatalf("Expected log matcher object, got %T", tree.Nodes[0].Children[0].Object)
+	}
+
+	expected := []string{
+		`select((.labels["alertname"] // "") == "KubePodCrashLooping" and ((.labels["namespace"] // "") | test("^(?:prod-.*)$")) and (.labels["severity"] // "") != "info")`,
+		`select(getpath(["status"]) | . == "firing")`,
+	}
+
+	if len(lm.Match) != len(expected) {
+		t.Fatalf("Expected %d match terms, got %d", len(expected), len(lm.Match))
+	}
+
+	for i, jq := range expected {
+		term := match.TermT{Type: match.TermJqJson, Value: jq}
+		if lm.Match[i].TermValue != term {
+			t.Errorf("term %d = %+v, want %+v", i, lm.Match[i].TermValue, term)
+		}
+	}
+
+	// The selector matches the labels of the alert, not its other fields
+	m, err := lm.Match[0].TermValue.NewMatcher()
+	if err != nil {
+		t.Fatalf("Error compiling selector: %v", err)
+	}
+
+	for event, want := range map[string]bool{
+		`{"status":"firing","labels":{"alertname":"KubePodCrashLooping","namespace":"prod-eu","severity":"critical"}}`:                         true,
+		`{"status":"firing","labels":{"alertname":"KubePodCrashLooping","namespace":"prod-eu","severity":"info"}}`:                             false,
+		`{"status":"firing","labels":{"alertname":"KubePodCrashLooping","namespace":"staging"},"annotations":{"summary":"namespace prod-eu"}}`: false,
+		`{"status":"firing","labels":{"alertname":"TargetDown","namespace":"prod-eu"},"annotations":{"summary":"KubePodCrashLooping"}}`:        false,
+	} {
+		if m(event) != want {
+			t.Errorf("selector match of %s = %v, want %v", event, !want, want)
+		}
+	}
+}
+
+func TestAstRegisterSource(t *testing.T) {
+
+	if err := schema.RegisterSource("cre.test.inventory", schema.FieldCatalogT{}, "region"); !errors.Is(err, schema.ErrSourceScope) {
+		t.Fatalf("Expected ErrSourceScope, got %v", err)
+	}
+
+	catalog := schema.FieldCatalogT{
+		Fields:   []string{"host", "state"},
+		Prefixes: []string{"tags."},
+	}
+
+	if err := schema.RegisterSource("cre.test.inventory", catalog, schema.ScopeOrganization); err != nil {
+		t.Fatalf("Error registering source: %v", err)
+	}
+
+	tree, err := Build([]byte(testdata.TestSuccessRegisteredSource))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if scope := tree.Nodes[0].Children[0].Metadata.Scope; scope != schema.ScopeOrganization {
+		t.Errorf("scope = %s, want %s", scope, schema.ScopeOrganization)
+	}
+
+	_, err = Build([]byte(testdata.TestFailRegisteredSource))
+	if !errors.Is(err, parser.ErrSourceField) {
+		t.Fatalf("Expected ErrSourceField, got %v", err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 14 || pos.Col != 13 {
+		t.Errorf("position = %+v, want 14:13", pos)
+	}
+
+	// Built-in sources are checked through the registry too
+	if err := schema.RegisterSource(schema.SourceJournald, catalog, schema.ScopeNode); !errors.Is(err, schema.ErrSourceBuilt) {
+		t.Errorf("Expected ErrSourceBuilt, got %v", err)
+	}
+
+	journald, ok := schema.LookupSource(schema.SourceJournald)
+	switch {
+	case !ok:
+		t.Fatalf("Expected the journald source to be registered")
+	case !journald.Fields.Known("CONTAINER_NAME"):
+		t.Errorf("Expected an unlisted journal field to be known")
+	case journald.Fields.Known("message"):
+		t.Errorf("Expected a lower case journal field to be unknown")
+	}
+}
+
+func TestAstFieldCatalog(t *testing.T) {
+
+	if err := schema.RegisterSource("cre.test.k8s", schema.K8sEventCatalog("BackOff", "OOMKilling"), schema.ScopeNode); err != nil {
+		t.Fatalf("Error registering source: %v", err)
+	}
+
+	tests := map[string]struct {
+		rule string
+		err  error
+		msg  string
+	}{
+		"Value": {
+			rule: testdata.TestFailCatalogValue,
+			err:  parser.ErrSourceValue,
+			msg:  "field=type value=Warn, did you mean Warning",
+		},
+		"Field": {
+			rule: testdata.TestFailCatalogField,
+			err:  parser.ErrSourceField,
+			msg:  "field=reasn, did you mean reason",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Build([]byte(test.rule))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+			var perr *pqerr.Error
+			if !errors.As(err, &perr) || perr.Msg != test.msg {
+				t.Errorf("msg = %q, want %q", perr.Msg, test.msg)
+			}
+		})
+	}
+
+	var traces *schema.SourceT
+	for _, src := range schema.Sources() {
+		if src.Name == schema.SourceTraces {
+			traces = &src
+		}
+	}
+
+	if traces == nil || !slices.Contains(traces.Fields.Fields, "status.code") {
+		t.Errorf("traces catalog = %+v, want span fields", traces)
+	}
+}
+
+func TestAstScopePolicy(t *testing.T) {
+
+	switch {
+	case !errors.Is(schema.RegisterScope(schema.ScopeCluster, ""), schema.ErrScopeName):
+		t.Errorf("Expected ErrScopeName for a built-in scope")
+	case !errors.Is(schema.RegisterScope("tenant", "nowhere"), schema.ErrScopeParent):
+		t.Errorf("Expected ErrScopeParent for an unknown parent")
+	}
+
+	for _, s := range []struct{ name, parent string }{
+		{"tenant", schema.ScopeOrganization},
+		{"tenant.team", "tenant"},
+		{"sandbox", ""},
+	} {
+		if err := schema.RegisterScope(s.name, s.parent); err != nil {
+			t.Fatalf("Error registering scope %s: %v", s.name, err)
+		}
+	}
+
+	if err := schema.RegisterScope("tenant", "tenant.team"); !errors.Is(err, schema.ErrScopeParent) {
+		t.Errorf("Expected ErrScopeParent for a cycle, got %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "61-mixed-sequence.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	policy := func(scope string) ScopePolicyT {
+		return func(in ScopeInputT) string {
+			if in.Source == "cre.k8s" {
+				return scope
+			}
+			return ""
+		}
+	}
+
+	tree, err := Build(data, WithScopePolicy(policy("tenant.team")))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root     = tree.Nodes[0]
+		expected = []string{schema.ScopeCluster, "tenant.team", "tenant.team"}
+	)
+
+	if root.Metadata.Scope != schema.ScopeOrganization {
+		t.Errorf("root scope = %s, want %s", root.Metadata.Scope, schema.ScopeOrganization)
+	}
+
+	for i, scope := range expected {
+		if got := root.Children[i].Metadata.Scope; got != scope {
+			t.Errorf("step %d scope = %s, want %s", i, got, scope)
+		}
+	}
+
+	if _, err = Build(data, WithScopePolicy(policy("sandbox"))); !errors.Is(err, ErrCrossScope) {
+		t.Errorf("Expected ErrCrossScope, got %v", err)
+	}
+
+	// The error is positioned at the machine whose terms have no common scope
+	_, err = Build([]byte(testdata.TestFailCrossScope), WithScopePolicy(policy("sandbox")))
+	if !errors.Is(err, ErrCrossScope) {
+		t.Fatalf("Expected ErrCrossScope, got %v", err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 13 || pos.Col != 11 {
+		t.Errorf("position = %+v, want 13:11", pos)
+	}
+
+	if _, err = Build(data, WithScopePolicy(policy("nowhere"))); !errors.Is(err, ErrUnknownScope) {
+		t.Errorf("Expected ErrUnknownScope, got %v", err)
+	}
+}
+
+func TestAstScopeBridge(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "71-scope-bridge.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root     = tree.Nodes[0]
+		expected = &AstScopeBridgeT{
+			Scopes: []string{schema.ScopeCluster, schema.ScopeNode},
+			Keys:   []string{"instance"},
+		}
+	)
+
+	if !reflect.DeepEqual(root.Metadata.ScopeBridge, expected) {
+		t.Errorf("bridge = %+v, want %+v", root.Metadata.ScopeBridge, expected)
+	}
+
+	for i, child := range root.Children {
+		if child.Metadata.ScopeBridge != nil {
+			t.Errorf("step %d bridge = %+v, want nil", i, child.Metadata.ScopeBridge)
+		}
+	}
+
+	_, err = Build([]byte(testdata.TestFailScopeBridge))
+	if !errors.Is(err, ErrScopeBridge) {
+		t.Fatalf("Expected ErrScopeBridge, got %v", err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 11 || pos.Col != 9 {
+		t.Errorf("position = %+v, want 11:9", pos)
+	}
+}
+
+func TestAstDiff(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	old, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if diffs := Diff(old, old); len(diffs) != 0 {
+		t.Errorf("Diff of identical trees = %+v, want none", diffs)
+	}
+
+	build := func(old, new string) *AstT {
+		tree, err := Build([]byte(strings.Replace(string(data), old, new, 1)))
+		if err != nil {
+			t.Fatalf("Error building rule: %v", err)
+		}
+		return tree
+	}
+
+	// A changed condition is reported on its matcher alone
+	diffs := Diff(old, build(`value: "BackOff"`, `value: "CrashLoopBackOff"`))
+	if len(diffs) != 1 || diffs[0].Kind != DiffChanged || !diffs[0].Semantic || diffs[0].New.Metadata.Type != schema.NodeTypeLogSet {
+		t.Errorf("value diffs = %+v, want one semantic change of a log set", diffs)
+	}
+
+	// Priority does not change what the rule matches
+	root := old.Nodes[0].Metadata.Address.String()
+	diffs = Diff(old, build("hash: Lr5wQv8JnTc3XyM7kPb2Dg", "hash: Lr5wQv8JnTc3XyM7kPb2Dg\n      priority: 5"))
+	if len(diffs) != 1 || diffs[0].Address != root || diffs[0].Semantic {
+		t.Errorf("priority diffs = %+v, want one metadata-only change of %s", diffs, root)
+	}
+
+	diffs = Diff(old, build("window: 10m", "window: 5m"))
+	if len(diffs) != 1 || diffs[0].Address != root || !diffs[0].Semantic {
+		t.Errorf("window diffs = %+v, want one semantic change of %s", diffs, root)
+	}
+
+	// Dropping the negate term removes its nodes and changes the root
+	idx := strings.Index(string(data), "        negate:")
+	trimmed, err := Build(data[:idx])
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var kinds = make(map[DiffKindT]int)
+	for _, d := range Diff(old, trimmed) {
+		kinds[d.Kind]++
+		if d.Kind == DiffChanged && d.Address != root {
+			t.Errorf("unexpected change of %s", d.Address)
+		}
+	}
+
+	if kinds[DiffRemoved] == 0 || kinds[DiffChanged] != 1 || kinds[DiffAdded] != 0 {
+		t.Errorf("negate diffs = %v, want removals and one change", kinds)
+	}
+}
+
+func TestAstWalk(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		root  = tree.Nodes[0]
+		pre   []*AstNodeT
+		post  []*AstNodeT
+		total int
+	)
+
+	err = Walk(tree, func(node, parent *AstNodeT, order WalkOrderT) error {
+		if parent == nil && node != root {
+			t.Errorf("node %s has no parent", node.Metadata.Address)
+		}
+		if parent != nil && !slices.Contains(parent.Children, node) {
+			t.Errorf("node %s is not a child of %s", node.Metadata.Address, parent.Metadata.Address)
+		}
+		if order == WalkPre {
+			pre = append(pre, node)
+		} else {
+			post = append(post, node)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error walking tree: %v", err)
+	}
+
+	if len(pre) != len(post) || pre[0] != root || post[len(post)-1] != root {
+		t.Errorf("walk visited %d/%d nodes, want the root first and last", len(pre), len(post))
+	}
+
+	// Skipping the children of the root visits it once
+	Walk(tree, func(node, _ *AstNodeT, order WalkOrderT) error {
+		total++
+		return SkipChildren
+	})
+	if total != 1 {
+		t.Errorf("SkipChildren visited %d nodes, want 1", total)
+	}
+
+	total = 0
+	err = Walk(tree, func(node, _ *AstNodeT, order WalkOrderT) error {
+		if total++; total == 3 {
+			return SkipAll
+		}
+		return nil
+	})
+	if err != nil || total != 3 {
+		t.Errorf("SkipAll = %v after %d visits, want nil after 3", err, total)
+	}
+
+	errStop := errors.New("stop")
+	if err = WalkNode(root.Children[0], func(*AstNodeT, *AstNodeT, WalkOrderT) error { return errStop }); err != errStop {
+		t.Errorf("WalkNode = %v, want %v", err, errStop)
+	}
+}
+
+func TestAstRegisterPass(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	var ran []string
+
+	rename := func(node *AstNodeT) (*AstNodeT, error) {
+		lm, ok := node.Object.(*AstLogMatcherT)
+		if !ok {
+			return node, nil
+		}
+		ran = append(ran, "rename")
+		out := *node
+		obj := *lm
+		obj.Event.Source = "cre.tenant.k8s"
+		out.Object = &obj
+		return &out, nil
+	}
+
+	count := func(node *AstNodeT) (*AstNodeT, error) {
+		if _, ok := node.Object.(*AstLogMatcherT); ok {
+			ran = append(ran, "count")
+		}
+		return node, nil
+	}
+
+	t.Cleanup(func() {
+		UnregisterPass("rename")
+		UnregisterPass("count")
+		UnregisterPass("fail")
+	})
+
+	if err := RegisterPass("", count); !errors.Is(err, ErrPassName) {
+		t.Errorf("Expected ErrPassName, got %v", err)
+	}
+
+	if err := RegisterPass("rename", rename, WithPassOrder(1)); err != nil {
+		t.Fatalf("Error registering pass: %v", err)
+	}
+	if err := RegisterPass("count", count); err != nil {
+		t.Fatalf("Error registering pass: %v", err)
+	}
+
+	if names := Passes(); !slices.Equal(names, []string{"count", "rename"}) {
+		t.Errorf("Passes() = %v, want [count rename]", names)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if !slices.Equal(ran, []string{"count", "count", "count", "rename", "rename", "rename"}) {
+		t.Errorf("passes ran %v, want count before rename on three matchers", ran)
+	}
+
+	var (
+		matchers int
+		descs    = make(map[*AstMetadataT]bool)
+	)
+
+	Walk(tree, func(node, parent *AstNodeT, order WalkOrderT) error {
+		switch o := node.Object.(type) {
+		case *AstSeqMatcherT:
+			for _, d := range append(o.Order, o.Negate...) {
+				descs[d] = true
+			}
+		case *AstSetMatcherT:
+			for _, d := range append(o.Match, o.Negate...) {
+				descs[d] = true
+			}
+		case *AstLogMatcherT:
+			if order == WalkPre {
+				matchers++
+				if o.Event.Source != "cre.tenant.k8s" {
+					t.Errorf("source = %s, want cre.tenant.k8s", o.Event.Source)
+				}
+			}
+		}
+		return nil
+	})
+
+	if matchers != 3 {
+		t.Errorf("found %d matchers, want 3", matchers)
+	}
+
+	// Replaced matchers are described by their parents
+	Walk(tree, func(node, parent *AstNodeT, order WalkOrderT) error {
+		if _, ok := node.Object.(*AstLogMatcherT); ok && order == WalkPre && !descs[&node.Metadata] {
+			t.Errorf("matcher %s is not described by its parent", node.Metadata.Address)
+		}
+		return nil
+	})
+
+	errDenied := errors.New("denied")
+	if err := RegisterPass("fail", func(node *AstNodeT) (*AstNodeT, error) {
+		if node.Metadata.Type == schema.NodeTypeLogSet {
+			return nil, errDenied
+		}
+		return node, nil
+	}, WithPassOrder(-1)); err != nil {
+		t.Fatalf("Error registering pass: %v", err)
+	}
+
+	ran = nil
+	_, err = Build(data)
+	if !errors.Is(err, errDenied) {
+		t.Fatalf("Expected %v, got %v", errDenied, err)
+	}
+
+	// Positioned at the first step of the sequence
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 13 || pos.Col != 11 {
+		t.Errorf("position = %+v, want 13:11", pos)
+	}
+
+	if len(ran) != 0 {
+		t.Errorf("passes ran %v after a failing pass", ran)
+	}
+}
+
+func TestAstValidations(t *testing.T) {
+
+	var (
+		rule  = []byte(testdata.TestFailSetWithoutWindow)
+		diags []pqerr.Diagnostic
+		diag  = WithDiagnostics(func(d pqerr.Diagnostic) { diags = append(diags, d) })
+	)
+
+	if _, err := Build(rule, diag); !errors.Is(err, ErrInvalidWindow) {
+		t.Fatalf("Expected ErrInvalidWindow, got %v", err)
+	}
+
+	if _, err := Build(rule, diag, WithValidationSeverity(ValidateLogSet, pqerr.SeverityWarning)); err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if len(diags) != 1 || diags[0].Code != ValidateLogSet || diags[0].Severity != pqerr.SeverityWarning || diags[0].Pos.Line != 11 {
+		t.Errorf("diagnostics = %+v, want one %s warning at line 11", diags, ValidateLogSet)
+	}
+
+	diags = nil
+	if _, err := Build(rule, diag, WithoutValidations(ValidateLogSet)); err != nil || len(diags) != 0 {
+		t.Errorf("WithoutValidations = %v and %d diagnostics, want neither", err, len(diags))
+	}
+
+	errTooMany := errors.New("too many conditions")
+	t.Cleanup(func() { UnregisterValidation("max-conditions") })
+
+	if err := RegisterValidation("", pqerr.SeverityError, nil); !errors.Is(err, ErrValidationName) {
+		t.Errorf("Expected ErrValidationName, got %v", err)
+	}
+
+	err := RegisterValidation("max-conditions", pqerr.SeverityError, func(in ValidateInputT) error {
+		if in.Matches > 1 {
+			return errTooMany
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error registering validation: %v", err)
+	}
+
+	_, err = Build(rule, WithoutValidations(ValidateLogSet))
+	if !errors.Is(err, errTooMany) {
+		t.Fatalf("Expected %v, got %v", errTooMany, err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 11 || pos.Col != 9 {
+		t.Errorf("position = %+v, want 11:9", pos)
+	}
+}
+
+func TestAstEstimateCost(t *testing.T) {
+
+	for _, name := range []string{"53-correlate-on.yaml", "61-mixed-sequence.yaml"} {
+		data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", name))
+		if err != nil {
+			t.Fatalf("Error reading rule: %v", err)
+		}
+		tree, err := Build(data)
+		if err != nil {
+			t.Fatalf("Error building rule: %v", err)
+		}
+		report := EstimateCost(tree)
+		if len(report.Rules) != 1 || report.Total <= 0 || report.Total != report.Rules[0].Cost {
+			t.Fatalf("%s: report = %+v, want one rule with a positive cost", name, report)
+		}
+	}
+
+	cheap, err := Build([]byte(testdata.TestSuccessRegisteredSource))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	// A regex costs more than a raw string, and jq more than either
+	var (
+		raw   = fieldsCost([]AstFieldT{{TermValue: match.TermT{Type: match.TermRaw, Value: "error"}}})
+		regex = fieldsCost([]AstFieldT{{TermValue: match.TermT{Type: match.TermRegex, Value: "(a|b)+c{2,5}"}}})
+		jq    = fieldsCost([]AstFieldT{{TermValue: match.TermT{Type: match.TermJqJson, Value: ".a"}}})
+	)
+
+	if !(raw < regex && regex < jq) {
+		t.Errorf("costs raw=%v regex=%v jq=%v, want increasing", raw, regex, jq)
+	}
+
+	if windowCost(time.Hour, 2) <= windowCost(time.Minute, 2) || windowCost(0, 2) != 0 {
+		t.Errorf("window cost does not grow with the window")
+	}
+
+	report := EstimateCost(cheap)
+	nodes := report.Rules[0].Nodes
+	for i := 1; i < len(nodes); i++ {
+		if nodes[i].Cost > nodes[i-1].Cost {
+			t.Errorf("nodes are not sorted by cost: %+v", nodes)
+		}
+	}
+}
+
+func TestAstEstimateSelectivity(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestFailSetWithoutWindow), WithoutValidations(ValidateLogSet))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	lines := []string{
+		"WARN Thread blocked for 2000 ms",
+		"INFO Connection reset by peer",
+		"WARN Thread blocked for 3000 ms",
+		"INFO request served",
+		"INFO request served",
+	}
+
+	report, err := EstimateSelectivity(tree, map[string][]string{"cre.log.kafka": lines})
+	if err != nil {
+		t.Fatalf("Error estimating selectivity: %v", err)
+	}
+
+	if len(report.Terms) != 2 {
+		t.Fatalf("Expected 2 terms, got %+v", report.Terms)
+	}
+
+	if first := report.Terms[0]; first.Term != "Thread blocked" || first.Hits != 2 || first.Rate != 0.4 || !first.Broad {
+		t.Errorf("first term = %+v, want Thread blocked at 0.4 and broad", first)
+	}
+
+	if broad := report.Broad(); len(broad) != 1 {
+		t.Errorf("Broad() = %+v, want one term", broad)
+	}
+
+	// A higher threshold flags neither; a sample of another source is not used
+	if report, err = EstimateSelectivity(tree, map[string][]string{"cre.log.kafka": lines}, WithBroadRate(0.5)); err != nil || len(report.Broad()) != 0 {
+		t.Errorf("WithBroadRate(0.5) = %+v, %v, want no broad terms", report, err)
+	}
+
+	if report, err = EstimateSelectivity(tree, map[string][]string{"cre.log.nginx": lines}); err != nil || len(report.Terms) != 0 {
+		t.Errorf("unrelated sample = %+v, %v, want no terms", report, err)
+	}
+}
+
+func TestAstWriteTree(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	tests := map[DrawFormatT][]string{
+		DrawDot:     {"digraph ast {", `window 10m0s`, `source cre.prequel.k8s\lmatch reason: OOMKilling`, "[style=dashed, label=\"negate\"]"},
+		DrawMermaid: {"flowchart TD", "window 10m0s<br/>", "-.->|negate|"},
+		DrawText:    {"depth_0: ", "scope=cluster"},
+	}
+
+	for format, want := range tests {
+		var buf bytes.Buffer
+		if err := WriteTree(tree, &buf, format); err != nil {
+			t.Fatalf("%s: error writing tree: %v", format, err)
+		}
+		for _, s := range want {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("%s output does not contain %q:\n%s", format, s, buf.String())
+			}
+		}
+	}
+
+	for path, format := range map[string]DrawFormatT{
+		"rule.dot": DrawDot, "rule.MMD": DrawMermaid, "rule.svg": DrawSVG, "rule.png": DrawPNG, "rule.txt": DrawText,
+	} {
+		if got := DrawFormat(path); got != format {
+			t.Errorf("DrawFormat(%s) = %s, want %s", path, got, format)
+		}
+	}
+
+	if _, err := exec.LookPath("dot"); err != nil {
+		if err = WriteTree(tree, io.Discard, DrawSVG); !errors.Is(err, ErrRenderer) {
+			t.Errorf("Expected ErrRenderer without graphviz, got %v", err)
+		}
+	}
+}
+
+func TestAstExplain(t *testing.T) {
+
+	tests := map[string]string{
+		"53-correlate-on.yaml": `X7cRm2TqLw9NvBk4Zd6Hpf: fires when reason "OOMKilling" in cre.prequel.k8s events, ` +
+			`followed within 10m by reason "BackOff" in cre.prequel.k8s events, unless reason "Killing" in cre.prequel.k8s events.`,
+		"09-sequence-negate-example.yaml": `eeJwJiWQa9TyH3qTYYSZM9: fires when a line matching /foo(.+)bar/ in cre.log.kafka events, ` +
+			`followed within 10s by "test", then a line matching /b(.+)az/, unless "already in use" occurs.`,
+		"60-metric-sequence.yaml": "Ht6WqN3zRb8KpX2sLf9Dmc: fires when the query `sum(rate(http_requests_total{code=~\"5..\"}[5m])) by (service) > 10` holds for 1m, " +
+			"followed within 10m by the query `node_memory_MemAvailable_bytes{job=\"node\"} < 1e9` holds for 2m.",
+	}
+
+	for name, want := range tests {
+
+		data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", name))
+		if err != nil {
+			t.Fatalf("Error reading rule: %v", err)
+		}
+
+		tree, err := Build(data)
+		if err != nil {
+			t.Fatalf("%s: error building rule: %v", name, err)
+		}
+
+		if got := strings.TrimSpace(Explain(tree)); got != want {
+			t.Errorf("%s:\n got: %s\nwant: %s", name, got, want)
+		}
+	}
+}
+
+// stopCtx reports no error for the first n calls to Err, then DeadlineExceeded
+type stopCtx struct {
+	context.Context
+	n int
+}
+
+func (c *stopCtx) Err() error {
+	if c.n--; c.n < 0 {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func TestAstBuildContext(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "42-shared-sub-sequence.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := BuildContext(context.Background(), data)
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+	if len(tree.Nodes) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(tree.Nodes))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = BuildContext(ctx, data); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, ok := pqerr.PosOf(err); ok {
+		t.Errorf("Expected no position before parsing, got %v", err)
+	}
+
+	// Stops before the second rule
+	_, err = BuildContext(&stopCtx{Context: context.Background(), n: 2}, data)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	var perr *pqerr.Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a positioned error, got %v", err)
+	}
+	if perr.RuleId != "4pXkQ2vRmT8sWzN6bHcJdL" || perr.Pos.Line != 20 {
+		t.Errorf("Expected error at the second rule, got %s at %d:%d", perr.RuleId, perr.Pos.Line, perr.Pos.Col)
+	}
+}
+
+func TestAstBuildLimits(t *testing.T) {
+
+	tests := []struct {
+		file string
+		opts []BuildOptT
+		err  error
+	}{
+		{file: "41-nested.yaml", opts: []BuildOptT{WithMaxDepth(2)}},
+		{file: "41-nested.yaml", opts: []BuildOptT{WithMaxDepth(1)}, err: ErrMaxDepth},
+		{file: "42-shared-sub-sequence.yaml", opts: []BuildOptT{WithMaxRules(2)}},
+		{file: "42-shared-sub-sequence.yaml", opts: []BuildOptT{WithMaxRules(1)}, err: ErrMaxRules},
+		{file: "53-correlate-on.yaml", opts: []BuildOptT{WithStrictSources("cre.prequel.k8s")}},
+		{file: "53-correlate-on.yaml", opts: []BuildOptT{WithStrictSources("cre.log.kafka")}, err: ErrSourceNotAllowed},
+		{file: "53-correlate-on.yaml", opts: []BuildOptT{WithStrictSources()}},
+		{file: "41-nested.yaml", opts: []BuildOptT{WithStrictSources()}, err: ErrSourceNotAllowed},
+		{file: "41-nested.yaml", opts: []BuildOptT{WithDisabledNodeTypes(schema.NodeTypeAgg)}},
+		{file: "41-nested.yaml", opts: []BuildOptT{WithDisabledNodeTypes(schema.NodeTypeLogSeq)}, err: ErrNodeTypeNotAllowed},
+	}
+
+	for i, test := range tests {
+
+		data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", test.file))
+		if err != nil {
+			t.Fatalf("Error reading rule: %v", err)
+		}
+
+		_, err = Build(data, test.opts...)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%d %s: expected %v, got %v", i, test.file, test.err, err)
+			continue
+		}
+		if test.err == nil {
+			continue
+		}
+		if _, ok := pqerr.PosOf(err); !ok {
+			t.Errorf("%d %s: expected a positioned error, got %v", i, test.file, err)
+		}
+	}
+}
+
+func TestAstRuleFilter(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessRuleFilter), WithRuleFilter(parser.RuleIdFilter("TestSuccessRuleFilter-rabbitmq")))
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	if len(tree.Nodes) != 1 || tree.Nodes[0].Metadata.RuleId != "Wb6NcR3tLy8KpZ2vHm5QxD" {
+		t.Errorf("Expected only the rabbitmq rule, got %d rules", len(tree.Nodes))
+	}
+}
+
+func TestAstBuildStats(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "41-nested.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+	if tree.Stats != nil {
+		t.Errorf("Expected no stats without WithStats")
+	}
+
+	if tree, err = Build(data, WithStats()); err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var (
+		stats = tree.Stats
+		nodes = map[string]int{"machine_seq": 2, "log_seq": 2, "log_set": 3}
+		terms = map[string]int{"raw": 17} // Ten from an expanded count
+	)
+
+	if stats.Rules != 1 {
+		t.Errorf("Expected 1 rule, got %d", stats.Rules)
+	}
+	if !reflect.DeepEqual(stats.Nodes, nodes) {
+		t.Errorf("Expected nodes %v, got %v", nodes, stats.Nodes)
+	}
+	if !reflect.DeepEqual(stats.Terms, terms) {
+		t.Errorf("Expected terms %v, got %v", terms, stats.Terms)
+	}
+	if stats.WindowSpan != 46*time.Second || stats.MaxWindow != 30*time.Second {
+		t.Errorf("Expected window span 46s and max 30s, got %s and %s", stats.WindowSpan, stats.MaxWindow)
+	}
+	for _, phase := range []string{PhaseParse, PhaseBuild, PhasePasses, PhaseScopes} {
+		if _, ok := stats.Phases[phase]; !ok {
+			t.Errorf("Expected a duration for phase %s", phase)
+		}
+	}
+}
+
+func TestAstVerifyDeterministic(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error listing rules: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading rule: %v", err)
+		}
+		if _, err = Build(data, WithParseOpts(parser.WithGenIds()), WithVerifyDeterministic()); errors.Is(err, ErrNondeterministic) {
+			t.Errorf("%s: %v", filepath.Base(file), err)
+		}
+	}
+
+	// A pass that changes the window of log sets on every build
+	var builds int
+	if err := RegisterPass("drift", func(node *AstNodeT) (*AstNodeT, error) {
+		if lm, ok := node.Object.(*AstLogMatcherT); ok && node.Metadata.Type == schema.NodeTypeLogSet {
+			builds++
+			lm.Window = time.Duration(builds) * time.Second
+		}
+		return node, nil
+	}); err != nil {
+		t.Fatalf("Error registering pass: %v", err)
+	}
+	t.Cleanup(func() { UnregisterPass("drift") })
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "01-set-single-example.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	if _, err = Build(data); err != nil {
+		t.Fatalf("Error building rule without verification: %v", err)
+	}
+
+	_, err = Build(data, WithVerifyDeterministic())
+	if !errors.Is(err, ErrNondeterministic) {
+		t.Fatalf("Expected ErrNondeterministic, got %v", err)
+	}
+	if _, ok := pqerr.PosOf(err); !ok {
+		t.Errorf("Expected the error to be positioned at the node, got %v", err)
+	}
+}
+
+func TestAstIntern(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "00-rules-document-example.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	var sources []string
+	Walk(tree, func(node, _ *AstNodeT, order WalkOrderT) error {
+		if lm, ok := node.Object.(*AstLogMatcherT); ok && order == WalkPre {
+			sources = append(sources, lm.Event.Source)
+		}
+		return nil
+	})
+
+	// The source of both rules is held once
+	if len(sources) != 2 || unsafe.StringData(sources[0]) != unsafe.StringData(sources[1]) {
+		t.Errorf("Expected one copy of the source of both rules, got %v", sources)
+	}
+}
+
+// benchBundle returns a bundle of n rules that share sources, fields and values,
+// as the rules of a large bundle do
+func TestAstParallel(t *testing.T) {
+
+	var (
+		data = benchBundle(64)
+		ids  = func(diags []pqerr.Diagnostic) []string {
+			var ids []string
+			for _, d := range diags {
+				ids = append(ids, d.RuleId)
+			}
+			return ids
+		}
+		seqDiags, parDiags []pqerr.Diagnostic
+	)
+
+	seq, err := Build(data, WithMinStepWindow(time.Hour), WithDiagnostics(func(d pqerr.Diagnostic) { seqDiags = append(seqDiags, d) }))
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	par, err := Build(data, WithParallelism(4), WithStats(), WithMinStepWindow(time.Hour), WithDiagnostics(func(d pqerr.Diagnostic) { parDiags = append(parDiags, d) }))
+	if err != nil {
+		t.Fatalf("Error building rules in parallel: %v", err)
+	}
+
+	seqJson, _ := json.Marshal(seq)
+	parJson, _ := json.Marshal(par)
+	if !bytes.Equal(seqJson, parJson) {
+		t.Errorf("Expected the same tree in parallel")
+	}
+
+	if len(seqDiags) != 64 || !slices.Equal(ids(seqDiags), ids(parDiags)) {
+		t.Errorf("Expected diagnostics in rule order, got %d then %d", len(seqDiags), len(parDiags))
+	}
+
+	if par.Stats.Rules != 64 || par.Stats.Nodes[schema.NodeTypeSeq.String()] != 64 {
+		t.Errorf("Expected stats of 64 rules, got %+v", par.Stats)
+	}
+
+	// The error of the first failing rule is returned, whichever fails first
+	rules := strings.SplitAfter(string(data), "generation: 1\n")
+	for _, i := range []int{50, 10, 40} {
+		rules[i+1] = strings.Replace(rules[i+1], "origin: true", "origin: false", 1)
+	}
+
+	for range 10 {
+		_, err = Build([]byte(strings.Join(rules, "")), WithParallelism(8))
+		if !errors.Is(err, ErrMissingOrigin) {
+			t.Fatalf("Expected ErrMissingOrigin, got %v", err)
+		}
+		var perr *pqerr.Error
+		if !errors.As(err, &perr) || perr.RuleId != parser.Hash(fmt.Sprint("id", 10)) {
+			t.Fatalf("Expected the error of rule 10, got %v", err)
+		}
+	}
+
+	// Each success example builds the same in parallel
+	files, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", file, err)
+		}
+		seq, err := Build(data)
+		if err != nil {
+			t.Fatalf("Error building rule %s: %v", file, err)
+		}
+		par, err := Build(data, WithParallelism(4))
+		if err != nil {
+			t.Fatalf("Error building rule %s in parallel: %v", file, err)
+		}
+		seqJson, _ := json.Marshal(seq)
+		parJson, _ := json.Marshal(par)
+		if !bytes.Equal(seqJson, parJson) {
+			t.Errorf("Expected the same tree in parallel for %s", file)
+		}
+	}
+}
+
+func TestAstStream(t *testing.T) {
+
+	data := benchBundle(32)
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	var nodes []*AstNodeT
+	for node, err := range Stream(bytes.NewReader(data)) {
+		if err != nil {
+			t.Fatalf("Error streaming rules: %v", err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	buildJson, _ := json.Marshal(tree.Nodes)
+	streamJson, _ := json.Marshal(nodes)
+	if !bytes.Equal(buildJson, streamJson) {
+		t.Errorf("Expected the rules of Build")
+	}
+
+	// Limits apply as the rules are read
+	var last error
+	n := 0
+	for _, err := range Stream(bytes.NewReader(data), WithMaxRules(10)) {
+		if err != nil {
+			last = err
+			break
+		}
+		n++
+	}
+	if n != 10 || !errors.Is(last, ErrMaxRules) {
+		t.Errorf("Expected 10 rules then ErrMaxRules, got %d then %v", n, last)
+	}
+}
+
+func TestAstCache(t *testing.T) {
+
+	var (
+		data  = benchBundle(20)
+		cache = NewCache()
+		diags []pqerr.Diagnostic
+		opts  = []BuildOptT{
+			WithCache(cache),
+			WithStats(),
+			WithMinStepWindow(time.Hour),
+			WithDiagnostics(func(d pqerr.Diagnostic) { diags = append(diags, d) }),
+		}
+	)
+
+	first, err := Build(data, opts...)
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	if s := first.Stats; s.CacheHits != 0 || s.CacheMisses != 20 || len(diags) != 20 {
+		t.Errorf("Expected 20 misses and diagnostics, got %d hits, %d misses, %d diagnostics", s.CacheHits, s.CacheMisses, len(diags))
+	}
+
+	if n := cache.Prune(); n != 0 {
+		t.Errorf("Expected no pruned rules, got %d", n)
+	}
+
+	// Change the window of one rule
+	rules := strings.SplitAfter(string(data), "generation: 1\n")
+	rules[6] = strings.Replace(rules[6], "window: 30s", "window: 40s", 1)
+	data = []byte(strings.Join(rules, ""))
+
+	diags = nil
+	second, err := Build(data, opts...)
+	if err != nil {
+		t.Fatalf("Error rebuilding rules: %v", err)
+	}
+
+	if s := second.Stats; s.CacheHits != 19 || s.CacheMisses != 1 || len(diags) != 20 {
+		t.Errorf("Expected 19 hits and 20 diagnostics, got %d hits, %d misses, %d diagnostics", s.CacheHits, s.CacheMisses, len(diags))
+	}
+
+	if stats := cache.Stats(); stats != (CacheStatsT{Hits: 19, Misses: 21, Entries: 21}) {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	if first.Nodes[0] != second.Nodes[0] || first.Nodes[5] == second.Nodes[5] {
+		t.Errorf("Expected only the changed rule to be built again")
+	}
+
+	fresh, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rules: %v", err)
+	}
+
+	freshJson, _ := json.Marshal(fresh)
+	cachedJson, err := cache.MarshalTree(second)
+	if err != nil {
+		t.Fatalf("Error marshaling tree: %v", err)
+	}
+	if !bytes.Equal(freshJson, cachedJson) {
+		t.Errorf("Expected the tree of an uncached build")
+	}
+
+	// The previous version of the changed rule was not used by the second build
+	if n := cache.Prune(); n != 1 {
+		t.Errorf("Expected 1 pruned rule, got %d", n)
+	}
+
+	third, err := Build(data, append(opts, WithParallelism(4))...)
+	if err != nil {
+		t.Fatalf("Error rebuilding rules in parallel: %v", err)
+	}
+	if third.Stats.CacheHits != 20 {
+		t.Errorf("Expected 20 hits in parallel, got %d", third.Stats.CacheHits)
+	}
+	if n := cache.Prune(); n != 0 {
+		t.Errorf("Expected no pruned rules, got %d", n)
+	}
+	if n := cache.Prune(); n != 20 {
+		t.Errorf("Expected 20 unused rules pruned, got %d", n)
+	}
+
+	// Annotations are not part of the rule hash, but are part of the tree
+	for _, runbook := range []string{"https://runbooks.example.com/disk-full", "https://runbooks.example.com/disk-full-v2"} {
+		data := strings.Replace(testdata.TestSuccessAnnotations, "https://runbooks.example.com/disk-full\n", runbook+"\n", 1)
+
+		tree, err := Build([]byte(data), WithCache(cache))
+		if err != nil {
+			t.Fatalf("Error building rules: %v", err)
+		}
+
+		field := tree.Nodes[0].Children[0].Object.(*AstLogMatcherT).Match[0]
+		if got := field.Annotations["runbook"]; got != runbook {
+			t.Errorf("runbook = %s, want %s", got, runbook)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the IR tests")
+
+func TestAstEmitIR(t *testing.T) {
+
+	names := []string{
+		"09-sequence-negate-example.yaml",
+		"29-negate-slide-anchor-1-window.yaml",
+		"44-any-of.yaml",
+		"48-quorum.yaml",
+		"62-traces.yaml",
+	}
+
+	for _, name := range names {
+
+		data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", name))
+		if err != nil {
+			t.Fatalf("Error reading rule: %v", err)
+		}
+
+		tree, err := Build(data)
+		if err != nil {
+			t.Fatalf("%s: error building rule: %v", name, err)
+		}
+
+		p, err := EmitIR(tree)
+		if err != nil {
+			t.Fatalf("%s: error emitting IR: %v", name, err)
+		}
+
+		enc, err := ir.Encode(p)
+		if err != nil {
+			t.Fatalf("%s: error encoding IR: %v", name, err)
+		}
+
+		var (
+			base    = filepath.Join("../testdata", "ir", strings.TrimSuffix(name, ".yaml"))
+			text    = p.Disassemble()
+			txtPath = base + ".txt"
+			binPath = base + ".pqir"
+		)
+
+		if *updateGolden {
+			if err = os.WriteFile(txtPath, []byte(text), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(binPath, enc, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		wantText, err := os.ReadFile(txtPath)
+		if err != nil {
+			t.Fatalf("Error reading golden file: %v", err)
+		}
+		if text != string(wantText) {
+			t.Errorf("%s: IR differs from %s:\n%s", name, txtPath, text)
+		}
+
+		wantBin, err := os.ReadFile(binPath)
+		if err != nil {
+			t.Fatalf("Error reading golden file: %v", err)
+		}
+		if !bytes.Equal(enc, wantBin) {
+			t.Errorf("%s: encoding differs from %s", name, binPath)
+		}
+
+		// The golden encoding decodes to the same program
+		dec, err := ir.Decode(wantBin)
+		if err != nil {
+			t.Fatalf("%s: error decoding IR: %v", name, err)
+		}
+		if !reflect.DeepEqual(dec, p) {
+			t.Errorf("%s: decoded program differs:\n%s", name, dec.Disassemble())
+		}
+	}
+
+	// Features the IR cannot express are refused at the node using them
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "53-correlate-on.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	_, err = EmitIR(tree)
+	if !errors.Is(err, ErrIRUnsupported) {
+		t.Fatalf("Expected ErrIRUnsupported, got %v", err)
+	}
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 9 {
+		t.Errorf("Expected error at line 9, got %v", err)
+	}
+}
+
+func benchBundle(n int) []byte {
+
+	var sb strings.Builder
+	sb.WriteString("rules:\n")
+
+	for i := range n {
+		fmt.Fprintf(&sb, `  - cre:
+      id: bench-%[1]d
+    metadata:
+      id: %[2]s
+      hash: %[3]s
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        correlations:
+          - hostname
+        order:
+          - set:
+              event:
+                source: cre.prequel.k8s
+                origin: true
+              match:
+                - field: reason
+                  value: OOMKilling
+          - set:
+              window: 10s
+              event:
+                source: cre.log.kafka
+              match:
+                - "Thread blocked"
+                - regex: "partition [0-9]+ offline"
+        negate:
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: reason
+                  value: Killing
+`, i, parser.Hash(fmt.Sprint("id", i)), parser.Hash(fmt.Sprint("hash", i)))
+	}
+
+	return []byte(sb.String())
+}
+
+func BenchmarkBuild(b *testing.B) {
+
+	data := benchBundle(1000)
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := Build(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildParallel(b *testing.B) {
+
+	data := benchBundle(1000)
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := Build(data, WithParallelism(runtime.GOMAXPROCS(0))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBuildRetained reports the heap held by the tree of a bundle, per rule
+func BenchmarkBuildRetained(b *testing.B) {
+
+	data := benchBundle(1000)
+
+	var before, after runtime.MemStats
+
+	for b.Loop() {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		tree, err := Build(data)
+		if err != nil {
+			b.Fatal(err)
 		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(tree.Nodes)), "retained-B/rule")
+		runtime.KeepAlive(tree)
 	}
 }
@@ -0,0 +1,171 @@
+package ast
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrValidationName = errors.New("validation name is empty")
+)
+
+// Names of the built-in validations
+const (
+	ValidateLogSet = "log-set-window"     // Sets with a window need two or more positive conditions, and vice versa
+	ValidateLogSeq = "log-seq-conditions" // Sequences need two or more positive conditions and a window
+)
+
+// ValidateInputT is a matcher node being built. Matches is the number of its
+// positive conditions, with counts expanded.
+type ValidateInputT struct {
+	Node    *parser.NodeT
+	Matches int
+}
+
+// ValidateFuncT checks a matcher node. Errors without a position are positioned
+// at the node.
+type ValidateFuncT func(in ValidateInputT) error
+
+type validationT struct {
+	name     string
+	severity pqerr.Severity
+	fn       ValidateFuncT
+}
+
+var (
+	validationsMu sync.RWMutex
+	validations   = []validationT{
+		{name: ValidateLogSet, severity: pqerr.SeverityError, fn: validateLogSet},
+		{name: ValidateLogSeq, severity: pqerr.SeverityError, fn: validateLogSeq},
+	}
+)
+
+// RegisterValidation adds a validation of matcher nodes. Validations run in the
+// order they were registered. A finding of error severity fails the build; others
+// are sent to WithDiagnostics with the name of the validation as their code.
+// Registering a name again replaces it in place.
+func RegisterValidation(name string, severity pqerr.Severity, fn ValidateFuncT) error {
+
+	if name == "" {
+		return ErrValidationName
+	}
+
+	validationsMu.Lock()
+	defer validationsMu.Unlock()
+
+	v := validationT{name: name, severity: severity, fn: fn}
+
+	if i := slices.IndexFunc(validations, func(v validationT) bool { return v.name == name }); i >= 0 {
+		validations[i] = v
+	} else {
+		validations = append(validations, v)
+	}
+
+	return nil
+}
+
+// UnregisterValidation removes a validation, and reports whether it was registered
+func UnregisterValidation(name string) bool {
+
+	validationsMu.Lock()
+	defer validationsMu.Unlock()
+
+	n := len(validations)
+	validations = slices.DeleteFunc(validations, func(v validationT) bool { return v.name == name })
+
+	return len(validations) < n
+}
+
+// WithoutValidations skips the named validations
+func WithoutValidations(names ...string) BuildOptT {
+	return func(o *buildOptsT) {
+		o.skipValidations = append(o.skipValidations, names...)
+	}
+}
+
+// WithValidationSeverity changes the severity of a validation for the build, e.g.
+// to report a built-in validation as a warning instead of failing the build
+func WithValidationSeverity(name string, severity pqerr.Severity) BuildOptT {
+	return func(o *buildOptsT) {
+		if o.validationSeverity == nil {
+			o.validationSeverity = make(map[string]pqerr.Severity)
+		}
+		o.validationSeverity[name] = severity
+	}
+}
+
+// validate runs the validations of a matcher node and returns the first finding
+// of error severity
+func (b *builderT) validate(n *parser.NodeT, matches int) error {
+
+	validationsMu.RLock()
+	list := slices.Clone(validations)
+	validationsMu.RUnlock()
+
+	var o = b.opts
+	if o == nil {
+		o = &buildOptsT{}
+	}
+
+	for _, v := range list {
+
+		if slices.Contains(o.skipValidations, v.name) {
+			continue
+		}
+
+		err := v.fn(ValidateInputT{Node: n, Matches: matches})
+		if err == nil {
+			continue
+		}
+
+		if _, ok := pqerr.PosOf(err); !ok {
+			err = n.WrapError(err)
+		}
+
+		severity := v.severity
+		if s, ok := o.validationSeverity[v.name]; ok {
+			severity = s
+		}
+
+		if severity == pqerr.SeverityError {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Str("validation", v.name).
+			Msg("Validation finding")
+
+		if o.diagnostics != nil {
+			pos, _ := pqerr.PosOf(err)
+			o.diagnostics(pqerr.Diagnostic{
+				Pos:      pos,
+				RuleId:   n.Metadata.RuleId,
+				RuleHash: n.Metadata.RuleHash,
+				CreId:    n.Metadata.CreId,
+				Code:     v.name,
+				Msg:      findingMsg(err),
+				Severity: severity,
+			})
+		}
+	}
+
+	return nil
+}
+
+// findingMsg returns the text of a finding without its position
+func findingMsg(err error) string {
+	var perr *pqerr.Error
+	switch {
+	case !errors.As(err, &perr) || perr.Err == nil:
+		return err.Error()
+	case perr.Msg != "":
+		return perr.Msg + ": " + perr.Err.Error()
+	}
+	return perr.Err.Error()
+}
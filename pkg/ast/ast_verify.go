@@ -0,0 +1,86 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrNondeterministic = errors.New("build is not deterministic")
+)
+
+// WithVerifyDeterministic builds the data a second time and fails with
+// ErrNondeterministic unless both trees serialize to the same JSON, so that
+// bundle artifacts can be reproduced and signed. The error is positioned at the
+// first node that differs, when the difference is in a node.
+func WithVerifyDeterministic() BuildOptT {
+	return func(o *buildOptsT) {
+		o.verifyDeterministic = true
+	}
+}
+
+// verifyDeterministic rebuilds the data, without the cache, and compares the
+// serialized trees
+func verifyDeterministic(tree *AstT, data []byte, opts []BuildOptT) error {
+
+	opts = append(slices.Clone(opts), func(o *buildOptsT) {
+		o.verifyDeterministic = false
+		o.cache = nil
+	})
+
+	again, _, err := BuildWithTree(data, opts...)
+	if err != nil {
+		return fmt.Errorf("%w: second build failed: %w", ErrNondeterministic, err)
+	}
+
+	first, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+
+	second, err := json.Marshal(again)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(first, second) {
+		return nil
+	}
+
+	log.Error().
+		Int("first", len(first)).
+		Int("second", len(second)).
+		Msg("Serialized trees differ")
+
+	if diffs := Diff(tree, again); len(diffs) > 0 {
+		d := diffs[0]
+		node := d.Old
+		if node == nil {
+			node = d.New
+		}
+		var ruleHash string
+		if node.Metadata.Address != nil {
+			ruleHash = node.Metadata.Address.RuleHash
+		}
+		return pqerr.Wrap(
+			node.Metadata.Pos,
+			node.Metadata.RuleId,
+			ruleHash,
+			"",
+			fmt.Errorf("%w: node %s %s", ErrNondeterministic, d.Address, d.Kind),
+		)
+	}
+
+	var i int
+	for i < min(len(first), len(second)) && first[i] == second[i] {
+		i++
+	}
+
+	return fmt.Errorf("%w: output differs at byte %d", ErrNondeterministic, i)
+}
@@ -0,0 +1,72 @@
+package ast
+
+import (
+	"errors"
+)
+
+var (
+	// SkipChildren is returned by a WalkFuncT before the children of a node to skip
+	// them and the visit after them
+	SkipChildren = errors.New("skip children")
+
+	// SkipAll is returned by a WalkFuncT to stop the walk without an error
+	SkipAll = errors.New("skip all")
+)
+
+type WalkOrderT int
+
+const (
+	WalkPre  WalkOrderT = iota // Before the children of the node
+	WalkPost                   // After the children of the node
+)
+
+// WalkFuncT visits a node before and after its children. The parent is nil for
+// the root of a rule. Any error other than SkipChildren and SkipAll stops the walk
+// and is returned by Walk.
+type WalkFuncT func(node, parent *AstNodeT, order WalkOrderT) error
+
+// Walk visits the nodes of every rule of the tree in depth-first order
+func Walk(tree *AstT, fn WalkFuncT) error {
+
+	for _, node := range tree.Nodes {
+		if err := walk(node, nil, fn); err != nil {
+			if err == SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WalkNode visits a node and its descendants in depth-first order
+func WalkNode(node *AstNodeT, fn WalkFuncT) error {
+	if err := walk(node, nil, fn); err != nil && err != SkipAll {
+		return err
+	}
+	return nil
+}
+
+func walk(node, parent *AstNodeT, fn WalkFuncT) error {
+
+	switch err := fn(node, parent, WalkPre); err {
+	case nil:
+	case SkipChildren:
+		return nil
+	default:
+		return err
+	}
+
+	for _, child := range node.Children {
+		if err := walk(child, node, fn); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(node, parent, WalkPost); err != SkipChildren {
+		return err
+	}
+
+	return nil
+}
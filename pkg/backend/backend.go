@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrTargetName    = errors.New("target name is empty")
+	ErrUnknownTarget = errors.New("unknown target")
+)
+
+// Target lowers the nodes of an AST to the artifacts of a runtime, such as the
+// matchers of prequel-logmatch, the queries of a SQL engine, or the jobs of a
+// streaming platform. TranslateNode is called for each node after its children,
+// and returns a nil artifact for a node the runtime has no use for, or an error
+// for a node the runtime cannot evaluate, which fails the translation.
+type Target interface {
+	TranslateNode(node *ast.AstNodeT) (any, error)
+}
+
+// ArtifactT is the artifact of a node of the tree
+type ArtifactT struct {
+	RuleId   string               `json:"rule_id"`
+	Address  *ast.AstNodeAddressT `json:"address"`
+	Scope    string               `json:"scope"`
+	Artifact any                  `json:"artifact"`
+}
+
+var (
+	targetsMu sync.RWMutex
+	targets   = make(map[string]Target)
+)
+
+// Register adds a target under a name. Registering a name again replaces it, so
+// that an embedder can replace a built-in target with one bound to its runtime.
+func Register(name string, target Target) error {
+
+	if name == "" {
+		return ErrTargetName
+	}
+
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+
+	targets[name] = target
+
+	return nil
+}
+
+// Unregister removes a target, and reports whether it was registered
+func Unregister(name string) bool {
+
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+
+	_, ok := targets[name]
+	delete(targets, name)
+
+	return ok
+}
+
+// Lookup returns the target registered under a name
+func Lookup(name string) (Target, bool) {
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+	t, ok := targets[name]
+	return t, ok
+}
+
+// Targets returns the names of the registered targets, sorted
+func Targets() []string {
+
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Translate lowers every node of the tree with the target registered under name,
+// and returns the artifacts in the order the nodes were translated
+func Translate(tree *ast.AstT, name string) ([]ArtifactT, error) {
+
+	target, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTarget, name)
+	}
+
+	return TranslateTree(tree, target)
+}
+
+// TranslateTree lowers every node of the tree with a target
+func TranslateTree(tree *ast.AstT, target Target) ([]ArtifactT, error) {
+
+	var artifacts []ArtifactT
+
+	err := ast.Walk(tree, func(node, _ *ast.AstNodeT, order ast.WalkOrderT) error {
+		if order != ast.WalkPost {
+			return nil
+		}
+
+		artifact, err := target.TranslateNode(node)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("rule_id", node.Metadata.RuleId).
+				Str("address", node.Metadata.Address.String()).
+				Msg("Failed to translate node")
+			return err
+		}
+
+		if artifact != nil {
+			artifacts = append(artifacts, ArtifactT{
+				RuleId:   node.Metadata.RuleId,
+				Address:  node.Metadata.Address,
+				Scope:    node.Metadata.Scope,
+				Artifact: artifact,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+)
+
+// leafTarget translates the leaves of a tree to their types, and has no use for
+// the machines that join them
+type leafTarget struct{}
+
+func (leafTarget) TranslateNode(node *ast.AstNodeT) (any, error) {
+	if len(node.Children) > 0 {
+		return nil, nil
+	}
+	return node.Metadata.Type, nil
+}
+
+func buildExample(t *testing.T, name string) *ast.AstT {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", name))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := ast.Build(data)
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	return tree
+}
+
+func TestRegistry(t *testing.T) {
+
+	if err := Register("", leafTarget{}); !errors.Is(err, ErrTargetName) {
+		t.Errorf("Expected ErrTargetName, got %v", err)
+	}
+
+	if err := Register("leaf", leafTarget{}); err != nil {
+		t.Fatalf("Error registering target: %v", err)
+	}
+
+	if names := Targets(); !slices.Equal(names, []string{"leaf", TargetLogmatch}) {
+		t.Errorf("targets = %v, want [leaf %s]", names, TargetLogmatch)
+	}
+
+	if target, ok := Lookup("leaf"); !ok || target != (leafTarget{}) {
+		t.Errorf("Expected the leaf target, got %v %v", target, ok)
+	}
+
+	if !Unregister("leaf") {
+		t.Errorf("Expected the leaf target to be unregistered")
+	}
+
+	if Unregister("leaf") {
+		t.Errorf("Expected the leaf target to be gone")
+	}
+
+	if _, ok := Lookup("leaf"); ok {
+		t.Errorf("Expected no leaf target after Unregister")
+	}
+}
+
+func TestTranslate(t *testing.T) {
+
+	var tree = buildExample(t, "41-nested.yaml")
+
+	if _, err := Translate(tree, "nowhere"); !errors.Is(err, ErrUnknownTarget) {
+		t.Errorf("Expected ErrUnknownTarget, got %v", err)
+	}
+
+	// Nodes without an artifact are left out
+	artifacts, err := TranslateTree(tree, leafTarget{})
+	if err != nil {
+		t.Fatalf("Error translating tree: %v", err)
+	}
+
+	if len(artifacts) != 5 {
+		t.Errorf("Expected 5 leaf artifacts, got %d", len(artifacts))
+	}
+
+	for _, a := range artifacts {
+		if a.RuleId != "eeJwJiWQa9TyH3qTYYSZM9" || a.Address == nil {
+			t.Errorf("artifact %+v has no rule or address", a)
+		}
+	}
+
+	// The logmatch target lowers every node, children before their parents
+	artifacts, err = Translate(tree, TargetLogmatch)
+	if err != nil {
+		t.Fatalf("Error translating tree: %v", err)
+	}
+
+	if len(artifacts) != 7 {
+		t.Fatalf("Expected 7 artifacts, got %d", len(artifacts))
+	}
+
+	seen := make(map[string]bool)
+
+	for _, a := range artifacts {
+		obj, ok := a.Artifact.(*compiler.ObjT)
+		if !ok {
+			t.Fatalf("artifact is %T, want *compiler.ObjT", a.Artifact)
+		}
+		if obj.Address != a.Address || obj.Scope != a.Scope {
+			t.Errorf("object %s/%s, want %s/%s", obj.Address, obj.Scope, a.Address, a.Scope)
+		}
+		if seen[obj.Address.String()] {
+			t.Errorf("node %s translated twice", obj.Address)
+		}
+		seen[obj.Address.String()] = true
+	}
+
+	last := artifacts[len(artifacts)-1].Artifact.(*compiler.ObjT)
+	if last.Address != tree.Nodes[0].Metadata.Address || last.AbstractType != schema.NodeTypeSeq {
+		t.Errorf("Expected the root machine last, got %s %s", last.AbstractType, last.Address)
+	}
+}
+
+func TestTranslateUnsupported(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		err  error
+	}{
+		{"60-metric-sequence.yaml", compiler.ErrUnsupportedNodeType},
+		{"63-k8s-resource.yaml", compiler.ErrUnsupportedNodeType},
+		{"53-correlate-on.yaml", compiler.ErrUnsupportedFeature},
+	}
+
+	for _, test := range tests {
+
+		_, err := Translate(buildExample(t, test.name), TargetLogmatch)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			continue
+		}
+
+		if pos, ok := pqerr.PosOf(err); !ok || pos.Line <= 1 {
+			t.Errorf("%s: expected the position of the node, got %+v", test.name, pos)
+		}
+	}
+}
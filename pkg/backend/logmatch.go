@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+)
+
+// TargetLogmatch is the name of the built-in prequel-logmatch target
+const TargetLogmatch = "logmatch"
+
+func init() {
+	Register(TargetLogmatch, NewLogmatchTarget(compiler.NewNoopRuntime()))
+}
+
+// LogmatchTarget is the reference target. It lowers log and trace matchers to
+// prequel-logmatch matchers and machines to assert objects with
+// compiler.CompileNode, as compiler.CompileRules does, each as a *compiler.ObjT
+// with the callback of the runtime. Every node of a rule is needed to detect it,
+// so nodes the runtime cannot evaluate, such as promql or k8s resource nodes, and
+// features it cannot express fail the translation with the positioned error of
+// compiler.CompileNode rather than being left out. The built-in target has no-op
+// callbacks; register one with the runtime of the embedder under TargetLogmatch
+// to replace it.
+type LogmatchTarget struct {
+	runtime compiler.RuntimeI
+}
+
+func NewLogmatchTarget(runtime compiler.RuntimeI) *LogmatchTarget {
+	return &LogmatchTarget{
+		runtime: runtime,
+	}
+}
+
+func (t *LogmatchTarget) TranslateNode(node *ast.AstNodeT) (any, error) {
+
+	objs, err := compiler.CompileNode(t.runtime, node)
+	if err != nil {
+		return nil, err
+	}
+
+	return objs[0], nil
+}
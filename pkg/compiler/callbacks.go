@@ -22,6 +22,7 @@ type MatchParamsT struct {
 	Address       *ast.AstNodeAddressT
 	ParentAddress *ast.AstNodeAddressT
 	Origin        bool
+	Primary       int // Index of the term of the primary condition, or -1; only the first term of a counted condition
 }
 
 type AssertParamsT struct {
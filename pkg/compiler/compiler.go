@@ -3,9 +3,11 @@ package compiler
 import (
 	"errors"
 	"sort"
+	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/ast"
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/rs/zerolog/log"
 )
@@ -14,10 +16,12 @@ var (
 	ErrUnsupportedMatcher = errors.New("unsupported matcher")
 	ErrUnsupportedScope   = errors.New("unsupported scope")
 	ErrInvalidMatcher     = errors.New("invalid matcher")
+	ErrUnsupportedFeature = errors.New("feature not supported by the logmatch runtime")
 )
 
 var (
 	defaultPlugin  = NewDefaultPlugin()
+	machinePlugin  = NewMachinePlugin()
 	defaultRuntime = &NoopRuntime{}
 )
 
@@ -42,6 +46,7 @@ type ObjT struct {
 	AbstractType  schema.NodeTypeT     `json:"abstract_type"`
 	ObjectType    ObjTypeT             `json:"object_type"`
 	Event         ast.AstEventT        `json:"event"`
+	ScopeBridge   *ast.AstScopeBridgeT `json:"scope_bridge,omitempty"` // Scopes whose matches the object joins, if more than its own
 	Object        any                  `json:"object"`
 	Cb            CallbackT            `json:"cb"`
 }
@@ -50,6 +55,9 @@ type compilerOptsT struct {
 	debugTree string
 	runtime   RuntimeI
 	plugins   map[string]PluginI
+	buildOpts []ast.BuildOptT
+
+	watchInterval time.Duration
 }
 
 type CompilerOptT func(*compilerOptsT)
@@ -75,6 +83,13 @@ func WithPlugin(scope string, plugin PluginI) CompilerOptT {
 	}
 }
 
+// WithBuildOpts passes options (e.g. lint diagnostics) through to the AST build
+func WithBuildOpts(opts ...ast.BuildOptT) CompilerOptT {
+	return func(o *compilerOptsT) {
+		o.buildOpts = append(o.buildOpts, opts...)
+	}
+}
+
 func parseOpts(opts []CompilerOptT) compilerOptsT {
 	o := compilerOptsT{
 		plugins: map[string]PluginI{schema.ScopeDefault: defaultPlugin},
@@ -86,21 +101,13 @@ func parseOpts(opts []CompilerOptT) compilerOptsT {
 	return o
 }
 
-func traverseTree(node *ast.AstNodeT, scope string, callback func(node *ast.AstNodeT) error) error {
-	for _, child := range node.Children {
-		if err := traverseTree(child, scope, callback); err != nil {
-			return err
-		}
-	}
-	return callback(node)
-}
-
 func NewObj(node *ast.AstNodeT, objType ObjTypeT) *ObjT {
 	return &ObjT{
 		RuleId:        node.Metadata.RuleId,
 		Address:       node.Metadata.Address,
 		ParentAddress: node.Metadata.ParentAddress,
 		Scope:         node.Metadata.Scope,
+		ScopeBridge:   node.Metadata.ScopeBridge,
 		AbstractType:  node.Metadata.Type,
 		ObjectType:    objType,
 	}
@@ -127,7 +134,7 @@ func CompileTree(pt *parser.TreeT, scope string, opts ...CompilerOptT) (ObjsT, e
 		tree *ast.AstT
 	)
 
-	if tree, err = ast.BuildTree(pt); err != nil {
+	if tree, err = ast.BuildTree(pt, o.buildOpts...); err != nil {
 		return nil, err
 	}
 
@@ -173,12 +180,8 @@ func compile(o compilerOptsT, tree *ast.AstT, scope string) (ObjsT, error) {
 			return ErrUnsupportedScope
 		}
 
-		objs, err := plugin.Compile(o.runtime, node)
+		objs, err := compileNode(o, plugin, node)
 		if err != nil {
-			log.Error().
-				Err(err).
-				Str("scope", scope).
-				Msg("Failed to compile")
 			return err
 		}
 
@@ -187,24 +190,47 @@ func compile(o compilerOptsT, tree *ast.AstT, scope string) (ObjsT, error) {
 		return nil
 	}
 
-	for _, node := range tree.Nodes {
-		if err = traverseTree(node, scope, compile); err != nil {
-			return nil, err
+	err = ast.Walk(tree, func(node, _ *ast.AstNodeT, order ast.WalkOrderT) error {
+		if order != ast.WalkPost {
+			return nil
 		}
+		return compile(node)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	sortObjs(outObjs, schema.NodeTypeSeq)
-	sortObjs(outObjs, schema.NodeTypeSet)
+	sortCompiled(outObjs)
+
+	return outObjs, nil
+}
 
-	for _, obj := range outObjs {
+func compileNode(o compilerOptsT, plugin PluginI, node *ast.AstNodeT) (ObjsT, error) {
+
+	objs, err := plugin.Compile(o.runtime, node)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("scope", node.Metadata.Scope).
+			Msg("Failed to compile")
+		return nil, err
+	}
+
+	return objs, nil
+}
+
+func sortCompiled(objs ObjsT) {
+
+	sortObjs(objs, schema.NodeTypeSeq)
+	sortObjs(objs, schema.NodeTypeSet)
+
+	for _, obj := range objs {
 		log.Debug().
 			Str("abstract_type", obj.AbstractType.String()).
 			Str("abstract_address", obj.Address.String()).
 			Str("object_type", obj.ObjectType.String()).
 			Msg("Compiled object")
 	}
-
-	return outObjs, nil
 }
 
 func Compile(data []byte, scope string, opts ...CompilerOptT) (ObjsT, error) {
@@ -214,7 +240,7 @@ func Compile(data []byte, scope string, opts ...CompilerOptT) (ObjsT, error) {
 		err  error
 	)
 
-	if tree, err = ast.Build(data); err != nil {
+	if tree, err = ast.Build(data, o.buildOpts...); err != nil {
 		return nil, err
 	}
 
@@ -226,3 +252,146 @@ func Compile(data []byte, scope string, opts ...CompilerOptT) (ObjsT, error) {
 
 	return compile(o, tree, scope)
 }
+
+// RuleObjsT is the compiled objects of a rule, by scope
+type RuleObjsT struct {
+	RuleId string           `json:"rule_id"`
+	Scopes map[string]ObjsT `json:"scopes"`
+}
+
+// CompileRules builds the rules of data and compiles every node of each rule, of
+// any scope, into its runtime objects: log and trace matchers become the
+// prequel-logmatch matchers that the runtime feeds events to. A node is compiled
+// by the plugin of its scope. In a scope without a plugin, log and trace matchers
+// are compiled by the default plugin and machines by the MachinePlugin; other
+// nodes, such as promql or k8s resource nodes, need a plugin from WithPlugin and
+// fail with ErrUnsupportedNodeType without one. The built-in plugins refuse nodes
+// using features the runtime cannot express, such as count ranges, repeats, or
+// join keys, with ErrUnsupportedFeature. Errors are positioned at the node. Rules
+// are returned in the order of the tree, with the objects of each scope ordered as
+// Compile orders them.
+func CompileRules(data []byte, opts ...CompilerOptT) ([]RuleObjsT, error) {
+	var (
+		tree *ast.AstT
+		o    = parseOpts(opts)
+		err  error
+	)
+
+	if tree, err = ast.Build(data, o.buildOpts...); err != nil {
+		return nil, err
+	}
+
+	if o.debugTree != "" {
+		if err = ast.DrawTree(tree, o.debugTree); err != nil {
+			return nil, err
+		}
+	}
+
+	return compileRules(o, tree)
+}
+
+func compileRules(o compilerOptsT, tree *ast.AstT) ([]RuleObjsT, error) {
+
+	var rules = make([]RuleObjsT, 0, len(tree.Nodes))
+
+	for _, root := range tree.Nodes {
+
+		var rule = RuleObjsT{
+			RuleId: root.Metadata.RuleId,
+			Scopes: make(map[string]ObjsT),
+		}
+
+		err := ast.Walk(&ast.AstT{Nodes: []*ast.AstNodeT{root}}, func(node, _ *ast.AstNodeT, order ast.WalkOrderT) error {
+			if order != ast.WalkPost {
+				return nil
+			}
+
+			var (
+				scope = node.Metadata.Scope
+				objs  ObjsT
+				err   error
+			)
+
+			if plugin, ok := o.plugins[scope]; ok {
+				objs, err = compileNode(o, plugin, node)
+			} else {
+				objs, err = CompileNode(o.runtime, node)
+			}
+			if err != nil {
+				return err
+			}
+
+			rule.Scopes[scope] = append(rule.Scopes[scope], objs...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, objs := range rule.Scopes {
+			sortCompiled(objs)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// CompileNode compiles a node with the built-in plugin for its type: log and trace
+// matchers with the default plugin, and machines with the MachinePlugin. Other
+// nodes fail with ErrUnsupportedNodeType, positioned at the node.
+func CompileNode(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+
+	plugin, ok := fallbackPlugin(node)
+	if !ok {
+		log.Error().Str("scope", node.Metadata.Scope).Str("rule_id", node.Metadata.RuleId).Msg("No plugin found")
+		return nil, nodeError(node, ErrUnsupportedNodeType, "type="+node.Metadata.Type.String()+" scope="+node.Metadata.Scope)
+	}
+
+	return plugin.Compile(runtime, node)
+}
+
+// fallbackPlugin returns the built-in plugin for a node in a scope without one
+func fallbackPlugin(node *ast.AstNodeT) (PluginI, bool) {
+	switch node.Metadata.Type {
+	case schema.NodeTypeLogSeq, schema.NodeTypeLogSet, schema.NodeTypeTraceSeq, schema.NodeTypeTraceSet:
+		return defaultPlugin, true
+	}
+	if isMachineNode(node) {
+		return machinePlugin, true
+	}
+	return nil, false
+}
+
+// Features of the AST, as ast.Features names them, that the built-in plugins
+// compile and the runtime evaluates
+var runtimeFeatures = map[string]bool{
+	"correlations": true,
+}
+
+// checkFeatures refuses a node using a feature the runtime cannot express, so that
+// it is not compiled into a matcher that silently ignores it
+func checkFeatures(node *ast.AstNodeT) error {
+	for _, feature := range ast.Features(node) {
+		if !runtimeFeatures[feature] {
+			log.Error().Str("feature", feature).Str("rule_id", node.Metadata.RuleId).Msg("Unsupported feature")
+			return nodeError(node, ErrUnsupportedFeature, feature)
+		}
+	}
+	return nil
+}
+
+func nodeError(node *ast.AstNodeT, err error, reason string) error {
+
+	var (
+		md   = node.Metadata
+		hash string
+	)
+
+	if md.Address != nil {
+		hash = md.Address.RuleHash
+	}
+
+	return pqerr.Wrap(md.Pos, md.RuleId, hash, "", err, reason)
+}
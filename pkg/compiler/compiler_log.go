@@ -16,7 +16,9 @@ var (
 	ErrNoFields             = errors.New("no fields")
 )
 
-func toLogResets(terms []ast.AstFieldT) []match.ResetT {
+// toLogResets converts negate fields to runtime resets. Anchors index the match
+// fields of the AST and are moved to the first runtime term of their field.
+func toLogResets(terms []ast.AstFieldT, offsets []int) []match.ResetT {
 	resets := make([]match.ResetT, 0, len(terms))
 	for _, term := range terms {
 
@@ -31,7 +33,7 @@ func toLogResets(terms []ast.AstFieldT) []match.ResetT {
 			Term:     term.TermValue,
 			Window:   term.NegateOpts.Window.Nanoseconds(),
 			Slide:    term.NegateOpts.Slide.Nanoseconds(),
-			Anchor:   uint8(term.NegateOpts.Anchor),
+			Anchor:   uint8(offsets[min(int(term.NegateOpts.Anchor), len(offsets)-1)]),
 			Absolute: term.NegateOpts.Absolute,
 		})
 
@@ -40,12 +42,34 @@ func toLogResets(terms []ast.AstFieldT) []match.ResetT {
 	return resets
 }
 
-func toLogTerms(fields []ast.AstFieldT) []match.TermT {
-	terms := make([]match.TermT, 0, len(fields))
+// toLogTerms converts match fields to runtime terms, repeating a field with a count
+// once per occurrence. offsets[i] is the index of the first term of field i, and
+// the last offset is the number of terms.
+func toLogTerms(fields []ast.AstFieldT) ([]match.TermT, []int) {
+	var (
+		terms   = make([]match.TermT, 0, len(fields))
+		offsets = make([]int, 0, len(fields)+1)
+	)
+	for _, field := range fields {
+		offsets = append(offsets, len(terms))
+		for range field.Occurrences() {
+			terms = append(terms, field.TermValue)
+		}
+	}
+	return terms, append(offsets, len(terms))
+}
+
+// primaryTerm returns the index of the runtime term of the primary field, or -1.
+// A counted field is repeated once per occurrence; only its first term is primary.
+func primaryTerm(fields []ast.AstFieldT) int {
+	var idx int
 	for _, field := range fields {
-		terms = append(terms, field.TermValue)
+		if field.Primary {
+			return idx
+		}
+		idx += field.Occurrences()
 	}
-	return terms
+	return -1
 }
 
 func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
@@ -61,6 +85,10 @@ func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
 		return nil, ErrInvalidMatcher
 	}
 
+	if err = checkFeatures(node); err != nil {
+		return nil, err
+	}
+
 	obj.Event.Origin = lm.Event.Origin
 	obj.Event.Source = lm.Event.Source
 
@@ -68,17 +96,18 @@ func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
 		Address:       node.Metadata.Address,
 		ParentAddress: node.Metadata.ParentAddress,
 		Origin:        lm.Event.Origin,
+		Primary:       primaryTerm(lm.Match),
 	}
 
 	obj.Cb = runtime.NewCbMatch(params)
 
 	switch node.Metadata.Type {
-	case schema.NodeTypeLogSeq:
+	case schema.NodeTypeLogSeq, schema.NodeTypeTraceSeq:
 		if obj.Object, err = makeLogSeqObjects(lm, node.Metadata.NegIdx); err != nil {
 			return nil, err
 		}
 
-	case schema.NodeTypeLogSet:
+	case schema.NodeTypeLogSet, schema.NodeTypeTraceSet:
 
 		if obj.Object, err = makeLogSetObjects(lm, node.Metadata.NegIdx); err != nil {
 			return nil, err
@@ -95,23 +124,24 @@ func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
 func makeLogSeqObjects(lm *ast.AstLogMatcherT, negIdx int) (any, error) {
 
 	var (
-		obj any
-		err error
+		terms, offsets = toLogTerms(lm.Match)
+		obj            any
+		err            error
 	)
 
 	if negIdx > 0 {
-		log.Trace().Any("terms", toLogTerms(lm.Match)).Msg("Creating inverse match sequence")
-		if obj, err = match.NewInverseSeq(lm.Window.Nanoseconds(), toLogTerms(lm.Match), toLogResets(lm.Negate)); err != nil {
+		log.Trace().Any("terms", terms).Msg("Creating inverse match sequence")
+		if obj, err = match.NewInverseSeq(lm.Window.Nanoseconds(), terms, toLogResets(lm.Negate, offsets)); err != nil {
 			log.Error().Err(err).Msg("Failed to create inverse match sequence")
 			return nil, err
 		}
 	} else {
-		if len(lm.Match) == 1 {
+		if len(terms) == 1 {
 			log.Error().Msg("Sequence with single match (use set instead)")
 			return nil, ErrSequenceSingleMatch
 		} else {
-			log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating match sequence")
-			if obj, err = match.NewMatchSeq(lm.Window.Nanoseconds(), toLogTerms(lm.Match)...); err != nil {
+			log.Debug().Any("terms", terms).Msg("Creating match sequence")
+			if obj, err = match.NewMatchSeq(lm.Window.Nanoseconds(), terms...); err != nil {
 				log.Error().Err(err).Msg("Failed to create match sequence")
 				return nil, err
 			}
@@ -124,26 +154,27 @@ func makeLogSeqObjects(lm *ast.AstLogMatcherT, negIdx int) (any, error) {
 func makeLogSetObjects(lm *ast.AstLogMatcherT, negIdx int) (any, error) {
 
 	var (
-		err error
-		obj any
+		terms, offsets = toLogTerms(lm.Match)
+		err            error
+		obj            any
 	)
 
 	if negIdx > 0 {
-		log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating inverse match set")
-		if obj, err = match.NewInverseSet(lm.Window.Nanoseconds(), toLogTerms(lm.Match), toLogResets(lm.Negate)); err != nil {
+		log.Debug().Any("terms", terms).Msg("Creating inverse match set")
+		if obj, err = match.NewInverseSet(lm.Window.Nanoseconds(), terms, toLogResets(lm.Negate, offsets)); err != nil {
 			log.Error().Err(err).Msg("Failed to create inverse match set")
 			return nil, err
 		}
 	} else {
-		if len(lm.Match) == 1 {
-			log.Debug().Any("term", toLogTerms(lm.Match)[0]).Msg("Creating match single")
-			if obj, err = match.NewMatchSingle(toLogTerms(lm.Match)[0]); err != nil {
+		if len(terms) == 1 {
+			log.Debug().Any("term", terms[0]).Msg("Creating match single")
+			if obj, err = match.NewMatchSingle(terms[0]); err != nil {
 				log.Error().Err(err).Msg("Failed to create match single")
 				return nil, err
 			}
 		} else {
-			log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating match set")
-			if obj, err = match.NewMatchSet(lm.Window.Nanoseconds(), toLogTerms(lm.Match)...); err != nil {
+			log.Debug().Any("terms", terms).Msg("Creating match set")
+			if obj, err = match.NewMatchSet(lm.Window.Nanoseconds(), terms...); err != nil {
 				log.Error().Err(err).Msg("Failed to create match set")
 				return nil, err
 			}
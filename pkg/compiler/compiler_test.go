@@ -0,0 +1,189 @@
+package compiler
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+func readExample(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", name))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+	return data
+}
+
+func TestCompileRules(t *testing.T) {
+
+	rules, err := CompileRules(readExample(t, "41-nested.yaml"))
+	if err != nil {
+		t.Fatalf("Error compiling rules: %v", err)
+	}
+
+	if len(rules) != 1 || rules[0].RuleId != "eeJwJiWQa9TyH3qTYYSZM9" {
+		t.Fatalf("Expected rule eeJwJiWQa9TyH3qTYYSZM9, got %+v", rules)
+	}
+
+	var matchers, asserts int
+
+	for scope, objs := range rules[0].Scopes {
+		for _, obj := range objs {
+			if obj.Scope != scope {
+				t.Errorf("object %s in scope %s, want %s", obj.Address, obj.Scope, scope)
+			}
+			switch obj.ObjectType {
+			case ObjTypeMatcher:
+				matchers++
+				switch obj.Object.(type) {
+				case *match.MatchSeq, *match.MatchSet, *match.MatchSingle, *match.InverseSeq, *match.InverseSet:
+				default:
+					t.Errorf("matcher %s is %T, want a logmatch matcher", obj.Address, obj.Object)
+				}
+			case ObjTypeAssert:
+				asserts++
+				if !isMachineNode(&ast.AstNodeT{Metadata: ast.AstMetadataT{Type: obj.AbstractType}}) {
+					t.Errorf("assert %s is a %s, want a machine", obj.Address, obj.AbstractType)
+				}
+			}
+		}
+	}
+
+	if matchers != 5 || asserts != 2 {
+		t.Errorf("Expected 5 matchers and 2 asserts, got %d and %d", matchers, asserts)
+	}
+
+	// Machines are placed in the cluster scope, log matchers in the node scope
+	if len(rules[0].Scopes[schema.ScopeCluster]) == 0 || len(rules[0].Scopes[schema.ScopeNode]) == 0 {
+		t.Errorf("Expected objects in the cluster and node scopes, got %v", rules[0].Scopes)
+	}
+}
+
+func TestCompileRulesUnsupported(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		data    []byte
+		err     error
+		feature string
+	}{
+		{"46-count-distinct", readExample(t, "46-count-distinct.yaml"), ErrUnsupportedFeature, "count_distinct"},
+		{"49-negate-groups", readExample(t, "49-negate-groups.yaml"), ErrUnsupportedFeature, "negate groups"},
+		{"50-negate-count", readExample(t, "50-negate-count.yaml"), ErrUnsupportedFeature, "negate count"},
+		{"52-negate-until", readExample(t, "52-negate-until.yaml"), ErrUnsupportedFeature, "until"},
+		{"53-correlate-on", readExample(t, "53-correlate-on.yaml"), ErrUnsupportedFeature, "join keys"},
+		{"54-correlate-composite", readExample(t, "54-correlate-composite.yaml"), ErrUnsupportedFeature, "join keys"},
+		{"55-correlation-window", readExample(t, "55-correlation-window.yaml"), ErrUnsupportedFeature, "correlation_window"},
+		{"57-step-refs", readExample(t, "57-step-refs.yaml"), ErrUnsupportedFeature, "step references"},
+		{"71-scope-bridge", readExample(t, "71-scope-bridge.yaml"), ErrUnsupportedFeature, "join keys"},
+		{"CountRange", []byte(testdata.TestSuccessCountRange), ErrUnsupportedFeature, "count range"},
+		{"Optional", []byte(testdata.TestSuccessOptional), ErrUnsupportedFeature, "optional"},
+		{"Repeat", []byte(testdata.TestSuccessRepeat), ErrUnsupportedFeature, "repeat"},
+		{"MaxGap", []byte(testdata.TestSuccessMaxGap), ErrUnsupportedFeature, "max_gap"},
+		{"OrderTolerance", []byte(testdata.TestSuccessOrderTolerance), ErrUnsupportedFeature, "order_tolerance"},
+		{"IPCidr", []byte(testdata.TestSuccessIPCidr), ErrUnsupportedFeature, "ip_cidr"},
+		{"59-aggregate", readExample(t, "59-aggregate.yaml"), ErrUnsupportedNodeType, "type=log_agg"},
+		{"60-metric-sequence", readExample(t, "60-metric-sequence.yaml"), ErrUnsupportedNodeType, "type=promql"},
+		{"63-k8s-resource", readExample(t, "63-k8s-resource.yaml"), ErrUnsupportedNodeType, "type=k8s_resource"},
+		{"69-netflow", readExample(t, "69-netflow.yaml"), ErrUnsupportedNodeType, "type=flow_set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			_, err := CompileRules(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+
+			if !strings.Contains(err.Error(), test.feature) {
+				t.Errorf("Expected %q in the error, got %v", test.feature, err)
+			}
+
+			// Positioned at the node using the feature, not at the top of the file
+			if pos, ok := pqerr.PosOf(err); !ok || pos.Line <= 1 {
+				t.Errorf("Expected the position of the node, got %+v", pos)
+			}
+		})
+	}
+}
+
+func TestCompileRulesPlugin(t *testing.T) {
+
+	var compiled []schema.NodeTypeT
+
+	plugin := pluginFuncT(func(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+		compiled = append(compiled, node.Metadata.Type)
+		return ObjsT{NewObj(node, ObjTypeMatcher)}, nil
+	})
+
+	// A plugin for the scope of the promql node compiles it, and the machines too
+	rules, err := CompileRules(readExample(t, "60-metric-sequence.yaml"), WithPlugin(schema.ScopeCluster, plugin))
+	if err != nil {
+		t.Fatalf("Error compiling rules: %v", err)
+	}
+
+	if len(rules) != 1 || len(rules[0].Scopes[schema.ScopeCluster]) != len(compiled) {
+		t.Errorf("Expected the objects of the plugin, got %+v", rules)
+	}
+
+	var promql bool
+	for _, typ := range compiled {
+		promql = promql || typ == schema.NodeTypePromQL
+	}
+
+	if !promql {
+		t.Errorf("Expected the plugin to compile the promql node, got %v", compiled)
+	}
+}
+
+func TestCompileRulesPrimary(t *testing.T) {
+
+	var runtime = &paramsRuntimeT{}
+
+	if _, err := CompileRules([]byte(testdata.TestSuccessPrimaryCount), WithRuntime(runtime)); err != nil {
+		t.Fatalf("Error compiling rules: %v", err)
+	}
+
+	// The counted steps before it are repeated, and only the first of its own terms is primary
+	if len(runtime.params) != 1 || runtime.params[0].Primary != 3 {
+		t.Errorf("Expected the primary condition at term 3, got %+v", runtime.params)
+	}
+
+	runtime.params = nil
+
+	if _, err := CompileRules(readExample(t, "41-nested.yaml"), WithRuntime(runtime)); err != nil {
+		t.Fatalf("Error compiling rules: %v", err)
+	}
+
+	for _, params := range runtime.params {
+		if params.Primary != -1 {
+			t.Errorf("Expected no primary condition, got term %d", params.Primary)
+		}
+	}
+}
+
+type paramsRuntimeT struct {
+	NoopRuntime
+	params []MatchParamsT
+}
+
+func (r *paramsRuntimeT) NewCbMatch(params MatchParamsT) CallbackT {
+	r.params = append(r.params, params)
+	return r.NoopRuntime.NewCbMatch(params)
+}
+
+type pluginFuncT func(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error)
+
+func (f pluginFuncT) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+	return f(runtime, node)
+}
@@ -21,7 +21,7 @@ func (p *DefaultPlugin) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, er
 	)
 
 	switch node.Metadata.Type {
-	case schema.NodeTypeLogSeq, schema.NodeTypeLogSet:
+	case schema.NodeTypeLogSeq, schema.NodeTypeLogSet, schema.NodeTypeTraceSeq, schema.NodeTypeTraceSet:
 		if obj, err = ObjLogMatcher(runtime, node); err != nil {
 			log.Error().Err(err).Str("scope", node.Metadata.Scope).Msg("Failed to compile matchers")
 			return nil, err
@@ -0,0 +1,45 @@
+package compiler
+
+import (
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+// MachinePlugin compiles the machine nodes that join the matchers of a rule into
+// assert objects. The object of each is the machine of the AST (ast.AstSeqMatcherT,
+// ast.AstSetMatcherT, or ast.AstGroupMatcherT), and its callback is the assert
+// callback of the runtime, which the runtime calls as its children match.
+type MachinePlugin struct{}
+
+func NewMachinePlugin() *MachinePlugin {
+	return &MachinePlugin{}
+}
+
+func (p *MachinePlugin) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+
+	if !isMachineNode(node) {
+		log.Error().
+			Interface("node_type", node.Metadata.Type).
+			Msg("Unsupported node type")
+		return nil, ErrUnsupportedNodeType
+	}
+
+	if err := checkFeatures(node); err != nil {
+		return nil, err
+	}
+
+	obj := NewObj(node, ObjTypeAssert)
+	obj.Object = node.Object
+	obj.Cb = runtime.NewCbAssert(AssertParamsT{Address: node.Metadata.Address})
+
+	return ObjsT{obj}, nil
+}
+
+func isMachineNode(node *ast.AstNodeT) bool {
+	switch node.Metadata.Type {
+	case schema.NodeTypeSeq, schema.NodeTypeSet, schema.NodeTypeAny, schema.NodeTypeAll:
+		return true
+	}
+	return false
+}
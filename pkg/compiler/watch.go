@@ -0,0 +1,261 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrWatchPaths = errors.New("no paths to watch")
+)
+
+// DefaultWatchInterval is how often Watch checks the rule files for changes
+const DefaultWatchInterval = time.Second
+
+// RuleUpdateT is a rule whose tree changed between two builds
+type RuleUpdateT struct {
+	Old   *ast.AstNodeT
+	New   *ast.AstNodeT
+	Diffs []ast.AstDiffT // Nodes that changed, as ast.Diff reports them
+}
+
+// WatchEventT is the result of a build by Watch. The first event lists every rule
+// as added. When a build fails, Err is set, Tree is the last good build, and the
+// rule lists are empty; the runtime keeps the rules it has.
+type WatchEventT struct {
+	Tree    *ast.AstT
+	Files   []string // Rule files the build read, in order
+	Added   []*ast.AstNodeT
+	Removed []*ast.AstNodeT
+	Updated []RuleUpdateT
+	Err     error
+}
+
+type WatchFuncT func(WatchEventT)
+
+// WithWatchInterval sets how often Watch checks the rule files for changes
+func WithWatchInterval(d time.Duration) CompilerOptT {
+	return func(o *compilerOptsT) {
+		o.watchInterval = d
+	}
+}
+
+// Watch builds the rules of paths, then rebuilds them each time a file changes, is
+// added, or is removed, until ctx is done. A directory is watched for its .yaml
+// and .yml files, at any depth. Files are polled by modification time and size.
+// Each build is made with the build options of the compiler through a cache, so
+// that only the changed rules are built again, and callback is called with the
+// rules that were added, removed, or updated since the previous build. Rules are
+// matched across builds by rule id. Watch returns ctx.Err() when ctx is done.
+//
+// Only the files of paths are polled. Files named by 'include', which are read
+// through the include resolver of the build options, are not watched, so a change
+// to them is seen only when a watched file changes too.
+func Watch(ctx context.Context, paths []string, callback WatchFuncT, opts ...CompilerOptT) error {
+
+	if len(paths) == 0 {
+		return ErrWatchPaths
+	}
+
+	var (
+		o         = parseOpts(opts)
+		w         = watchT{paths: paths, cache: ast.NewCache()}
+		buildOpts = append([]ast.BuildOptT{ast.WithCache(w.cache)}, o.buildOpts...)
+		interval  = o.watchInterval
+	)
+
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if ev, ok := w.poll(buildOpts); ok {
+			callback(ev)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type fileStateT struct {
+	modTime int64
+	size    int64
+}
+
+type watchT struct {
+	paths   []string
+	cache   *ast.CacheT
+	files   []string
+	state   map[string]fileStateT
+	tree    *ast.AstT
+	scanErr string // Last scan error reported, so that it is reported once
+}
+
+// poll rebuilds the rules if the files changed since the last poll, and returns
+// the event to report, if any
+func (w *watchT) poll(buildOpts []ast.BuildOptT) (WatchEventT, bool) {
+
+	files, state, err := scanPaths(w.paths)
+	if err != nil {
+		if err.Error() == w.scanErr {
+			return WatchEventT{}, false
+		}
+		// Forget the files, so that they are rebuilt once they can be read
+		w.scanErr, w.state = err.Error(), nil
+		return WatchEventT{Tree: w.tree, Files: w.files, Err: err}, true
+	}
+
+	w.scanErr = ""
+
+	if w.state != nil && slices.Equal(files, w.files) && sameState(state, w.state) {
+		return WatchEventT{}, false
+	}
+
+	w.files, w.state = files, state
+
+	if len(files) == 0 {
+		return WatchEventT{Tree: w.tree, Err: ErrWatchPaths}, true
+	}
+
+	tree, err := ast.BuildFiles(files, buildOpts...)
+	if err != nil {
+		log.Error().Err(err).Strs("files", files).Msg("Fail rebuild of watched rules")
+		return WatchEventT{Tree: w.tree, Files: files, Err: err}, true
+	}
+
+	w.cache.Prune()
+
+	ev := diffRules(w.tree, tree)
+	ev.Files = files
+	w.tree = tree
+
+	return ev, true
+}
+
+// scanPaths returns the rule files of paths, sorted within each directory, and
+// their states
+func scanPaths(paths []string) ([]string, map[string]fileStateT, error) {
+
+	var (
+		files []string
+		state = make(map[string]fileStateT)
+	)
+
+	add := func(path string, info fs.FileInfo) {
+		if _, ok := state[path]; ok {
+			return
+		}
+		files = append(files, path)
+		state[path] = fileStateT{modTime: info.ModTime().UnixNano(), size: info.Size()}
+	}
+
+	for _, path := range paths {
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !info.IsDir() {
+			add(path, info)
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isRuleFile(p) {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			add(p, info)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return files, state, nil
+}
+
+func isRuleFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func sameState(a, b map[string]fileStateT) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, s := range a {
+		if b[path] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// diffRules compares the rules of two builds by rule id. Rules served from the
+// cache are the same nodes in both builds and are not compared.
+func diffRules(old, new *ast.AstT) WatchEventT {
+
+	var (
+		ev      = WatchEventT{Tree: new}
+		oldById = make(map[string]*ast.AstNodeT)
+		seen    = make(map[string]bool)
+	)
+
+	if old != nil {
+		for _, node := range old.Nodes {
+			oldById[node.Metadata.RuleId] = node
+		}
+	}
+
+	for _, node := range new.Nodes {
+		id := node.Metadata.RuleId
+		seen[id] = true
+
+		prev, ok := oldById[id]
+		switch {
+		case !ok:
+			ev.Added = append(ev.Added, node)
+		case prev == node:
+		default:
+			diffs := ast.Diff(&ast.AstT{Nodes: []*ast.AstNodeT{prev}}, &ast.AstT{Nodes: []*ast.AstNodeT{node}})
+			if len(diffs) > 0 {
+				ev.Updated = append(ev.Updated, RuleUpdateT{Old: prev, New: node, Diffs: diffs})
+			}
+		}
+	}
+
+	if old != nil {
+		for _, node := range old.Nodes {
+			if !seen[node.Metadata.RuleId] {
+				ev.Removed = append(ev.Removed, node)
+			}
+		}
+	}
+
+	return ev
+}
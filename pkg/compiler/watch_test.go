@@ -0,0 +1,275 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+)
+
+const (
+	watchRuleA = "eeJwJiWQa9TyH3qTYYSZM9"
+	watchRuleB = "J7uRQTGpGMyL1iFpssnBeS"
+)
+
+var watchHashes = map[string]string{
+	watchRuleA: "9GJSdx4smGJeJCdiw6tiK5",
+	watchRuleB: "rdJLgqYgkEp8jg8Qks1qiq",
+}
+
+// writeRule writes a rule matching term to path, with a modification time after
+// any earlier write so that the change is seen whatever the clock resolution
+func writeRule(t *testing.T, path, id, term string, gen int) {
+	t.Helper()
+
+	data := fmt.Sprintf(`rules:
+  - cre:
+      id: watch-%s
+    metadata:
+      id: %s
+      hash: %s
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - %q
+`, id, id, watchHashes[id], term)
+
+	writeFile(t, path, data, gen)
+}
+
+func writeFile(t *testing.T, path, data string, gen int) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Now().Add(time.Duration(gen) * time.Minute)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ruleIds(nodes []*ast.AstNodeT) []string {
+	var ids []string
+	for _, node := range nodes {
+		ids = append(ids, node.Metadata.RuleId)
+	}
+	return ids
+}
+
+func newWatch(paths ...string) (*watchT, []ast.BuildOptT) {
+	w := &watchT{paths: paths, cache: ast.NewCache()}
+	return w, []ast.BuildOptT{ast.WithCache(w.cache)}
+}
+
+func TestWatchPoll(t *testing.T) {
+
+	var (
+		dir     = t.TempDir()
+		pathA   = filepath.Join(dir, "a.yaml")
+		pathB   = filepath.Join(dir, "b.yml")
+		w, opts = newWatch(dir)
+	)
+
+	writeRule(t, pathA, watchRuleA, "shutdown", 1)
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not a rule", 1)
+
+	// The first build adds every rule
+	ev, ok := w.poll(opts)
+	switch {
+	case !ok:
+		t.Fatalf("Expected an event for the first build")
+	case ev.Err != nil:
+		t.Fatalf("Error building rules: %v", ev.Err)
+	case len(ev.Files) != 1 || ev.Files[0] != pathA:
+		t.Errorf("files = %v, want [%s]", ev.Files, pathA)
+	case len(ev.Added) != 1 || ev.Added[0].Metadata.RuleId != watchRuleA:
+		t.Errorf("added = %v, want [%s]", ruleIds(ev.Added), watchRuleA)
+	}
+
+	if _, ok = w.poll(opts); ok {
+		t.Errorf("Expected no event when no file changed")
+	}
+
+	// Add
+	writeRule(t, pathB, watchRuleB, "panic", 2)
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || ev.Err != nil:
+		t.Fatalf("Expected an event for an added file, got %v %v", ok, ev.Err)
+	case len(ev.Added) != 1 || ev.Added[0].Metadata.RuleId != watchRuleB:
+		t.Errorf("added = %v, want [%s]", ruleIds(ev.Added), watchRuleB)
+	case len(ev.Updated) != 0 || len(ev.Removed) != 0:
+		t.Errorf("Expected only an added rule, got %d updated, %d removed", len(ev.Updated), len(ev.Removed))
+	case len(ev.Tree.Nodes) != 2:
+		t.Errorf("Expected 2 rules in the tree, got %d", len(ev.Tree.Nodes))
+	}
+
+	// Update
+	writeRule(t, pathA, watchRuleA, "shutdown complete", 3)
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || ev.Err != nil:
+		t.Fatalf("Expected an event for an updated file, got %v %v", ok, ev.Err)
+	case len(ev.Updated) != 1 || ev.Updated[0].New.Metadata.RuleId != watchRuleA:
+		t.Errorf("updated = %+v, want [%s]", ev.Updated, watchRuleA)
+	case len(ev.Updated[0].Diffs) == 0:
+		t.Errorf("Expected the diffs of the updated rule")
+	case len(ev.Added) != 0 || len(ev.Removed) != 0:
+		t.Errorf("Expected only an updated rule, got %d added, %d removed", len(ev.Added), len(ev.Removed))
+	}
+
+	// Remove
+	if err := os.Remove(pathB); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || ev.Err != nil:
+		t.Fatalf("Expected an event for a removed file, got %v %v", ok, ev.Err)
+	case len(ev.Removed) != 1 || ev.Removed[0].Metadata.RuleId != watchRuleB:
+		t.Errorf("removed = %v, want [%s]", ruleIds(ev.Removed), watchRuleB)
+	case len(ev.Added) != 0 || len(ev.Updated) != 0:
+		t.Errorf("Expected only a removed rule, got %d added, %d updated", len(ev.Added), len(ev.Updated))
+	}
+
+	good := ev.Tree
+
+	// A failed build reports the error with the last good tree
+	writeFile(t, pathA, "rules:\n  - cre: [\n", 4)
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || ev.Err == nil:
+		t.Fatalf("Expected an error event for a failed build, got %v %v", ok, ev.Err)
+	case ev.Tree != good:
+		t.Errorf("Expected the last good tree with the error")
+	case len(ev.Added)+len(ev.Removed)+len(ev.Updated) != 0:
+		t.Errorf("Expected no rule changes with the error")
+	}
+
+	if _, ok = w.poll(opts); ok {
+		t.Errorf("Expected no event until the failed file changes")
+	}
+
+	// Once fixed, the changes are against the last good build
+	writeRule(t, pathA, watchRuleA, "shutdown complete", 5)
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || ev.Err != nil:
+		t.Fatalf("Expected an event for the fixed file, got %v %v", ok, ev.Err)
+	case len(ev.Added)+len(ev.Removed)+len(ev.Updated) != 0:
+		t.Errorf("Expected no rule changes since the last good build, got %d added, %d removed, %d updated",
+			len(ev.Added), len(ev.Removed), len(ev.Updated))
+	}
+}
+
+func TestWatchScanError(t *testing.T) {
+
+	var (
+		dir     = t.TempDir()
+		path    = filepath.Join(dir, "rules.yaml")
+		w, opts = newWatch(path)
+	)
+
+	// A missing file is reported once, however many polls fail
+	ev, ok := w.poll(opts)
+	if !ok || !errors.Is(ev.Err, os.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got %v %v", ok, ev.Err)
+	}
+
+	for range 3 {
+		if ev, ok = w.poll(opts); ok {
+			t.Fatalf("Expected the scan error once, got %v again", ev.Err)
+		}
+	}
+
+	writeRule(t, path, watchRuleA, "shutdown", 1)
+
+	ev, ok = w.poll(opts)
+	if !ok || ev.Err != nil || len(ev.Added) != 1 {
+		t.Fatalf("Expected the rule to be added once the file exists, got %v %v %v", ok, ev.Err, ruleIds(ev.Added))
+	}
+
+	// A file that disappears again is reported again, with the last good tree
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, ok = w.poll(opts)
+	switch {
+	case !ok || !errors.Is(ev.Err, os.ErrNotExist):
+		t.Fatalf("Expected a not exist error, got %v %v", ok, ev.Err)
+	case ev.Tree == nil || len(ev.Tree.Nodes) != 1:
+		t.Errorf("Expected the last good tree with the error")
+	}
+
+	// An empty directory has no rules to build
+	w, opts = newWatch(dir)
+
+	if ev, ok = w.poll(opts); !ok || !errors.Is(ev.Err, ErrWatchPaths) {
+		t.Errorf("Expected ErrWatchPaths, got %v %v", ok, ev.Err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	if err := Watch(context.Background(), nil, func(WatchEventT) {}); !errors.Is(err, ErrWatchPaths) {
+		t.Errorf("Expected ErrWatchPaths, got %v", err)
+	}
+
+	var (
+		dir    = t.TempDir()
+		path   = filepath.Join(dir, "rules.yaml")
+		events = make(chan WatchEventT, 8)
+	)
+
+	writeRule(t, path, watchRuleA, "shutdown", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, []string{dir}, func(ev WatchEventT) { events <- ev }, WithWatchInterval(10*time.Millisecond))
+	}()
+
+	next := func() WatchEventT {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a watch event")
+		}
+		return WatchEventT{}
+	}
+
+	if ev := next(); ev.Err != nil || len(ev.Added) != 1 {
+		t.Fatalf("Expected the rule to be added, got %v %v", ev.Err, ruleIds(ev.Added))
+	}
+
+	writeRule(t, path, watchRuleA, "shutdown complete", 2)
+
+	if ev := next(); ev.Err != nil || len(ev.Updated) != 1 {
+		t.Fatalf("Expected the rule to be updated, got %v %+v", ev.Err, ev.Updated)
+	}
+
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
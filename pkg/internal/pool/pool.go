@@ -0,0 +1,57 @@
+// Package pool runs the rules of a bundle on a bounded number of goroutines.
+package pool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Run calls fn for each index below count on up to n workers, passing the worker
+// number so that callers can keep state per worker. Indexes are handed out in
+// order. Once fn fails, indexes above the failed one are skipped and the error of
+// the lowest failed index is returned, the same error a sequential loop returns.
+// With n of one or less, fn runs on the calling goroutine.
+func Run(n, count int, fn func(worker, i int) error) error {
+
+	if n <= 1 || count <= 1 {
+		for i := range count {
+			if err := fn(0, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		next   atomic.Int64
+		failed atomic.Int64 // Lowest failed index, or count
+		errs   = make([]error, count)
+		wg     sync.WaitGroup
+	)
+
+	failed.Store(int64(count))
+
+	for w := range min(n, count) {
+		wg.Go(func() {
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(count) || i > failed.Load() {
+					return
+				}
+				if err := fn(w, int(i)); err != nil {
+					errs[i] = err
+					for f := failed.Load(); i < f && !failed.CompareAndSwap(f, i); f = failed.Load() {
+					}
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if f := failed.Load(); f < int64(count) {
+		return errs[f]
+	}
+
+	return nil
+}
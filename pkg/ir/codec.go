@@ -0,0 +1,199 @@
+package ir
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrMagic     = errors.New("not an IR program")
+	ErrVersion   = errors.New("unsupported IR version")
+	ErrTruncated = errors.New("truncated IR program")
+	ErrTrailing  = errors.New("trailing bytes after IR program")
+)
+
+// Magic starts every encoded program
+const Magic = "PQIR"
+
+// Encode returns the binary form of a program: Magic, then the version, the
+// strings, and the rules. The version, counts, and lengths are unsigned varints,
+// and each op a byte. Every arg of an instruction, string indexes included, is a
+// signed (zig-zag) varint, as written by binary.AppendVarint. An op's args are not
+// counted; their number is fixed by the op.
+func Encode(p *ProgramT) ([]byte, error) {
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	buf := []byte(Magic)
+	buf = binary.AppendUvarint(buf, uint64(p.Version))
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.Strings)))
+	for _, s := range p.Strings {
+		buf = appendString(buf, s)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.Rules)))
+	for _, rule := range p.Rules {
+		buf = appendString(buf, rule.Id)
+		buf = appendString(buf, rule.Hash)
+		buf = binary.AppendUvarint(buf, uint64(len(rule.Code)))
+		for _, in := range rule.Code {
+			buf = append(buf, byte(in.Op))
+			for _, arg := range in.Args {
+				buf = binary.AppendVarint(buf, arg)
+			}
+		}
+	}
+
+	return buf, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// Decode reads a program written by Encode, and validates it. Programs of another
+// version are refused with ErrVersion.
+func Decode(data []byte) (*ProgramT, error) {
+
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, ErrMagic
+	}
+
+	var (
+		d = decoderT{data: data[len(Magic):]}
+		p = &ProgramT{Version: d.int()}
+	)
+
+	if d.err == nil && p.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, p.Version)
+	}
+
+	p.Strings = make([]string, d.count())
+	for i := range p.Strings {
+		p.Strings[i] = d.string()
+	}
+
+	p.Rules = make([]RuleT, d.count())
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.Id = d.string()
+		rule.Hash = d.string()
+		rule.Code = make([]InstrT, d.count())
+		for j := range rule.Code {
+			rule.Code[j] = d.instr()
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.data) > 0 {
+		return nil, ErrTrailing
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// decoderT reads from data until the first error, after which it returns zeros
+type decoderT struct {
+	data []byte
+	err  error
+}
+
+func (d *decoderT) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = ErrTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoderT) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = ErrTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoderT) int() int {
+	v := d.uvarint()
+	if v > math.MaxInt32 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	return int(v)
+}
+
+// count reads the length of a list, which cannot exceed the bytes left since each
+// element takes at least one
+func (d *decoderT) count() int {
+	v := d.int()
+	if v > len(d.data) {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	return v
+}
+
+func (d *decoderT) string() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoderT) instr() InstrT {
+
+	if d.err != nil || len(d.data) == 0 {
+		d.fail(ErrTruncated)
+		return InstrT{}
+	}
+
+	in := InstrT{Op: OpT(d.data[0])}
+	d.data = d.data[1:]
+
+	n, ok := opArity[in.Op]
+	if !ok {
+		d.fail(fmt.Errorf("%w %d", ErrOp, in.Op))
+		return in
+	}
+
+	if n > 0 {
+		in.Args = make([]int64, n)
+	}
+	for i := range in.Args {
+		in.Args[i] = d.varint()
+	}
+
+	return in
+}
+
+func (d *decoderT) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
@@ -0,0 +1,251 @@
+package ir
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOp       = errors.New("invalid op")
+	ErrArgs     = errors.New("wrong number of args")
+	ErrString   = errors.New("string index out of range")
+	ErrNodeRef  = errors.New("node reference out of range")
+	ErrTermKind = errors.New("invalid term kind")
+	ErrBlock    = errors.New("instruction outside a node block")
+	ErrNoDetect = errors.New("rule does not end with detect")
+)
+
+// Version of the IR. It changes whenever an op is added or changes meaning, so
+// that a runtime can refuse programs it cannot interpret.
+const Version = 1
+
+// ProgramT is the IR of a tree: a flat list of instructions per rule. String
+// arguments are indexes into Strings, which holds each string once.
+type ProgramT struct {
+	Version int
+	Strings []string
+	Rules   []RuleT
+}
+
+type RuleT struct {
+	Id   string
+	Hash string
+	Code []InstrT
+}
+
+type InstrT struct {
+	Op   OpT
+	Args []int64
+}
+
+type OpT uint8
+
+// The code of a rule is a list of node blocks, each a node op followed by the
+// instructions of the node, in the order of the AST with children before their
+// parents. Nodes are numbered from zero in the order their blocks start. Each
+// block ends with emit, except the last, the root, which ends with detect. Negate
+// anchors index the match terms of the node, window and slide are nanoseconds,
+// and absolute is one or zero, as in the negate options of the AST.
+const (
+	OpNode       OpT = iota + 1 // type, scope, address: starts the block of a node
+	OpSource                    // source: the events the terms of the node match
+	OpWindow                    // nanoseconds: the terms must match within the window
+	OpRequire                   // n: a set matches once n of its terms match; zero requires all
+	OpMatch                     // kind, field, value, count: a term matched in an event count times
+	OpMatchNode                 // node: a term matched when an earlier node emits
+	OpNegate                    // kind, field, value, window, slide, anchor, absolute: a term that cancels the match
+	OpNegateNode                // node, window, slide, anchor, absolute: a node whose emit cancels the match
+	OpEmit                      // ends the block; the node emits to the nodes that refer to it
+	OpDetect                    // ends the block of the root; the rule emits a detection
+)
+
+var opNames = map[OpT]string{
+	OpNode:       "node",
+	OpSource:     "source",
+	OpWindow:     "window",
+	OpRequire:    "require",
+	OpMatch:      "match",
+	OpMatchNode:  "match_node",
+	OpNegate:     "negate",
+	OpNegateNode: "negate_node",
+	OpEmit:       "emit",
+	OpDetect:     "detect",
+}
+
+// Number of args of each op
+var opArity = map[OpT]int{
+	OpNode:       3,
+	OpSource:     1,
+	OpWindow:     1,
+	OpRequire:    1,
+	OpMatch:      4,
+	OpMatchNode:  1,
+	OpNegate:     7,
+	OpNegateNode: 5,
+	OpEmit:       0,
+	OpDetect:     0,
+}
+
+// Indexes of the args of each op that are strings
+var opStrings = map[OpT][]int{
+	OpNode:   {0, 1, 2},
+	OpSource: {0},
+	OpMatch:  {1, 2},
+	OpNegate: {1, 2},
+}
+
+func (op OpT) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "op(" + strconv.Itoa(int(op)) + ")"
+}
+
+type TermKindT int64
+
+const (
+	TermRaw TermKindT = iota
+	TermRegex
+	TermJqJson
+	TermJqYaml
+)
+
+var termNames = []string{"raw", "regex", "jq_json", "jq_yaml"}
+
+func (k TermKindT) String() string {
+	if k >= 0 && int(k) < len(termNames) {
+		return termNames[k]
+	}
+	return "term(" + strconv.FormatInt(int64(k), 10) + ")"
+}
+
+// Validate checks that each rule is a list of well-formed node blocks ending with
+// detect, whose string and node arguments are in range
+func (p *ProgramT) Validate() error {
+	for _, rule := range p.Rules {
+		if err := p.validateRule(rule); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Id, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProgramT) validateRule(rule RuleT) error {
+
+	var (
+		nodes   int
+		inBlock bool
+	)
+
+	for pc, in := range rule.Code {
+
+		n, ok := opArity[in.Op]
+		if !ok {
+			return fmt.Errorf("%d: %w %d", pc, ErrOp, in.Op)
+		}
+		if len(in.Args) != n {
+			return fmt.Errorf("%d: %w for %s: %d", pc, ErrArgs, in.Op, len(in.Args))
+		}
+
+		for _, i := range opStrings[in.Op] {
+			if in.Args[i] < 0 || in.Args[i] >= int64(len(p.Strings)) {
+				return fmt.Errorf("%d: %w: %d", pc, ErrString, in.Args[i])
+			}
+		}
+
+		switch in.Op {
+		case OpNode:
+			if inBlock {
+				return fmt.Errorf("%d: %w", pc, ErrBlock)
+			}
+			inBlock = true
+			continue
+		case OpMatch, OpNegate:
+			if k := TermKindT(in.Args[0]); k < TermRaw || k > TermJqYaml {
+				return fmt.Errorf("%d: %w %d", pc, ErrTermKind, k)
+			}
+		case OpMatchNode, OpNegateNode:
+			// A node refers only to nodes whose blocks have ended
+			if in.Args[0] < 0 || in.Args[0] >= int64(nodes) {
+				return fmt.Errorf("%d: %w: %d", pc, ErrNodeRef, in.Args[0])
+			}
+		}
+
+		if !inBlock {
+			return fmt.Errorf("%d: %w", pc, ErrBlock)
+		}
+
+		switch in.Op {
+		case OpEmit:
+			inBlock = false
+			nodes++
+		case OpDetect:
+			if pc != len(rule.Code)-1 {
+				return fmt.Errorf("%d: %w", pc, ErrBlock)
+			}
+			return nil
+		}
+	}
+
+	return ErrNoDetect
+}
+
+// Disassemble returns the program as text, one instruction per line, with the
+// strings of the args quoted
+func (p *ProgramT) Disassemble() string {
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "pqir v%d\n", p.Version)
+
+	for _, rule := range p.Rules {
+
+		var node int
+
+		fmt.Fprintf(&sb, "rule %s %s\n", rule.Id, rule.Hash)
+
+		for _, in := range rule.Code {
+			if in.Op == OpNode {
+				fmt.Fprintf(&sb, "  n%d:\n", node)
+				node++
+			}
+			fmt.Fprintf(&sb, "    %s%s\n", in.Op, p.formatArgs(in))
+		}
+	}
+
+	return sb.String()
+}
+
+func (p *ProgramT) formatArgs(in InstrT) string {
+
+	var sb strings.Builder
+
+	for i, arg := range in.Args {
+		sb.WriteByte(' ')
+		switch {
+		case slices.Contains(opStrings[in.Op], i):
+			sb.WriteString(strconv.Quote(p.str(arg)))
+		case (in.Op == OpMatch || in.Op == OpNegate) && i == 0:
+			sb.WriteString(TermKindT(arg).String())
+		case in.Op == OpMatchNode, in.Op == OpNegateNode && i == 0:
+			sb.WriteString("n" + strconv.FormatInt(arg, 10))
+		case in.Op == OpWindow, in.Op == OpNegate && (i == 3 || i == 4), in.Op == OpNegateNode && (i == 1 || i == 2):
+			sb.WriteString(time.Duration(arg).String())
+		default:
+			sb.WriteString(strconv.FormatInt(arg, 10))
+		}
+	}
+
+	return sb.String()
+}
+
+func (p *ProgramT) str(i int64) string {
+	if i < 0 || i >= int64(len(p.Strings)) {
+		return ""
+	}
+	return p.Strings[i]
+}
@@ -0,0 +1,170 @@
+package ir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// program is a set of two log matchers joined by a sequence, with a negate
+func program() *ProgramT {
+	return &ProgramT{
+		Version: Version,
+		Strings: []string{"log_set", "node", "v1.a", "cre.log.app", "", "panic", "machine_seq", "cluster", "v1.b", "v1.c"},
+		Rules: []RuleT{{Id: "rule", Hash: "hash", Code: []InstrT{
+			{Op: OpNode, Args: []int64{0, 1, 2}},
+			{Op: OpSource, Args: []int64{3}},
+			{Op: OpMatch, Args: []int64{int64(TermRaw), 4, 5, 1}},
+			{Op: OpEmit},
+			{Op: OpNode, Args: []int64{0, 1, 8}},
+			{Op: OpSource, Args: []int64{3}},
+			{Op: OpMatch, Args: []int64{int64(TermRegex), 4, 5, 2}},
+			{Op: OpNegate, Args: []int64{int64(TermJqJson), 4, 5, 1e9, 0, 0, 1}},
+			{Op: OpEmit},
+			{Op: OpNode, Args: []int64{6, 7, 9}},
+			{Op: OpWindow, Args: []int64{30e9}},
+			{Op: OpMatchNode, Args: []int64{0}},
+			{Op: OpMatchNode, Args: []int64{1}},
+			{Op: OpDetect},
+		}}},
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+
+	p := program()
+
+	enc, err := Encode(p)
+	if err != nil {
+		t.Fatalf("Error encoding program: %v", err)
+	}
+
+	if !strings.HasPrefix(string(enc), Magic) {
+		t.Errorf("Expected the encoding to start with %q", Magic)
+	}
+
+	dec, err := Decode(enc)
+	if err != nil {
+		t.Fatalf("Error decoding program: %v", err)
+	}
+
+	if !reflect.DeepEqual(dec, p) {
+		t.Errorf("decoded program differs:\n%s\nwant:\n%s", dec.Disassemble(), p.Disassemble())
+	}
+
+	// Args are signed varints, so a negative arg round trips
+	p.Rules[0].Code[2].Args[3] = -1
+	if enc, err = Encode(p); err != nil {
+		t.Fatalf("Error encoding program: %v", err)
+	}
+	if dec, err = Decode(enc); err != nil || dec.Rules[0].Code[2].Args[3] != -1 {
+		t.Errorf("Expected the negative arg to round trip, got %v", err)
+	}
+
+	// A negative string index is refused
+	p.Rules[0].Code[1].Args[0] = -1
+	if _, err = Encode(p); !errors.Is(err, ErrString) {
+		t.Errorf("Expected ErrString, got %v", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+
+	text := program().Disassemble()
+
+	for _, line := range []string{
+		"pqir v1",
+		"rule rule hash",
+		"  n1:",
+		`    match regex "" "panic" 2`,
+		`    negate jq_json "" "panic" 1s 0s 0 1`,
+		"    window 30s",
+		"    match_node n1",
+		"    detect",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+
+	enc, err := os.ReadFile(filepath.Join("../testdata", "ir", "09-sequence-negate-example.pqir"))
+	if err != nil {
+		t.Fatalf("Error reading golden file: %v", err)
+	}
+
+	next := slices.Clone(enc)
+	next[len(Magic)] = Version + 1
+
+	// The last byte is the detect op of the rule
+	badOp := slices.Clone(enc)
+	badOp[len(badOp)-1] = 0xff
+
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"magic":     {data: []byte("PQ"), err: ErrMagic},
+		"version":   {data: next, err: ErrVersion},
+		"truncated": {data: enc[:len(enc)-3], err: ErrTruncated},
+		"trailing":  {data: append(slices.Clone(enc), 0), err: ErrTrailing},
+		"op":        {data: badOp, err: ErrOp},
+	}
+
+	for name, tc := range tests {
+		if _, err := Decode(tc.data); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	// Programs that Validate refuses are not encoded
+	bad := &ProgramT{
+		Version: Version,
+		Strings: []string{"log_set"},
+		Rules: []RuleT{{Id: "bad", Code: []InstrT{
+			{Op: OpNode, Args: []int64{0, 0, 0}},
+			{Op: OpMatchNode, Args: []int64{0}},
+			{Op: OpDetect},
+		}}},
+	}
+
+	if _, err := Encode(bad); !errors.Is(err, ErrNodeRef) {
+		t.Errorf("Expected ErrNodeRef, got %v", err)
+	}
+
+	bad.Rules[0].Code = bad.Rules[0].Code[:2]
+	if _, err := Encode(bad); !errors.Is(err, ErrNodeRef) {
+		t.Errorf("Expected ErrNodeRef, got %v", err)
+	}
+
+	bad.Rules[0].Code = bad.Rules[0].Code[:1]
+	if _, err := Encode(bad); !errors.Is(err, ErrNoDetect) {
+		t.Errorf("Expected ErrNoDetect, got %v", err)
+	}
+
+	tests := map[string]struct {
+		code []InstrT
+		err  error
+	}{
+		"op":    {code: []InstrT{{Op: 0xff}}, err: ErrOp},
+		"args":  {code: []InstrT{{Op: OpNode, Args: []int64{0}}}, err: ErrArgs},
+		"kind":  {code: []InstrT{{Op: OpNode, Args: []int64{0, 0, 0}}, {Op: OpMatch, Args: []int64{9, 0, 0, 1}}}, err: ErrTermKind},
+		"block": {code: []InstrT{{Op: OpSource, Args: []int64{0}}}, err: ErrBlock},
+	}
+
+	for name, tc := range tests {
+		bad.Rules[0].Code = tc.code
+		if err := bad.Validate(); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+}
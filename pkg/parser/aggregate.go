@@ -0,0 +1,230 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrAggregate = errors.New("invalid 'aggregate' (requires an event, match conditions, and an expression such as 'sum(bytes) > 1GB over 5m')")
+)
+
+// AggregateT is a parsed aggregate expression. Thresholds for duration extracts
+// are in nanoseconds and size thresholds are in bytes.
+type AggregateT struct {
+	Func      schema.AggFuncT `json:"func"`
+	Extract   string          `json:"extract"`
+	Op        schema.AggOpT   `json:"op"`
+	Threshold float64         `json:"threshold"`
+	Expr      string          `json:"expr"`
+	Field     bool            `json:"field,omitempty"` // Extract names a number field of the events, such as the bytes of a flow record
+}
+
+var aggExprRegex = regexp.MustCompile(`^\s*([a-z]+)\s*\(\s*([A-Za-z][A-Za-z0-9_]*)\s*\)\s*(>=|<=|==|!=|>|<)\s*(\S+)(?:\s+over\s+(\S+))?\s*$`)
+
+// Size units for thresholds; decimal and binary multiples of bytes
+var aggSizeUnits = map[string]float64{
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+type thresholdKindT int
+
+const (
+	thresholdNumber thresholdKindT = iota
+	thresholdSize
+	thresholdDuration
+)
+
+func nodeFromAgg(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+
+	var agg = term.Aggregate
+
+	aggYn, ok := findChild(yn, docAgg)
+	if !ok {
+		aggYn = yn
+	}
+
+	node, err := parent.initChild(aggYn)
+	if err != nil {
+		return nil, err
+	}
+
+	exprYn, ok := findChild(aggYn, docExpr)
+	if !ok {
+		exprYn = aggYn
+	}
+
+	if agg.Event == nil || agg.Event.Source == "" {
+		return nil, node.aggError(aggYn, agg, "missing event source")
+	}
+
+	if len(agg.Match) == 0 {
+		return nil, node.aggError(aggYn, agg, "missing match conditions")
+	}
+
+	matchYn, ok := findChild(aggYn, docMatch)
+	if !ok {
+		matchYn = aggYn
+	}
+
+	children, err := buildChildren(node, termsT, agg.Match, false, false, matchYn, termsY)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		m, ok := child.(*MatcherT)
+		if !ok {
+			return nil, node.aggError(matchYn, agg, "match terms must be conditions")
+		}
+		if len(m.Negate.Fields) > 0 {
+			return nil, node.aggError(matchYn, agg, "match terms cannot negate")
+		}
+	}
+
+	node.Children = children
+	node.Metadata.Type = schema.NodeTypeAgg
+	node.Metadata.Event = newEvent(agg.Event)
+
+	if err = node.checkSource(); err != nil {
+		return nil, err
+	}
+
+	m := aggExprRegex.FindStringSubmatch(agg.Expr)
+	if m == nil {
+		return nil, node.aggError(exprYn, agg, "malformed expression")
+	}
+
+	var (
+		a = &AggregateT{
+			Func:    schema.AggFuncT(m[1]),
+			Extract: m[2],
+			Op:      schema.AggOpT(m[3]),
+			Expr:    agg.Expr,
+		}
+		kind   thresholdKindT
+		window = m[5]
+	)
+
+	switch {
+	case window != "" && agg.Window != "":
+		return nil, node.aggError(exprYn, agg, "both 'over' and 'window' are set")
+	case window == "" && agg.Window == "":
+		return nil, node.aggError(exprYn, agg, "missing window")
+	case window == "":
+		window = agg.Window
+	}
+
+	if node.Metadata.Window, err = node.parseWindow(window); err != nil {
+		return nil, err
+	}
+	if node.Metadata.Window <= 0 {
+		return nil, node.aggError(exprYn, agg, "window must be positive")
+	}
+
+	if a.Threshold, kind, err = parseThreshold(m[4]); err != nil {
+		return nil, node.aggError(exprYn, agg, "invalid threshold")
+	}
+
+	var typ schema.ExtractTypeT
+
+	switch e, ok := node.FindExtract(a.Extract); {
+	case ok:
+		typ = schema.ExtractTypeT(e.Type)
+	case node.Metadata.Event.Source == schema.SourceNetFlow && flowNumberField(a.Extract):
+		typ, a.Field = schema.ExtractTypeInt, true
+	default:
+		return nil, node.aggError(exprYn, agg, "match conditions do not extract "+a.Extract)
+	}
+
+	if reason := checkAggregate(a.Func, typ, kind); reason != "" {
+		return nil, node.aggError(exprYn, agg, reason)
+	}
+
+	node.Metadata.Aggregate = a
+
+	return node, nil
+}
+
+// checkAggregate verifies that the function applies to the type of the extract
+// and that the threshold is in the units of the aggregate
+func checkAggregate(fn schema.AggFuncT, typ schema.ExtractTypeT, kind thresholdKindT) string {
+
+	switch fn {
+	case schema.AggCount:
+		if kind != thresholdNumber {
+			return "count threshold must be a number"
+		}
+		return ""
+	case schema.AggSum, schema.AggAvg, schema.AggMin, schema.AggMax:
+	default:
+		return fmt.Sprintf("unknown function %q", fn)
+	}
+
+	switch typ {
+	case schema.ExtractTypeInt, schema.ExtractTypeFloat:
+		if kind == thresholdDuration {
+			return "duration threshold requires a duration extract"
+		}
+	case schema.ExtractTypeDuration:
+		if kind != thresholdDuration {
+			return "duration extract requires a duration threshold"
+		}
+	default:
+		return fmt.Sprintf("%s requires an int, float, or duration extract", fn)
+	}
+
+	return ""
+}
+
+// parseThreshold parses a number, a number with a size unit such as 1GB, or a duration
+func parseThreshold(s string) (float64, thresholdKindT, error) {
+
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, thresholdNumber, nil
+	}
+
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i > 0 {
+		if mult, ok := aggSizeUnits[s[i:]]; ok {
+			v, err := strconv.ParseFloat(s[:i], 64)
+			return v * mult, thresholdSize, err
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	return float64(d), thresholdDuration, err
+}
+
+func (node *NodeT) aggError(yn *yaml.Node, agg *ParseAggregateT, reason string) error {
+
+	log.Error().
+		Str("expr", agg.Expr).
+		Str("reason", reason).
+		Msg("Invalid aggregate")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		ErrAggregate,
+		reason,
+	)
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"errors"
+
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+var (
+	ErrAlertField    = errors.New("unknown alerts field (must be one of alertname, severity, status, fingerprint, selector, labels.<name>, or annotations.<name>)")
+	ErrAlertSelector = errors.New("invalid alert selector (use label selector syntax such as KubePodCrashLooping{namespace=~\"prod-.*\"})")
+	ErrAlertStatus   = errors.New("invalid alert status (use firing or resolved)")
+)
+
+const (
+	alertSelector = "selector" // Label selector of the alert
+	alertStatus   = "status"
+)
+
+// Fields of an Alertmanager notification; alertname and severity are labels
+var alertFields = map[string]bool{
+	"alertname":   true,
+	"severity":    true,
+	alertStatus:   true,
+	"fingerprint": true,
+	alertSelector: true,
+}
+
+var alertStatuses = map[string]bool{
+	"firing":   true,
+	"resolved": true,
+}
+
+// AlertSelector parses the label selector of an alerts condition. The selector
+// has the syntax of a PromQL vector selector, where the metric name is the
+// alertname: KubePodCrashLooping{namespace=~"prod-.*"}.
+func AlertSelector(expr string) (PromSelectorT, error) {
+
+	e, err := promParser.ParseExpr(expr)
+	if err != nil {
+		return PromSelectorT{}, err
+	}
+
+	vs, ok := e.(*promparser.VectorSelector)
+	if !ok || vs.OriginalOffset != 0 || vs.OriginalOffsetExpr != nil || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return PromSelectorT{}, errors.New("expected a single selector")
+	}
+
+	return newPromSelector(vs), nil
+}
+
+// checkAlertField checks the selector and status conditions of alerts. A selector
+// is a 'value' on its own, and its regex matchers must compile.
+func (node *NodeT) checkAlertField(field *FieldT) error {
+
+	switch field.Field {
+	case alertSelector:
+		if field.StrValue == "" || field.JqValue != "" || field.RegexValue != "" || len(field.Values) > 0 ||
+			field.Regexes != nil || field.Glob != "" || field.Options != nil || field.Compare != nil || field.Exists != nil {
+			return ErrAlertSelector
+		}
+		sel, err := AlertSelector(field.StrValue)
+		if err != nil {
+			return ErrAlertSelector
+		}
+		for _, m := range sel.Matchers {
+			if m.Op != "=~" && m.Op != "!~" {
+				continue
+			}
+			if _, err := node.opts.checkRegex(m.Value); err != nil {
+				return ErrAlertSelector
+			}
+		}
+
+	case alertStatus:
+		values := field.Values
+		if field.StrValue != "" {
+			values = append([]string{field.StrValue}, values...)
+		}
+		for _, v := range values {
+			if !alertStatuses[v] {
+				return ErrAlertStatus
+			}
+		}
+	}
+
+	return nil
+}
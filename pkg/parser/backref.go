@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrStepRef = errors.New("invalid step reference (must name an extract of an earlier step of the enclosing sequence)")
+)
+
+// stepRefRegex matches ${step.extract} references in the conditions of sequence
+// steps. Parameter references have no '.' and are expanded before parsing.
+var stepRefRegex = regexp.MustCompile(`\$\{([A-Za-z0-9_-]+)\.([A-Za-z][A-Za-z0-9_]*)\}`)
+
+// StepRefT is a reference from a condition to the value extracted by an earlier
+// step of the enclosing sequence. The reference is left in the expression for the
+// runtime to substitute.
+type StepRefT struct {
+	Step    int    `json:"step"` // Index into the children of the sequence
+	Extract string `json:"extract"`
+}
+
+// resolveStepRefs resolves the ${step.extract} references in the conditions of the
+// steps of a sequence. Steps are named by the term they reference. A reference
+// must name an extract of an earlier step; nested sequences resolve their own.
+func (node *NodeT) resolveStepRefs(tm map[string]ParseTermT, steps []ParseTermT, children []any) error {
+
+	for i, child := range children {
+		err := walkStepFields(child, func(field *FieldT) error {
+			for _, expr := range []string{field.StrValue, field.JqValue, field.RegexValue} {
+				for _, m := range stepRefRegex.FindAllStringSubmatch(expr, -1) {
+					ref, err := node.stepRef(tm, steps, children[:i], m[1], m[2], field.Pos)
+					if err != nil {
+						return err
+					}
+					if !slices.Contains(field.StepRefs, ref) {
+						field.StepRefs = append(field.StepRefs, ref)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stepRef resolves a reference to the extract of one of the earlier steps
+func (node *NodeT) stepRef(tm map[string]ParseTermT, steps []ParseTermT, earlier []any, step, extract string, pos pqerr.Pos) (StepRefT, error) {
+
+	var (
+		idx    = termIndex(tm, steps, step)
+		reason string
+	)
+
+	switch {
+	case idx < 0:
+		reason = "step not found"
+	case idx >= len(earlier):
+		reason = "step is not earlier in the sequence"
+	case !hasExtract(earlier[idx], extract):
+		reason = "step does not extract the value"
+	}
+
+	if reason == "" {
+		return StepRefT{Step: idx, Extract: extract}, nil
+	}
+
+	return StepRefT{}, node.stepRefError(step, extract, reason, pos)
+}
+
+func (node *NodeT) stepRefError(step, extract, reason string, pos pqerr.Pos) error {
+
+	log.Error().
+		Str("step", step).
+		Str("extract", extract).
+		Str("reason", reason).
+		Msg("Invalid step reference")
+
+	return pqerr.Wrap(
+		pos,
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		ErrStepRef,
+		fmt.Sprintf("ref=%s.%s", step, extract),
+	)
+}
+
+// checkStepRefs fails on the references left unresolved in the tree of node: those
+// of conditions that are not steps of a sequence, and those of negate conditions,
+// which the runtime does not substitute. Left in the expression, they would match
+// nothing.
+func (node *NodeT) checkStepRefs() error {
+
+	for _, child := range node.Children {
+		switch c := child.(type) {
+		case *NodeT:
+			if err := c.checkStepRefs(); err != nil {
+				return err
+			}
+		case *MatcherT:
+			for _, field := range c.Match.Fields {
+				if m := findStepRef(field); m != nil && len(field.StepRefs) == 0 {
+					return node.stepRefError(m[1], m[2], "condition is not a step of a sequence", field.Pos)
+				}
+			}
+			for _, field := range c.Negate.Fields {
+				if m := findStepRef(field); m != nil {
+					return node.stepRefError(m[1], m[2], "negate conditions cannot reference steps", field.Pos)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// findStepRef returns the submatches of the first step reference of a condition
+func findStepRef(field FieldT) []string {
+	for _, expr := range []string{field.StrValue, field.JqValue, field.RegexValue} {
+		if m := stepRefRegex.FindStringSubmatch(expr); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func hasExtract(child any, name string) bool {
+	switch c := child.(type) {
+	case *NodeT:
+		_, ok := c.FindExtract(name)
+		return ok
+	case *MatcherT:
+		for _, field := range c.Match.Fields {
+			if slices.ContainsFunc(field.Extract, func(e ExtractT) bool { return e.Name == name }) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkStepFields visits the match fields of a sequence step, not descending
+// into nested sequences
+func walkStepFields(child any, fn func(*FieldT) error) error {
+	switch c := child.(type) {
+	case *MatcherT:
+		for i := range c.Match.Fields {
+			if err := fn(&c.Match.Fields[i]); err != nil {
+				return err
+			}
+		}
+	case *NodeT:
+		if c.Metadata.Type == schema.NodeTypeSeq || c.Metadata.Type == schema.NodeTypeLogSeq || c.Metadata.Type == schema.NodeTypeTraceSeq {
+			return nil
+		}
+		for _, gc := range c.Children {
+			if err := walkStepFields(gc, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StepRefs returns the references to earlier steps of the enclosing sequence made
+// by the conditions of the node, not including those of nested sequences
+func (node *NodeT) StepRefs() []StepRefT {
+	var refs []StepRefT
+	_ = walkStepFields(node, func(field *FieldT) error {
+		for _, ref := range field.StepRefs {
+			if !slices.Contains(refs, ref) {
+				refs = append(refs, ref)
+			}
+		}
+		return nil
+	})
+	return refs
+}
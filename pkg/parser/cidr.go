@@ -0,0 +1,78 @@
+package parser
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrIPCidr = errors.New("invalid 'ipCidr' (requires a dot-path 'field' and one or more CIDR blocks such as 10.0.0.0/8, and cannot be combined with another condition)")
+)
+
+// parseIPCidr validates the CIDR blocks of an 'ipCidr' term and returns them in
+// canonical form, with the host bits cleared.
+func (parent *NodeT) parseIPCidr(term ParseTermT, yn *yaml.Node) ([]string, error) {
+
+	if term.IPCidr == nil {
+		return nil, nil
+	}
+
+	cn, ok := findChild(yn, docIPCidr)
+	if !ok {
+		cn = yn
+	}
+
+	var reason string
+
+	switch {
+	case len(term.IPCidr) == 0:
+		reason = "missing CIDR block"
+	case !validFieldPath(term.Field):
+		reason = "missing field"
+	case term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" || term.Exists != nil ||
+		term.Delimiter != "" || term.ValueSet != "" || len(term.Values) > 0 || term.Glob != "":
+		reason = "combined with another condition"
+	}
+
+	var prefixes = make([]string, 0, len(term.IPCidr))
+
+	for i, s := range term.IPCidr {
+		if reason != "" {
+			break
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			reason = err.Error()
+			if item, ok := seqItem(cn, i); ok {
+				cn = item
+			}
+			break
+		}
+
+		prefixes = append(prefixes, prefix.Masked().String())
+	}
+
+	if reason == "" {
+		return prefixes, nil
+	}
+
+	log.Error().
+		Str("field", term.Field).
+		Strs("ip_cidr", term.IPCidr).
+		Str("reason", reason).
+		Msg("Invalid ipCidr")
+
+	return nil, pqerr.Wrap(
+		pqerr.Pos{Line: cn.Line, Col: cn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		ErrIPCidr,
+		reason,
+	)
+}
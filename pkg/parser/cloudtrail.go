@@ -0,0 +1,66 @@
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrCloudTrailField  = errors.New("unknown cloudtrail field (must be one of eventName, eventSource, eventType, errorCode, errorMessage, awsRegion, sourceIPAddress, userAgent, userIdentity.<key>, requestParameters.<key>, or responseElements.<key>)")
+	ErrCloudTrailSource = errors.New("invalid cloudtrail eventSource (must be a service endpoint such as iam.amazonaws.com)")
+)
+
+const cloudTrailSource = "eventSource"
+
+// Top-level fields of a CloudTrail record
+var cloudTrailFields = map[string]bool{
+	"eventName":          true,
+	cloudTrailSource:     true,
+	"eventType":          true,
+	"errorCode":          true,
+	"errorMessage":       true,
+	"awsRegion":          true,
+	"sourceIPAddress":    true,
+	"userAgent":          true,
+	"recipientAccountId": true,
+}
+
+// Objects of a CloudTrail record whose keys are matched by prefix
+var cloudTrailObjects = []string{"userIdentity.", "requestParameters.", "responseElements."}
+
+var cloudTrailSourceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*\.amazonaws\.com$`)
+
+// knownCloudTrailField reports whether a condition on CloudTrail records may name the field
+func knownCloudTrailField(field string) bool {
+
+	if cloudTrailFields[field] {
+		return true
+	}
+
+	for _, prefix := range cloudTrailObjects {
+		if key, ok := strings.CutPrefix(field, prefix); ok && validFieldPath(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cloudTrailSources reports whether the values of an eventSource condition are
+// service endpoints, such as s3.amazonaws.com
+func cloudTrailSources(field *FieldT) bool {
+
+	values := field.Values
+	if field.StrValue != "" {
+		values = append([]string{field.StrValue}, values...)
+	}
+
+	for _, v := range values {
+		if !cloudTrailSourceRegex.MatchString(v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrCompare      = errors.New("invalid comparison (use exactly one of 'gt', 'gte', 'lt', 'lte', or 'eq')")
+	ErrCompareField = errors.New("comparisons require a dot-path 'field' and cannot be combined with a string, jq, regex, exists, or value set condition")
+)
+
+// CompareOpT is a numeric comparison of a structured field
+type CompareOpT string
+
+const (
+	CompareGt  CompareOpT = "gt"
+	CompareGte CompareOpT = "gte"
+	CompareLt  CompareOpT = "lt"
+	CompareLte CompareOpT = "lte"
+	CompareEq  CompareOpT = "eq"
+)
+
+// CompareT compares the number at a dot-path field, such as response.latency_ms,
+// with Value. Fields that are missing or not numbers do not match.
+type CompareT struct {
+	Op       CompareOpT `json:"op"`
+	Value    float64    `json:"value"`
+	Duration bool       `json:"duration,omitempty"` // Value is a duration in nanoseconds
+}
+
+// ParseNumberT is a comparison threshold: a number, or a duration such as 500ms.
+// Durations are in nanoseconds and only compare span durations.
+type ParseNumberT struct {
+	Value    float64
+	Duration bool
+}
+
+func (n *ParseNumberT) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&n.Value); err == nil {
+		return nil
+	}
+
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	n.Value, n.Duration = float64(d), true
+
+	return nil
+}
+
+// MarshalJSON hashes a threshold by its value
+func (n ParseNumberT) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.Value)
+}
+
+func hasCompare(term ParseTermT) bool {
+	return term.Gt != nil || term.Gte != nil || term.Lt != nil || term.Lte != nil || term.Eq != nil
+}
+
+// parseCompare returns the comparison of the term, or nil if it has none
+func (parent *NodeT) parseCompare(term ParseTermT, yn *yaml.Node) (*CompareT, error) {
+
+	if !hasCompare(term) {
+		return nil, nil
+	}
+
+	var cmp *CompareT
+	for _, c := range []struct {
+		op CompareOpT
+		v  *ParseNumberT
+	}{
+		{CompareGt, term.Gt},
+		{CompareGte, term.Gte},
+		{CompareLt, term.Lt},
+		{CompareLte, term.Lte},
+		{CompareEq, term.Eq},
+	} {
+		if c.v == nil {
+			continue
+		}
+		if cmp != nil {
+			log.Error().
+				Str("field", term.Field).
+				Str("op", string(c.op)).
+				Msg("Multiple comparison operators")
+			return nil, parent.wrapNodeError(compareNode(yn, c.op), ErrCompare)
+		}
+		cmp = &CompareT{Op: c.op, Value: c.v.Value, Duration: c.v.Duration}
+	}
+
+	if !validFieldPath(term.Field) || term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" ||
+		term.Exists != nil || term.Delimiter != "" || term.ValueSet != "" || len(term.Values) > 0 ||
+		term.Strings != nil || term.Regexes != nil || term.ValuesFrom != "" || term.IPCidr != nil || term.Glob != "" {
+		log.Error().
+			Str("field", term.Field).
+			Msg("Invalid comparison field")
+		return nil, parent.wrapNodeError(compareNode(yn, cmp.Op), ErrCompareField)
+	}
+
+	return cmp, nil
+}
+
+// validFieldPath reports whether s is a dot-path of one or more non-empty keys
+func validFieldPath(s string) bool {
+	if s == "" || strings.ContainsAny(s, "[]") {
+		return false
+	}
+	for _, key := range strings.Split(s, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func compareNode(yn *yaml.Node, op CompareOpT) *yaml.Node {
+	if n, ok := findChild(yn, string(op)); ok {
+		return n
+	}
+	return yn
+}
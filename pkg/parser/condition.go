@@ -0,0 +1,450 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrCondition      = errors.New("invalid 'condition'")
+	ErrConditionMatch = errors.New("'condition' cannot be combined with 'match' or 'negate'")
+	ErrConditionNot   = errors.New("'not' must be an operand of 'and' with at least one term that is not negated")
+)
+
+type BoolOpT string
+
+const (
+	BoolOpTerm BoolOpT = "term"
+	BoolOpAnd  BoolOpT = "and"
+	BoolOpOr   BoolOpT = "or"
+	BoolOpNot  BoolOpT = "not"
+)
+
+// BoolExprT is a parsed 'condition' expression such as "(a and b) or (c and not d)".
+// Operands of 'and' and 'or' are flattened, so an operand never has the same
+// operator as its parent.
+type BoolExprT struct {
+	Op   BoolOpT      `json:"op"`
+	Term string       `json:"term,omitempty"` // BoolOpTerm only
+	Args []*BoolExprT `json:"args,omitempty"`
+	Pos  pqerr.Pos    `json:"pos"` // Position of the term or operator in the rule document
+}
+
+func (e *BoolExprT) String() string {
+	switch e.Op {
+	case BoolOpTerm:
+		return e.Term
+	case BoolOpNot:
+		return "not " + e.Args[0].String()
+	}
+
+	var args = make([]string, 0, len(e.Args))
+	for _, arg := range e.Args {
+		if arg.Op == BoolOpAnd || arg.Op == BoolOpOr {
+			args = append(args, "("+arg.String()+")")
+		} else {
+			args = append(args, arg.String())
+		}
+	}
+	return strings.Join(args, " "+string(e.Op)+" ")
+}
+
+// ParseCondition parses a boolean expression of term names joined with 'and',
+// 'or', 'not', and parentheses. 'not' binds tightest, then 'and', then 'or'.
+// Keywords are case insensitive. yn is the scalar holding the expression and is
+// used to position terms and errors; it may be nil.
+func ParseCondition(s string, yn *yaml.Node) (*BoolExprT, error) {
+
+	var p = &condParserT{src: s, yn: yn}
+
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok != nil {
+		return nil, p.errorAt(tok.off, fmt.Sprintf("unexpected %q", tok.text))
+	}
+
+	return expr, nil
+}
+
+type condTokenT struct {
+	text string
+	off  int // Byte offset in the expression
+}
+
+type condParserT struct {
+	src    string
+	yn     *yaml.Node
+	tokens []condTokenT
+	next   int
+}
+
+func (p *condParserT) tokenize() error {
+	for i := 0; i < len(p.src); {
+		c := rune(p.src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			p.tokens = append(p.tokens, condTokenT{text: string(c), off: i})
+			i++
+		case isTermNameChar(c):
+			j := i
+			for j < len(p.src) && isTermNameChar(rune(p.src[j])) {
+				j++
+			}
+			p.tokens = append(p.tokens, condTokenT{text: p.src[i:j], off: i})
+			i = j
+		default:
+			return p.errorAt(i, fmt.Sprintf("unexpected %q", c))
+		}
+	}
+
+	if len(p.tokens) == 0 {
+		return p.errorAt(0, "empty expression")
+	}
+
+	return nil
+}
+
+func isTermNameChar(c rune) bool {
+	return c == '_' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func (p *condParserT) peek() *condTokenT {
+	if p.next >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.next]
+}
+
+// accept consumes the next token if it is the keyword kw
+func (p *condParserT) accept(kw string) (*condTokenT, bool) {
+	tok := p.peek()
+	if tok == nil || !strings.EqualFold(tok.text, kw) {
+		return nil, false
+	}
+	p.next++
+	return tok, true
+}
+
+func (p *condParserT) parseOr() (*BoolExprT, error) {
+	return p.parseBinary(BoolOpOr, p.parseAnd)
+}
+
+func (p *condParserT) parseAnd() (*BoolExprT, error) {
+	return p.parseBinary(BoolOpAnd, p.parseUnary)
+}
+
+func (p *condParserT) parseBinary(op BoolOpT, operand func() (*BoolExprT, error)) (*BoolExprT, error) {
+
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	var expr = &BoolExprT{Op: op, Pos: first.Pos}
+	expr.add(first)
+
+	for {
+		if _, ok := p.accept(string(op)); !ok {
+			break
+		}
+		arg, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		expr.add(arg)
+	}
+
+	if len(expr.Args) == 1 {
+		return expr.Args[0], nil
+	}
+
+	return expr, nil
+}
+
+// add appends arg, flattening operands with the same operator
+func (e *BoolExprT) add(arg *BoolExprT) {
+	if arg.Op == e.Op {
+		e.Args = append(e.Args, arg.Args...)
+		return
+	}
+	e.Args = append(e.Args, arg)
+}
+
+func (p *condParserT) parseUnary() (*BoolExprT, error) {
+
+	if tok, ok := p.accept(string(BoolOpNot)); ok {
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		// Double negation cancels out
+		if arg.Op == BoolOpNot {
+			return arg.Args[0], nil
+		}
+		return &BoolExprT{Op: BoolOpNot, Args: []*BoolExprT{arg}, Pos: p.pos(tok.off)}, nil
+	}
+
+	tok := p.peek()
+	switch {
+	case tok == nil:
+		return nil, p.errorAt(len(p.src), "unexpected end of expression")
+
+	case tok.text == "(":
+		p.next++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			off := len(p.src)
+			if next := p.peek(); next != nil {
+				off = next.off
+			}
+			return nil, p.errorAt(off, "missing ')'")
+		}
+		return expr, nil
+
+	case tok.text == ")" || isCondKeyword(tok.text):
+		return nil, p.errorAt(tok.off, fmt.Sprintf("unexpected %q", tok.text))
+	}
+
+	p.next++
+	return &BoolExprT{Op: BoolOpTerm, Term: tok.text, Pos: p.pos(tok.off)}, nil
+}
+
+func isCondKeyword(s string) bool {
+	for _, op := range []BoolOpT{BoolOpAnd, BoolOpOr, BoolOpNot} {
+		if strings.EqualFold(s, string(op)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pos converts an offset in the expression to a position in the document.
+// Offsets are exact for plain and single line quoted scalars.
+func (p *condParserT) pos(off int) pqerr.Pos {
+	if p.yn == nil {
+		return pqerr.Pos{Col: off + 1}
+	}
+	col := p.yn.Column + off
+	if p.yn.Style == yaml.DoubleQuotedStyle || p.yn.Style == yaml.SingleQuotedStyle {
+		col++
+	}
+	return pqerr.Pos{Line: p.yn.Line, Col: col}
+}
+
+func (p *condParserT) errorAt(off int, msg string) error {
+	return pqerr.Wrap(p.pos(off), "", "", "", ErrCondition, msg)
+}
+
+// applyCondition lowers the condition of a set into match and negate terms:
+// 'and' operands become the terms of the set, 'or' becomes an 'anyOf' group, or a
+// single term matching any of the values if every operand is a value term, and
+// a nested 'and' becomes an 'allOf' group, or a set with the enclosing window if
+// it negates terms. Returns the lowered copy of the set and the condition node.
+func (node *NodeT) applyCondition(set *ParseSetT, tm map[string]ParseTermT, yn *yaml.Node) (*ParseSetT, *yaml.Node, error) {
+
+	var (
+		lowered = *set
+		condYn  *yaml.Node
+		ok      bool
+	)
+
+	if condYn, ok = findChild(yn, docCond); !ok {
+		condYn = yn
+	}
+
+	if set.Match != nil || set.Negate != nil {
+		return nil, nil, node.wrapNodeError(condYn, ErrConditionMatch)
+	}
+
+	expr, err := ParseCondition(set.Condition, condYn)
+	if err != nil {
+		return nil, nil, withRule(err, node)
+	}
+
+	if err = node.checkConditionTerms(expr, tm); err != nil {
+		return nil, nil, err
+	}
+
+	if lowered.Match, lowered.Negate, err = node.lowerAnd(expr, tm, set.Window); err != nil {
+		return nil, nil, err
+	}
+
+	node.Metadata.Condition = expr
+
+	return &lowered, condYn, nil
+}
+
+// checkConditionTerms verifies that every term named by the condition is defined
+func (node *NodeT) checkConditionTerms(expr *BoolExprT, tm map[string]ParseTermT) error {
+	if expr.Op == BoolOpTerm {
+		if _, ok := tm[expr.Term]; !ok {
+			log.Error().
+				Str("term", expr.Term).
+				Msg("Condition term not found")
+			return pqerr.Wrap(expr.Pos, node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId, ErrTermNotFound, "term="+expr.Term)
+		}
+		return nil
+	}
+	for _, arg := range expr.Args {
+		if err := node.checkConditionTerms(arg, tm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withRule fills in the rule identity of a positioned error
+func withRule(err error, node *NodeT) error {
+	var perr *pqerr.Error
+	if errors.As(err, &perr) {
+		perr.RuleId, perr.RuleHash, perr.CreId = node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId
+	}
+	return err
+}
+
+// lowerAnd splits the operands of an 'and' (or a single operand) into positive and negated terms
+func (node *NodeT) lowerAnd(expr *BoolExprT, tm map[string]ParseTermT, window string) (match, negate []ParseTermT, err error) {
+
+	var args = []*BoolExprT{expr}
+	if expr.Op == BoolOpAnd {
+		args = expr.Args
+	}
+
+	for _, arg := range args {
+		if arg.Op == BoolOpNot {
+			t, err := node.lowerExpr(arg.Args[0], tm, window)
+			if err != nil {
+				return nil, nil, err
+			}
+			negate = append(negate, t)
+			continue
+		}
+
+		t, err := node.lowerExpr(arg, tm, window)
+		if err != nil {
+			return nil, nil, err
+		}
+		match = append(match, t)
+	}
+
+	if len(match) == 0 {
+		log.Error().
+			Str("condition", expr.String()).
+			Msg("Condition has no positive term")
+		return nil, nil, node.wrapPosError(expr.Pos, ErrConditionNot)
+	}
+
+	return match, negate, nil
+}
+
+func (node *NodeT) lowerExpr(expr *BoolExprT, tm map[string]ParseTermT, window string) (ParseTermT, error) {
+
+	switch expr.Op {
+	case BoolOpTerm:
+		return ParseTermT{TermRef: expr.Term}, nil
+
+	case BoolOpOr:
+		var terms = make([]ParseTermT, 0, len(expr.Args))
+		for _, arg := range expr.Args {
+			if arg.Op == BoolOpNot {
+				return ParseTermT{}, node.wrapPosError(arg.Pos, ErrConditionNot)
+			}
+			t, err := node.lowerExpr(arg, tm, window)
+			if err != nil {
+				return ParseTermT{}, err
+			}
+			terms = append(terms, t)
+		}
+		if t, ok := orValues(expr, tm); ok {
+			return t, nil
+		}
+		return ParseTermT{AnyOf: terms}, nil
+
+	case BoolOpAnd:
+		match, negate, err := node.lowerAnd(expr, tm, window)
+		if err != nil {
+			return ParseTermT{}, err
+		}
+		if len(negate) == 0 {
+			return ParseTermT{AllOf: match}, nil
+		}
+		return ParseTermT{Set: &ParseSetT{Window: window, Match: match, Negate: negate}}, nil
+	}
+
+	return ParseTermT{}, node.wrapPosError(expr.Pos, ErrConditionNot)
+}
+
+// orValues merges the operands of an 'or' into one term when each names a plain
+// value or regex on the same field, e.g. "a" or "b". An 'anyOf' group requires
+// sets, sequences, or promql. Values on a field match the whole value, so they
+// are not mixed with regexes there.
+func orValues(expr *BoolExprT, tm map[string]ParseTermT) (ParseTermT, bool) {
+
+	var (
+		merged  ParseTermT
+		regexes []string // Every operand as a regex
+	)
+
+	for i, arg := range expr.Args {
+		if arg.Op != BoolOpTerm {
+			return ParseTermT{}, false
+		}
+
+		var (
+			t    = tm[arg.Term]
+			rest = t
+		)
+
+		rest.Field, rest.StrValue, rest.RegexValue = "", "", ""
+		if !reflect.DeepEqual(rest, ParseTermT{}) || (t.StrValue == "") == (t.RegexValue == "") {
+			return ParseTermT{}, false
+		}
+
+		if i > 0 && t.Field != merged.Field {
+			return ParseTermT{}, false
+		}
+		merged.Field = t.Field
+
+		switch {
+		case t.StrValue != "":
+			merged.Strings = append(merged.Strings, t.StrValue)
+			regexes = append(regexes, regexp.QuoteMeta(t.StrValue))
+		default:
+			merged.Regexes = append(merged.Regexes, t.RegexValue)
+			regexes = append(regexes, t.RegexValue)
+		}
+	}
+
+	switch {
+	case merged.Strings == nil || merged.Regexes == nil:
+		return merged, true
+	case merged.Field != "":
+		return ParseTermT{}, false
+	}
+
+	return ParseTermT{Regexes: regexes}, true
+}
+
+func (node *NodeT) wrapPosError(pos pqerr.Pos, err error) error {
+	return pqerr.Wrap(pos, node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId, err)
+}
@@ -0,0 +1,61 @@
+package parser
+
+import "errors"
+
+var (
+	ErrContainerField    = errors.New("unknown container field (must be one of action, exitCode, signal, id, name, image, runtime, or labels.<key>)")
+	ErrContainerAction   = errors.New("invalid container action (use one of create, start, restart, stop, kill, die, oom, destroy, pause, or unpause)")
+	ErrContainerExitCode = errors.New("invalid container exitCode (must be a number from 0 to 255)")
+)
+
+const (
+	containerAction   = "action"
+	containerExitCode = "exitCode"
+)
+
+// Fields of a container lifecycle event from docker or containerd
+var containerFields = map[string]bool{
+	containerAction:   true,
+	containerExitCode: true, // Die events only
+	"signal":          true, // Kill events only
+	"id":              true,
+	"name":            true,
+	"image":           true,
+	"runtime":         true, // docker or containerd
+}
+
+// Lifecycle actions, with the names used by runtimes for OOM kills
+var containerActions = map[string]string{
+	"create":   "create",
+	"start":    "start",
+	"restart":  "restart",
+	"stop":     "stop",
+	"kill":     "kill",
+	"die":      "die",
+	"oom":      "oom",
+	"oom-kill": "oom",
+	"oomkill":  "oom",
+	"destroy":  "destroy",
+	"pause":    "pause",
+	"unpause":  "unpause",
+}
+
+// containerActionValues replaces the aliases in the values of an action condition
+func containerActionValues(field *FieldT) bool {
+
+	var ok bool
+
+	if field.StrValue != "" {
+		if field.StrValue, ok = containerActions[field.StrValue]; !ok {
+			return false
+		}
+	}
+
+	for i, v := range field.Values {
+		if field.Values[i], ok = containerActions[v]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,344 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+// SampleEvent is an event used to explain which conditions of a rule match.
+// Line is the raw log line; Fields holds the decoded structured event, if any.
+type SampleEvent struct {
+	Source string         `json:"source,omitempty"` // Matches any source if empty
+	Line   string         `json:"line,omitempty"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+type CondKindT string
+
+const (
+	CondKindRaw       CondKindT = "raw"
+	CondKindEq        CondKindT = "eq"
+	CondKindRegex     CondKindT = "regex"
+	CondKindExists    CondKindT = "exists"
+	CondKindDelimited CondKindT = "delimited"
+	CondKindJq        CondKindT = "jq"
+	CondKindGlob      CondKindT = "glob"
+	CondKindCompare   CondKindT = "compare"
+	CondKindIPCidr    CondKindT = "ip_cidr"
+)
+
+// CondResultT reports which sample events satisfied a single condition
+type CondResultT struct {
+	Kind    CondKindT `json:"kind"`
+	Field   string    `json:"field,omitempty"`
+	Value   string    `json:"value,omitempty"`
+	Source  string    `json:"source,omitempty"` // Event source the condition applies to
+	Negate  bool      `json:"negate,omitempty"`
+	Pos     pqerr.Pos `json:"pos"`
+	Matched []int     `json:"matched"`           // Indexes of the sample events that satisfied the condition
+	Skipped bool      `json:"skipped,omitempty"` // Condition kind is not evaluated (e.g. jq)
+}
+
+// ExplainResult holds the per-condition results for one rule, in pre-order DFS traversal
+type ExplainResult struct {
+	RuleHash   string        `json:"rule_hash"`
+	CreId      string        `json:"cre_id"`
+	Conditions []CondResultT `json:"conditions"`
+}
+
+// Unmatched returns the evaluated positive conditions that no sample event satisfied
+func (r ExplainResult) Unmatched() []CondResultT {
+	var out []CondResultT
+	for _, c := range r.Conditions {
+		if !c.Negate && !c.Skipped && len(c.Matched) == 0 {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Explain evaluates each condition of a rule against sample events. Only
+// condition-level matching is done; windows, ordering, counts, and
+// correlations are not applied. Jq conditions are reported as skipped.
+func Explain(tree *TreeT, ruleHash string, events []SampleEvent) (ExplainResult, error) {
+
+	for _, node := range tree.Nodes {
+		if node.Metadata.RuleHash != ruleHash {
+			continue
+		}
+
+		res := ExplainResult{
+			RuleHash:   ruleHash,
+			CreId:      node.Metadata.CreId,
+			Conditions: make([]CondResultT, 0),
+		}
+
+		if err := node.explain(&res, "", events); err != nil {
+			return ExplainResult{}, err
+		}
+
+		return res, nil
+	}
+
+	log.Error().
+		Str("rule_hash", ruleHash).
+		Msg("Rule not found")
+
+	return ExplainResult{}, ErrRuleNotFound
+}
+
+func (node *NodeT) explain(res *ExplainResult, source string, events []SampleEvent) error {
+
+	if node.Metadata.Event != nil {
+		source = node.Metadata.Event.Source
+	}
+
+	for _, child := range node.Children {
+		switch c := child.(type) {
+		case *NodeT:
+			if err := c.explain(res, source, events); err != nil {
+				return err
+			}
+		case *MatcherT:
+			for _, field := range c.Match.Fields {
+				if err := node.explainField(res, field, false, source, events); err != nil {
+					return err
+				}
+			}
+			for _, field := range c.Negate.Fields {
+				if err := node.explainField(res, field, true, source, events); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (node *NodeT) explainField(res *ExplainResult, field FieldT, negate bool, source string, events []SampleEvent) error {
+
+	var (
+		cond = CondResultT{
+			Field:   field.Field,
+			Source:  source,
+			Negate:  negate,
+			Pos:     field.Pos,
+			Matched: make([]int, 0),
+		}
+		re *regexp.Regexp
+	)
+
+	// A value set is evaluated as the alternation of its literals, a regex list
+	// as the alternation of its regexes
+	switch {
+	case len(field.Values) > 0:
+		field.RegexValue = ValueSetRegex(field.Values)
+	case len(field.Regexes) > 0:
+		field.RegexValue = AnyRegex(field.Regexes)
+	}
+
+	switch {
+	case field.JqValue != "":
+		cond.Kind, cond.Value, cond.Skipped = CondKindJq, field.JqValue, true
+	case field.Exists != nil:
+		cond.Kind, cond.Value = CondKindExists, fmt.Sprint(*field.Exists)
+	case field.Compare != nil:
+		cond.Kind, cond.Value = CondKindCompare, fmt.Sprintf("%s %s", field.Compare.Op, strconv.FormatFloat(field.Compare.Value, 'g', -1, 64))
+	case len(field.IPCidr) > 0:
+		cond.Kind, cond.Value = CondKindIPCidr, strings.Join(field.IPCidr, ",")
+	case field.Glob != "":
+		cond.Kind, cond.Value = CondKindGlob, field.Glob
+	case field.Delimiter != "":
+		cond.Kind, cond.Value = CondKindDelimited, field.StrValue+field.RegexValue
+	case field.RegexValue != "":
+		cond.Kind, cond.Value = CondKindRegex, field.RegexValue
+	case field.Field != "":
+		cond.Kind, cond.Value = CondKindEq, field.StrValue
+	default:
+		cond.Kind, cond.Value = CondKindRaw, field.StrValue
+	}
+
+	if !cond.Skipped {
+		regex, err := explainRegex(field)
+		if err == nil && regex != "" {
+			re, err = regexp.Compile(regex)
+		}
+		if err != nil {
+			return pqerr.Wrap(field.Pos, node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId, err)
+		}
+	}
+
+	for i, ev := range events {
+		if cond.Skipped || (ev.Source != "" && source != "" && ev.Source != source) {
+			continue
+		}
+		if matchField(field, re, ev) {
+			cond.Matched = append(cond.Matched, i)
+		}
+	}
+
+	res.Conditions = append(res.Conditions, cond)
+	return nil
+}
+
+// explainRegex returns the regex a condition is tested with, if any, folding in
+// its match options as the rule is compiled. The values of a field compare with
+// the whole value, so they are anchored; a string without a field stays a plain
+// substring unless it is matched without case or on word boundaries.
+func explainRegex(field FieldT) (string, error) {
+
+	var (
+		regex = field.RegexValue
+		opts  = field.Options
+		whole = field.Field != "" && field.Delimiter == ""
+	)
+
+	switch {
+	case field.Glob != "":
+		return GlobRegex(field.Glob)
+	case whole && len(field.Values) > 0:
+		regex = "^" + regex + "$"
+	case field.StrValue == "" || opts == nil:
+	case whole:
+		regex = "^" + ValueSetRegex([]string{field.StrValue}) + "$"
+	case opts.CaseInsensitive || opts.WordBoundary:
+		regex = regexp.QuoteMeta(field.StrValue)
+	}
+
+	if regex != "" && opts != nil {
+		regex = opts.Regex(regex)
+	}
+
+	return regex, nil
+}
+
+// fieldValue returns the value of a field of an event: the value of the key, or
+// else the value at the dot path of nested objects
+func fieldValue(fields map[string]any, field string) (any, bool) {
+
+	if v, ok := fields[field]; ok {
+		return v, true
+	}
+
+	var v any = fields
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// compareValue compares a number with the value of a comparison. Values that are
+// not numbers, including numeric strings, do not compare.
+func compareValue(cmp CompareT, v any) bool {
+
+	var n float64
+	switch v := v.(type) {
+	case float64:
+		n = v
+	case float32:
+		n = float64(v)
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	default:
+		return false
+	}
+
+	switch cmp.Op {
+	case CompareGt:
+		return n > cmp.Value
+	case CompareGte:
+		return n >= cmp.Value
+	case CompareLt:
+		return n < cmp.Value
+	case CompareLte:
+		return n <= cmp.Value
+	case CompareEq:
+		return n == cmp.Value
+	}
+
+	return false
+}
+
+// cidrValue reports whether the value is an IP address within any of the blocks.
+// IPv4-mapped IPv6 addresses match IPv4 blocks.
+func cidrValue(blocks []string, v any) bool {
+
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, b := range blocks {
+		if p, err := netip.ParsePrefix(b); err == nil && p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchField(field FieldT, re *regexp.Regexp, ev SampleEvent) bool {
+
+	// matchValue compares a value with the string or regex condition
+	matchValue := func(v string) bool {
+		if re != nil {
+			return re.MatchString(v)
+		}
+		return v == field.StrValue
+	}
+
+	switch {
+	case field.Exists != nil:
+		_, ok := ev.Fields[field.Field]
+		return ok == *field.Exists
+
+	case field.Compare != nil:
+		v, ok := fieldValue(ev.Fields, field.Field)
+		return ok && compareValue(*field.Compare, v)
+
+	case len(field.IPCidr) > 0:
+		v, ok := fieldValue(ev.Fields, field.Field)
+		return ok && cidrValue(field.IPCidr, v)
+
+	case field.Delimiter != "":
+		for _, pair := range strings.Split(ev.Line, field.Delimiter) {
+			if k, v, ok := strings.Cut(pair, "="); ok && k == field.Field {
+				return matchValue(strings.Trim(v, `"`))
+			}
+		}
+		return false
+
+	case field.Field != "" && ev.Fields != nil:
+		v, ok := fieldValue(ev.Fields, field.Field)
+		return ok && matchValue(fmt.Sprint(v))
+
+	case re != nil:
+		return re.MatchString(ev.Line)
+	}
+
+	return strings.Contains(ev.Line, field.StrValue)
+}
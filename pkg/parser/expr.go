@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+)
+
+type ExprKindT string
+
+const (
+	ExprKindRegex ExprKindT = "regex"
+	ExprKindJq    ExprKindT = "jq"
+	ExprKindGlob  ExprKindT = "glob"
+)
+
+type ExprSiteT string
+
+const (
+	ExprSiteMatch   ExprSiteT = "match"
+	ExprSiteNegate  ExprSiteT = "negate"
+	ExprSiteExtract ExprSiteT = "extract"
+)
+
+// ExprRef locates a regex, jq, or glob expression in a rule for static analysis
+type ExprRef struct {
+	Kind     ExprKindT `json:"kind"`
+	Site     ExprSiteT `json:"site"`
+	Text     string    `json:"text"`
+	RuleId   string    `json:"rule_id"`
+	RuleHash string    `json:"rule_hash"`
+	CreId    string    `json:"cre_id"`
+	Pos      pqerr.Pos `json:"pos"` // Position of the condition or extract
+}
+
+// Expressions returns every regex, jq, and glob expression in the tree, in pre-order DFS traversal
+func (t *TreeT) Expressions() []ExprRef {
+	var refs = make([]ExprRef, 0)
+
+	for _, node := range t.Nodes {
+		refs = node.appendExpressions(refs)
+	}
+
+	return refs
+}
+
+func (node *NodeT) appendExpressions(refs []ExprRef) []ExprRef {
+
+	for _, child := range node.Children {
+		switch c := child.(type) {
+		case *NodeT:
+			refs = c.appendExpressions(refs)
+		case *MatcherT:
+			for _, field := range c.Match.Fields {
+				refs = node.appendFieldExpressions(refs, field, ExprSiteMatch)
+			}
+			for _, field := range c.Negate.Fields {
+				refs = node.appendFieldExpressions(refs, field, ExprSiteNegate)
+			}
+		}
+	}
+
+	return refs
+}
+
+func (node *NodeT) appendFieldExpressions(refs []ExprRef, field FieldT, site ExprSiteT) []ExprRef {
+
+	refs = node.appendExpr(refs, ExprKindRegex, site, field.RegexValue, field.Pos)
+	for _, r := range field.Regexes {
+		refs = node.appendExpr(refs, ExprKindRegex, site, r, field.Pos)
+	}
+	refs = node.appendExpr(refs, ExprKindGlob, site, field.Glob, field.Pos)
+	refs = node.appendExpr(refs, ExprKindJq, site, field.JqValue, field.Pos)
+
+	for _, extract := range field.Extract {
+		pos := extract.Pos
+		if pos == (pqerr.Pos{}) {
+			pos = field.Pos
+		}
+		refs = node.appendExpr(refs, ExprKindRegex, ExprSiteExtract, extract.RegexValue, pos)
+		refs = node.appendExpr(refs, ExprKindJq, ExprSiteExtract, extract.JqValue, pos)
+	}
+
+	return refs
+}
+
+func (node *NodeT) appendExpr(refs []ExprRef, kind ExprKindT, site ExprSiteT, text string, pos pqerr.Pos) []ExprRef {
+
+	if text == "" {
+		return refs
+	}
+
+	return append(refs, ExprRef{
+		Kind:     kind,
+		Site:     site,
+		Text:     text,
+		RuleId:   node.Metadata.RuleId,
+		RuleHash: node.Metadata.RuleHash,
+		CreId:    node.Metadata.CreId,
+		Pos:      pos,
+	})
+}
@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrGlob = errors.New("invalid 'glob' ('*' matches any characters, '?' one character, [abc] or [!abc] a class, and '\\' escapes)")
+)
+
+// GlobRegex converts a glob to an equivalent regex that matches the whole value.
+// '*' matches any run of characters, '?' any one character, [abc], [a-z], and
+// [!abc] a character class, and '\' escapes the next character.
+func GlobRegex(glob string) (string, error) {
+
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+
+	for i := 0; i < len(glob); {
+		r, size := utf8.DecodeRuneInString(glob[i:])
+		i += size
+
+		switch r {
+		case '*':
+			for i < len(glob) && glob[i] == '*' {
+				i++
+			}
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i == len(glob) {
+				return "", errors.New("trailing '\\'")
+			}
+			r, size = utf8.DecodeRuneInString(glob[i:])
+			i += size
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		case '[':
+			class, n, err := globClass(glob[i:])
+			if err != nil {
+				return "", err
+			}
+			i += n
+			b.WriteString(class)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return b.String(), nil
+}
+
+// globClass converts the character class that follows a '[' and returns the
+// number of bytes consumed, including the closing ']'
+func globClass(s string) (string, int, error) {
+
+	var (
+		b strings.Builder
+		i = 0
+	)
+
+	b.WriteString("[")
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		b.WriteString("^")
+		i++
+	}
+
+	for start := i; ; {
+		if i == len(s) {
+			return "", 0, errors.New("missing ']'")
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == ']' && i > start:
+			b.WriteString("]")
+			return b.String(), i + size, nil
+		case r == '\\':
+			if i+size == len(s) {
+				return "", 0, errors.New("trailing '\\'")
+			}
+			i += size
+			r, size = utf8.DecodeRuneInString(s[i:])
+			b.WriteString(`\` + string(r))
+		case r == '-' && i > start && i+size < len(s) && s[i+size] != ']':
+			b.WriteString("-")
+		case r == '[' || r == ']' || r == '^' || r == '-':
+			b.WriteString(`\` + string(r))
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+}
+
+// parseGlob validates the 'glob' of a term
+func (parent *NodeT) parseGlob(term ParseTermT, yn *yaml.Node) error {
+
+	if term.Glob == "" {
+		return nil
+	}
+
+	var reason string
+
+	if term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" || term.Exists != nil ||
+		term.Delimiter != "" || len(term.Values) > 0 || term.Regexes != nil {
+		reason = "combined with another condition"
+	} else if re, err := GlobRegex(term.Glob); err != nil {
+		reason = err.Error()
+	} else if _, err = regexp.Compile(re); err != nil {
+		reason = err.Error()
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	gn, ok := findChild(yn, docGlob)
+	if !ok {
+		gn = yn
+	}
+
+	log.Error().
+		Str("glob", term.Glob).
+		Str("reason", reason).
+		Msg("Invalid glob")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: gn.Line, Col: gn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		ErrGlob,
+		reason,
+	)
+}
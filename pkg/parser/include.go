@@ -0,0 +1,196 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInclude      = errors.New("invalid 'include'")
+	ErrIncludeURL   = errors.New("'include' of a URL requires WithIncludeURLs")
+	ErrIncludeFile  = errors.New("'include' of a file requires WithIncludeResolver")
+	ErrIncludeParse = errors.New("'include' is only resolved by Read and ReadFiles")
+)
+
+// includeT is an entry of the 'include' section. The short form is a bare path:
+//
+//	include:
+//	  - common/terms.yaml
+//	  - path: https://example.com/rules/network.yaml
+//	    rules: true
+//
+// Relative paths are resolved against the directory of the including file.
+// Terms are always merged; rules only if Rules is set. Files are opened with the
+// resolver of WithIncludeResolver, and URLs only WithIncludeURLs.
+type includeT struct {
+	Path  string `yaml:"path"`
+	Rules bool   `yaml:"rules,omitempty"`
+
+	rulesOnly bool // The terms were merged when the file was read before
+}
+
+func (o *includeT) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		o.Path = str
+		return nil
+	}
+	type plain includeT
+	return unmarshal((*plain)(o))
+}
+
+// IncludeResolverT opens a local 'include' location, a path already resolved
+// against the directory of the including file
+type IncludeResolverT func(path string) (io.ReadCloser, error)
+
+// WithIncludeResolver allows 'include' entries to read local files with resolver.
+// Without it, only URLs may be included, and only WithIncludeURLs.
+func WithIncludeResolver(resolver IncludeResolverT) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.includeResolver = resolver
+	}
+}
+
+// FSIncludeResolver opens 'include' paths in fsys. Paths are relative to the root
+// of fsys, so the files read with it should be named by paths in fsys too.
+func FSIncludeResolver(fsys fs.FS) IncludeResolverT {
+	return func(path string) (io.ReadCloser, error) {
+		return fsys.Open(filepath.ToSlash(path))
+	}
+}
+
+// OSIncludeResolver opens 'include' paths on the local file system, as ReadFiles
+// opens its files
+func OSIncludeResolver(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// WithIncludeURLs allows 'include' entries to fetch http(s) URLs with client.
+// A nil client uses http.DefaultClient.
+func WithIncludeURLs(client *http.Client) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		o.includeClient = client
+	}
+}
+
+// include reads the files listed in an 'include' section. Each location is read
+// at most once per reader, whether included or read directly, which also breaks
+// include cycles. A file first included for its terms is read again only for its
+// rules.
+func (r *readerT) include(yn *yaml.Node, from string) error {
+
+	var specs []includeT
+	if err := yn.Decode(&specs); err != nil {
+		return pqerr.Wrap(pqerr.Pos{Line: yn.Line, Col: yn.Column}, "", "", "", ErrInclude, err.Error())
+	}
+
+	for i, spec := range specs {
+		var (
+			item, _ = seqItem(yn, i)
+			pos     = pqerr.Pos{Line: item.Line, Col: item.Column}
+		)
+
+		if spec.Path == "" {
+			return pqerr.Wrap(pos, "", "", "", ErrInclude, "missing path")
+		}
+
+		loc := resolveInclude(spec.Path, from)
+		key := includeKey(loc)
+		delete(r.termsOnly, key)
+
+		rules, ok := r.included[key]
+		if ok && (rules || !spec.Rules) {
+			continue
+		}
+		spec.rulesOnly = ok
+		r.included[key] = spec.Rules
+
+		rc, err := r.openInclude(loc)
+		if err != nil {
+			log.Error().Err(err).Str("include", loc).Msg("Failed to open include")
+			return pqerr.Wrap(pos, "", "", "", err, fmt.Sprintf("include=%s", loc))
+		}
+
+		err = r.readDocs(rc, loc, spec, true)
+		rc.Close()
+
+		if err != nil {
+			var perr *pqerr.Error
+			if errors.As(err, &perr) {
+				return pqerr.WithFile(err, loc)
+			}
+			return pqerr.Wrap(pos, "", "", "", err, fmt.Sprintf("include=%s", loc))
+		}
+	}
+
+	return nil
+}
+
+func (r *readerT) openInclude(loc string) (io.ReadCloser, error) {
+
+	if !isURL(loc) {
+		if r.o.includeResolver == nil {
+			return nil, ErrIncludeFile
+		}
+		return r.o.includeResolver(loc)
+	}
+
+	if r.o.includeClient == nil {
+		return nil, ErrIncludeURL
+	}
+
+	resp, err := r.o.includeClient.Get(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: status=%s", ErrInclude, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// resolveInclude resolves path relative to the file or URL that includes it
+func resolveInclude(path, from string) string {
+
+	switch {
+	case isURL(path) || filepath.IsAbs(path):
+		return path
+	case isURL(from):
+		return from[:strings.LastIndex(from, "/")+1] + path
+	case from == "":
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(from), path)
+}
+
+// includeKey normalizes a location so that the same file is recognized by any path
+func includeKey(loc string) string {
+	if isURL(loc) {
+		return loc
+	}
+	if abs, err := filepath.Abs(loc); err == nil {
+		return abs
+	}
+	return filepath.Clean(loc)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
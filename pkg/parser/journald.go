@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"errors"
+)
+
+var (
+	ErrJournaldField    = errors.New("unknown journald field (fields are upper case, such as MESSAGE, PRIORITY, UNIT, or SYSLOG_IDENTIFIER)")
+	ErrJournaldPriority = errors.New("invalid journald PRIORITY (use 0-7 or one of emerg, alert, crit, err, warning, notice, info, or debug)")
+)
+
+// PRIORITY holds the syslog severity of an entry as a number
+const journaldPriority = "PRIORITY"
+
+// knownJournaldField reports whether the field is a journal field name: upper case
+// letters, digits, and underscores, not starting with a digit. Trusted fields such
+// as _SYSTEMD_UNIT start with an underscore.
+func knownJournaldField(field string) bool {
+
+	for i, c := range []byte(field) {
+		switch {
+		case c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidJSON = errors.New("invalid JSON rules document")
+)
+
+// ParseJSON parses a rules document written in JSON. The schema and key names are
+// the same as the YAML form. JSON is a subset of YAML, so the document is parsed by
+// the YAML path and errors carry the line and column in the JSON source.
+func ParseJSON(data []byte, opts ...ParseOptT) (*TreeT, error) {
+
+	var (
+		config *RulesT
+		err    error
+	)
+
+	if config, err = UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+
+	return ParseRules(config, opts)
+}
+
+// UnmarshalJSON is the JSON counterpart of Unmarshal
+func UnmarshalJSON(data []byte) (*RulesT, error) {
+
+	if err := validJSON(data); err != nil {
+		return nil, err
+	}
+
+	return Unmarshal(data)
+}
+
+// validJSON rejects YAML-only syntax, so a JSON document is never silently
+// accepted because it happens to be valid YAML
+func validJSON(data []byte) error {
+
+	var (
+		dec = json.NewDecoder(bytes.NewReader(data))
+		v   any
+	)
+
+	err := dec.Decode(&v)
+	if err == nil {
+		end := dec.InputOffset()
+		if _, err = dec.Token(); errors.Is(err, io.EOF) {
+			return nil
+		}
+		return pqerr.Wrap(offsetPos(data, end), "", "", "", ErrInvalidJSON, "trailing data")
+	}
+
+	var (
+		syntaxErr *json.SyntaxError
+		pos       pqerr.Pos
+	)
+
+	// The decoder reports the offset just past the offending byte
+	if errors.As(err, &syntaxErr) && syntaxErr.Offset > 0 {
+		pos = offsetPos(data, syntaxErr.Offset-1)
+	}
+
+	log.Error().Err(err).Msg("Invalid JSON")
+
+	return pqerr.Wrap(pos, "", "", "", ErrInvalidJSON, err.Error())
+}
+
+// offsetPos converts a byte offset into a one-based line and column
+func offsetPos(data []byte, offset int64) pqerr.Pos {
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	var (
+		prefix = data[:offset]
+		line   = bytes.Count(prefix, []byte("\n")) + 1
+		col    = len(prefix) - bytes.LastIndexByte(prefix, '\n')
+	)
+
+	return pqerr.Pos{Line: line, Col: col}
+}
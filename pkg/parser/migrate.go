@@ -0,0 +1,221 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrMigrateConflict = errors.New("legacy key conflicts with its replacement")
+	ErrMigrateHash     = errors.New("migration changed the rule's stable hash")
+)
+
+// MigrationNote describes one change applied by Migrate
+type MigrationNote struct {
+	Pos     pqerr.Pos `json:"pos"`     // Position in the original document
+	From    string    `json:"from"`    // Legacy form
+	To      string    `json:"to"`      // Replacement
+	Neutral bool      `json:"neutral"` // Change does not alter the rule's behavior
+}
+
+func (n MigrationNote) String() string {
+	return fmt.Sprintf("line=%d, col=%d: %s -> %s", n.Pos.Line, n.Pos.Col, n.From, n.To)
+}
+
+// keyRenames maps legacy keys to their current spelling. The legacy keys were
+// never decoded, so renaming them changes the rule's behavior.
+var keyRenames = map[string]string{
+	"abs":             docAbs,
+	"require_sources": docReqSrcs,
+	"order_tolerance": docOrdTol,
+}
+
+// Migrate rewrites a rules document to the current schema and returns the upgraded
+// document with a note per change. Rules touched only by behavior-neutral changes are
+// verified to keep their StableHash.
+func Migrate(data []byte) ([]byte, []MigrationNote, error) {
+
+	var (
+		dec   = yaml.NewDecoder(bytes.NewReader(data))
+		notes = make([]MigrationNote, 0)
+		buf   bytes.Buffer
+		enc   = yaml.NewEncoder(&buf)
+	)
+
+	enc.SetIndent(2)
+
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, nil, err
+		}
+
+		docNotes, err := migrateDoc(&doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		notes = append(notes, docNotes...)
+
+		if err = enc.Encode(&doc); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(notes) == 0 {
+		return data, notes, nil
+	}
+
+	return buf.Bytes(), notes, nil
+}
+
+func migrateDoc(doc *yaml.Node) ([]MigrationNote, error) {
+
+	var (
+		notes   = make([]MigrationNote, 0)
+		changed = make(map[int]bool) // Rules with a behavior-changing note
+		before  []byte
+		err     error
+	)
+
+	if len(doc.Content) == 0 {
+		return notes, nil
+	}
+
+	if before, err = yaml.Marshal(doc); err != nil {
+		return nil, err
+	}
+
+	if rulesNode, ok := findChild(doc.Content[0], docRules); ok {
+		for i, ruleNode := range rulesNode.Content {
+			var ruleNotes []MigrationNote
+			if err = migrateNode(ruleNode, &ruleNotes); err != nil {
+				return nil, err
+			}
+			for _, note := range ruleNotes {
+				changed[i] = changed[i] || !note.Neutral
+			}
+			notes = append(notes, ruleNotes...)
+		}
+	}
+
+	if termsNode, ok := findChild(doc.Content[0], docTerms); ok {
+		if err = migrateNode(termsNode, &notes); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(notes) == 0 {
+		return notes, nil
+	}
+
+	after, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = verifyMigration(before, after, changed); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+func migrateNode(n *yaml.Node, notes *[]MigrationNote) error {
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i < len(n.Content); i += 2 {
+			k := n.Content[i]
+			to, ok := keyRenames[k.Value]
+			if !ok {
+				continue
+			}
+			if _, dup := findChild(n, to); dup {
+				return pqerr.Wrap(pqerr.Pos{Line: k.Line, Col: k.Column}, "", "", "", ErrMigrateConflict, fmt.Sprintf("key=%s", k.Value))
+			}
+			*notes = append(*notes, MigrationNote{
+				Pos:  pqerr.Pos{Line: k.Line, Col: k.Column},
+				From: k.Value,
+				To:   to,
+			})
+			k.Value = to
+		}
+
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			// A term with only a string value is written in its short form
+			if item.Kind == yaml.MappingNode && len(item.Content) == 2 &&
+				item.Content[0].Value == "value" && item.Content[1].Kind == yaml.ScalarNode {
+				*notes = append(*notes, MigrationNote{
+					Pos:     pqerr.Pos{Line: item.Line, Col: item.Column},
+					From:    "value: " + item.Content[1].Value,
+					To:      item.Content[1].Value,
+					Neutral: true,
+				})
+				n.Content[i] = item.Content[1]
+			}
+		}
+	}
+
+	for _, c := range n.Content {
+		if err := migrateNode(c, notes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyMigration checks that rules without behavior-changing notes keep their StableHash
+func verifyMigration(before, after []byte, changed map[int]bool) error {
+
+	oldRules, _, err := _parse(before)
+	if err != nil {
+		return err
+	}
+
+	newRules, _, err := _parse(after)
+	if err != nil {
+		return err
+	}
+
+	for i, rule := range oldRules.Rules {
+		if changed[i] || i >= len(newRules.Rules) {
+			continue
+		}
+
+		oldHash, err := StableHash(rule)
+		if err != nil {
+			return err
+		}
+
+		newHash, err := StableHash(newRules.Rules[i])
+		if err != nil {
+			return err
+		}
+
+		if oldHash != newHash {
+			log.Error().
+				Str("cre_id", rule.Cre.Id).
+				Str("old_hash", oldHash).
+				Str("new_hash", newHash).
+				Msg("Migration changed stable hash")
+			return pqerr.Wrap(pqerr.Pos{}, rule.Metadata.Id, rule.Metadata.Hash, rule.Cre.Id, ErrMigrateHash)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+)
+
+var (
+	ErrFlowField     = errors.New("unknown netflow field (must be one of src_ip, dst_ip, src_port, dst_port, protocol, bytes, or packets)")
+	ErrFlowCondition = errors.New("invalid netflow condition (IP fields take addresses or 'ipCidr', ports and counters take numbers or comparisons, and protocol takes names such as tcp or numbers)")
+	ErrFlowSequence  = errors.New("netflow events are matched by sets and aggregates, not sequences")
+)
+
+type flowKindT int
+
+const (
+	flowIP flowKindT = iota + 1
+	flowNumber
+	flowProtocol
+)
+
+// Fields of a flow record
+var flowFields = map[string]flowKindT{
+	"src_ip":   flowIP,
+	"dst_ip":   flowIP,
+	"src_port": flowNumber,
+	"dst_port": flowNumber,
+	"protocol": flowProtocol,
+	"bytes":    flowNumber,
+	"packets":  flowNumber,
+}
+
+// IANA numbers of common protocols. Flow records hold the number.
+var flowProtocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"gre":    47,
+	"esp":    50,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+// flowNumberField reports whether the field of a flow record is a number that
+// may be aggregated, such as bytes
+func flowNumberField(field string) bool {
+	return flowFields[field] == flowNumber
+}
+
+// checkFlowField checks that the condition suits the kind of the field. Protocol
+// names are replaced with their numbers.
+func checkFlowField(field *FieldT) bool {
+
+	if field.JqValue != "" || field.RegexValue != "" || field.Regexes != nil || field.Glob != "" ||
+		field.Delimiter != "" || field.Exists != nil || field.Options != nil || field.NegateOpts != nil {
+		return false
+	}
+
+	values := field.Values
+	if field.StrValue != "" {
+		values = append([]string{field.StrValue}, values...)
+	}
+
+	switch flowFields[field.Field] {
+	case flowIP:
+		if field.Compare != nil {
+			return false
+		}
+		for _, v := range values {
+			if _, err := netip.ParseAddr(v); err != nil {
+				return false
+			}
+		}
+	case flowNumber:
+		if len(field.IPCidr) > 0 {
+			return false
+		}
+		for _, v := range values {
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return false
+			}
+		}
+	case flowProtocol:
+		if field.Compare != nil || len(field.IPCidr) > 0 {
+			return false
+		}
+		return enumValues(field, flowProtocols, 255)
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"errors"
+	"maps"
+	"regexp"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUndefinedParam = errors.New("undefined parameter")
+)
+
+var paramRefRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// WithParams sets values for ${name} references in rules. The values override
+// the defaults declared in a rule's 'parameters' section.
+func WithParams(params map[string]string) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.params = params
+	}
+}
+
+// expandParams substitutes ${name} references in the scalars of the 'rule' section
+// and decodes the result. The expanded node keeps the positions of the template.
+// Rules without parameters are left as is, and references in the 'cre' and
+// 'metadata' sections or in the shared 'terms' section are not expanded.
+func (o *parseOptsT) expandParams(rule ParseRuleT, ruleNode *yaml.Node) (ParseRuleT, *yaml.Node, error) {
+
+	if len(rule.Parameters) == 0 && len(o.params) == 0 || ruleNode.Kind != yaml.MappingNode {
+		return rule, ruleNode, nil
+	}
+
+	idx := -1
+	for i := 0; i+1 < len(ruleNode.Content); i += 2 {
+		if ruleNode.Content[i].Value == docRule {
+			idx = i + 1
+		}
+	}
+
+	if idx < 0 || !hasParamRef(ruleNode.Content[idx]) {
+		return rule, ruleNode, nil
+	}
+
+	var (
+		params   = make(map[string]string, len(rule.Parameters)+len(o.params))
+		expanded ParseRuleT
+		node     = *ruleNode
+	)
+
+	maps.Copy(params, rule.Parameters)
+	maps.Copy(params, o.params)
+
+	body, err := expandNode(rule, ruleNode.Content[idx], params)
+	if err != nil {
+		return ParseRuleT{}, nil, err
+	}
+
+	node.Content = slices.Clone(ruleNode.Content)
+	node.Content[idx] = body
+
+	if err = node.Decode(&expanded); err != nil {
+		return ParseRuleT{}, nil, err
+	}
+
+	return expanded, &node, nil
+}
+
+// expandNode returns a copy of n with parameter references substituted
+func expandNode(rule ParseRuleT, n *yaml.Node, params map[string]string) (*yaml.Node, error) {
+
+	var (
+		c   = *n
+		err error
+	)
+
+	if n.Kind == yaml.ScalarNode {
+		c.Value = paramRefRegex.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			name := paramRefRegex.FindStringSubmatch(ref)[1]
+			v, ok := params[name]
+			if !ok && err == nil {
+				log.Error().
+					Str("param", name).
+					Str("cre_id", rule.Cre.Id).
+					Msg("Undefined parameter")
+				err = pqerr.Wrap(
+					pqerr.Pos{Line: n.Line, Col: n.Column},
+					rule.Metadata.Id,
+					rule.Metadata.Hash,
+					rule.Cre.Id,
+					ErrUndefinedParam,
+					"param="+name,
+				)
+			}
+			return v
+		})
+
+		// Expanded values are plain strings; the template may have been quoted
+		if c.Value != n.Value {
+			c.Tag = "!!str"
+		}
+
+		return &c, err
+	}
+
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		if c.Content[i], err = expandNode(rule, child, params); err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
+
+func hasParamRef(n *yaml.Node) bool {
+	if n.Kind == yaml.ScalarNode {
+		return paramRefRegex.MatchString(n.Value)
+	}
+	for _, child := range n.Content {
+		if hasParamRef(child) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,40 +1,93 @@
 package parser
 
 import (
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"gopkg.in/yaml.v3"
 )
 
 // Note that we prefer lower camel case like Kubernetes
 
 const (
-	docRules   = "rules"
-	docRule    = "rule"
-	docSeq     = "sequence"
-	docSet     = "set"
-	docOrder   = "order"
-	docWindow  = "window"
-	docMatch   = "match"
-	docNegate  = "negate"
-	docTerms   = "terms"
-	docSection = "section"
-	docVersion = "version"
+	docRules    = "rules"
+	docRule     = "rule"
+	docSeq      = "sequence"
+	docSet      = "set"
+	docOrder    = "order"
+	docWindow   = "window"
+	docMatch    = "match"
+	docNegate   = "negate"
+	docTerms    = "terms"
+	docInclude  = "include"
+	docSection  = "section"
+	docVersion  = "version"
+	docMeta     = "metadata"
+	docReqSrcs  = "requireSources"
+	docPromQL   = "promql"
+	docDesc     = "description"
+	docOrdTol   = "orderTolerance"
+	docPrio     = "priority"
+	docTermRef  = "term"
+	docRepeat   = "repeat"
+	docMaxGap   = "maxGap"
+	docOpt      = "optional"
+	docCount    = "count"
+	docRequire  = "require"
+	docUntil    = "until"
+	docCorrOn   = "correlateOn"
+	docCorrWin  = "correlationWindow"
+	docAnnots   = "annotations"
+	docValSet   = "valueSet"
+	docSlide    = "slide"
+	docAnchor   = "anchor"
+	docAbs      = "absolute"
+	docAnyOf    = "anyOf"
+	docAllOf    = "allOf"
+	docCond     = "condition"
+	docCntDist  = "countDistinct"
+	docExtract  = "extract"
+	docRegex    = "regex"
+	docType     = "type"
+	docXforms   = "transforms"
+	docAgg      = "aggregate"
+	docExpr     = "expr"
+	docStrings  = "strings"
+	docRegexes  = "regexes"
+	docValsFrom = "valuesFrom"
+	docIPCidr   = "ipCidr"
+	docGlob     = "glob"
+	docOptions  = "options"
+	docRes      = "resource"
+	docTo       = "to"
 )
 
 type ParseRuleT struct {
-	Metadata ParseRuleMetadataT `yaml:"metadata,omitempty" json:"metadata,omitempty"`
-	Cre      ParseCreT          `yaml:"cre,omitempty" json:"cre,omitempty"`
-	Rule     ParseRuleDataT     `yaml:"rule,omitempty" json:"rule,omitempty"`
+	Metadata   ParseRuleMetadataT `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	Cre        ParseCreT          `yaml:"cre,omitempty" json:"cre,omitempty"`
+	Rule       ParseRuleDataT     `yaml:"rule,omitempty" json:"rule,omitempty"`
+	Parameters map[string]string  `yaml:"parameters,omitempty" json:"parameters,omitempty"` // Defaults for ${name} references
+
+	// Digests of the 'valuesFrom' lists of the terms, keyed by reference. Set when
+	// the rule is parsed with WithValuesResolver, so the lists are part of the hash.
+	ValuesDigests map[string]string `yaml:"-" json:"values_digests,omitempty"`
 }
 
 type ParseRuleMetadataT struct {
-	Name    string `yaml:"name,omitempty" json:"name,omitempty"`
-	Id      string `yaml:"id,omitempty" json:"id,omitempty"`
-	Hash    string `yaml:"hash,omitempty" json:"hash,omitempty"`
-	Gen     uint   `yaml:"generation" json:"generation"`
-	Kind    string `yaml:"kind,omitempty" json:"kind,omitempty"`
-	Version string `yaml:"version,omitempty" json:"version,omitempty"`
+	Name           string `yaml:"name,omitempty" json:"name,omitempty"`
+	Id             string `yaml:"id,omitempty" json:"id,omitempty"`
+	Hash           string `yaml:"hash,omitempty" json:"hash,omitempty"`
+	Gen            uint   `yaml:"generation" json:"generation"`
+	Kind           string `yaml:"kind,omitempty" json:"kind,omitempty"`
+	Version        string `yaml:"version,omitempty" json:"version,omitempty"`
+	RequireSources string `yaml:"requireSources,omitempty" json:"require_sources,omitempty"`
+	Priority       int    `yaml:"priority,omitempty" json:"priority,omitempty"`
 }
 
+// Allowed values for ParseRuleMetadataT.RequireSources
+const (
+	RequireSourcesAny = "any" // Default; rule is active when any referenced source is collected
+	RequireSourcesAll = "all" // Rule is skipped unless every referenced source is collected
+)
+
 type ParseRuleDataT struct {
 	Sequence *ParseSequenceT `yaml:"sequence,omitempty"`
 	Set      *ParseSetT      `yaml:"set,omitempty"`
@@ -77,46 +130,179 @@ type ParseCreT struct {
 }
 
 type ParseSequenceT struct {
-	Window       string       `yaml:"window"`
-	Correlations []string     `yaml:"correlations,omitempty"`
-	Event        *ParseEventT `yaml:"event,omitempty"`
-	Origin       bool         `yaml:"origin,omitempty"`
-	Order        []ParseTermT `yaml:"order,omitempty"`
-	Negate       []ParseTermT `yaml:"negate,omitempty"`
+	Window            string               `yaml:"window"`
+	OrderTolerance    string               `yaml:"orderTolerance,omitempty" json:",omitempty"`
+	CorrelationWindow string               `yaml:"correlationWindow,omitempty" json:",omitempty"` // Horizon for correlating steps; defaults to window
+	Correlations      []string             `yaml:"correlations,omitempty"`
+	CorrelateOn       []ParseCorrelateKeyT `yaml:"correlateOn,omitempty" json:",omitempty"` // Extracts every step must share
+	Event             *ParseEventT         `yaml:"event,omitempty"`
+	Origin            bool                 `yaml:"origin,omitempty"`
+	Order             []ParseTermT         `yaml:"order,omitempty"`
+	Negate            []ParseTermT         `yaml:"negate,omitempty"`
 }
 
 type ParseNegateOptsT struct {
-	Window   string `yaml:"window,omitempty"`
-	Slide    string `yaml:"slide,omitempty"`
-	Anchor   uint32 `yaml:"anchor,omitempty"`
-	Absolute bool   `yaml:"absolute,omitempty"`
+	Window     string `yaml:"window,omitempty"`
+	Slide      string `yaml:"slide,omitempty"`
+	Anchor     uint32 `yaml:"anchor,omitempty"` // Index of the order or match term; a counted term is one index
+	Absolute   bool   `yaml:"absolute,omitempty"`
+	AnchorName string `yaml:"-" json:",omitempty"`               // Set when 'anchor' names a term; resolved to Anchor
+	Until      string `yaml:"until,omitempty" json:",omitempty"` // Term that ends the negation
+	UntilIdx   uint32 `yaml:"-" json:"-"`                        // Resolved index of Until
+}
+
+// parseNegateOptsT decodes negate options where 'anchor' is an index or a term name
+type parseNegateOptsT struct {
+	Window   string       `yaml:"window,omitempty"`
+	Slide    string       `yaml:"slide,omitempty"`
+	Anchor   parseAnchorT `yaml:"anchor,omitempty"`
+	Absolute bool         `yaml:"absolute,omitempty"`
+	Until    string       `yaml:"until,omitempty"`
+}
+
+type parseAnchorT struct {
+	idx  uint32
+	name string
+}
+
+func (a *parseAnchorT) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&a.idx); err == nil {
+		return nil
+	}
+	return unmarshal(&a.name)
 }
 
 type ParseTermT struct {
+	TermRef    string            `yaml:"term,omitempty" json:",omitempty"`
 	Field      string            `yaml:"field,omitempty"`
 	StrValue   string            `yaml:"value,omitempty"`
 	JqValue    string            `yaml:"jq,omitempty"`
 	RegexValue string            `yaml:"regex,omitempty"`
+	ValueSet   string            `yaml:"valueSet,omitempty" json:",omitempty"`
+	Values     []string          `yaml:"-" json:",omitempty"`                    // Set when the term is a list of literals
+	Strings    []string          `yaml:"strings,omitempty" json:",omitempty"`    // Matches any of the literals
+	Regexes    []string          `yaml:"regexes,omitempty" json:",omitempty"`    // Matches any of the regexes
+	ValuesFrom string            `yaml:"valuesFrom,omitempty" json:",omitempty"` // Matches any of the values of an external list
+	Glob       string            `yaml:"glob,omitempty" json:",omitempty"`       // Matches the whole value, e.g. *timeout*connect*
+	Options    *ParseMatchOptsT  `yaml:"options,omitempty" json:",omitempty"`    // How value and regex conditions are matched
+	IPCidr     []string          `yaml:"-" json:",omitempty"`                    // Matches an IP address field within any of the CIDR blocks
+	Exists     *bool             `yaml:"exists,omitempty" json:",omitempty"`
+	Delimiter  string            `yaml:"delimiter,omitempty" json:",omitempty"`
+	Gt         *ParseNumberT     `yaml:"gt,omitempty" json:",omitempty"` // Numeric comparisons of a dot-path field
+	Gte        *ParseNumberT     `yaml:"gte,omitempty" json:",omitempty"`
+	Lt         *ParseNumberT     `yaml:"lt,omitempty" json:",omitempty"`
+	Lte        *ParseNumberT     `yaml:"lte,omitempty" json:",omitempty"`
+	Eq         *ParseNumberT     `yaml:"eq,omitempty" json:",omitempty"`
 	Count      int               `yaml:"count,omitempty"`
+	CountRange *ParseCountRangeT `yaml:"-" json:",omitempty"` // Set when 'count' is a {min, max} range
+	Repeat     string            `yaml:"repeat,omitempty" json:",omitempty"`
+	MaxGap     string            `yaml:"maxGap,omitempty" json:",omitempty"`   // Sequence steps only; bounds the gap from the previous step
+	Optional   bool              `yaml:"optional,omitempty" json:",omitempty"` // Sequence steps only; the step may be skipped
+	Primary    bool              `yaml:"primary,omitempty" json:",omitempty"`
 	Set        *ParseSetT        `yaml:"set,omitempty"`
 	Sequence   *ParseSequenceT   `yaml:"sequence,omitempty"`
+	AnyOf      []ParseTermT      `yaml:"anyOf,omitempty" json:",omitempty"`
+	AllOf      []ParseTermT      `yaml:"allOf,omitempty" json:",omitempty"`
 	NegateOpts *ParseNegateOptsT `yaml:",inline,omitempty"`
 	PromQL     *ParsePromQL      `yaml:"promql,omitempty"`
+	Aggregate  *ParseAggregateT  `yaml:"aggregate,omitempty" json:",omitempty"`
+	Resource   *ParseResourceT   `yaml:"resource,omitempty" json:",omitempty"`
 	Extract    []ParseExtractT   `yaml:"extract,omitempty"`
+
+	// Passed through to emitted events. Excluded from the rule hash.
+	Annotations map[string]string `yaml:"annotations,omitempty" json:"-"`
 }
 
 type ParseSetT struct {
-	Window       string       `yaml:"window,omitempty"`
-	Correlations []string     `yaml:"correlations,omitempty"`
-	Event        *ParseEventT `yaml:"event,omitempty"`
-	Match        []ParseTermT `yaml:"match,omitempty"`
-	Negate       []ParseTermT `yaml:"negate,omitempty"`
+	Window            string               `yaml:"window,omitempty"`
+	CorrelationWindow string               `yaml:"correlationWindow,omitempty" json:",omitempty"` // Horizon for correlating terms; defaults to window
+	Correlations      []string             `yaml:"correlations,omitempty"`
+	CorrelateOn       []ParseCorrelateKeyT `yaml:"correlateOn,omitempty" json:",omitempty"` // Extracts every match term must share
+	Event             *ParseEventT         `yaml:"event,omitempty"`
+	Match             []ParseTermT         `yaml:"match,omitempty"`
+	Negate            []ParseTermT         `yaml:"negate,omitempty"`
+	Condition         string               `yaml:"condition,omitempty" json:",omitempty"` // Boolean expression of term names; replaces match and negate
+
+	CountDistinct *ParseCountDistinctT `yaml:"countDistinct,omitempty" json:",omitempty"`
+	Require       int                  `yaml:"require,omitempty" json:",omitempty"` // Fire when at least this many match terms match
+}
+
+// ParseCorrelateKeyT is an element of a correlation key. The short form is the
+// name of an extract present in every term. Extracts maps an event source to the
+// name of the extract that supplies the key in terms on that source:
+//
+//	correlateOn:
+//	  - namespace
+//	  - key: pod
+//	    extracts:
+//	      cre.prequel.k8s: pod_name
+type ParseCorrelateKeyT struct {
+	Key      string            `yaml:"key"`
+	Extracts map[string]string `yaml:"extracts,omitempty" json:",omitempty"`
+}
+
+func (o *ParseCorrelateKeyT) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		o.Key = str
+		return nil
+	}
+	type plain ParseCorrelateKeyT
+	return unmarshal((*plain)(o))
+}
+
+// ParseCountDistinctT fires a log set once Threshold distinct values of the
+// extract named Field are observed within the window
+type ParseCountDistinctT struct {
+	Field     string `yaml:"field"`
+	Threshold int    `yaml:"threshold"`
+}
+
+// ParseMatchOptsT modifies how the value and regex conditions of a term match
+type ParseMatchOptsT struct {
+	CaseSensitive *bool `yaml:"caseSensitive,omitempty" json:",omitempty"` // Defaults to true
+	WordBoundary  bool  `yaml:"wordBoundary,omitempty" json:",omitempty"`  // Match whole words only
+	Multiline     bool  `yaml:"multiline,omitempty" json:",omitempty"`     // '^' and '$' match at line breaks
+}
+
+// ParseCountRangeT bounds how many times a sequence step must match. A Max of zero is unbounded.
+type ParseCountRangeT struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max,omitempty"`
+}
+
+// parseCountT decodes 'count' as either a fixed count or a {min, max} range
+type parseCountT struct {
+	n int
+	r *ParseCountRangeT
+}
+
+func (c *parseCountT) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&c.n); err == nil {
+		return nil
+	}
+	c.r = &ParseCountRangeT{}
+	return unmarshal(c.r)
+}
+
+// parseStringsT is a list of strings, or a single string
+type parseStringsT []string
+
+func (l *parseStringsT) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		*l = parseStringsT{str}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
 }
 
 type ParseExtractT struct {
-	Name       string `yaml:"name"`
-	JqValue    string `yaml:"jq,omitempty"`
-	RegexValue string `yaml:"regex,omitempty"`
+	Name       string   `yaml:"name"`
+	JqValue    string   `yaml:"jq,omitempty"`
+	RegexValue string   `yaml:"regex,omitempty"`
+	Type       string   `yaml:"type,omitempty" json:",omitempty"`       // Parse the value as int, float, duration, timestamp, or bool
+	Transforms []string `yaml:"transforms,omitempty" json:",omitempty"` // Applied in order before the type, e.g. "substring(0, 8)"
 }
 
 type ParsePromQL struct {
@@ -124,6 +310,46 @@ type ParsePromQL struct {
 	Interval string       `yaml:"interval,omitempty"`
 	For      string       `yaml:"for,omitempty"`
 	Event    *ParseEventT `yaml:"event,omitempty"`
+
+	// Not supported; decoded only so that it can be rejected. PromQL uses 'for' and 'interval'.
+	Window string `yaml:"window,omitempty" json:",omitempty"`
+
+	// Human readable intent of the expression. Excluded from the rule hash.
+	Description string `yaml:"description,omitempty" json:"-"`
+}
+
+// ParseAggregateT fires when an aggregate of an extract of the matching events
+// crosses a threshold, e.g. "sum(bytes) > 1GB over 5m". The window is given by
+// the 'over' clause or by 'window'.
+type ParseAggregateT struct {
+	Expr   string       `yaml:"expr"`
+	Window string       `yaml:"window,omitempty" json:",omitempty"`
+	Event  *ParseEventT `yaml:"event,omitempty"`
+	Match  []ParseTermT `yaml:"match,omitempty"`
+}
+
+// ParseResourceT fires when a field of a Kubernetes object changes state, e.g. when
+// the availableReplicas of a Deployment drop to 0. Field is a known name for the
+// kind, such as availableReplicas, or a spec, status, or metadata dot-path.
+type ParseResourceT struct {
+	APIVersion string       `yaml:"apiVersion"`
+	Kind       string       `yaml:"kind"`
+	Namespace  string       `yaml:"namespace,omitempty" json:",omitempty"`
+	Name       string       `yaml:"name,omitempty" json:",omitempty"`
+	Field      string       `yaml:"field"`
+	From       *ParseStateT `yaml:"from,omitempty" json:",omitempty"` // Any prior state if unset
+	To         *ParseStateT `yaml:"to"`
+	Event      *ParseEventT `yaml:"event,omitempty" json:",omitempty"` // Defaults to the cre.k8s.resource source
+}
+
+// ParseStateT is a state of a resource field: a value, or one numeric comparison
+type ParseStateT struct {
+	Value string        `yaml:"value,omitempty" json:",omitempty"`
+	Gt    *ParseNumberT `yaml:"gt,omitempty" json:",omitempty"`
+	Gte   *ParseNumberT `yaml:"gte,omitempty" json:",omitempty"`
+	Lt    *ParseNumberT `yaml:"lt,omitempty" json:",omitempty"`
+	Lte   *ParseNumberT `yaml:"lte,omitempty" json:",omitempty"`
+	Eq    *ParseNumberT `yaml:"eq,omitempty" json:",omitempty"`
 }
 
 func (o *ParseTermT) UnmarshalYAML(unmarshal func(any) error) error {
@@ -132,31 +358,94 @@ func (o *ParseTermT) UnmarshalYAML(unmarshal func(any) error) error {
 		o.StrValue = str
 		return nil
 	}
+	var values []string
+	if err := unmarshal(&values); err == nil {
+		o.Values = values
+		return nil
+	}
 	var temp struct {
+		TermRef     string            `yaml:"term,omitempty"`
 		Field       string            `yaml:"field,omitempty"`
 		StrValue    string            `yaml:"value,omitempty"`
 		JqValue     string            `yaml:"jq,omitempty"`
 		RegexValue  string            `yaml:"regex,omitempty"`
-		Count       int               `yaml:"count,omitempty"`
+		ValueSet    string            `yaml:"valueSet,omitempty"`
+		Strings     []string          `yaml:"strings,omitempty"`
+		Regexes     []string          `yaml:"regexes,omitempty"`
+		ValuesFrom  string            `yaml:"valuesFrom,omitempty"`
+		Glob        string            `yaml:"glob,omitempty"`
+		Options     *ParseMatchOptsT  `yaml:"options,omitempty"`
+		IPCidr      parseStringsT     `yaml:"ipCidr,omitempty"`
+		Exists      *bool             `yaml:"exists,omitempty"`
+		Delimiter   string            `yaml:"delimiter,omitempty"`
+		Gt          *ParseNumberT     `yaml:"gt,omitempty"`
+		Gte         *ParseNumberT     `yaml:"gte,omitempty"`
+		Lt          *ParseNumberT     `yaml:"lt,omitempty"`
+		Lte         *ParseNumberT     `yaml:"lte,omitempty"`
+		Eq          *ParseNumberT     `yaml:"eq,omitempty"`
+		Count       parseCountT       `yaml:"count,omitempty"`
+		Repeat      string            `yaml:"repeat,omitempty"`
+		MaxGap      string            `yaml:"maxGap,omitempty"`
+		Optional    bool              `yaml:"optional,omitempty"`
+		Primary     bool              `yaml:"primary,omitempty"`
 		Set         *ParseSetT        `yaml:"set,omitempty"`
 		Sequence    *ParseSequenceT   `yaml:"sequence,omitempty"`
-		NegateOpts  *ParseNegateOptsT `yaml:",inline,omitempty"`
+		AnyOf       []ParseTermT      `yaml:"anyOf,omitempty"`
+		AllOf       []ParseTermT      `yaml:"allOf,omitempty"`
+		NegateOpts  *parseNegateOptsT `yaml:",inline,omitempty"`
 		ParsePromQL *ParsePromQL      `yaml:"promql,omitempty"`
+		Aggregate   *ParseAggregateT  `yaml:"aggregate,omitempty"`
+		Resource    *ParseResourceT   `yaml:"resource,omitempty"`
 		Extract     []ParseExtractT   `yaml:"extract,omitempty"`
+		Annotations map[string]string `yaml:"annotations,omitempty"`
 	}
 	if err := unmarshal(&temp); err != nil {
 		return err
 	}
+	o.TermRef = temp.TermRef
 	o.Field = temp.Field
 	o.StrValue = temp.StrValue
 	o.JqValue = temp.JqValue
 	o.RegexValue = temp.RegexValue
-	o.Count = temp.Count
+	o.ValueSet = temp.ValueSet
+	o.Strings = temp.Strings
+	o.Regexes = temp.Regexes
+	o.ValuesFrom = temp.ValuesFrom
+	o.Glob = temp.Glob
+	o.Options = temp.Options
+	o.IPCidr = temp.IPCidr
+	o.Exists = temp.Exists
+	o.Delimiter = temp.Delimiter
+	o.Gt = temp.Gt
+	o.Gte = temp.Gte
+	o.Lt = temp.Lt
+	o.Lte = temp.Lte
+	o.Eq = temp.Eq
+	o.Count = temp.Count.n
+	o.CountRange = temp.Count.r
+	o.Repeat = temp.Repeat
+	o.MaxGap = temp.MaxGap
+	o.Optional = temp.Optional
+	o.Primary = temp.Primary
 	o.Set = temp.Set
 	o.Sequence = temp.Sequence
-	o.NegateOpts = temp.NegateOpts
+	o.AnyOf = temp.AnyOf
+	o.AllOf = temp.AllOf
+	if opts := temp.NegateOpts; opts != nil {
+		o.NegateOpts = &ParseNegateOptsT{
+			Window:     opts.Window,
+			Slide:      opts.Slide,
+			Anchor:     opts.Anchor.idx,
+			Absolute:   opts.Absolute,
+			AnchorName: opts.Anchor.name,
+			Until:      opts.Until,
+		}
+	}
 	o.PromQL = temp.ParsePromQL
+	o.Aggregate = temp.Aggregate
+	o.Resource = temp.Resource
 	o.Extract = temp.Extract
+	o.Annotations = temp.Annotations
 	return nil
 }
 
@@ -166,10 +455,22 @@ type ParseEventT struct {
 }
 
 type RulesT struct {
-	Rules  []ParseRuleT          `yaml:"rules"`
-	Root   *yaml.Node            `yaml:"-"`
-	TermsT map[string]ParseTermT `yaml:"terms,omitempty"`
-	TermsY map[string]*yaml.Node `yaml:"-"`
+	Rules   []ParseRuleT          `yaml:"rules"`
+	Root    *yaml.Node            `yaml:"-"`
+	TermsT  map[string]ParseTermT `yaml:"terms,omitempty"`
+	TermsY  map[string]*yaml.Node `yaml:"-"`
+	Footer  *FooterT              `yaml:"-"` // Last version footer read. Nil if none.
+	Footers []*FooterT            `yaml:"-"` // Version footers of every file read, in order
+}
+
+// FooterT is a trailing document that marks the version of a rules bundle:
+//
+//	section: version
+//	version: 1.2.3
+type FooterT struct {
+	Version string    `json:"version"`
+	File    string    `json:"file,omitempty"`
+	Pos     pqerr.Pos `json:"pos"`
 }
 
 func RootNode(data []byte) (*yaml.Node, error) {
@@ -1,14 +1,25 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
 	"github.com/rs/zerolog/log"
 )
@@ -217,6 +228,468 @@ func TestParseFail(t *testing.T) {
 			col:  7,
 			err:  ErrInvalidRuleHash,
 		},
+		"Fail_TermCycle": {
+			rule: testdata.TestFailTermCycle,
+			line: 17,
+			col:  5,
+			err:  ErrTermCycle,
+		},
+		"Fail_RequireSources": {
+			rule: testdata.TestFailRequireSources,
+			line: 9,
+			col:  23,
+			err:  ErrRequireSources,
+		},
+		"Fail_TermRef": {
+			rule: testdata.TestFailTermRef,
+			line: 17,
+			col:  19,
+			err:  ErrTermNotFound,
+		},
+		"Fail_TermRefCondition": {
+			rule: testdata.TestFailTermRefCondition,
+			line: 16,
+			col:  19,
+			err:  ErrTermRef,
+		},
+		"Fail_RepeatSyntax": {
+			rule: testdata.TestFailRepeatSyntax,
+			line: 18,
+			col:  21,
+			err:  ErrRepeat,
+		},
+		"Fail_RepeatSet": {
+			rule: testdata.TestFailRepeatSet,
+			line: 18,
+			col:  21,
+			err:  ErrRepeatScope,
+		},
+		"Fail_RepeatNegate": {
+			rule: testdata.TestFailRepeatNegate,
+			line: 20,
+			col:  21,
+			err:  ErrRepeatScope,
+		},
+		"Fail_MaxGapFirst": {
+			rule: testdata.TestFailMaxGapFirst,
+			line: 17,
+			col:  21,
+			err:  ErrMaxGap,
+		},
+		"Fail_MaxGapSet": {
+			rule: testdata.TestFailMaxGapSet,
+			line: 18,
+			col:  21,
+			err:  ErrMaxGap,
+		},
+		"Fail_MaxGapDuration": {
+			rule: testdata.TestFailMaxGapDuration,
+			line: 18,
+			col:  21,
+			err:  ErrMaxGap,
+		},
+		"Fail_OptionalLast": {
+			rule: testdata.TestFailOptionalLast,
+			line: 18,
+			col:  23,
+			err:  ErrOptional,
+		},
+		"Fail_OptionalSet": {
+			rule: testdata.TestFailOptionalSet,
+			line: 18,
+			col:  23,
+			err:  ErrOptional,
+		},
+		"Fail_CountRangeBounds": {
+			rule: testdata.TestFailCountRangeBounds,
+			line: 19,
+			col:  15,
+			err:  ErrCountRange,
+		},
+		"Fail_CountRangeSet": {
+			rule: testdata.TestFailCountRangeSet,
+			line: 19,
+			col:  15,
+			err:  ErrCountRange,
+		},
+		"Fail_Priority": {
+			rule: testdata.TestFailPriority,
+			line: 9,
+			col:  17,
+			err:  ErrPriority,
+		},
+		"Fail_MetricSeqInnerEvent": {
+			rule: testdata.TestFailMetricSeqInnerEvent,
+			line: 18,
+			col:  13,
+			err:  ErrInnerEvent,
+		},
+		"Fail_OrderTolerance": {
+			rule: testdata.TestFailOrderTolerance,
+			line: 13,
+			col:  11,
+			err:  ErrOrderTolerance,
+		},
+		"Fail_NegativeOrderTolerance": {
+			rule: testdata.TestFailNegativeOrderTolerance,
+			line: 13,
+			col:  11,
+			err:  ErrOrderTolerance,
+		},
+		"Fail_MatchNegateOpts": {
+			rule: testdata.TestFailMatchNegateOpts,
+			line: 19,
+			col:  21,
+			err:  ErrMatchNegateOpts,
+		},
+		"Fail_PromQLWindow": {
+			rule: testdata.TestFailPromQLWindow,
+			line: 26,
+			col:  15,
+			err:  ErrPromQLWindow,
+		},
+		"Fail_TermIndirectCycle": {
+			rule: testdata.TestFailTermIndirectCycle,
+			line: 17,
+			col:  5,
+			err:  ErrTermCycle,
+		},
+		"Fail_ValueSetNotFound": {
+			rule: testdata.TestFailValueSetNotFound,
+			line: 16,
+			col:  23,
+			err:  ErrValueSetNotFound,
+		},
+		"Fail_ValueSetEmpty": {
+			rule: testdata.TestFailValueSetEmpty,
+			line: 16,
+			col:  23,
+			err:  ErrValueSetEmpty,
+		},
+		"Fail_AnnotationKey": {
+			rule: testdata.TestFailAnnotationKey,
+			line: 17,
+			col:  15,
+			err:  ErrAnnotationKey,
+		},
+		"Fail_UndefinedParam": {
+			rule: testdata.TestFailUndefinedParam,
+			line: 18,
+			col:  20,
+			err:  ErrUndefinedParam,
+		},
+		"Fail_GroupTerm": {
+			rule: testdata.TestFailGroupTerm,
+			line: 20,
+			col:  17,
+			err:  ErrGroupTerm,
+		},
+		"Fail_GroupSize": {
+			rule: testdata.TestFailGroupSize,
+			line: 14,
+			col:  15,
+			err:  ErrGroup,
+		},
+		"Fail_ConditionTerm": {
+			rule: testdata.TestFailConditionTerm,
+			line: 12,
+			col:  35,
+			err:  ErrTermNotFound,
+		},
+		"Fail_ConditionNot": {
+			rule: testdata.TestFailConditionNot,
+			line: 12,
+			col:  29,
+			err:  ErrConditionNot,
+		},
+		"Fail_CountDistinctField": {
+			rule: testdata.TestFailCountDistinctField,
+			line: 15,
+			col:  11,
+			err:  ErrCountDistinct,
+		},
+		"Fail_CountDistinctThreshold": {
+			rule: testdata.TestFailCountDistinctThreshold,
+			line: 15,
+			col:  11,
+			err:  ErrCountDistinct,
+		},
+		"Fail_RequireTerms": {
+			rule: testdata.TestFailRequireTerms,
+			line: 12,
+			col:  18,
+			err:  ErrRequire,
+		},
+		"Fail_RequireLogSet": {
+			rule: testdata.TestFailRequireLogSet,
+			line: 12,
+			col:  18,
+			err:  ErrRequire,
+		},
+		"Fail_NegateGroupNested": {
+			rule: testdata.TestFailNegateGroupNested,
+			line: 20,
+			col:  15,
+			err:  ErrNegateGroup,
+		},
+		"Fail_AnchorName": {
+			rule: testdata.TestFailAnchorName,
+			line: 21,
+			col:  21,
+			err:  ErrAnchorName,
+		},
+		"Fail_AnchorValue": {
+			rule: testdata.TestFailAnchorValue,
+			line: 21,
+			col:  21,
+			err:  ErrAnchorName,
+		},
+		"Fail_AnchorCount": {
+			rule: testdata.TestFailAnchorCount,
+			line: 22,
+			col:  21,
+			err:  ErrAnchorRange,
+		},
+		"Fail_AnchorRange": {
+			rule: testdata.TestFailTermsSemanticError5,
+			line: 20,
+			col:  21,
+			err:  ErrAnchorRange,
+		},
+		"Fail_NegateUntilName": {
+			rule: testdata.TestFailNegateUntilName,
+			line: 20,
+			col:  20,
+			err:  ErrUntil,
+		},
+		"Fail_CorrelateOn": {
+			rule: testdata.TestFailCorrelateOn,
+			line: 13,
+			col:  11,
+			err:  ErrCorrelateOn,
+		},
+		"Fail_CorrelateKeyMapped": {
+			rule: testdata.TestFailCorrelateKeyMapped,
+			line: 13,
+			col:  11,
+			err:  ErrCorrelateOn,
+		},
+		"Fail_CorrelationWindow": {
+			rule: testdata.TestFailCorrelationWindow,
+			line: 12,
+			col:  28,
+			err:  ErrCorrelationWindow,
+		},
+		"Fail_CorrelationWindowUncorrelated": {
+			rule: testdata.TestFailCorrelationWindowUncorrelated,
+			line: 12,
+			col:  28,
+			err:  ErrCorrelationWindow,
+		},
+		"Fail_RegexGroupCollision": {
+			rule: testdata.TestFailRegexGroupCollision,
+			line: 14,
+			col:  20,
+			err:  ErrExtractCollision,
+		},
+		"Fail_RegexGroupName": {
+			rule: testdata.TestFailRegexGroupName,
+			line: 14,
+			col:  20,
+			err:  ErrExtractName,
+		},
+		"Fail_StepRefForward": {
+			rule: testdata.TestFailStepRefForward,
+			line: 15,
+			col:  13,
+			err:  ErrStepRef,
+		},
+		"Fail_StepRefExtract": {
+			rule: testdata.TestFailStepRefExtract,
+			line: 16,
+			col:  13,
+			err:  ErrStepRef,
+		},
+		"Fail_StepRefSet": {
+			rule: testdata.TestFailStepRefSet,
+			line: 16,
+			col:  13,
+			err:  ErrStepRef,
+		},
+		"Fail_StepRefNegate": {
+			rule: testdata.TestFailStepRefNegate,
+			line: 18,
+			col:  13,
+			err:  ErrStepRef,
+		},
+		"Fail_AggregateType": {
+			rule: testdata.TestFailAggregateType,
+			line: 21,
+			col:  21,
+			err:  ErrAggregate,
+		},
+		"Fail_AggregateThreshold": {
+			rule: testdata.TestFailAggregateThreshold,
+			line: 22,
+			col:  21,
+			err:  ErrAggregate,
+		},
+		"Fail_FieldCompareOps": {
+			rule: testdata.TestFailFieldCompareOps,
+			line: 16,
+			col:  17,
+			err:  ErrCompare,
+		},
+		"Fail_FieldCompareField": {
+			rule: testdata.TestFailFieldCompareField,
+			line: 15,
+			col:  18,
+			err:  ErrCompareField,
+		},
+		"Fail_ValueListEmpty": {
+			rule: testdata.TestFailValueListEmpty,
+			line: 14,
+			col:  22,
+			err:  ErrValueList,
+		},
+		"Fail_ValueListRegex": {
+			rule: testdata.TestFailValueListRegex,
+			line: 16,
+			col:  17,
+			err:  ErrValueList,
+		},
+		"Fail_IPCidrBlock": {
+			rule: testdata.TestFailIPCidrBlock,
+			line: 17,
+			col:  17,
+			err:  ErrIPCidr,
+		},
+		"Fail_IPCidrField": {
+			rule: testdata.TestFailIPCidrField,
+			line: 14,
+			col:  21,
+			err:  ErrIPCidr,
+		},
+		"Fail_Glob": {
+			rule: testdata.TestFailGlob,
+			line: 14,
+			col:  19,
+			err:  ErrGlob,
+		},
+		"Fail_MatchOpts": {
+			rule: testdata.TestFailMatchOpts,
+			line: 16,
+			col:  15,
+			err:  ErrMatchOpts,
+		},
+		"Fail_Regex": {
+			rule: testdata.TestFailRegex,
+			line: 14,
+			col:  20,
+			err:  ErrRegex,
+		},
+		"Fail_RegexExtract": {
+			rule: testdata.TestFailRegexExtract,
+			line: 17,
+			col:  24,
+			err:  ErrRegex,
+		},
+		"Fail_RegexSize": {
+			rule: testdata.TestFailRegexSize,
+			line: 14,
+			col:  20,
+			err:  ErrRegexSize,
+		},
+		"Fail_PromQLSyntax": {
+			rule: testdata.TestFailPromQLSyntax,
+			line: 13,
+			col:  21,
+			err:  ErrPromQL,
+		},
+		"Fail_SpanField": {
+			rule: testdata.TestFailSpanField,
+			line: 16,
+			col:  13,
+			err:  ErrSpanField,
+		},
+		"Fail_CompareDuration": {
+			rule: testdata.TestFailCompareDuration,
+			line: 14,
+			col:  13,
+			err:  ErrCompareDuration,
+		},
+		"Fail_ResourceField": {
+			rule: testdata.TestFailResourceField,
+			line: 15,
+			col:  22,
+			err:  ErrResource,
+		},
+		"Fail_JournaldField": {
+			rule: testdata.TestFailJournaldField,
+			line: 14,
+			col:  13,
+			err:  ErrJournaldField,
+		},
+		"Fail_JournaldPriority": {
+			rule: testdata.TestFailJournaldPriority,
+			line: 14,
+			col:  13,
+			err:  ErrJournaldPriority,
+		},
+		"Fail_SyslogFacility": {
+			rule: testdata.TestFailSyslogFacility,
+			line: 14,
+			col:  13,
+			err:  ErrSyslogFacility,
+		},
+		"Fail_SyslogField": {
+			rule: testdata.TestFailSyslogField,
+			line: 14,
+			col:  13,
+			err:  ErrSyslogField,
+		},
+		"Fail_WinEventID": {
+			rule: testdata.TestFailWinEventID,
+			line: 14,
+			col:  13,
+			err:  ErrWinEventID,
+		},
+		"Fail_CloudTrailSource": {
+			rule: testdata.TestFailCloudTrailSource,
+			line: 14,
+			col:  13,
+			err:  ErrCloudTrailSource,
+		},
+		"Fail_ContainerAction": {
+			rule: testdata.TestFailContainerAction,
+			line: 14,
+			col:  13,
+			err:  ErrContainerAction,
+		},
+		"Fail_K8sEventType": {
+			rule: testdata.TestFailK8sEventType,
+			line: 14,
+			col:  13,
+			err:  ErrSourceValue,
+		},
+		"Fail_FlowCondition": {
+			rule: testdata.TestFailFlowCondition,
+			line: 14,
+			col:  13,
+			err:  ErrFlowCondition,
+		},
+		"Fail_AlertSelector": {
+			rule: testdata.TestFailAlertSelector,
+			line: 14,
+			col:  13,
+			err:  ErrAlertSelector,
+		},
+		"Fail_NegateWindow": {
+			rule: testdata.TestFailNegateWindow,
+			line: 26,
+			col:  18,
+			err:  ErrNegateWindow,
+		},
 	}
 
 	for name, test := range tests {
@@ -246,11 +719,1911 @@ func TestParseFail(t *testing.T) {
 	}
 }
 
-func DumpErrorChain(err error) {
-	i := 0
-	for err != nil {
-		fmt.Printf("#%d  %T  %q\n", i, err, err.Error())
-		i++
-		err = errors.Unwrap(err)
+func TestParseSharedSubSequence(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessSharedSubSequence))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	if len(tree.Nodes) != 2 {
+		t.Fatalf("Expected 2 root nodes, got %d", len(tree.Nodes))
+	}
+
+	var expected = [][]string{
+		{"machine_seq", "log_seq", "log_set"},
+		{"machine_set", "log_seq", "log_set"},
+	}
+
+	for i, root := range tree.Nodes {
+		var actualNodes []string
+		gatherNodeTypes(root, &actualNodes)
+
+		if !reflect.DeepEqual(actualNodes, expected[i]) {
+			t.Errorf("rule %d: gathered types = %v, want %v", i, actualNodes, expected[i])
+		}
+	}
+
+	// Each rule must get its own copy of the shared sub-sequence
+	seq1 := tree.Nodes[0].Children[0].(*NodeT)
+	seq2 := tree.Nodes[1].Children[0].(*NodeT)
+
+	if seq1 == seq2 {
+		t.Fatalf("Expected distinct nodes for shared sub-sequence")
+	}
+
+	if seq1.Metadata.RuleHash == seq2.Metadata.RuleHash {
+		t.Errorf("Expected shared sub-sequence to inherit the referencing rule hash")
+	}
+
+	if seq1.Metadata.Window != seq2.Metadata.Window || seq1.Metadata.Window == 0 {
+		t.Errorf("Expected shared sub-sequence window, got %v and %v", seq1.Metadata.Window, seq2.Metadata.Window)
+	}
+}
+
+func TestParseRequireSources(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessRequireSources))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if !root.Metadata.RequireAllSources {
+		t.Errorf("Expected root to require all sources")
+	}
+
+	expected := []string{"cre.log.nginx", "cre.prequel.k8s"}
+	if sources := root.Sources(); !reflect.DeepEqual(sources, expected) {
+		t.Errorf("sources = %v, want %v", sources, expected)
+	}
+
+	if tree, err = Parse([]byte(testdata.TestSuccessComplexRule3)); err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	if tree.Nodes[0].Metadata.RequireAllSources {
+		t.Errorf("Expected rule without requireSources to default to any")
+	}
+}
+
+func TestParsePromQLDescription(t *testing.T) {
+
+	config, err := Unmarshal([]byte(testdata.TestSuccessDescribedPromQL))
+	if err != nil {
+		t.Fatalf("Error unmarshalling rule: %v", err)
+	}
+
+	rule := config.Rules[0]
+
+	hash, err := StableHash(rule)
+	if err != nil {
+		t.Fatalf("Error hashing rule: %v", err)
+	}
+
+	rule.Rule.Set.Match[0].PromQL.Description = "Something else entirely"
+
+	if changed, err := StableHash(rule); err != nil {
+		t.Fatalf("Error hashing rule: %v", err)
+	} else if changed != hash {
+		t.Errorf("Expected description to not affect the stable hash")
+	}
+
+	long := strings.Replace(
+		testdata.TestSuccessDescribedPromQL,
+		"Sustained 5xx error rate above 10 req/s per service",
+		strings.Repeat("x", maxDescriptionLen+1),
+		1,
+	)
+
+	_, err = Parse([]byte(long))
+	if !errors.Is(err, ErrDescription) {
+		t.Fatalf("Expected error %v, got %v", ErrDescription, err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 19 || pos.Col != 28 {
+		t.Errorf("Expected error position line=19, col=28, got %+v", pos)
+	}
+}
+
+func TestParseOrderTolerance(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessOrderTolerance))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if root.Metadata.OrderTolerance != 2*time.Second {
+		t.Errorf("root order tolerance = %v, want %v", root.Metadata.OrderTolerance, 2*time.Second)
+	}
+
+	child := root.Children[0].(*NodeT)
+	if child.Metadata.OrderTolerance != 500*time.Millisecond {
+		t.Errorf("child order tolerance = %v, want %v", child.Metadata.OrderTolerance, 500*time.Millisecond)
+	}
+
+	// Default preserves strict ordering
+	if tree, err = Parse([]byte(testdata.TestSuccessComplexRule3)); err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	if tree.Nodes[0].Metadata.OrderTolerance != 0 {
+		t.Errorf("Expected zero order tolerance by default, got %v", tree.Nodes[0].Metadata.OrderTolerance)
+	}
+}
+
+func TestParseExpressions(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessExpressions))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	type site struct {
+		Kind ExprKindT
+		Site ExprSiteT
+		Text string
+		Line int
+	}
+
+	// Each expression is positioned at its own condition or extract
+	var expected = []site{
+		{ExprKindRegex, ExprSiteMatch, "connection (refused|reset)", 37},
+		{ExprKindRegex, ExprSiteExtract, `host=(\S+)`, 39},
+		{ExprKindGlob, ExprSiteMatch, "*timeout*connect*", 42},
+		{ExprKindJq, ExprSiteMatch, `select(.reason == "Killing")`, 21},
+		{ExprKindJq, ExprSiteExtract, ".involvedObject.name", 23},
+		{ExprKindRegex, ExprSiteMatch, "Back-off restarting .+", 25},
+		{ExprKindRegex, ExprSiteMatch, "Liveness probe failed", 25},
+		{ExprKindRegex, ExprSiteNegate, "Started container (.+)", 29},
+	}
+
+	var actual []site
+	for _, ref := range tree.Expressions() {
+		actual = append(actual, site{ref.Kind, ref.Site, ref.Text, ref.Pos.Line})
+
+		if ref.RuleHash != "rdJLgqYgkEp8jg8Qks1qiq" {
+			t.Errorf("Expected rule hash on %s, got %q", ref.Text, ref.RuleHash)
+		}
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expressions = %v, want %v", actual, expected)
+	}
+}
+
+func TestParseWindowConstants(t *testing.T) {
+
+	var constants = map[string]time.Duration{
+		"short": 5 * time.Second,
+		"long":  time.Minute,
+	}
+
+	tree, err := Parse([]byte(testdata.TestSuccessWindowConstants), WithDurationConstants(constants))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if root.Metadata.Window != time.Minute {
+		t.Errorf("root window = %v, want %v", root.Metadata.Window, time.Minute)
+	}
+
+	if child := root.Children[0].(*NodeT); child.Metadata.Window != 5*time.Second {
+		t.Errorf("child window = %v, want %v", child.Metadata.Window, 5*time.Second)
+	}
+
+	delete(constants, "short")
+
+	_, err = Parse([]byte(testdata.TestSuccessWindowConstants), WithDurationConstants(constants))
+	if !errors.Is(err, ErrUndefinedConst) {
+		t.Fatalf("Expected error %v, got %v", ErrUndefinedConst, err)
+	}
+
+	if !strings.Contains(err.Error(), "constant=short") {
+		t.Errorf("Expected constant name in error, got %v", err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 13 || pos.Col != 11 {
+		t.Errorf("Expected error position line=13, col=11, got %+v", pos)
+	}
+
+	// No constants supplied
+	if _, err = Parse([]byte(testdata.TestSuccessWindowConstants)); !errors.Is(err, ErrUndefinedConst) {
+		t.Fatalf("Expected error %v, got %v", ErrUndefinedConst, err)
+	}
+}
+
+func TestReadFilesDuplicates(t *testing.T) {
+
+	var (
+		dir       = t.TempDir()
+		rule      = testdata.TestSuccessPriority
+		identical = filepath.Join(dir, "identical.yaml")
+		original  = filepath.Join(dir, "original.yaml")
+		conflict  = filepath.Join(dir, "conflict.yaml")
+	)
+
+	// Same rule ids, different content
+	conflicting := strings.Replace(rule, "priority: 5", "priority: 6", 1)
+
+	for path, data := range map[string]string{original: rule, identical: rule, conflict: conflicting} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("Error writing %s: %v", path, err)
+		}
+	}
+
+	// Identical duplicates are an error by default
+	if _, err := ReadFiles([]string{original, identical}); !errors.Is(err, ErrDuplicateRule) {
+		t.Fatalf("Expected error %v, got %v", ErrDuplicateRule, err)
+	}
+
+	config, err := ReadFiles([]string{original, identical}, WithDedupeIdentical())
+	if err != nil {
+		t.Fatalf("Error reading files: %v", err)
+	}
+
+	if len(config.Rules) != 4 || len(config.Root.Content) != 4 {
+		t.Fatalf("Expected 4 rules, got %d (%d nodes)", len(config.Rules), len(config.Root.Content))
+	}
+
+	if _, err = ParseRules(config, nil); err != nil {
+		t.Fatalf("Error parsing merged rules: %v", err)
+	}
+
+	// Conflicting definitions always error, naming both locations
+	_, err = ReadFiles([]string{original, conflict}, WithDedupeIdentical())
+	if !errors.Is(err, ErrDuplicateRule) {
+		t.Fatalf("Expected error %v, got %v", ErrDuplicateRule, err)
+	}
+
+	msg := err.Error()
+	if !strings.Contains(msg, "file="+original+", line=30") || !strings.Contains(msg, "file="+conflict) {
+		t.Errorf("Expected both locations in error, got %v", msg)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 30 {
+		t.Errorf("Expected error position line=30, got %+v", pos)
+	}
+}
+
+func TestReadVersionFooter(t *testing.T) {
+
+	var (
+		footer = "---\nsection: version\nversion: 1.4.0\n"
+		data   = testdata.TestSuccessPriority + footer
+	)
+
+	config, err := Read(strings.NewReader(data), WithRequireVersionFooter())
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if config.Footer == nil || config.Footer.Version != "1.4.0" {
+		t.Fatalf("Expected footer version 1.4.0, got %+v", config.Footer)
+	}
+
+	if len(config.Rules) != 4 {
+		t.Errorf("Expected 4 rules, got %d", len(config.Rules))
+	}
+
+	// Absent footers are skipped silently by default
+	config, err = Read(strings.NewReader(testdata.TestSuccessPriority))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if config.Footer != nil {
+		t.Errorf("Expected no footer, got %+v", config.Footer)
+	}
+
+	if _, err = Read(strings.NewReader(testdata.TestSuccessPriority), WithRequireVersionFooter()); !errors.Is(err, ErrMissingFooter) {
+		t.Errorf("Expected error %v, got %v", ErrMissingFooter, err)
+	}
+
+	// The footer of each file is kept
+	var (
+		dir   = t.TempDir()
+		paths = []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")}
+		other = `rules:
+  - cre:
+      id: footer-b
+    metadata:
+      id: Hq4fWmT8sZpYb2cNvRx7Lk
+      hash: Nd6gPzV3kXrT9wQm2bYs5J
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - "panic"
+`
+		files = []string{data, other + "---\nsection: version\nversion: 2.0.0\n"}
+	)
+
+	for i, path := range paths {
+		if err = os.WriteFile(path, []byte(files[i]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if config, err = ReadFiles(paths, WithRequireVersionFooter()); err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if len(config.Footers) != 2 {
+		t.Fatalf("Expected 2 footers, got %d", len(config.Footers))
+	}
+
+	for i, want := range []string{"1.4.0", "2.0.0"} {
+		if f := config.Footers[i]; f.Version != want || f.File != paths[i] {
+			t.Errorf("footer %d = %s %s, want %s %s", i, f.Version, f.File, want, paths[i])
+		}
+	}
+
+	if config.Footer != config.Footers[1] {
+		t.Errorf("Expected the last footer, got %+v", config.Footer)
+	}
+}
+
+func TestParseRuleById(t *testing.T) {
+
+	var data = []byte(testdata.TestPartialBundle)
+
+	// The broken rule in the bundle is never built
+	for _, id := range []string{"J7uRQTGpGMyL1iFpssnBeS", "rdJLgqYgkEp8jg8Qks1qiq", "TestPartialBundleGood"} {
+		node, err := ParseRuleById(data, id)
+		if err != nil {
+			t.Fatalf("Error parsing rule %s: %v", id, err)
+		}
+
+		if node.Metadata.CreId != "TestPartialBundleGood" {
+			t.Errorf("id=%s: got cre id %s", id, node.Metadata.CreId)
+		}
+
+		if len(node.Children) != 2 {
+			t.Errorf("id=%s: expected resolved terms, got %d children", id, len(node.Children))
+		}
+	}
+
+	if _, err := ParseRuleById(data, "TestPartialBundleBad"); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected error %v, got %v", ErrInvalidWindow, err)
+	}
+
+	if _, err := ParseRuleById(data, "missing"); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("Expected error %v, got %v", ErrRuleNotFound, err)
+	}
+}
+
+func TestCompileEach(t *testing.T) {
+
+	results, err := CompileEach([]byte(testdata.TestPartialBundle))
+	if err != nil {
+		t.Fatalf("Error compiling bundle: %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	good, ok := results["rdJLgqYgkEp8jg8Qks1qiq"]
+	if !ok {
+		t.Fatalf("Missing result for valid rule")
+	}
+
+	if good.Err != nil || good.Node == nil {
+		t.Errorf("Expected valid rule to compile, got err=%v", good.Err)
+	}
+
+	if good.CreId != "TestPartialBundleGood" {
+		t.Errorf("CreId = %q, want %q", good.CreId, "TestPartialBundleGood")
+	}
+
+	bad, ok := results["JjnzCzQ1pWjVmPnXEyoGjR"]
+	if !ok {
+		t.Fatalf("Missing result for invalid rule")
+	}
+
+	if !errors.Is(bad.Err, ErrInvalidWindow) || bad.Node != nil {
+		t.Errorf("Expected error %v, got err=%v node=%v", ErrInvalidWindow, bad.Err, bad.Node)
+	}
+
+	// The whole bundle fails under Parse
+	if _, err = Parse([]byte(testdata.TestPartialBundle)); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected error %v, got %v", ErrInvalidWindow, err)
+	}
+}
+
+func TestParseTermDepth(t *testing.T) {
+
+	var makeRule = func(depth int) string {
+		var sb strings.Builder
+
+		sb.WriteString(`
+rules:
+  - cre:
+      id: TestParseTermDepth
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+    rule:
+      set:
+        window: 10s
+        match:
+          - term0
+          - leaf
+terms:
+  leaf:
+    set:
+      event:
+        source: cre.log.kafka
+      match:
+        - leaf value
+`)
+		for i := range depth {
+			fmt.Fprintf(&sb, "  term%d:\n    set:\n      window: 10s\n      match:\n        - leaf\n", i)
+			if i+1 < depth {
+				fmt.Fprintf(&sb, "        - term%d\n", i+1)
+			} else {
+				sb.WriteString("        - leaf\n")
+			}
+		}
+
+		return sb.String()
+	}
+
+	// The chain of terms plus the shared leaf term
+	if _, err := Parse([]byte(makeRule(maxTermDepth - 1))); err != nil {
+		t.Fatalf("Expected rule at maximum term depth to parse: %v", err)
+	}
+
+	_, err := Parse([]byte(makeRule(maxTermDepth)))
+	if !errors.Is(err, ErrTermDepth) {
+		t.Fatalf("Expected error %v, got %v", ErrTermDepth, err)
+	}
+}
+
+func TestParseTermRef(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessTermRef), WithStrictTermRefs())
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if len(root.Children) != 4 {
+		t.Fatalf("Expected 4 children, got %d", len(root.Children))
+	}
+
+	field := func(i int) FieldT {
+		m := root.Children[i].(*MatcherT)
+		if len(m.Match.Fields) > 0 {
+			return m.Match.Fields[0]
+		}
+		return m.Negate.Fields[0]
+	}
+
+	// Explicit and bare references resolve to the term
+	for i := range 2 {
+		if f := field(i); f.RegexValue != "OOM ?Killed" || f.StrValue != "" {
+			t.Errorf("child %d: expected term reference, got %+v", i, f)
+		}
+	}
+
+	// A bare value that matches no term is a literal
+	if f := field(2); f.StrValue != "oomkilled" || f.RegexValue != "" {
+		t.Errorf("child 2: expected literal, got %+v", f)
+	}
+
+	// Negate options on an explicit reference are kept
+	if f := field(3); f.RegexValue != "OOM ?Killed" || f.NegateOpts == nil || f.NegateOpts.Window != 5*time.Second {
+		t.Errorf("child 3: expected negated reference with window, got %+v", f)
+	}
+}
+
+func TestParseRepeat(t *testing.T) {
+
+	var tests = map[string]struct {
+		repeat string
+		want   *RepeatT
+	}{
+		"Exact":     {repeat: "2", want: &RepeatT{Min: 2, Max: 2}},
+		"AtLeast":   {repeat: "1+", want: &RepeatT{Min: 1}},
+		"Range":     {repeat: "2-5", want: &RepeatT{Min: 2, Max: 5}},
+		"Zero":      {repeat: "0+"},
+		"Inverted":  {repeat: "3-1"},
+		"Garbage":   {repeat: "many"},
+		"Negative":  {repeat: "-1"},
+		"OpenRange": {repeat: "2-"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseRepeat(test.repeat)
+			if test.want == nil {
+				if !errors.Is(err, ErrRepeat) {
+					t.Errorf("Expected error %v, got %v", ErrRepeat, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseRepeat(%q) = %+v, %v, want %+v", test.repeat, got, err, test.want)
+			}
+		})
+	}
+
+	tree, err := Parse([]byte(testdata.TestSuccessRepeat))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var (
+		root  = tree.Nodes[0]
+		seq   = root.Children[0].(*NodeT)
+		set   = root.Children[1].(*NodeT)
+		steps []*RepeatT
+	)
+
+	for _, child := range seq.Children {
+		steps = append(steps, child.(*MatcherT).Match.Fields[0].Repeat)
+	}
+
+	if expected := []*RepeatT{nil, {Min: 1}, {Min: 2, Max: 2}}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("step repeats = %+v, want %+v", steps, expected)
+	}
+
+	if !reflect.DeepEqual(set.Metadata.Repeat, &RepeatT{Min: 2, Max: 5}) {
+		t.Errorf("set repeat = %+v, want 2-5", set.Metadata.Repeat)
+	}
+}
+
+func TestParseMaxGap(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessMaxGap))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var (
+		root  = tree.Nodes[0]
+		seq   = root.Children[0].(*NodeT)
+		set   = root.Children[1].(*NodeT)
+		steps []time.Duration
+	)
+
+	for _, child := range seq.Children {
+		steps = append(steps, child.(*MatcherT).Match.Fields[0].MaxGap)
+	}
+
+	if expected := []time.Duration{0, 5 * time.Second, 2 * time.Second}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("step gaps = %v, want %v", steps, expected)
+	}
+
+	if set.Metadata.MaxGap != 10*time.Second {
+		t.Errorf("set gap = %v, want 10s", set.Metadata.MaxGap)
+	}
+}
+
+func TestParseOptional(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessOptional))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var (
+		root  = tree.Nodes[0]
+		seq   = root.Children[0].(*NodeT)
+		steps []bool
+	)
+
+	for _, child := range seq.Children {
+		steps = append(steps, child.(*MatcherT).Match.Fields[0].Optional)
+	}
+
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("optional steps = %v, want %v", steps, expected)
+	}
+
+	steps = nil
+	for _, child := range root.Children {
+		steps = append(steps, child.(*NodeT).Metadata.Optional)
+	}
+
+	if expected := []bool{false, true, false}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("optional children = %v, want %v", steps, expected)
+	}
+}
+
+func TestExplain(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessExplain))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	events := []SampleEvent{
+		{Source: "cre.log.app", Line: "disk full, timeout after 30s", Fields: map[string]any{"level": "warn"}},
+		{Source: "cre.log.app", Line: "request failed", Fields: map[string]any{"level": "error", "trace_id": "abc"}},
+		{Source: "cre.log.other", Line: "disk full, shutting down"},
+	}
+
+	res, err := Explain(tree, "rdJLgqYgkEp8jg8Qks1qiq", events)
+	if err != nil {
+		t.Fatalf("Error explaining rule: %v", err)
+	}
+
+	var expected = []struct {
+		kind    CondKindT
+		line    int
+		matched []int
+		skipped bool
+	}{
+		{kind: CondKindRaw, line: 16, matched: []int{0}},
+		{kind: CondKindEq, line: 17, matched: []int{1}},
+		{kind: CondKindRegex, line: 19, matched: []int{0}},
+		{kind: CondKindExists, line: 20, matched: []int{1}},
+		{kind: CondKindJq, line: 22, matched: []int{}, skipped: true},
+		{kind: CondKindRaw, line: 24, matched: []int{}}, // Event 2 is from another source
+	}
+
+	if len(res.Conditions) != len(expected) {
+		t.Fatalf("Expected %d conditions, got %d", len(expected), len(res.Conditions))
+	}
+
+	for i, exp := range expected {
+		c := res.Conditions[i]
+		if c.Kind != exp.kind || c.Pos.Line != exp.line || c.Skipped != exp.skipped || !reflect.DeepEqual(c.Matched, exp.matched) {
+			t.Errorf("condition %d = %+v, want kind=%s line=%d matched=%v skipped=%v", i, c, exp.kind, exp.line, exp.matched, exp.skipped)
+		}
+	}
+
+	if !res.Conditions[5].Negate {
+		t.Errorf("Expected last condition to be negated")
+	}
+
+	// A miss on every event
+	res, err = Explain(tree, "rdJLgqYgkEp8jg8Qks1qiq", []SampleEvent{{Line: "all good"}})
+	if err != nil {
+		t.Fatalf("Error explaining rule: %v", err)
+	}
+
+	if n := len(res.Unmatched()); n != 4 {
+		t.Errorf("Expected 4 unmatched conditions, got %d", n)
+	}
+
+	if _, err = Explain(tree, "missing", events); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("Expected error %v, got %v", ErrRuleNotFound, err)
+	}
+}
+
+func TestExplainValues(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessExplainValues))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	events := []SampleEvent{
+		{Line: "out of memory: connection reset by peer"},
+		{Line: "pod-a.log", Fields: map[string]any{"level": "error", "response": map[string]any{"latency_ms": 750.0}, "src_ip": "10.1.2.3"}},
+		{Line: "oomkill in pod-b.log", Fields: map[string]any{"level": "errors", "response": map[string]any{"latency_ms": "750"}, "src_ip": "192.168.1.1"}},
+	}
+
+	res, err := Explain(tree, "rdJLgqYgkEp8jg8Qks1qiq", events)
+	if err != nil {
+		t.Fatalf("Error explaining rule: %v", err)
+	}
+
+	var expected = []struct {
+		kind    CondKindT
+		line    int
+		matched []int
+	}{
+		{kind: CondKindRegex, line: 15, matched: []int{0, 2}},
+		{kind: CondKindGlob, line: 16, matched: []int{1}}, // Globs match the whole line
+		{kind: CondKindRaw, line: 17, matched: []int{0}},
+		{kind: CondKindEq, line: 20, matched: []int{1}}, // And values the whole field
+		{kind: CondKindCompare, line: 24, matched: []int{1}},
+		{kind: CondKindIPCidr, line: 26, matched: []int{1}},
+	}
+
+	if len(res.Conditions) != len(expected) {
+		t.Fatalf("Expected %d conditions, got %d", len(expected), len(res.Conditions))
+	}
+
+	for i, exp := range expected {
+		c := res.Conditions[i]
+		if c.Kind != exp.kind || c.Pos.Line != exp.line || c.Skipped || !reflect.DeepEqual(c.Matched, exp.matched) {
+			t.Errorf("condition %d = %+v, want kind=%s line=%d matched=%v", i, c, exp.kind, exp.line, exp.matched)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+
+	out, notes, err := Migrate([]byte(testdata.TestMigrateLegacy))
+	if err != nil {
+		t.Fatalf("Error migrating rule: %v", err)
+	}
+
+	var expected = []MigrationNote{
+		{Pos: pqerr.Pos{Line: 9, Col: 7}, From: "require_sources", To: "requireSources"},
+		{Pos: pqerr.Pos{Line: 13, Col: 9}, From: "order_tolerance", To: "orderTolerance"},
+		{Pos: pqerr.Pos{Line: 18, Col: 13}, From: "value: starting", To: "starting", Neutral: true},
+		{Pos: pqerr.Pos{Line: 23, Col: 13}, From: "abs", To: "absolute"},
+		{Pos: pqerr.Pos{Line: 36, Col: 13}, From: "value: disk full", To: "disk full", Neutral: true},
+	}
+
+	if !reflect.DeepEqual(notes, expected) {
+		t.Errorf("notes = %v, want %v", notes, expected)
+	}
+
+	tree, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Error parsing migrated rule: %v\n%s", err, out)
+	}
+
+	root := tree.Nodes[0]
+	if !root.Metadata.RequireAllSources || root.Metadata.OrderTolerance != time.Second {
+		t.Errorf("Expected migrated metadata, got %+v", root.Metadata)
+	}
+
+	negate := root.Children[2].(*MatcherT).Negate.Fields[0]
+	if negate.NegateOpts == nil || !negate.NegateOpts.Absolute {
+		t.Errorf("Expected absolute negate option, got %+v", negate.NegateOpts)
+	}
+
+	// The neutral rule keeps its identity
+	before, _ := Unmarshal([]byte(testdata.TestMigrateLegacy))
+	after, _ := Unmarshal(out)
+	oldHash, _ := StableHash(before.Rules[1])
+	newHash, _ := StableHash(after.Rules[1])
+	if oldHash != newHash {
+		t.Errorf("stable hash changed: %s != %s", oldHash, newHash)
+	}
+
+	// Already migrated documents are returned unchanged
+	again, notes, err := Migrate(out)
+	if err != nil || len(notes) != 0 || !bytes.Equal(again, out) {
+		t.Errorf("Expected no further migration, got notes=%v err=%v", notes, err)
+	}
+
+	conflict := strings.Replace(testdata.TestMigrateLegacy, "abs: true", "abs: true\n            absolute: false", 1)
+	if _, _, err = Migrate([]byte(conflict)); !errors.Is(err, ErrMigrateConflict) {
+		t.Errorf("Expected error %v, got %v", ErrMigrateConflict, err)
+	}
+}
+
+func TestSortByPriority(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessPriority))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var actual []string
+	for _, node := range tree.SortByPriority() {
+		actual = append(actual, node.Metadata.CreId)
+	}
+
+	expected := []string{
+		"TestPriorityHighFirst",
+		"TestPriorityHighSecond",
+		"TestPriorityLow",
+		"TestPriorityDefault",
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("order = %v, want %v", actual, expected)
+	}
+
+	// File order is left untouched
+	if tree.Nodes[0].Metadata.CreId != "TestPriorityDefault" {
+		t.Errorf("Expected tree nodes in file order, got %s first", tree.Nodes[0].Metadata.CreId)
+	}
+}
+
+func TestStableHashIgnoresPriority(t *testing.T) {
+
+	config, err := Unmarshal([]byte(testdata.TestSuccessSimpleRule1))
+	if err != nil {
+		t.Fatalf("Error unmarshalling rule: %v", err)
+	}
+
+	rule := config.Rules[0]
+	before, err := StableHash(rule)
+	if err != nil {
+		t.Fatalf("Error hashing rule: %v", err)
+	}
+
+	rule.Metadata.Priority = 7
+	after, err := StableHash(rule)
+	if err != nil {
+		t.Fatalf("Error hashing rule: %v", err)
+	}
+
+	if before != after {
+		t.Errorf("stable hash changed with priority: %s != %s", before, after)
+	}
+}
+
+// New optional schema fields must not change the hash of existing rules
+func TestHashStability(t *testing.T) {
+
+	var tests = map[string]struct {
+		rule       string
+		hash       string
+		stableHash string
+	}{
+		"Simple1": {
+			rule:       testdata.TestSuccessSimpleRule1,
+			hash:       "EgMvBpFFW7iwTSkfymNiaW5ELCBwWNxAzBfWgmCN2GPA",
+			stableHash: "DsfeCdt6AwyL2X8HV93WjP6RnwLT8j3X1wfnLFB6T66M",
+		},
+		"Complex2": {
+			rule:       testdata.TestSuccessComplexRule2,
+			hash:       "9w4vZn1LdvBdoTFE696Fx5BRLoKTWp5BdJDN1yih58E5",
+			stableHash: "5AadihkmQY5k2fBzjBR4miNUVcjBPtNLdWSXWYtrmp8U",
+		},
+		"PromQL": {
+			rule:       testdata.TestSuccessSimplePromQL,
+			hash:       "EweFHx1uNxCVpfcCs37orS7sjfhXoJc3EorHT1ej5K7t",
+			stableHash: "rwYzpogn9eLEeLgdyox3dFSkQxJJhF2GPUcuZG2F5xh",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := Unmarshal([]byte(test.rule))
+			if err != nil {
+				t.Fatalf("Error unmarshalling rule: %v", err)
+			}
+
+			if hash, err := HashRule(config.Rules[0]); err != nil {
+				t.Fatalf("Error hashing rule: %v", err)
+			} else if hash != test.hash {
+				t.Errorf("hash = %s, want %s", hash, test.hash)
+			}
+
+			if hash, err := StableHash(config.Rules[0]); err != nil {
+				t.Fatalf("Error hashing rule: %v", err)
+			} else if hash != test.stableHash {
+				t.Errorf("stable hash = %s, want %s", hash, test.stableHash)
+			}
+		})
+	}
+}
+
+func DumpErrorChain(err error) {
+	i := 0
+	for err != nil {
+		fmt.Printf("#%d  %T  %q\n", i, err, err.Error())
+		i++
+		err = errors.Unwrap(err)
+	}
+}
+
+func TestParseRegexGroups(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessRegexGroups))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	matcher, ok := tree.Nodes[0].Children[0].(*MatcherT)
+	if !ok {
+		t.Fatalf("Expected matcher, got %T", tree.Nodes[0].Children[0])
+	}
+
+	var (
+		got      = make(map[string]string)
+		expected = map[string]string{
+			"method": `(GET|POST)`,
+			"path":   `(?:GET|POST) (/\S+) status=(?:\d+)`,
+			"status": `(?:GET|POST) (?:/\S+) status=(\d+)`,
+		}
+	)
+
+	for _, e := range matcher.Match.Fields[0].Extract {
+		got[e.Name] = e.RegexValue
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("extracts = %v, want %v", got, expected)
+	}
+}
+
+func TestParseValueSet(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessValueSet))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	matcher, ok := tree.Nodes[0].Children[0].(*MatcherT)
+	if !ok {
+		t.Fatalf("Expected matcher, got %T", tree.Nodes[0].Children[0])
+	}
+
+	var expected = []string{"OOMKilled", "Error", "Init:Error"}
+	if field := matcher.Match.Fields[0]; !reflect.DeepEqual(field.Values, expected) {
+		t.Errorf("values = %v, want %v", field.Values, expected)
+	}
+
+	if re := ValueSetRegex(expected); re != `(?:OOMKilled|Error|Init:Error)` {
+		t.Errorf("regex = %s", re)
+	}
+}
+
+func TestParseValueList(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessValueList))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var (
+		strs = tree.Nodes[0].Children[0].(*MatcherT).Match.Fields[0]
+		res  = tree.Nodes[0].Children[1].(*MatcherT).Match.Fields[0]
+	)
+
+	if expected := []string{"OOMKilled", "Error"}; !reflect.DeepEqual(strs.Values, expected) {
+		t.Errorf("values = %v, want %v", strs.Values, expected)
+	}
+
+	if expected := []string{`exit code \d+`, "signal (9|15)"}; !reflect.DeepEqual(res.Regexes, expected) {
+		t.Errorf("regexes = %v, want %v", res.Regexes, expected)
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+
+	var data = testdata.TestSuccessAnnotations
+
+	tree, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var expected = []map[string]string{
+		{"runbook": "https://runbooks.example.com/disk-full", "team.owner": "storage"},
+		{"runbook": "https://runbooks.example.com/write-failed"},
+		{"runbook": "https://runbooks.example.com/disk-cleanup"},
+	}
+
+	var actual []map[string]string
+	for _, child := range tree.Nodes[0].Children {
+		m := child.(*MatcherT)
+		for _, field := range append(m.Match.Fields, m.Negate.Fields...) {
+			actual = append(actual, field.Annotations)
+		}
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("annotations = %v, want %v", actual, expected)
+	}
+
+	// Annotations do not change the stable hash
+	var (
+		stripped = regexp.MustCompile(`(?m)^\s+annotations:\n(\s+\S+: .*\n)+`).ReplaceAllString(data, "")
+		hashes   []string
+	)
+
+	if stripped == data {
+		t.Fatalf("Expected annotations to be stripped")
+	}
+
+	for _, d := range []string{data, stripped} {
+		config, err := Unmarshal([]byte(d))
+		if err != nil {
+			t.Fatalf("Error unmarshaling rule: %v", err)
+		}
+		hash, err := StableHash(config.Rules[0])
+		if err != nil {
+			t.Fatalf("Error hashing rule: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if hashes[0] != hashes[1] {
+		t.Errorf("Expected annotations to not affect the stable hash, got %s and %s", hashes[0], hashes[1])
+	}
+}
+
+func TestFindSemanticDuplicates(t *testing.T) {
+
+	config, err := Unmarshal([]byte(testdata.TestSemanticDuplicates))
+	if err != nil {
+		t.Fatalf("Error unmarshaling rules: %v", err)
+	}
+
+	dupes := FindSemanticDuplicates(config)
+	if len(dupes) != 1 {
+		t.Fatalf("Expected 1 group of duplicates, got %v", dupes)
+	}
+
+	var expected = []string{"J7uRQTGpGMyL1iFpssnBeS", "5UD1RZxGC5LJQnVpAkV11A"}
+	for _, ids := range dupes {
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("ids = %v, want %v", ids, expected)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+
+	yamlConfig, err := Unmarshal([]byte(testdata.TestSuccessTermRef))
+	if err != nil {
+		t.Fatalf("Error unmarshaling YAML rules: %v", err)
+	}
+
+	jsonConfig, err := UnmarshalJSON([]byte(testdata.TestSuccessJSON))
+	if err != nil {
+		t.Fatalf("Error unmarshaling JSON rules: %v", err)
+	}
+
+	if !reflect.DeepEqual(yamlConfig.Rules, jsonConfig.Rules) || !reflect.DeepEqual(yamlConfig.TermsT, jsonConfig.TermsT) {
+		t.Fatalf("Expected identical rules, got %+v and %+v", yamlConfig.Rules, jsonConfig.Rules)
+	}
+
+	tree, err := ParseJSON([]byte(testdata.TestSuccessJSON))
+	if err != nil {
+		t.Fatalf("Error parsing JSON rules: %v", err)
+	}
+
+	if len(tree.Nodes) != 1 || len(tree.Nodes[0].Children) != 4 {
+		t.Fatalf("Expected 1 rule with 4 children, got %+v", tree.Nodes)
+	}
+
+	var tests = map[string]struct {
+		data string
+		err  error
+		line int
+		col  int
+	}{
+		"Window": {
+			data: testdata.TestFailJSONWindow,
+			err:  ErrInvalidWindow,
+			line: 14,
+			col:  21,
+		},
+		"Syntax": {
+			data: "{\n  \"rules\": [\n    {\"cre\": }\n  ]\n}\n",
+			err:  ErrInvalidJSON,
+			line: 3,
+			col:  13,
+		},
+		"Trailing": {
+			data: "{\"rules\": []}\nrules: []\n",
+			err:  ErrInvalidJSON,
+			line: 1,
+			col:  14,
+		},
+		"YAML": {
+			data: testdata.TestSuccessTermRef,
+			err:  ErrInvalidJSON,
+			line: 1,
+			col:  2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseJSON([]byte(test.data))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if pos, ok := pqerr.PosOf(err); !ok || pos.Line != test.line || pos.Col != test.col {
+				t.Errorf("Expected error position line=%d, col=%d, got %+v", test.line, test.col, pos)
+			}
+		})
+	}
+}
+
+func TestReadInclude(t *testing.T) {
+
+	var (
+		dir    = t.TempDir()
+		main   = filepath.Join(dir, "main.yaml")
+		shared = filepath.Join(dir, "shared", "rules.yaml")
+		files  = map[string]string{
+			main:                              testdata.TestIncludeMain,
+			filepath.Join(dir, "common.yaml"): testdata.TestIncludeCommon,
+			shared:                            strings.Replace(testdata.TestIncludeShared, "terms:\n  oom:\n    value: \"out of memory\"\n", "", 1),
+		}
+	)
+
+	if err := os.Mkdir(filepath.Join(dir, "shared"), 0o755); err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("Error writing %s: %v", path, err)
+		}
+	}
+
+	// Local files must be enabled
+	_, err := ReadFiles([]string{main})
+	if !errors.Is(err, ErrIncludeFile) {
+		t.Fatalf("Expected error %v, got %v", ErrIncludeFile, err)
+	}
+
+	// Included files are read once, even though they include each other
+	config, err := ReadFiles([]string{main}, WithIncludeResolver(OSIncludeResolver))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if len(config.Rules) != 2 || len(config.TermsT) != 2 {
+		t.Fatalf("Expected 2 rules and 2 terms, got %d and %d", len(config.Rules), len(config.TermsT))
+	}
+
+	if _, err = ParseRules(config, nil); err != nil {
+		t.Fatalf("Error parsing rules: %v", err)
+	}
+
+	// Files listed directly are not read again when included, in any order
+	for _, paths := range [][]string{
+		{main, filepath.Join(dir, "common.yaml")},
+		{filepath.Join(dir, "common.yaml"), main},
+		{main, shared},
+		{shared, main},
+		{filepath.Join(dir, "common.yaml"), shared, main},
+	} {
+		config, err = ReadFiles(paths, WithIncludeResolver(OSIncludeResolver))
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", paths, err)
+		}
+
+		if len(config.Rules) != 2 || len(config.TermsT) != 2 {
+			t.Errorf("%v: expected 2 rules and 2 terms, got %d and %d", paths, len(config.Rules), len(config.TermsT))
+		}
+	}
+
+	// A file without rules must still be included by another
+	terms := filepath.Join(dir, "terms.yaml")
+	if err = os.WriteFile(terms, []byte("terms:\n  panic:\n    value: panic\n"), 0o644); err != nil {
+		t.Fatalf("Error writing %s: %v", terms, err)
+	}
+
+	_, err = ReadFiles([]string{main, terms}, WithIncludeResolver(OSIncludeResolver))
+	if !errors.Is(err, ErrRulesNotFound) {
+		t.Errorf("Expected error %v, got %v", ErrRulesNotFound, err)
+	}
+
+	// Paths resolve the same way in a file system
+	config, err = Read(strings.NewReader(testdata.TestIncludeMain), WithIncludeResolver(FSIncludeResolver(os.DirFS(dir))))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if len(config.Rules) != 2 || len(config.TermsT) != 2 {
+		t.Fatalf("Expected 2 rules and 2 terms, got %d and %d", len(config.Rules), len(config.TermsT))
+	}
+
+	// Parse has no files to resolve includes against, so it refuses them rather
+	// than leaving included term names as literal terms
+	_, err = Parse([]byte(testdata.TestIncludeMain))
+	if !errors.Is(err, ErrIncludeParse) {
+		t.Fatalf("Expected error %v, got %v", ErrIncludeParse, err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 2 {
+		t.Errorf("Expected error position line=2, got %+v", pos)
+	}
+
+	// Included terms are merged with the same duplicate checks
+	if err = os.WriteFile(shared, []byte(testdata.TestIncludeShared), 0o644); err != nil {
+		t.Fatalf("Error writing %s: %v", shared, err)
+	}
+
+	_, err = ReadFiles([]string{main}, WithIncludeResolver(OSIncludeResolver))
+	if !errors.Is(err, ErrDuplicateTerm) {
+		t.Fatalf("Expected error %v, got %v", ErrDuplicateTerm, err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 3 || pos.Col != 5 {
+		t.Errorf("Expected error position line=3, col=5, got %+v", pos)
+	}
+
+	// URLs must be enabled
+	data := "include:\n  - https://example.com/terms.yaml\n" + testdata.TestIncludeMain[len("include:\n"):]
+	if _, err = Read(strings.NewReader(data)); !errors.Is(err, ErrIncludeURL) {
+		t.Errorf("Expected error %v, got %v", ErrIncludeURL, err)
+	}
+}
+
+func TestReadIncludeURL(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rules/common.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("terms:\n  oom:\n    regex: \"OOM ?Killed\"\n"))
+	}))
+	defer srv.Close()
+
+	data := fmt.Sprintf("include:\n  - %s/rules/common.yaml\n", srv.URL) +
+		testdata.TestIncludeMain[strings.Index(testdata.TestIncludeMain, "rules:\n"):]
+
+	config, err := Read(strings.NewReader(data), WithIncludeURLs(srv.Client()))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if _, ok := config.TermsT["oom"]; !ok {
+		t.Fatalf("Expected included term, got %v", config.TermsT)
+	}
+
+	data = strings.Replace(data, "common.yaml", "missing.yaml", 1)
+	if _, err = Read(strings.NewReader(data), WithIncludeURLs(srv.Client())); !errors.Is(err, ErrInclude) {
+		t.Errorf("Expected error %v, got %v", ErrInclude, err)
+	}
+}
+
+func TestParseParams(t *testing.T) {
+
+	var tests = map[string]struct {
+		params map[string]string
+		window time.Duration
+		source string
+		values []string
+	}{
+		"Defaults": {
+			window: 30 * time.Second,
+			source: "cre.log.postgres",
+			values: []string{"postgres shutting down", "postgres (started|ready)"},
+		},
+		"Override": {
+			params: map[string]string{"service": "mysql"},
+			window: 30 * time.Second,
+			source: "cre.log.mysql",
+			values: []string{"mysql shutting down", "mysql (started|ready)"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tree, err := Parse([]byte(testdata.TestSuccessParams), WithParams(test.params))
+			if err != nil {
+				t.Fatalf("Error parsing rule: %v", err)
+			}
+
+			root := tree.Nodes[0]
+			if root.Metadata.Window != test.window {
+				t.Errorf("window = %v, want %v", root.Metadata.Window, test.window)
+			}
+
+			if root.Metadata.Event.Source != test.source {
+				t.Errorf("source = %s, want %s", root.Metadata.Event.Source, test.source)
+			}
+
+			var values []string
+			for _, child := range root.Children {
+				field := child.(*MatcherT).Match.Fields[0]
+				values = append(values, field.StrValue+field.RegexValue)
+			}
+
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("values = %v, want %v", values, test.values)
+			}
+		})
+	}
+
+	// Supplying the parameter resolves the reference
+	if _, err := Parse([]byte(testdata.TestFailUndefinedParam), WithParams(map[string]string{"service": "app"})); err != nil {
+		t.Errorf("Error parsing rule: %v", err)
+	}
+
+	// References are only expanded in the rule section, and only if the rule has parameters
+	description := "      description: \"Restarts ${DEPLOYMENT}\"\n"
+	for name, data := range map[string]string{
+		"Params":   strings.Replace(testdata.TestSuccessParams, "      id: TestSuccessParams\n", "      id: TestSuccessParams\n"+description, 1),
+		"NoParams": strings.Replace(testdata.TestSuccessSimpleRule1, "      severity: 1\n", "      severity: 1\n"+description, 1),
+	} {
+		if _, err := Parse([]byte(data)); err != nil {
+			t.Errorf("%s: error parsing rule with a literal reference in the description: %v", name, err)
+		}
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+
+	var tests = map[string]struct {
+		cond     string
+		expected string
+		col      int // Error column, if the condition is invalid
+	}{
+		"Precedence":     {cond: "a or b and not c", expected: "a or (b and not c)"},
+		"Parens":         {cond: "(a or b) and c", expected: "(a or b) and c"},
+		"Flatten":        {cond: "a and (b and c) and d", expected: "a and b and c and d"},
+		"DoubleNegation": {cond: "a and not not b", expected: "a and b"},
+		"Keywords":       {cond: "a AND NOT b OR c", expected: "(a and not b) or c"},
+		"Unbalanced":     {cond: "(a and b", col: 9},
+		"MissingTerm":    {cond: "a and or b", col: 7},
+		"Trailing":       {cond: "a b", col: 3},
+		"BadChar":        {cond: "a & b", col: 3},
+		"Empty":          {cond: " ", col: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := ParseCondition(test.cond, nil)
+			if test.col > 0 {
+				if !errors.Is(err, ErrCondition) {
+					t.Fatalf("Expected error %v, got %v", ErrCondition, err)
+				}
+				if pos, _ := pqerr.PosOf(err); pos.Col != test.col {
+					t.Errorf("Expected error col=%d, got %+v", test.col, pos)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error parsing condition: %v", err)
+			}
+			if expr.String() != test.expected {
+				t.Errorf("condition = %s, want %s", expr.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestParseConditionRule(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "45-condition.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	tree, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	root := tree.Nodes[0]
+	if root.Metadata.Condition == nil || root.Metadata.Condition.String() != "(crash and not restart) or (oom and evicted)" {
+		t.Fatalf("Unexpected condition %v", root.Metadata.Condition)
+	}
+
+	if len(root.Children) != 1 {
+		t.Fatalf("Expected 1 child, got %d", len(root.Children))
+	}
+
+	anyOf := root.Children[0].(*NodeT)
+	if anyOf.Metadata.Type != schema.NodeTypeAny || len(anyOf.Children) != 2 {
+		t.Fatalf("Expected anyOf with 2 children, got %s with %d", anyOf.Metadata.Type, len(anyOf.Children))
+	}
+
+	// The negated branch is a set with the enclosing window
+	set := anyOf.Children[0].(*NodeT)
+	if set.Metadata.Type != schema.NodeTypeSet || set.NegIdx != 1 || set.Metadata.Window != 30*time.Second {
+		t.Errorf("Expected set with a negate and 30s window, got %s neg_idx=%d window=%v", set.Metadata.Type, set.NegIdx, set.Metadata.Window)
+	}
+
+	if allOf := anyOf.Children[1].(*NodeT); allOf.Metadata.Type != schema.NodeTypeAll {
+		t.Errorf("Expected %s, got %s", schema.NodeTypeAll, allOf.Metadata.Type)
+	}
+}
+
+func TestParseConditionOr(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestSuccessConditionOr))
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	// An 'or' of values is one field matching any of them
+	var root = tree.Nodes[0]
+
+	if root.Metadata.Type != schema.NodeTypeLogSet || len(root.Children) != 2 || root.NegIdx != 1 {
+		t.Fatalf("Expected a log set with one match and one negate term, got %s with %d children", root.Metadata.Type, len(root.Children))
+	}
+
+	var (
+		field    = root.Children[0].(*MatcherT).Match.Fields[0]
+		expected = []string{`panic: runtime error`, `fatal error`, "out of memory|OOM"}
+	)
+
+	if !reflect.DeepEqual(field.Regexes, expected) {
+		t.Errorf("regexes = %q, want %q", field.Regexes, expected)
+	}
+}
+
+func TestParseValuesFrom(t *testing.T) {
+
+	var (
+		data = []byte(testdata.TestSuccessValuesFrom)
+		fsys = fstest.MapFS{
+			"iocs.txt": {Data: []byte("# known bad domains\nevil.example.com\n\n  bad.example.net  \nevil.example.com\n")},
+		}
+		opts = []ParseOptT{WithGenIds(), WithValuesResolver(FSValuesResolver(fsys))}
+	)
+
+	tree, err := Parse(data, opts...)
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	var (
+		field    = tree.Nodes[0].Children[0].(*MatcherT).Match.Fields[0]
+		expected = []string{"evil.example.com", "bad.example.net"}
+		hash     = tree.Nodes[0].Metadata.RuleHash
+	)
+
+	if !reflect.DeepEqual(field.Values, expected) {
+		t.Errorf("values = %v, want %v", field.Values, expected)
+	}
+
+	// A change to the list changes the rule hash
+	fsys["iocs.txt"] = &fstest.MapFile{Data: []byte("evil.example.com\n")}
+
+	if tree, err = Parse(data, opts[0], WithValuesResolver(FSValuesResolver(fsys))); err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	if tree.Nodes[0].Metadata.RuleHash == hash {
+		t.Errorf("Expected rule hash to change with the list, got %s", hash)
+	}
+
+	// References require a resolver and must resolve
+	var tests = []struct {
+		opts []ParseOptT
+		err  error
+	}{
+		{opts: nil, err: ErrValuesFromResolver},
+		{opts: []ParseOptT{WithValuesResolver(FSValuesResolver(fstest.MapFS{}))}, err: ErrValuesFrom},
+		{opts: []ParseOptT{WithValuesResolver(FSValuesResolver(fstest.MapFS{"iocs.txt": {Data: []byte("# empty\n")}}))}, err: ErrValueList},
+	}
+
+	for _, test := range tests {
+		_, err = Parse(data, append(test.opts, WithGenIds())...)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Expected error %v, got %v", test.err, err)
+			continue
+		}
+		if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 13 || pos.Col != 25 {
+			t.Errorf("Expected error position line=13, col=25, got %+v", pos)
+		}
+	}
+}
+
+func TestGlobRegex(t *testing.T) {
+
+	var tests = []struct {
+		glob  string
+		regex string
+		err   bool
+	}{
+		{glob: "*timeout*connect*", regex: `(?s)^.*timeout.*connect.*$`},
+		{glob: "a**b?.log", regex: `(?s)^a.*b.\.log$`},
+		{glob: "[!0-9]x[]a-]", regex: `(?s)^[^0-9]x[\]a\-]$`},
+		{glob: `\*literal\?`, regex: `(?s)^\*literal\?$`},
+		{glob: "pod-[0-9", err: true},
+		{glob: `trailing\`, err: true},
+	}
+
+	for _, test := range tests {
+		re, err := GlobRegex(test.glob)
+		if (err != nil) != test.err {
+			t.Errorf("GlobRegex(%q) error = %v, want error %v", test.glob, err, test.err)
+			continue
+		}
+		if re != test.regex {
+			t.Errorf("GlobRegex(%q) = %s, want %s", test.glob, re, test.regex)
+		}
+	}
+}
+
+func TestParseMaxRegexProg(t *testing.T) {
+
+	var tests = map[string]struct {
+		rule string
+		opts []ParseOptT
+		err  error
+	}{
+		"Default": {
+			rule: testdata.TestFailRegexSize,
+			err:  ErrRegexSize,
+		},
+		"Disabled": {
+			rule: testdata.TestFailRegexSize,
+			opts: []ParseOptT{WithMaxRegexProg(-1)},
+		},
+		"Lowered": {
+			rule: testdata.TestSuccessRegexGroups,
+			opts: []ParseOptT{WithMaxRegexProg(8)},
+			err:  ErrRegexSize,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(test.rule), test.opts...)
+			if !errors.Is(err, test.err) {
+				t.Errorf("Expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestPromSelectors(t *testing.T) {
+
+	var tests = map[string]struct {
+		expr     string
+		expected []PromSelectorT
+		err      bool
+	}{
+		"Aggregation": {
+			expr: `sum(rate(http_requests_total{code=~"5..", job!="batch"}[5m])) by (service) > 10`,
+			expected: []PromSelectorT{{
+				Metric: "http_requests_total",
+				Matchers: []PromMatcherT{
+					{Name: "code", Op: "=~", Value: "5.."},
+					{Name: "job", Op: "!=", Value: "batch"},
+				},
+			}},
+		},
+		"BinaryOp": {
+			expr: `sum without (instance) (errors_total) / on(job) group_left(team) up{job="api"} offset 5m`,
+			expected: []PromSelectorT{
+				{Metric: "errors_total"},
+				{Metric: "up", Matchers: []PromMatcherT{{Name: "job", Op: "=", Value: "api"}}},
+			},
+		},
+		"NoMetric": {
+			expr:     `count({__name__=~"node_.+", job='node'})`,
+			expected: []PromSelectorT{{Matchers: []PromMatcherT{{Name: "__name__", Op: "=~", Value: "node_.+"}, {Name: "job", Op: "=", Value: "node"}}}},
+		},
+		"Subquery": {
+			expr:     `max_over_time(rate(node_cpu_seconds_total[1m])[30m:1m]) > bool 0.9`,
+			expected: []PromSelectorT{{Metric: "node_cpu_seconds_total"}},
+		},
+		"QuotedName": {
+			expr:     `rate({"http.server.requests"}[5m]) / {"http.server.active", job="api"}`,
+			expected: []PromSelectorT{{Metric: "http.server.requests"}, {Metric: "http.server.active", Matchers: []PromMatcherT{{Name: "job", Op: "=", Value: "api"}}}},
+		},
+		"Functions": {
+			expr:     `histogram_quantile(0.99, sum by (le) (rate(latency_bucket[5m]))) > 0.5 and on() absent(up{job="api"}) == 0`,
+			expected: []PromSelectorT{{Metric: "latency_bucket"}, {Metric: "up", Matchers: []PromMatcherT{{Name: "job", Op: "=", Value: "api"}}}},
+		},
+		"Empty":           {expr: " ", err: true},
+		"UnclosedParen":   {expr: `sum(rate(x[5m])`, err: true},
+		"UnclosedString":  {expr: `up{job="api}`, err: true},
+		"MissingOperator": {expr: `up{job "api"}`, err: true},
+		"EmptySelector":   {expr: `{job=""}`, err: true},
+		"BadCharacter":    {expr: `up; down`, err: true},
+		"Mismatched":      {expr: `sum(x[5m)]`, err: true},
+		"UnknownFunction": {expr: `rated(x[5m])`, err: true},
+		"TypeMismatch":    {expr: `rate(x)`, err: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			selectors, err := PromSelectors(test.expr)
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected error for %q, got selectors %v", test.expr, selectors)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(selectors, test.expected) {
+				t.Errorf("selectors = %+v, want %+v", selectors, test.expected)
+			}
+		})
+	}
+}
+
+func TestAlertSelector(t *testing.T) {
+
+	var tests = map[string]struct {
+		expr     string
+		expected PromSelectorT
+		err      bool
+	}{
+		"Name":       {expr: `KubePodCrashLooping`, expected: PromSelectorT{Metric: "KubePodCrashLooping"}},
+		"Matchers":   {expr: `{severity="critical"}`, expected: PromSelectorT{Matchers: []PromMatcherT{{Name: "severity", Op: "=", Value: "critical"}}}},
+		"QuotedName": {expr: `{"Kube.PodCrashLooping", namespace=~"prod-.*"}`, expected: PromSelectorT{Metric: "Kube.PodCrashLooping", Matchers: []PromMatcherT{{Name: "namespace", Op: "=~", Value: "prod-.*"}}}},
+		"Offset":     {expr: `KubePodCrashLooping offset 5m`, err: true},
+		"Expression": {expr: `count(KubePodCrashLooping)`, err: true},
+		"Range":      {expr: `KubePodCrashLooping[5m]`, err: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sel, err := AlertSelector(test.expr)
+			switch {
+			case test.err && err == nil:
+				t.Fatalf("Expected error for %q, got selector %+v", test.expr, sel)
+			case !test.err && err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case !test.err && !reflect.DeepEqual(sel, test.expected):
+				t.Errorf("selector = %+v, want %+v", sel, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseRuleFilter(t *testing.T) {
+
+	var tests = map[string]struct {
+		filter func(ParseRuleT) bool
+		ids    []string
+	}{
+		"CreId":   {filter: RuleIdFilter("TestSuccessRuleFilter-kafka"), ids: []string{"Qm4TzV8bHnR2xWc6YpLs3K"}},
+		"RuleId":  {filter: RuleIdFilter("Wb6NcR3tLy8KpZ2vHm5QxD"), ids: []string{"Wb6NcR3tLy8KpZ2vHm5QxD"}},
+		"Hash":    {filter: RuleIdFilter("Fd7JkP2wNq9RtB5vXm3ZcH", "Ts9GhM4pXr7VkC2nBw6JqF"), ids: []string{"Qm4TzV8bHnR2xWc6YpLs3K", "Wb6NcR3tLy8KpZ2vHm5QxD"}},
+		"Tag":     {filter: RuleTagFilter("queue"), ids: []string{"Wb6NcR3tLy8KpZ2vHm5QxD"}},
+		"NoMatch": {filter: RuleTagFilter("redis")},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			tree, err := Parse([]byte(testdata.TestSuccessRuleFilter), WithRuleFilter(test.filter))
+			if err != nil {
+				t.Fatalf("Error parsing rules: %v", err)
+			}
+
+			var ids []string
+			for _, node := range tree.Nodes {
+				ids = append(ids, node.Metadata.RuleId)
+			}
+			if !slices.Equal(ids, test.ids) {
+				t.Errorf("Expected rules %v, got %v", test.ids, ids)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte(testdata.TestSuccessRuleFilter)); err == nil {
+		t.Errorf("Expected the unfiltered bundle to fail")
+	}
+
+	results, err := CompileEach([]byte(testdata.TestSuccessRuleFilter), WithRuleFilter(RuleTagFilter("kafka")))
+	if err != nil {
+		t.Fatalf("Error compiling rules: %v", err)
+	}
+	if _, ok := results["Fd7JkP2wNq9RtB5vXm3ZcH"]; !ok || len(results) != 1 {
+		t.Errorf("Expected only the kafka rule, got %v", results)
+	}
+}
+
+func TestParseParallel(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", file, err)
+		}
+		seq, err := Parse(data, WithTiming())
+		if err != nil {
+			t.Fatalf("Error parsing rule %s: %v", file, err)
+		}
+		par, err := Parse(data, WithTiming(), WithParallelism(4))
+		if err != nil {
+			t.Fatalf("Error parsing rule %s in parallel: %v", file, err)
+		}
+		seqJson, _ := json.Marshal(seq.Nodes)
+		parJson, _ := json.Marshal(par.Nodes)
+		if !bytes.Equal(seqJson, parJson) {
+			t.Errorf("Expected the same tree in parallel for %s", file)
+		}
+		if len(seq.Timings) != len(par.Timings) {
+			t.Errorf("Expected %d timings in parallel for %s, got %d", len(seq.Timings), file, len(par.Timings))
+		}
+	}
+
+	// The error of the first failing rule is returned
+	_, seqErr := Parse([]byte(testdata.TestSuccessRuleFilter))
+	_, parErr := Parse([]byte(testdata.TestSuccessRuleFilter), WithParallelism(3))
+	if seqErr == nil || parErr == nil || seqErr.Error() != parErr.Error() {
+		t.Errorf("Expected %v in parallel, got %v", seqErr, parErr)
+	}
+}
+
+func TestParseStream(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", file, err)
+		}
+
+		var (
+			rules     []ParseRuleT
+			streamErr error
+		)
+
+		for rule, err := range Stream(bytes.NewReader(data)) {
+			if err != nil {
+				streamErr = err
+				break
+			}
+			rules = append(rules, rule)
+		}
+
+		// Streams check duplicates as Read does
+		config, err := Read(bytes.NewReader(data))
+		switch {
+		case err != nil && (streamErr == nil || err.Error() != streamErr.Error()):
+			t.Errorf("Expected %v for %s, got %v", err, file, streamErr)
+		case err == nil && streamErr != nil:
+			t.Fatalf("Error streaming rule %s: %v", file, streamErr)
+		case err == nil:
+			readJson, _ := json.Marshal(config.Rules)
+			streamJson, _ := json.Marshal(rules)
+			if !bytes.Equal(readJson, streamJson) {
+				t.Errorf("Expected the rules of Read for %s", file)
+			}
+		}
+
+		tree, err := Parse(data, WithGenIds())
+		if err != nil {
+			t.Fatalf("Error parsing rule %s: %v", file, err)
+		}
+
+		var nodes []*NodeT
+		for node, err := range StreamTrees(bytes.NewReader(data), WithGenIds()) {
+			if err != nil {
+				t.Fatalf("Error streaming rule %s: %v", file, err)
+			}
+			nodes = append(nodes, node)
+		}
+
+		parseJson, _ := json.Marshal(tree.Nodes)
+		streamJson, _ := json.Marshal(nodes)
+		if !bytes.Equal(parseJson, streamJson) {
+			t.Errorf("Expected the trees of Parse for %s", file)
+		}
+	}
+
+	// Stops when the caller does
+	var n int
+	for range StreamTrees(strings.NewReader(testdata.TestSuccessRuleFilter)) {
+		if n++; n == 2 {
+			break
+		}
+	}
+
+	// Errors are yielded last, with their lines in the stream
+	var tests = map[string]struct {
+		data string
+		err  error
+		msg  string
+	}{
+		"Syntax": {
+			data: "terms:\n  a:\n    field: x\n    value: y\nrules:\n  - cre:\n      id: a\n  - cre:\n      id: [b\n",
+			msg:  "yaml: line 8:",
+		},
+		"Duplicate": {
+			data: "rules:\n  - metadata:\n      id: a\n  - metadata:\n      id: a\n",
+			err:  ErrDuplicateRule,
+		},
+		"Include": {
+			data: "include:\n  - other.yaml\nrules: []\n",
+			err:  ErrStreamInclude,
+		},
+		"NoRules": {
+			data: "---\nterms: {}\n---\nrules: []\n",
+			err:  ErrRulesNotFound,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var last error
+			for _, err := range Stream(strings.NewReader(test.data)) {
+				if err != nil {
+					last = err
+				}
+			}
+			switch {
+			case last == nil:
+				t.Fatalf("Expected an error")
+			case test.err != nil && !errors.Is(last, test.err):
+				t.Errorf("Expected %v, got %v", test.err, last)
+			case test.msg != "" && !strings.Contains(last.Error(), test.msg):
+				t.Errorf("Expected %q, got %v", test.msg, last)
+			}
+		})
+	}
+
+	var (
+		ids  []string
+		last error
+	)
+
+	for node, err := range StreamTrees(strings.NewReader(testdata.TestSuccessRuleFilter)) {
+		if err != nil {
+			last = err
+			break
+		}
+		ids = append(ids, node.Metadata.RuleId)
+	}
+
+	if len(ids) != 2 || !errors.Is(last, ErrInvalidWindow) {
+		t.Errorf("Expected 2 rules then ErrInvalidWindow, got %v then %v", ids, last)
+	}
+}
+
+func TestParseContentHash(t *testing.T) {
+
+	data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "41-nested.yaml"))
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	config, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	var (
+		rule  = config.Rules[0]
+		terms = maps.Clone(config.TermsT)
+	)
+
+	hash, err := ContentHash(rule, terms)
+	if err != nil {
+		t.Fatalf("Error hashing rule: %v", err)
+	}
+
+	tree, err := Parse(data, WithContentHash())
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+	if tree.Nodes[0].Metadata.ContentHash != hash {
+		t.Errorf("Expected content hash %s, got %s", hash, tree.Nodes[0].Metadata.ContentHash)
+	}
+
+	var tests = map[string]struct {
+		change func(rule *ParseRuleT, terms map[string]ParseTermT)
+		same   bool
+	}{
+		"Generation":  {change: func(rule *ParseRuleT, _ map[string]ParseTermT) { rule.Metadata.Gen++ }, same: true},
+		"UnusedTerm":  {change: func(_ *ParseRuleT, terms map[string]ParseTermT) { terms["unused"] = ParseTermT{StrValue: "x"} }, same: true},
+		"Priority":    {change: func(rule *ParseRuleT, _ map[string]ParseTermT) { rule.Metadata.Priority = 5 }},
+		"Hash":        {change: func(rule *ParseRuleT, _ map[string]ParseTermT) { rule.Metadata.Hash = "other" }},
+		"SharedTerm":  {change: func(_ *ParseRuleT, terms map[string]ParseTermT) { terms["term2"] = ParseTermT{StrValue: "x"} }},
+		"RuleContent": {change: func(rule *ParseRuleT, _ map[string]ParseTermT) { rule.Rule.Sequence.Window = "1m" }},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			var (
+				rule  = config.Rules[0]
+				terms = maps.Clone(config.TermsT)
+			)
+
+			seq := *rule.Rule.Sequence
+			rule.Rule.Sequence = &seq
+
+			test.change(&rule, terms)
+
+			changed, err := ContentHash(rule, terms)
+			if err != nil {
+				t.Fatalf("Error hashing rule: %v", err)
+			}
+			if (changed == hash) != test.same {
+				t.Errorf("Expected same=%v, got %s and %s", test.same, hash, changed)
+			}
+		})
 	}
 }
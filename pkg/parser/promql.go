@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"errors"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrPromQL = errors.New("invalid promql expression")
+)
+
+// PromSelectorT is a vector selector of a PromQL expression, such as
+// http_requests_total{code=~"5.."}. Metric is empty for selectors of the form {job="api"}.
+type PromSelectorT struct {
+	Metric   string         `json:"metric,omitempty"`
+	Matchers []PromMatcherT `json:"matchers,omitempty"`
+}
+
+// PromMatcherT is a label matcher of a selector. Op is one of =, !=, =~, or !~.
+type PromMatcherT struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Parses expressions with the default options: experimental functions and
+// duration expressions are refused, as in a Prometheus server without feature flags
+var promParser = promparser.NewParser(promparser.Options{})
+
+// PromSelectors parses a PromQL expression and returns its vector selectors in the
+// order they appear. Selectors of range vectors and subqueries are included.
+func PromSelectors(expr string) ([]PromSelectorT, error) {
+
+	e, err := promParser.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var selectors []PromSelectorT
+
+	promparser.Inspect(e, func(node promparser.Node, _ []promparser.Node) error {
+		if vs, ok := node.(*promparser.VectorSelector); ok {
+			selectors = append(selectors, newPromSelector(vs))
+		}
+		return nil
+	})
+
+	return selectors, nil
+}
+
+// newPromSelector converts a vector selector. The metric name is taken out of the
+// matchers, whether written before the braces or quoted inside them.
+func newPromSelector(vs *promparser.VectorSelector) PromSelectorT {
+
+	var (
+		sel  = PromSelectorT{Metric: vs.Name}
+		name = -1
+	)
+
+	for i, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual && (sel.Metric == "" || sel.Metric == m.Value) {
+			sel.Metric, name = m.Value, i
+			break
+		}
+	}
+
+	for i, m := range vs.LabelMatchers {
+		if i != name {
+			sel.Matchers = append(sel.Matchers, PromMatcherT{Name: m.Name, Op: m.Type.String(), Value: m.Value})
+		}
+	}
+
+	return sel
+}
+
+// promQLError positions an error of the expression at its 'expr' value
+func (node *NodeT) promQLError(yn *yaml.Node, expr string, err error, msg string) error {
+
+	if exprYn, ok := promExprNode(yn, expr); ok {
+		yn = exprYn
+	}
+
+	log.Error().
+		Err(err).
+		Str("expr", expr).
+		Str("reason", msg).
+		Msg("Invalid promql expression")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		err,
+		msg,
+	)
+}
+
+// promExprNode finds the 'expr' value of a promql term. Inline terms are built
+// with the node of the enclosing list, so its items are searched for the expression.
+func promExprNode(yn *yaml.Node, expr string) (*yaml.Node, bool) {
+
+	items := []*yaml.Node{yn}
+	if yn.Kind == yaml.SequenceNode {
+		items = yn.Content
+	}
+
+	for _, item := range items {
+		if promYn, ok := findChild(item, docPromQL); ok {
+			if exprYn, ok := findChild(promYn, docExpr); ok && exprYn.Value == expr {
+				return exprYn, true
+			}
+		}
+	}
+
+	return nil, false
+}
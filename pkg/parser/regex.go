@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrRegex     = errors.New("invalid regex")
+	ErrRegexSize = errors.New("regex too large (exceeds the maximum program size)")
+)
+
+// DefaultMaxRegexProg is the default limit on the number of instructions in the
+// compiled program of a regex. Nested and bounded repetitions such as (a{100}){100}
+// expand into large programs that are slow to match against every event.
+const DefaultMaxRegexProg = 10000
+
+// WithMaxRegexProg sets the limit on the compiled program size of a regex.
+// A limit of zero uses DefaultMaxRegexProg; a negative limit disables the check.
+func WithMaxRegexProg(limit int) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.maxRegexProg = limit
+	}
+}
+
+// checkRegex compiles a regex with the syntax of the runtime and checks the size
+// of its program
+func (o *parseOptsT) checkRegex(expr string) (string, error) {
+
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return err.Error(), ErrRegex
+	}
+
+	limit := DefaultMaxRegexProg
+	if o != nil && o.maxRegexProg != 0 {
+		limit = o.maxRegexProg
+	}
+
+	if limit < 0 {
+		return "", nil
+	}
+
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return err.Error(), ErrRegex
+	}
+
+	if len(prog.Inst) > limit {
+		return fmt.Sprintf("size=%d max=%d", len(prog.Inst), limit), ErrRegexSize
+	}
+
+	return "", nil
+}
+
+// validateRegexes checks the 'regex' of a term and of each of its extracts. The
+// error is positioned at the offending value.
+func (parent *NodeT) validateRegexes(term ParseTermT, yn *yaml.Node) error {
+
+	if term.RegexValue != "" {
+		regexYn, ok := findChild(yn, docRegex)
+		if !ok {
+			regexYn = yn
+		}
+		if err := parent.regexError(term.RegexValue, regexYn); err != nil {
+			return err
+		}
+	}
+
+	extractYn, _ := findChild(yn, docExtract)
+
+	for i, e := range term.Extract {
+		if e.RegexValue == "" {
+			continue
+		}
+		regexYn, ok := seqItem(extractYn, i)
+		if !ok {
+			regexYn = yn
+		} else if n, ok := findChild(regexYn, docRegex); ok {
+			regexYn = n
+		}
+		if err := parent.regexError(e.RegexValue, regexYn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (parent *NodeT) regexError(expr string, yn *yaml.Node) error {
+
+	reason, err := parent.opts.checkRegex(expr)
+	if err == nil {
+		return nil
+	}
+
+	log.Error().
+		Str("regex", expr).
+		Str("reason", reason).
+		Msg("Invalid regex")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		err,
+		reason,
+	)
+}
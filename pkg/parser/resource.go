@@ -0,0 +1,196 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrResource = errors.New("invalid 'resource' (requires an apiVersion, a kind, a field, and a 'to' state)")
+)
+
+// ResourceT is a state transition of a field of the Kubernetes objects selected
+// by group, version, and kind, and optionally by namespace and name
+type ResourceT struct {
+	Group     string  `json:"group,omitempty"` // Empty for the core group
+	Version   string  `json:"version"`
+	Kind      string  `json:"kind"`
+	Namespace string  `json:"namespace,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Field     string  `json:"field"`          // Dot-path in the object, e.g. status.availableReplicas
+	From      *StateT `json:"from,omitempty"` // Nil matches any prior state
+	To        StateT  `json:"to"`
+}
+
+// StateT matches the value of a resource field as a string, or compares it as a number
+type StateT struct {
+	Value   string    `json:"value,omitempty"`
+	Compare *CompareT `json:"compare,omitempty"`
+}
+
+// Known fields of common kinds, keyed by kind and then by name
+var resourceFields = map[string]map[string]string{
+	"Deployment":  replicaFields,
+	"StatefulSet": replicaFields,
+	"ReplicaSet":  replicaFields,
+	"DaemonSet": {
+		"desiredNumberScheduled": "status.desiredNumberScheduled",
+		"numberReady":            "status.numberReady",
+		"numberUnavailable":      "status.numberUnavailable",
+	},
+	"Job": {
+		"active":    "status.active",
+		"failed":    "status.failed",
+		"succeeded": "status.succeeded",
+	},
+	"Pod": {
+		"phase": "status.phase",
+	},
+	"Node": {
+		"unschedulable": "spec.unschedulable",
+	},
+}
+
+var replicaFields = map[string]string{
+	"replicas":          "spec.replicas",
+	"availableReplicas": "status.availableReplicas",
+	"readyReplicas":     "status.readyReplicas",
+	"updatedReplicas":   "status.updatedReplicas",
+}
+
+// resourceField resolves the known name of a field of the kind, or a spec, status,
+// or metadata dot-path
+func resourceField(kind, field string) (string, bool) {
+
+	if path, ok := resourceFields[kind][field]; ok {
+		return path, true
+	}
+
+	for _, prefix := range []string{"spec.", "status.", "metadata."} {
+		if strings.HasPrefix(field, prefix) && validFieldPath(field) {
+			return field, true
+		}
+	}
+
+	return "", false
+}
+
+func nodeFromResource(parent *NodeT, term ParseTermT, yn *yaml.Node) (*NodeT, error) {
+
+	var res = term.Resource
+
+	resYn, ok := findChild(yn, docRes)
+	if !ok {
+		resYn = yn
+	}
+
+	node, err := parent.initChild(resYn)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.APIVersion == "" || res.Kind == "" {
+		return nil, node.resourceError(resYn, res, "missing apiVersion or kind")
+	}
+
+	r := &ResourceT{
+		Kind:      res.Kind,
+		Namespace: res.Namespace,
+		Name:      res.Name,
+	}
+
+	if group, version, ok := strings.Cut(res.APIVersion, "/"); ok {
+		r.Group, r.Version = group, version
+	} else {
+		r.Version = res.APIVersion
+	}
+
+	if r.Version == "" || strings.Contains(r.Version, "/") || (r.Group == "" && strings.Contains(res.APIVersion, "/")) {
+		return nil, node.resourceError(childOr(resYn, "apiVersion"), res, "malformed apiVersion")
+	}
+
+	if r.Field, ok = resourceField(res.Kind, res.Field); !ok {
+		return nil, node.resourceError(childOr(resYn, "field"), res, fmt.Sprintf("unknown field %q for kind %s", res.Field, res.Kind))
+	}
+
+	if res.To == nil {
+		return nil, node.resourceError(resYn, res, "missing 'to' state")
+	}
+
+	to, err := node.parseState(res, res.To, childOr(resYn, docTo), r.Field)
+	if err != nil {
+		return nil, err
+	}
+	r.To = *to
+
+	if res.From != nil {
+		if r.From, err = node.parseState(res, res.From, childOr(resYn, "from"), r.Field); err != nil {
+			return nil, err
+		}
+	}
+
+	event := &EventT{Source: schema.SourceK8sResource}
+	if res.Event != nil {
+		event.Origin = res.Event.Origin
+		if res.Event.Source != "" {
+			event.Source = res.Event.Source
+		}
+	}
+
+	node.Metadata.Type = schema.NodeTypeK8sResource
+	node.Metadata.Event = event
+	node.Metadata.Resource = r
+
+	return node, nil
+}
+
+// parseState parses a 'from' or 'to' state of a resource field
+func (node *NodeT) parseState(res *ParseResourceT, s *ParseStateT, yn *yaml.Node, field string) (*StateT, error) {
+
+	cmp, err := node.parseCompare(ParseTermT{Field: field, Gt: s.Gt, Gte: s.Gte, Lt: s.Lt, Lte: s.Lte, Eq: s.Eq}, yn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cmp == nil && s.Value == "":
+		return nil, node.resourceError(yn, res, "state requires a value or a comparison")
+	case cmp != nil && s.Value != "":
+		return nil, node.resourceError(yn, res, "state cannot have both a value and a comparison")
+	case cmp != nil && cmp.Duration:
+		return nil, node.resourceError(yn, res, "state comparisons must be numbers")
+	}
+
+	return &StateT{Value: s.Value, Compare: cmp}, nil
+}
+
+func childOr(yn *yaml.Node, key string) *yaml.Node {
+	if n, ok := findChild(yn, key); ok {
+		return n
+	}
+	return yn
+}
+
+func (node *NodeT) resourceError(yn *yaml.Node, res *ParseResourceT, reason string) error {
+
+	log.Error().
+		Str("kind", res.Kind).
+		Str("field", res.Field).
+		Str("reason", reason).
+		Msg("Invalid resource")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		ErrResource,
+		reason,
+	)
+}
@@ -0,0 +1,236 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrSourceField = errors.New("unknown field for the event source")
+	ErrSourceValue = errors.New("invalid value for a field of the event source")
+)
+
+// Errors for fields that are unknown to a built-in source
+var srcFieldErrors = map[string]error{
+	schema.SourceTraces:     ErrSpanField,
+	schema.SourceJournald:   ErrJournaldField,
+	schema.SourceSyslog:     ErrSyslogField,
+	schema.SourceWinEvent:   ErrWinEventField,
+	schema.SourceCloudTrail: ErrCloudTrailField,
+	schema.SourceContainer:  ErrContainerField,
+	schema.SourceNetFlow:    ErrFlowField,
+	schema.SourceAlerts:     ErrAlertField,
+}
+
+// knownSrcField reports whether a condition may name the field for events of the
+// source. Sources registered with schema.RegisterSource, the built-in sources
+// too, are checked against their field catalog. Sources without known fields are
+// not checked, and a condition without a field matches the whole event.
+func knownSrcField(source, field string) bool {
+
+	if field == "" {
+		return true
+	}
+
+	if src, ok := schema.LookupSource(source); ok {
+		return src.Fields.Known(field)
+	}
+
+	return true
+}
+
+// checkSource checks the fields of the conditions of a matcher node against its
+// event source and expands the shorthand values of the source. Log sets and
+// sequences over trace spans become trace sets and sequences, and log sets over
+// flow records become flow sets.
+func (node *NodeT) checkSource() error {
+
+	var source string
+	if node.Metadata.Event != nil {
+		source = node.Metadata.Event.Source
+	}
+
+	for _, child := range node.Children {
+		m, ok := child.(*MatcherT)
+		if !ok {
+			continue
+		}
+		for _, fields := range [][]FieldT{m.Match.Fields, m.Negate.Fields} {
+			for i := range fields {
+				if err := node.checkSrcField(source, &fields[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	switch source {
+	case schema.SourceTraces:
+		switch node.Metadata.Type {
+		case schema.NodeTypeLogSet:
+			node.Metadata.Type = schema.NodeTypeTraceSet
+		case schema.NodeTypeLogSeq:
+			node.Metadata.Type = schema.NodeTypeTraceSeq
+		}
+	case schema.SourceNetFlow:
+		switch node.Metadata.Type {
+		case schema.NodeTypeLogSet:
+			node.Metadata.Type = schema.NodeTypeFlowSet
+		case schema.NodeTypeLogSeq:
+			log.Error().Msg("Sequence over flow records")
+			return node.WrapError(ErrFlowSequence)
+		}
+	}
+
+	return nil
+}
+
+func (node *NodeT) checkSrcField(source string, field *FieldT) error {
+
+	var (
+		err    error
+		reason string
+	)
+
+	switch {
+	case !knownSrcField(source, field.Field):
+		if err = srcFieldErrors[source]; err == nil {
+			err = ErrSourceField
+		}
+		if src, ok := schema.LookupSource(source); ok {
+			if s, ok := src.Fields.SuggestField(field.Field); ok {
+				reason = fmt.Sprintf("field=%s, did you mean %s", field.Field, s)
+			}
+		}
+	case field.Compare != nil && field.Compare.Duration && (source != schema.SourceTraces || field.Field != spanDuration):
+		err = ErrCompareDuration
+	case source == schema.SourceJournald && field.Field == journaldPriority:
+		if enumValues(field, syslogSeverities, 7) {
+			return nil
+		}
+		err = ErrJournaldPriority
+	case source == schema.SourceSyslog && field.Field == syslogSeverity:
+		if enumValues(field, syslogSeverities, 7) {
+			return nil
+		}
+		err = ErrSyslogSeverity
+	case source == schema.SourceSyslog && field.Field == syslogFacility:
+		if enumValues(field, syslogFacilities, 23) {
+			return nil
+		}
+		err = ErrSyslogFacility
+	case source == schema.SourceWinEvent && field.Field == winEventID:
+		if enumValues(field, nil, 65535) {
+			return nil
+		}
+		err = ErrWinEventID
+	case source == schema.SourceWinEvent && field.Field == winEventLevel:
+		if enumValues(field, winEventLevels, 5) {
+			return nil
+		}
+		err = ErrWinEventLevel
+	case source == schema.SourceCloudTrail && field.Field == cloudTrailSource:
+		if cloudTrailSources(field) {
+			return nil
+		}
+		err = ErrCloudTrailSource
+	case source == schema.SourceContainer && field.Field == containerAction:
+		if containerActionValues(field) {
+			return nil
+		}
+		err = ErrContainerAction
+	case source == schema.SourceContainer && field.Field == containerExitCode:
+		if enumValues(field, nil, 255) {
+			return nil
+		}
+		err = ErrContainerExitCode
+	case source == schema.SourceNetFlow:
+		if checkFlowField(field) {
+			return nil
+		}
+		err = ErrFlowCondition
+	case source == schema.SourceAlerts:
+		if err = node.checkAlertField(field); err == nil {
+			return nil
+		}
+	default:
+		if reason = catalogValues(source, field); reason == "" {
+			return nil
+		}
+		err = ErrSourceValue
+	}
+
+	log.Error().
+		Str("source", source).
+		Str("field", field.Field).
+		Str("reason", reason).
+		Msg("Invalid field for event source")
+
+	return pqerr.Wrap(field.Pos, node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId, err, reason)
+}
+
+// catalogValues checks the value and strings conditions of a field against the
+// catalog of a registered source. It returns the reason a value is not allowed.
+func catalogValues(source string, field *FieldT) string {
+
+	src, ok := schema.LookupSource(source)
+	if !ok {
+		return ""
+	}
+
+	values := field.Values
+	if field.StrValue != "" {
+		values = append([]string{field.StrValue}, values...)
+	}
+
+	for _, v := range values {
+		if src.Fields.KnownValue(field.Field, v) {
+			continue
+		}
+		if s, ok := src.Fields.SuggestValue(field.Field, v); ok {
+			return fmt.Sprintf("field=%s value=%s, did you mean %s", field.Field, v, s)
+		}
+		return fmt.Sprintf("field=%s value=%s", field.Field, v)
+	}
+
+	return ""
+}
+
+// Built-in sources are registered with the catalogs their fields are checked
+// against, which also serve editor completions and "did you mean" diagnostics.
+func init() {
+
+	builtin := []struct {
+		name     string
+		fields   []string
+		prefixes []string
+		match    func(string) bool
+	}{
+		{schema.SourceTraces, slices.Sorted(maps.Keys(spanFields)), []string{"attributes.", "resource."}, nil},
+		{schema.SourceJournald, []string{"MESSAGE", journaldPriority, "UNIT", "SYSLOG_IDENTIFIER", "_SYSTEMD_UNIT", "_PID", "_COMM", "_HOSTNAME"}, nil, knownJournaldField},
+		{schema.SourceSyslog, slices.Sorted(maps.Keys(syslogFields)), []string{syslogSDPrefix}, nil},
+		{schema.SourceWinEvent, slices.Sorted(maps.Keys(winEventFields)), []string{winEventDataPrefix}, nil},
+		{schema.SourceCloudTrail, slices.Sorted(maps.Keys(cloudTrailFields)), cloudTrailObjects, knownCloudTrailField},
+		{schema.SourceContainer, slices.Sorted(maps.Keys(containerFields)), []string{"labels."}, nil},
+		{schema.SourceNetFlow, slices.Sorted(maps.Keys(flowFields)), nil, nil},
+		{schema.SourceAlerts, slices.Sorted(maps.Keys(alertFields)), []string{"labels.", "annotations."}, nil},
+	}
+
+	for _, b := range builtin {
+		catalog := schema.FieldCatalogT{Fields: b.fields, Prefixes: b.prefixes, Match: b.match}
+		if err := schema.RegisterSource(b.name, catalog, schema.SourceScope(b.name, schema.ScopeNode)); err != nil {
+			panic(err)
+		}
+	}
+
+	// Embedders may replace the catalog of Kubernetes events to restrict reasons
+	if err := schema.RegisterSource(schema.SourceK8sEvent, schema.K8sEventCatalog(), schema.ScopeNode); err != nil {
+		panic(err)
+	}
+}
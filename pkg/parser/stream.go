@@ -0,0 +1,412 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrStreamInclude = errors.New("'include' is not supported when streaming")
+)
+
+// errStreamStop ends a stream when the caller stops iterating
+var errStreamStop = errors.New("stream stopped")
+
+// Stream yields the rules of a bundle one at a time, as Read reads them, without
+// holding the bundle in memory. yaml.v3 decodes whole documents, so the input is
+// split by lines instead: each top-level section of a document, and each item of
+// a block 'rules' sequence, is decoded on its own with its positions shifted to
+// their place in the stream. An anchor cannot be aliased from another item.
+// Memory grows only with the ids kept to report duplicate rules, which are not
+// checked WithGenIds, as in Read.
+//
+// Iteration stops at the first error, which is yielded with a zero rule.
+func Stream(rdr io.Reader, opts ...ParseOptT) iter.Seq2[ParseRuleT, error] {
+	return func(yield func(ParseRuleT, error) bool) {
+
+		var s = newStream(opts...)
+
+		err := s.rules(rdr, func(rule ParseRuleT, _ *yaml.Node) error {
+			if !yield(rule, nil) {
+				return errStreamStop
+			}
+			return nil
+		})
+
+		if err != nil && err != errStreamStop {
+			yield(ParseRuleT{}, err)
+		}
+	}
+}
+
+// StreamTrees yields the tree of each rule of a bundle, as Parse builds them, one
+// at a time. When rdr is an io.Seeker, such as a file, the shared terms of the
+// bundle are read in a first pass that skips the rules; otherwise terms must
+// precede the rules that use them.
+func StreamTrees(rdr io.Reader, opts ...ParseOptT) iter.Seq2[*NodeT, error] {
+	return func(yield func(*NodeT, error) bool) {
+
+		var s = newStream(opts...)
+
+		if seeker, ok := rdr.(io.Seeker); ok {
+			if err := s.readTerms(seeker, rdr); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+
+		err := s.rules(rdr, func(rule ParseRuleT, item *yaml.Node) error {
+
+			if s.o.ruleFilter != nil {
+				if err := s.o.fillIds(&rule, s.termsT); err != nil {
+					return err
+				}
+				if !s.o.ruleFilter(rule) {
+					return nil
+				}
+			}
+
+			root := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{item}}
+
+			node, err := parseRule(0, rule, s.termsT, root, s.termsY, s.o)
+			if err != nil {
+				return err
+			}
+
+			if !yield(node, nil) {
+				return errStreamStop
+			}
+			return nil
+		})
+
+		if err != nil && err != errStreamStop {
+			yield(nil, err)
+		}
+	}
+}
+
+type streamT struct {
+	o         *parseOptsT
+	dupes     map[string]ruleOriginT
+	termsT    map[string]ParseTermT
+	termsY    map[string]*yaml.Node
+	termsRead bool // Terms were read in a first pass
+}
+
+func newStream(opts ...ParseOptT) *streamT {
+	return &streamT{
+		o:      parseOpts(opts...),
+		dupes:  make(map[string]ruleOriginT),
+		termsT: make(map[string]ParseTermT),
+		termsY: make(map[string]*yaml.Node),
+	}
+}
+
+// readTerms reads the shared terms of the stream and seeks back to where it started
+func (s *streamT) readTerms(seeker io.Seeker, rdr io.Reader) error {
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	err = scanBundle(rdr, func(c streamChunkT) error {
+
+		if c.item || c.end {
+			return nil
+		}
+
+		node, err := c.decode()
+		if err != nil || node == nil {
+			return err
+		}
+
+		if vNode, ok := findChild(node, docTerms); ok {
+			return s.mergeTerms(vNode)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.termsRead = true
+
+	_, err = seeker.Seek(start, io.SeekStart)
+	return err
+}
+
+func (s *streamT) mergeTerms(vNode *yaml.Node) error {
+	termsT, termsY, err := parseTermsNode(vNode)
+	if err != nil {
+		return err
+	}
+	return mergeTerms(s.termsT, s.termsY, termsT, termsY)
+}
+
+// rules calls fn for each rule of the stream with its node, in order
+func (s *streamT) rules(rdr io.Reader, fn func(rule ParseRuleT, item *yaml.Node) error) error {
+
+	var (
+		empty  = true // No section in the document
+		rules  bool
+		footer bool
+	)
+
+	return scanBundle(rdr, func(c streamChunkT) error {
+
+		if c.end {
+			if !empty && !rules && !footer {
+				return ErrRulesNotFound
+			}
+			empty, rules, footer = true, false, false
+			return nil
+		}
+
+		empty = false
+
+		node, err := c.decode()
+		if err != nil || node == nil {
+			return err
+		}
+
+		if c.item {
+			return s.ruleList(node, fn)
+		}
+
+		// Walk the keys of the section, as Read does for a document
+		for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+			kNode, vNode := node.Content[i], node.Content[i+1]
+			switch kNode.Value {
+			case docInclude:
+				return ErrStreamInclude
+			case docSection:
+				footer = footer || vNode.Kind == yaml.ScalarNode && vNode.Value == docVersion
+			case docRules:
+				rules = true
+				if err = s.ruleList(vNode, fn); err != nil {
+					return err
+				}
+			case docTerms:
+				if s.termsRead {
+					continue
+				}
+				if err = s.mergeTerms(vNode); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *streamT) ruleList(seq *yaml.Node, fn func(rule ParseRuleT, item *yaml.Node) error) error {
+
+	var rules []ParseRuleT
+	if err := seq.Decode(&rules); err != nil {
+		return err
+	}
+
+	for j, rule := range rules {
+		item, _ := seqItem(seq, j)
+
+		if !s.o.genIds {
+			// Keep only the position of the first definition, not its nodes
+			origin := ruleOriginT{node: &yaml.Node{Line: item.Line, Column: item.Column}}
+			keep, err := checkDuplicate(rule, origin, s.dupes, s.o.dedupeIdentical)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+		}
+
+		if err := fn(rule, item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// streamChunkT is a top-level section of a document, or an item of its block
+// 'rules' sequence, or the end of a document
+type streamChunkT struct {
+	item bool
+	end  bool
+	line int // Line of the stream the chunk starts on
+	text []byte
+}
+
+// scanBundle splits a stream into chunks by lines. A line at column zero other
+// than a comment or sequence entry starts a section; a 'rules' key without an
+// inline value starts a block sequence, whose items are the lines at the
+// indentation of its first entry.
+func scanBundle(rdr io.Reader, fn func(streamChunkT) error) error {
+
+	var (
+		br      = bufio.NewReader(rdr)
+		cur     streamChunkT
+		lineNo  int
+		inRules bool
+		indent  = -1 // Indentation of the items of the sequence
+	)
+
+	flush := func() error {
+		if len(cur.text) == 0 {
+			return nil
+		}
+		c := cur
+		cur = streamChunkT{}
+		return fn(c)
+	}
+
+	start := func(item bool, line string) {
+		cur = streamChunkT{item: item, line: lineNo, text: []byte(line)}
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+
+		lineNo++
+
+		var (
+			trimmed = strings.TrimRight(line, "\r\n")
+			body    = strings.TrimLeft(trimmed, " ")
+			ind     = len(trimmed) - len(body)
+			skip    = body == "" || body[0] == '#'
+		)
+
+		switch {
+		case isDocMarker(trimmed):
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := fn(streamChunkT{end: true, line: lineNo}); err != nil {
+				return err
+			}
+			inRules = false
+
+		case ind == 0 && !skip && !isSeqEntry(body) && body[0] != '%':
+			if err := flush(); err != nil {
+				return err
+			}
+			start(false, line)
+			key, rest, _ := strings.Cut(body, ":")
+			rest = strings.TrimSpace(rest)
+			inRules = strings.Trim(key, `"'`) == docRules && (rest == "" || rest[0] == '#')
+			if inRules {
+				indent = -1
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+
+		case inRules && skip:
+			if cur.item {
+				cur.text = append(cur.text, line...)
+			}
+
+		case inRules:
+			if indent < 0 && isSeqEntry(body) {
+				indent = ind
+			}
+			if ind == indent && isSeqEntry(body) || len(cur.text) == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+				start(true, line)
+			} else {
+				cur.text = append(cur.text, line...)
+			}
+
+		case len(cur.text) == 0 && skip:
+			// Comments and blank lines between sections
+
+		case len(cur.text) == 0:
+			start(false, line)
+
+		default:
+			cur.text = append(cur.text, line...)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return fn(streamChunkT{end: true, line: lineNo})
+}
+
+func isDocMarker(line string) bool {
+	for _, m := range []string{"---", "..."} {
+		if rest, ok := strings.CutPrefix(line, m); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			return true
+		}
+	}
+	return false
+}
+
+func isSeqEntry(body string) bool {
+	return body == "-" || strings.HasPrefix(body, "- ")
+}
+
+var yamlLineRe = regexp.MustCompile(`^yaml: line (\d+):`)
+
+// decode returns the root node of the chunk, with lines counted from the start
+// of the stream
+func (c streamChunkT) decode() (*yaml.Node, error) {
+
+	var (
+		doc   yaml.Node
+		delta = c.line - 1
+	)
+
+	if err := yaml.Unmarshal(c.text, &doc); err != nil {
+		log.Error().Err(err).Int("line", c.line).Msg("fail yaml decode")
+		return nil, shiftError(err, delta)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	shiftLines(doc.Content[0], delta)
+
+	return doc.Content[0], nil
+}
+
+func shiftLines(n *yaml.Node, delta int) {
+	n.Line += delta
+	for _, c := range n.Content {
+		shiftLines(c, delta)
+	}
+}
+
+// shiftError shifts the line of a yaml syntax error
+func shiftError(err error, delta int) error {
+	m := yamlLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(m[1])
+	return fmt.Errorf("yaml: line %d:%s", line+delta, strings.TrimPrefix(err.Error(), m[0]))
+}
@@ -0,0 +1,99 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrSyslogField    = errors.New("unknown syslog field (must be one of facility, severity, hostname, appname, procid, msgid, message, timestamp, or sd.<SD-ID>[.<param>])")
+	ErrSyslogFacility = errors.New("invalid syslog facility (use 0-23 or a name such as kern, daemon, auth, or local0)")
+	ErrSyslogSeverity = errors.New("invalid syslog severity (use 0-7 or one of emerg, alert, crit, err, warning, notice, info, or debug)")
+)
+
+const (
+	syslogFacility = "facility"
+	syslogSeverity = "severity"
+	syslogSDPrefix = "sd." // Structured data elements and their parameters
+)
+
+// Fields of an RFC 5424 message
+var syslogFields = map[string]bool{
+	syslogFacility: true,
+	syslogSeverity: true,
+	"hostname":     true,
+	"appname":      true,
+	"procid":       true,
+	"msgid":        true,
+	"message":      true,
+	"timestamp":    true,
+}
+
+// Codes of the syslog severities, which are also the journald priorities
+var syslogSeverities = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"warning": 4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+// Codes of the syslog facilities
+var syslogFacilities = map[string]int{
+	"kern":         0,
+	"user":         1,
+	"mail":         2,
+	"daemon":       3,
+	"auth":         4,
+	"syslog":       5,
+	"lpr":          6,
+	"news":         7,
+	"uucp":         8,
+	"cron":         9,
+	"authpriv":     10,
+	"ftp":          11,
+	"ntp":          12,
+	"security":     13,
+	"console":      14,
+	"solaris-cron": 15,
+	"local0":       16,
+	"local1":       17,
+	"local2":       18,
+	"local3":       19,
+	"local4":       20,
+	"local5":       21,
+	"local6":       22,
+	"local7":       23,
+}
+
+// enumValues replaces the names in the value conditions of a field with their
+// codes. Codes from zero to maxCode are kept.
+func enumValues(field *FieldT, names map[string]int, maxCode int) bool {
+
+	code := func(v string) (string, bool) {
+		if n, ok := names[v]; ok {
+			return strconv.Itoa(n), true
+		}
+		n, err := strconv.Atoi(v)
+		return strconv.Itoa(n), err == nil && n >= 0 && n <= maxCode
+	}
+
+	var ok bool
+
+	if field.StrValue != "" {
+		if field.StrValue, ok = code(field.StrValue); !ok {
+			return false
+		}
+	}
+
+	for i, v := range field.Values {
+		if field.Values[i], ok = code(v); !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,23 @@
+package parser
+
+import "errors"
+
+var (
+	ErrSpanField       = errors.New("unknown span field (must be one of name, kind, duration, status.code, status.message, service.name, trace_id, span_id, parent_span_id, attributes.<key>, or resource.<key>)")
+	ErrCompareDuration = errors.New("duration thresholds only compare the 'duration' of spans")
+)
+
+const spanDuration = "duration" // Nanoseconds from the start to the end of the span
+
+// Fields of a span event; attributes and resource attributes are matched by prefix
+var spanFields = map[string]bool{
+	"name":           true,
+	"kind":           true,
+	spanDuration:     true,
+	"status.code":    true,
+	"status.message": true,
+	"service.name":   true,
+	"trace_id":       true,
+	"span_id":        true,
+	"parent_span_id": true,
+}
@@ -1,17 +1,27 @@
 package parser
 
 import (
+	"cmp"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
+	"os"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
 
+	"github.com/prequel-dev/prequel-compiler/pkg/internal/pool"
 	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/rs/zerolog/log"
@@ -19,33 +29,78 @@ import (
 )
 
 var (
-	ErrRuleNotFound     = errors.New("rule not found")
-	ErrRuleRootNotFound = errors.New("missing rule section")
-	ErrNotSupported     = errors.New("not supported")
-	ErrTermNotFound     = errors.New("term not found")
-	ErrMissingOrder     = errors.New("'sequence' missing 'order'")
-	ErrMissingMatch     = errors.New("'set' missing 'match'")
-	ErrInvalidWindow    = errors.New("invalid 'window'")
-	ErrTermsMapping     = errors.New("'terms' must be a mapping")
-	ErrDuplicateTerm    = errors.New("duplicate term name")
-	ErrMissingRuleId    = errors.New("missing rule id")
-	ErrMissingRuleHash  = errors.New("missing rule hash")
-	ErrMissingCreId     = errors.New("missing cre id")
-	ErrInvalidCreId     = errors.New("invalid cre id")
-	ErrInvalidRuleId    = errors.New("invalid rule id (must be base58)")
-	ErrInvalidRuleHash  = errors.New("invalid rule hash (must be base58)")
-	ErrExtractName      = errors.New("invalid extract name (alphanumeric and underscores only)")
-	ErrInnerEvent       = errors.New("invalid event on inner node")
+	ErrRuleNotFound      = errors.New("rule not found")
+	ErrRuleRootNotFound  = errors.New("missing rule section")
+	ErrRulesNotFound     = errors.New("rules not found")
+	ErrNotSupported      = errors.New("not supported")
+	ErrTermNotFound      = errors.New("term not found")
+	ErrMissingOrder      = errors.New("'sequence' missing 'order'")
+	ErrMissingMatch      = errors.New("'set' missing 'match'")
+	ErrInvalidWindow     = errors.New("invalid 'window'")
+	ErrTermsMapping      = errors.New("'terms' must be a mapping")
+	ErrDuplicateTerm     = errors.New("duplicate term name")
+	ErrMissingRuleId     = errors.New("missing rule id")
+	ErrMissingRuleHash   = errors.New("missing rule hash")
+	ErrMissingCreId      = errors.New("missing cre id")
+	ErrInvalidCreId      = errors.New("invalid cre id")
+	ErrInvalidRuleId     = errors.New("invalid rule id (must be base58)")
+	ErrInvalidRuleHash   = errors.New("invalid rule hash (must be base58)")
+	ErrExtractName       = errors.New("invalid extract name (alphanumeric and underscores only)")
+	ErrExtractCollision  = errors.New("named capture group collides with an extract of the same name")
+	ErrInnerEvent        = errors.New("invalid event on inner node")
+	ErrTermCycle         = errors.New("term reference cycle")
+	ErrTermDepth         = errors.New("term references nested too deeply")
+	ErrRequireSources    = errors.New("invalid 'requireSources' (must be 'any' or 'all')")
+	ErrDescription       = errors.New("'description' too long")
+	ErrOrderTolerance    = errors.New("invalid 'orderTolerance' (must be non-negative and less than 'window')")
+	ErrPromQLWindow      = errors.New("'window' is not supported on promql (use 'for' or 'interval')")
+	ErrUndefinedConst    = errors.New("undefined duration constant")
+	ErrValueSetNotFound  = errors.New("value set not found")
+	ErrValueSetEmpty     = errors.New("value set is empty")
+	ErrRepeat            = errors.New("invalid 'repeat' (must be N, N+, or N-M with 1 <= N <= M)")
+	ErrRepeatScope       = errors.New("'repeat' is only valid on sequence order steps")
+	ErrMaxGap            = errors.New("invalid 'maxGap' (must be a positive duration on a sequence order step after the first)")
+	ErrCountRange        = errors.New("invalid 'count' range (must be {min: N, max: M} with 1 <= N <= M on a sequence order step)")
+	ErrOptional          = errors.New("'optional' is only valid on sequence order steps between the first and the last")
+	ErrDuplicateRule     = errors.New("duplicate rule")
+	ErrTermRef           = errors.New("'term' reference cannot be combined with other conditions")
+	ErrPriority          = errors.New("invalid 'priority' (must be non-negative)")
+	ErrMatchNegateOpts   = errors.New("negate options ('window', 'slide', 'anchor', 'absolute') are only valid on negate fields")
+	ErrMissingFooter     = errors.New("missing version footer")
+	ErrAnnotationKey     = errors.New("invalid annotation key (alphanumeric, '_', '-', '.', and '/' only)")
+	ErrGroup             = errors.New("invalid group (use one of 'anyOf' or 'allOf' with two or more terms)")
+	ErrGroupTerm         = errors.New("'anyOf' and 'allOf' terms must be sets, sequences, or promql")
+	ErrAnchorName        = errors.New("negate 'anchor' must name exactly one term of the order or match list")
+	ErrAnchorRange       = errors.New("negate 'anchor' must be the index of a term of the order or match list")
+	ErrUntil             = errors.New("negate 'until' must name exactly one term of the order or match list")
+	ErrNegateGroup       = errors.New("negated 'anyOf' and 'allOf' groups of conditions cannot be nested in each other")
+	ErrCountDistinct     = errors.New("invalid 'countDistinct' (requires a log set with a 'window', a 'field' naming an extract, and a 'threshold' of at least 2)")
+	ErrRequire           = errors.New("invalid 'require' (must be between 1 and the number of match terms of a set of sequences, sets, or promql)")
+	ErrCorrelateOn       = errors.New("invalid 'correlateOn' (requires a set or sequence of sets, sequences, or promql whose match terms all extract the name)")
+	ErrCorrelationWindow = errors.New("invalid 'correlationWindow' (requires correlations and a 'window', and must not be less than the 'window')")
+	ErrValueList         = errors.New("invalid 'strings', 'regexes', or 'valuesFrom' (must be a non-empty list of non-empty values, and cannot be combined with another condition)")
+	ErrMatchOpts         = errors.New("'options' only apply to value, regex, and value list conditions")
+	ErrNegateWindow      = errors.New("negate 'window' or 'slide' requires a 'window' on the enclosing sequence")
 )
 
+// Maximum length of a PromQL description after trimming whitespace
+const maxDescriptionLen = 1024
+
+// Maximum number of nested term references resolved for a single rule
+const maxTermDepth = 32
+
 var (
 	validCreIdRegex     = regexp.MustCompile(`^[A-Za-z0-9-]{4,}$`)
 	validBase58IdRegex  = regexp.MustCompile(`^[1-9A-Za-z]{12,}$`)
 	validateExtractName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	validAnnotationKey  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_./-]*$`)
 )
 
 type TreeT struct {
 	Nodes []*NodeT `json:"nodes"`
+
+	// Per-rule parse time keyed by rule hash. Only populated WithTiming()
+	Timings map[string]time.Duration `json:"-"`
 }
 
 type EventT struct {
@@ -54,44 +109,144 @@ type EventT struct {
 }
 
 type NodeMetadataT struct {
-	RuleHash     string           `json:"rule_hash"`
-	RuleId       string           `json:"rule_id"`
-	CreId        string           `json:"cre_id"`
-	Window       time.Duration    `json:"window"`
-	Event        *EventT          `json:"event"`
-	Type         schema.NodeTypeT `json:"type"`
-	Correlations []string         `json:"correlations"`
-	NegateOpts   *NegateOptsT     `json:"negate_opts"`
-	Pos          pqerr.Pos        `json:"pos"`
+	RuleHash          string           `json:"rule_hash"`
+	RuleId            string           `json:"rule_id"`
+	CreId             string           `json:"cre_id"`
+	Window            time.Duration    `json:"window"`
+	OrderTolerance    time.Duration    `json:"order_tolerance,omitempty"`    // Sequences only
+	CorrelationWindow time.Duration    `json:"correlation_window,omitempty"` // Horizon for correlations; zero uses Window
+	Event             *EventT          `json:"event"`
+	Type              schema.NodeTypeT `json:"type"`
+	Correlations      []string         `json:"correlations"`
+	CorrelateOn       []CorrelateKeyT  `json:"correlate_on,omitempty"` // Machine nodes only; ordered key the children are joined on
+	NegateOpts        *NegateOptsT     `json:"negate_opts"`
+	RequireAllSources bool             `json:"require_all_sources,omitempty"` // Root only
+	Priority          int              `json:"priority,omitempty"`            // Root only
+	Repeat            *RepeatT         `json:"repeat,omitempty"`              // Sequence steps only
+	MaxGap            time.Duration    `json:"max_gap,omitempty"`             // Sequence steps only; maximum time since the previous step
+	Optional          bool             `json:"optional,omitempty"`            // Sequence steps only; the step may be skipped
+	Condition         *BoolExprT       `json:"condition,omitempty"`           // Sets with a 'condition' only
+	CountDistinct     *CountDistinctT  `json:"count_distinct,omitempty"`      // Log sets only
+	Aggregate         *AggregateT      `json:"aggregate,omitempty"`           // Aggregate nodes only
+	Resource          *ResourceT       `json:"resource,omitempty"`            // K8s resource nodes only
+	Require           int              `json:"require,omitempty"`             // Machine sets only; zero requires every match term
+	ContentHash       string           `json:"content_hash,omitempty"`        // Root only, WithContentHash
+	Pos               pqerr.Pos        `json:"pos"`
+	WindowPos         pqerr.Pos        `json:"window_pos,omitzero"` // Position of the 'window' key, if any
+}
+
+// RepeatT bounds how many consecutive times a sequence step may match.
+// A Max of zero is unbounded.
+type RepeatT struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
+}
+
+// MatchOptsT modifies how value and regex conditions match
+type MatchOptsT struct {
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+	WordBoundary    bool `json:"word_boundary,omitempty"`
+	Multiline       bool `json:"multiline,omitempty"`
+}
+
+// Regex folds the options into a regex: word boundaries wrap it, and the case
+// and multiline flags prefix it.
+func (o MatchOptsT) Regex(expr string) string {
+
+	if o.WordBoundary {
+		expr = `\b(?:` + expr + `)\b`
+	}
+
+	var flags string
+	if o.CaseInsensitive {
+		flags += "i"
+	}
+	if o.Multiline {
+		flags += "m"
+	}
+	if flags != "" {
+		expr = "(?" + flags + ")" + expr
+	}
+
+	return expr
+}
+
+// CountRangeT bounds how many times a sequence step must match.
+// A Max of zero is unbounded.
+type CountRangeT struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
 }
 
 type NodeT struct {
 	Metadata NodeMetadataT `json:"metadata"`
 	NegIdx   int           `json:"neg_idx"`
 	Children []any         `json:"children"`
+
+	// Names of the terms resolved on the path to this node; used to detect cycles
+	termPath []string
+
+	// Options the tree is parsed with
+	opts *parseOptsT
 }
 
 type NegateOptsT struct {
-	Window   time.Duration `json:"window"`
-	Slide    time.Duration `json:"slide"`
-	Anchor   uint32        `json:"anchor"`
-	Absolute bool          `json:"absolute"`
+	Window     time.Duration `json:"window"`
+	Slide      time.Duration `json:"slide"`
+	Anchor     uint32        `json:"anchor"` // Index in the order or match list; a counted term is one entry
+	Absolute   bool          `json:"absolute"`
+	AnchorName string        `json:"anchor_name,omitempty"` // Term the anchor was resolved from, if named
+	Until      string        `json:"until,omitempty"`       // Term that ends the negation, if any
+	UntilIdx   uint32        `json:"until_idx,omitempty"`   // Index of Until in the order or match list
+}
+
+// CountDistinctT fires a log set once Threshold distinct values of the extract
+// named Field are observed within the window
+type CountDistinctT struct {
+	Field     string `json:"field"`
+	Threshold int    `json:"threshold"`
 }
 
 type ExtractT struct {
-	Name       string `json:"name"`
-	JqValue    string `json:"jq_value,omitempty"`
-	RegexValue string `json:"regex_value,omitempty"`
+	Name       string       `json:"name"`
+	JqValue    string       `json:"jq_value,omitempty"`
+	RegexValue string       `json:"regex_value,omitempty"`
+	Type       string       `json:"type,omitempty"`
+	Transforms []TransformT `json:"transforms,omitempty"`
+	Pos        pqerr.Pos    `json:"pos,omitzero"` // Position of the 'type', or of the extract if untyped
+}
+
+// TransformT is an extract transform as written, such as "trim" or "substring(0, 8)"
+type TransformT struct {
+	Expr string    `json:"expr"`
+	Pos  pqerr.Pos `json:"pos,omitzero"`
 }
 
 type FieldT struct {
-	Field      string       `json:"field"`
-	StrValue   string       `json:"value"`
-	JqValue    string       `json:"jq_value"`
-	RegexValue string       `json:"regex_value"`
-	Count      int          `json:"count"`
-	NegateOpts *NegateOptsT `json:"negate"`
-	Extract    []ExtractT   `json:"extract,omitempty"`
+	Field      string        `json:"field"`
+	StrValue   string        `json:"value"`
+	JqValue    string        `json:"jq_value"`
+	RegexValue string        `json:"regex_value"`
+	Values     []string      `json:"values,omitempty"`  // Matches any of the literals
+	Regexes    []string      `json:"regexes,omitempty"` // Matches any of the regexes
+	IPCidr     []string      `json:"ip_cidr,omitempty"` // Matches an IP address within any of the CIDR blocks
+	Glob       string        `json:"glob,omitempty"`
+	Options    *MatchOptsT   `json:"options,omitempty"` // Value and regex conditions only
+	Exists     *bool         `json:"exists,omitempty"`
+	Delimiter  string        `json:"delimiter,omitempty"`
+	Compare    *CompareT     `json:"compare,omitempty"`
+	Count      int           `json:"count"`
+	CountRange *CountRangeT  `json:"count_range,omitempty"` // Sequence steps only
+	Repeat     *RepeatT      `json:"repeat,omitempty"`
+	MaxGap     time.Duration `json:"max_gap,omitempty"`  // Sequence steps only; maximum time since the previous step
+	Optional   bool          `json:"optional,omitempty"` // Sequence steps only; the step may be skipped
+	Primary    bool          `json:"primary,omitempty"`
+	NegateOpts *NegateOptsT  `json:"negate"`
+	Extract    []ExtractT    `json:"extract,omitempty"`
+	StepRefs   []StepRefT    `json:"step_refs,omitempty"` // Sequence steps only; values the condition takes from earlier steps
+	Pos        pqerr.Pos     `json:"pos,omitzero"`        // Position of the condition
+
+	Annotations map[string]string `json:"annotations,omitempty"` // Passed through to emitted events
 }
 
 type TermsT struct {
@@ -99,19 +254,22 @@ type TermsT struct {
 }
 
 type MatcherT struct {
-	Match  TermsT        `json:"match"`
-	Negate TermsT        `json:"negate"`
-	Window time.Duration `json:"window"`
+	Match     TermsT        `json:"match"`
+	Negate    TermsT        `json:"negate"`
+	Window    time.Duration `json:"window"`
+	NegateAll bool          `json:"negate_all,omitempty"` // Negate fields suppress only when all of them occur
 }
 
 type PromQLT struct {
-	Expr     string         `json:"expr"`
-	For      *time.Duration `json:"for,omitempty"`
-	Interval *time.Duration `json:"interval,omitempty"`
+	Expr        string          `json:"expr"`
+	For         *time.Duration  `json:"for,omitempty"`
+	Interval    *time.Duration  `json:"interval,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Selectors   []PromSelectorT `json:"selectors,omitempty"` // Vector selectors of Expr, in order
 }
 
-// PromQLValidator validates a PromQL expression.
-// Hook exposed to avoid importing promql dependencies in compiler.
+// PromQLValidator validates a PromQL expression once it parses, for checks beyond
+// the grammar, such as the functions or metrics a deployment supports.
 var PromQLValidator = func(expr string) error { return nil }
 
 func newEvent(t *ParseEventT) *EventT {
@@ -173,6 +331,10 @@ func initNode(ruleId, ruleHash string, creId string, yn *yaml.Node) (*NodeT, err
 
 func assignNodeSeq(node *NodeT, seq *ParseSequenceT) error {
 
+	if node.IsMetricSeq() {
+		return node.metricSteps(seq.Event)
+	}
+
 	if seq.Event == nil {
 		node.Metadata.Type = schema.NodeTypeSeq
 		return nil
@@ -184,15 +346,103 @@ func assignNodeSeq(node *NodeT, seq *ParseSequenceT) error {
 	switch {
 	case node.IsPromNode():
 		node.Metadata.Type = schema.NodeTypePromQL
-	case !node.IsMatcherNode():
-		return ErrInnerEvent
-	default:
+	case node.IsMatcherNode():
 		node.Metadata.Type = schema.NodeTypeLogSeq
+	default:
+		return node.liftSteps()
+	}
+
+	return node.checkSource()
+}
+
+// liftSteps turns a sequence with an event whose order mixes conditions and
+// nested sets into a state machine. Each condition becomes a single match log
+// set, and nested sets or sequences without an event inherit the event of the
+// sequence. Promql and resource steps keep their own event, so metrics or object
+// state may be followed by logs. Only the first step keeps the origin flag.
+func (node *NodeT) liftSteps() error {
+
+	var event = node.Metadata.Event
+
+	for i, child := range node.Children {
+		var step *NodeT
+
+		switch c := child.(type) {
+		case *MatcherT:
+			step = liftMatcher(node, c)
+		case *NodeT:
+			if (c.Metadata.Type == schema.NodeTypePromQL || c.Metadata.Type == schema.NodeTypeK8sResource) && c.Metadata.Event != nil {
+				c.Metadata.Event.Origin = c.Metadata.Event.Origin || (event.Origin && i == 0)
+				continue
+			}
+			if c.Metadata.Event != nil || !c.IsMatcherNode() {
+				return ErrInnerEvent
+			}
+			switch c.Metadata.Type {
+			case schema.NodeTypeSet:
+				c.Metadata.Type = schema.NodeTypeLogSet
+			case schema.NodeTypeSeq:
+				c.Metadata.Type = schema.NodeTypeLogSeq
+			default:
+				return ErrInnerEvent
+			}
+			step = c
+		default:
+			return ErrInnerEvent
+		}
+
+		step.Metadata.Event = &EventT{
+			Source: event.Source,
+			Origin: event.Origin && i == 0,
+		}
+
+		if err := step.checkSource(); err != nil {
+			return err
+		}
+
+		node.Children[i] = step
 	}
 
+	node.Metadata.Type = schema.NodeTypeSeq
+	node.Metadata.Event = nil
+
 	return nil
 }
 
+// liftMatcher wraps a single condition of a sequence order in a log set. A negated
+// condition becomes the match of the set; the set is negated by its position.
+func liftMatcher(parent *NodeT, m *MatcherT) *NodeT {
+
+	var (
+		field FieldT
+		step  = &NodeT{
+			Metadata: NodeMetadataT{
+				RuleId:   parent.Metadata.RuleId,
+				RuleHash: parent.Metadata.RuleHash,
+				CreId:    parent.Metadata.CreId,
+				Type:     schema.NodeTypeLogSet,
+			},
+			NegIdx: -1,
+		}
+	)
+
+	if len(m.Match.Fields) > 0 {
+		field = m.Match.Fields[0]
+	} else {
+		field = m.Negate.Fields[0]
+		step.Metadata.NegateOpts, field.NegateOpts = field.NegateOpts, nil
+	}
+
+	step.Metadata.Pos = field.Pos
+	step.Metadata.Repeat, field.Repeat = field.Repeat, nil
+	step.Metadata.MaxGap, field.MaxGap = field.MaxGap, 0
+	step.Metadata.Optional, field.Optional = field.Optional, false
+
+	step.Children = []any{&MatcherT{Match: TermsT{Fields: []FieldT{field}}}}
+
+	return step
+}
+
 func assignNodeSet(node *NodeT, set *ParseSetT) error {
 
 	if set.Event == nil {
@@ -212,7 +462,7 @@ func assignNodeSet(node *NodeT, set *ParseSetT) error {
 		node.Metadata.Type = schema.NodeTypeLogSet
 	}
 
-	return nil
+	return node.checkSource()
 }
 
 func (node *NodeT) IsMatcherNode() bool {
@@ -232,6 +482,34 @@ func (node *NodeT) IsMatcherNode() bool {
 	return allMatcher
 }
 
+// Sources returns the sorted, de-duplicated set of event sources referenced by the node and its descendants
+func (node *NodeT) Sources() []string {
+	var (
+		seen    = make(map[string]struct{})
+		sources = make([]string, 0)
+		walk    func(n *NodeT)
+	)
+
+	walk = func(n *NodeT) {
+		if n.Metadata.Event != nil && n.Metadata.Event.Source != "" {
+			if _, ok := seen[n.Metadata.Event.Source]; !ok {
+				seen[n.Metadata.Event.Source] = struct{}{}
+				sources = append(sources, n.Metadata.Event.Source)
+			}
+		}
+		for _, child := range n.Children {
+			if c, ok := child.(*NodeT); ok {
+				walk(c)
+			}
+		}
+	}
+
+	walk(node)
+	slices.Sort(sources)
+
+	return sources
+}
+
 func (node *NodeT) IsPromNode() bool {
 	if len(node.Children) == 0 {
 		return false
@@ -248,6 +526,47 @@ func (node *NodeT) IsPromNode() bool {
 	return allPromQL
 }
 
+// IsMetricSeq reports whether the node is a sequence of two or more promql
+// conditions without negates
+func (node *NodeT) IsMetricSeq() bool {
+	if len(node.Children) < 2 || node.NegIdx >= 0 {
+		return false
+	}
+
+	for _, child := range node.Children {
+		if c, ok := child.(*NodeT); !ok || c.Metadata.Type != schema.NodeTypePromQL {
+			return false
+		}
+	}
+
+	return true
+}
+
+// metricSteps makes a sequence of promql conditions a metric sequence. Steps
+// without an event inherit the event of the sequence, if any; only the first
+// step keeps the origin flag.
+func (node *NodeT) metricSteps(event *ParseEventT) error {
+
+	node.Metadata.Type = schema.NodeTypeMetricSeq
+
+	if event == nil {
+		return nil
+	}
+
+	for i, child := range node.Children {
+		step := child.(*NodeT)
+		if step.Metadata.Event != nil {
+			return step.WrapError(ErrInnerEvent)
+		}
+		step.Metadata.Event = &EventT{
+			Source: event.Source,
+			Origin: event.Origin && i == 0,
+		}
+	}
+
+	return nil
+}
+
 func seqNodeProps(node *NodeT, seq *ParseSequenceT, order bool, yn *yaml.Node) error {
 
 	if !order {
@@ -263,10 +582,17 @@ func seqNodeProps(node *NodeT, seq *ParseSequenceT, order bool, yn *yaml.Node) e
 
 		if winNode, ok := findChild(yn, docWindow); ok {
 			node.Metadata.Pos = pqerr.Pos{Line: winNode.Line, Col: winNode.Column}
+			node.Metadata.WindowPos = node.Metadata.Pos
+		}
+
+		if node.Metadata.Window, err = node.parseWindow(seq.Window); err != nil {
+			return err
 		}
+	}
 
-		if node.Metadata.Window, err = time.ParseDuration(seq.Window); err != nil {
-			return node.WrapError(ErrInvalidWindow)
+	if seq.OrderTolerance != "" {
+		if err := orderTolerance(node, seq, yn); err != nil {
+			return err
 		}
 	}
 
@@ -274,6 +600,189 @@ func seqNodeProps(node *NodeT, seq *ParseSequenceT, order bool, yn *yaml.Node) e
 		node.Metadata.Correlations = seq.Correlations
 	}
 
+	if seq.CorrelateOn != nil {
+		if err := correlateOn(node, seq.CorrelateOn, yn); err != nil {
+			return err
+		}
+	}
+
+	if seq.CorrelationWindow != "" {
+		return correlationWindow(node, seq.CorrelationWindow, yn)
+	}
+
+	return nil
+}
+
+// CorrelateKeyT is one element of the key that joins the children of a machine node
+type CorrelateKeyT struct {
+	Key   string           `json:"key"`
+	Terms []CorrelateTermT `json:"terms"` // Children that extract the key, in order
+}
+
+// CorrelateTermT is the extract that supplies a correlation key in one child
+type CorrelateTermT struct {
+	Term    int      `json:"term"` // Index into the children of the node
+	Extract ExtractT `json:"extract"`
+}
+
+// correlateOn resolves the extracts that join the children of a machine node.
+// Every positive child must supply each key; negates are joined if they do.
+func correlateOn(node *NodeT, keys []ParseCorrelateKeyT, yn *yaml.Node) error {
+
+	var (
+		positives = len(node.Children)
+		resolved  = make([]CorrelateKeyT, 0, len(keys))
+		reason    string
+	)
+
+	if node.NegIdx >= 0 {
+		positives = node.NegIdx
+	}
+
+	switch {
+	case node.Metadata.Type != schema.NodeTypeSeq && node.Metadata.Type != schema.NodeTypeSet:
+		reason = "not a set or sequence of sets, sequences, or promql"
+	case len(keys) == 0:
+		reason = "no keys"
+	}
+
+	for _, key := range keys {
+		if reason != "" {
+			break
+		}
+
+		if key.Key == "" {
+			reason = "missing key"
+			break
+		}
+
+		var ck = CorrelateKeyT{Key: key.Key}
+
+		for i, child := range node.Children {
+			c, ok := child.(*NodeT)
+			if ok {
+				var e ExtractT
+				if e, ok = c.keyExtract(key); ok {
+					ck.Terms = append(ck.Terms, CorrelateTermT{Term: i, Extract: e})
+				}
+			}
+			if !ok && i < positives {
+				reason = fmt.Sprintf("term %d does not extract %q", i, key.Key)
+				break
+			}
+		}
+
+		resolved = append(resolved, ck)
+	}
+
+	if reason == "" {
+		node.Metadata.CorrelateOn = resolved
+		return nil
+	}
+
+	log.Error().
+		Any("correlate_on", keys).
+		Str("reason", reason).
+		Msg("Invalid correlate on")
+
+	corrYn, ok := findChild(yn, docCorrOn)
+	if !ok {
+		corrYn = yn
+	}
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: corrYn.Line, Col: corrYn.Column},
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		ErrCorrelateOn,
+		reason,
+	)
+}
+
+// keyExtract returns the extract that supplies key in the node: the one mapped
+// to the node's source, if any, otherwise the one named after the key.
+func (node *NodeT) keyExtract(key ParseCorrelateKeyT) (ExtractT, bool) {
+	for _, src := range node.Sources() {
+		if name, ok := key.Extracts[src]; ok {
+			return node.FindExtract(name)
+		}
+	}
+	return node.FindExtract(key.Key)
+}
+
+// FindExtract returns the extract named name on a match condition of the node or its descendants
+func (node *NodeT) FindExtract(name string) (ExtractT, bool) {
+	for _, child := range node.Children {
+		switch c := child.(type) {
+		case *MatcherT:
+			for _, field := range c.Match.Fields {
+				if i := slices.IndexFunc(field.Extract, func(e ExtractT) bool { return e.Name == name }); i >= 0 {
+					return field.Extract[i], true
+				}
+			}
+		case *NodeT:
+			if e, ok := c.FindExtract(name); ok {
+				return e, true
+			}
+		}
+	}
+	return ExtractT{}, false
+}
+
+// correlationWindow parses the horizon over which the correlations of a node are
+// joined. It may exceed the match window but not fall short of it.
+func correlationWindow(node *NodeT, s string, yn *yaml.Node) error {
+	var (
+		err error
+		pos = node.Metadata.Pos
+	)
+
+	if winNode, ok := findChild(yn, docCorrWin); ok {
+		pos = pqerr.Pos{Line: winNode.Line, Col: winNode.Column}
+	}
+
+	if node.Metadata.CorrelationWindow, err = node.parseWindow(s); err != nil {
+		return node.wrapPosError(pos, ErrCorrelationWindow)
+	}
+
+	var correlated = len(node.Metadata.Correlations) > 0 || len(node.Metadata.CorrelateOn) > 0
+
+	if !correlated || node.Metadata.Window == 0 || node.Metadata.CorrelationWindow < node.Metadata.Window {
+		log.Error().
+			Dur("correlation_window", node.Metadata.CorrelationWindow).
+			Dur("window", node.Metadata.Window).
+			Bool("correlated", correlated).
+			Msg("Invalid correlation window")
+		return node.wrapPosError(pos, ErrCorrelationWindow)
+	}
+
+	return nil
+}
+
+// orderTolerance parses the allowance for slightly inverted timestamps between ordered steps
+func orderTolerance(node *NodeT, seq *ParseSequenceT, yn *yaml.Node) error {
+	var (
+		err error
+		pos = node.Metadata.Pos
+	)
+
+	if tolNode, ok := findChild(yn, docOrdTol); ok {
+		pos = pqerr.Pos{Line: tolNode.Line, Col: tolNode.Column}
+	}
+
+	if node.Metadata.OrderTolerance, err = time.ParseDuration(seq.OrderTolerance); err != nil {
+		return node.wrapPosError(pos, ErrOrderTolerance)
+	}
+
+	if node.Metadata.OrderTolerance < 0 || node.Metadata.OrderTolerance >= node.Metadata.Window {
+		log.Error().
+			Dur("order_tolerance", node.Metadata.OrderTolerance).
+			Dur("window", node.Metadata.Window).
+			Msg("Invalid order tolerance")
+		return node.wrapPosError(pos, ErrOrderTolerance)
+	}
+
 	return nil
 }
 
@@ -292,10 +801,11 @@ func setNodeProps(node *NodeT, set *ParseSetT, match bool, yn *yaml.Node) error
 
 		if winNode, ok := findChild(yn, docWindow); ok {
 			node.Metadata.Pos = pqerr.Pos{Line: winNode.Line, Col: winNode.Column}
+			node.Metadata.WindowPos = node.Metadata.Pos
 		}
 
-		if node.Metadata.Window, err = time.ParseDuration(set.Window); err != nil {
-			return node.WrapError(ErrInvalidWindow)
+		if node.Metadata.Window, err = node.parseWindow(set.Window); err != nil {
+			return err
 		}
 	}
 
@@ -303,16 +813,153 @@ func setNodeProps(node *NodeT, set *ParseSetT, match bool, yn *yaml.Node) error
 		node.Metadata.Correlations = set.Correlations
 	}
 
+	if set.CountDistinct != nil {
+		if err := countDistinct(node, set.CountDistinct, yn); err != nil {
+			return err
+		}
+	}
+
+	if set.Require != 0 {
+		if err := quorum(node, set.Require, yn); err != nil {
+			return err
+		}
+	}
+
+	if set.CorrelateOn != nil {
+		if err := correlateOn(node, set.CorrelateOn, yn); err != nil {
+			return err
+		}
+	}
+
+	if set.CorrelationWindow != "" {
+		return correlationWindow(node, set.CorrelationWindow, yn)
+	}
+
 	return nil
 }
 
-func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+// quorum validates the number of match terms a machine set requires to fire
+func quorum(node *NodeT, k int, yn *yaml.Node) error {
+
+	var terms = len(node.Children)
+	if node.NegIdx >= 0 {
+		terms = node.NegIdx
+	}
+
+	if node.Metadata.Type == schema.NodeTypeSet && k >= 1 && k <= terms {
+		node.Metadata.Require = k
+		return nil
+	}
+
+	log.Error().
+		Int("require", k).
+		Int("terms", terms).
+		Str("type", node.Metadata.Type.String()).
+		Msg("Invalid require")
+
+	reqYn, ok := findChild(yn, docRequire)
+	if !ok {
+		reqYn = yn
+	}
+
+	return node.wrapNodeError(reqYn, ErrRequire)
+}
+
+// countDistinct validates the distinct count of a log set. The field must name
+// an extract of one of the set's match conditions.
+func countDistinct(node *NodeT, cd *ParseCountDistinctT, yn *yaml.Node) error {
+
+	cdYn, ok := findChild(yn, docCntDist)
+	if !ok {
+		cdYn = yn
+	}
 
 	var (
-		root *NodeT
-		n    *yaml.Node
-		ok   bool
-		err  error
+		extracted bool
+		reason    string
+	)
+
+	for _, child := range node.Children {
+		if m, ok := child.(*MatcherT); ok {
+			for _, field := range m.Match.Fields {
+				extracted = extracted || slices.ContainsFunc(field.Extract, func(e ExtractT) bool {
+					return e.Name == cd.Field
+				})
+			}
+		}
+	}
+
+	switch {
+	case node.Metadata.Type != schema.NodeTypeLogSet:
+		reason = "not a log set"
+	case node.Metadata.Window == 0:
+		reason = "missing window"
+	case cd.Threshold < 2:
+		reason = "threshold below 2"
+	case !extracted:
+		reason = "field is not an extract"
+	default:
+		node.Metadata.CountDistinct = &CountDistinctT{Field: cd.Field, Threshold: cd.Threshold}
+		return nil
+	}
+
+	log.Error().
+		Str("field", cd.Field).
+		Int("threshold", cd.Threshold).
+		Str("reason", reason).
+		Msg("Invalid count distinct")
+
+	return pqerr.Wrap(
+		pqerr.Pos{Line: cdYn.Line, Col: cdYn.Column},
+		node.Metadata.RuleId,
+		node.Metadata.RuleHash,
+		node.Metadata.CreId,
+		ErrCountDistinct,
+		reason,
+	)
+}
+
+// parseWindow parses a window duration. A value of the form $name is
+// resolved from the constants supplied WithDurationConstants().
+func (node *NodeT) parseWindow(window string) (time.Duration, error) {
+
+	if name, ok := strings.CutPrefix(window, "$"); ok {
+		var d time.Duration
+		if node.opts != nil {
+			d, ok = node.opts.durations[name]
+		}
+		if !ok {
+			log.Error().
+				Str("constant", name).
+				Msg("Undefined duration constant")
+			return 0, pqerr.Wrap(
+				node.Metadata.Pos,
+				node.Metadata.RuleId,
+				node.Metadata.RuleHash,
+				node.Metadata.CreId,
+				ErrUndefinedConst,
+				fmt.Sprintf("constant=%s", name),
+			)
+		}
+		return d, nil
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, node.WrapError(ErrInvalidWindow)
+	}
+
+	return d, nil
+}
+
+func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node, termsY map[string]*yaml.Node, o *parseOptsT) (*NodeT, error) {
+
+	var (
+		root       *NodeT
+		n          *yaml.Node
+		requireAll bool
+		ok         bool
+		err        error
 	)
 
 	n, ok = findChild(ruleNode, docRule)
@@ -326,6 +973,14 @@ func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node,
 		)
 	}
 
+	if requireAll, err = requireAllSources(r, ruleNode); err != nil {
+		return nil, err
+	}
+
+	if err = validPriority(r, ruleNode); err != nil {
+		return nil, err
+	}
+
 	switch {
 	case r.Rule.Sequence != nil:
 		seqNode, _ := findChild(n, docSeq)
@@ -339,7 +994,8 @@ func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node,
 				err,
 			)
 		}
-		return buildSequenceTree(root, termsT, r, seqNode, termsY)
+		root.opts = o
+		root, err = buildSequenceTree(root, termsT, r, seqNode, termsY)
 	case r.Rule.Set != nil:
 		setNode, _ := findChild(n, docSet)
 		root, err = initNode(r.Metadata.Id, r.Metadata.Hash, r.Cre.Id, setNode)
@@ -352,7 +1008,8 @@ func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node,
 				err,
 			)
 		}
-		return buildSetTree(root, termsT, r, setNode, termsY)
+		root.opts = o
+		root, err = buildSetTree(root, termsT, r, setNode, termsY)
 	default:
 		return nil, pqerr.Wrap(
 			pqerr.Pos{Line: n.Line, Col: n.Column},
@@ -362,17 +1019,83 @@ func buildTree(termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node,
 			ErrNotSupported,
 		)
 	}
-}
 
-// buildSequenceTree processes a rule with a Sequence definition.
-func buildSequenceTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+	if err != nil {
+		return nil, err
+	}
 
-	var (
-		seq      = r.Rule.Sequence
-		orderYn  *yaml.Node
-		negateYn *yaml.Node
-		ok       bool
-	)
+	if err = root.checkStepRefs(); err != nil {
+		return nil, err
+	}
+
+	root.Metadata.RequireAllSources = requireAll
+	root.Metadata.Priority = r.Metadata.Priority
+
+	return root, nil
+}
+
+// requireAllSources validates the rule's requireSources metadata
+func requireAllSources(r ParseRuleT, ruleNode *yaml.Node) (bool, error) {
+
+	switch r.Metadata.RequireSources {
+	case "", RequireSourcesAny:
+		return false, nil
+	case RequireSourcesAll:
+		return true, nil
+	}
+
+	log.Error().
+		Str("require_sources", r.Metadata.RequireSources).
+		Msg("Invalid requireSources")
+
+	return false, pqerr.Wrap(
+		metaPos(ruleNode, docReqSrcs),
+		r.Metadata.Id,
+		r.Metadata.Hash,
+		r.Cre.Id,
+		ErrRequireSources,
+	)
+}
+
+// validPriority validates the rule's priority metadata
+func validPriority(r ParseRuleT, ruleNode *yaml.Node) error {
+
+	if r.Metadata.Priority >= 0 {
+		return nil
+	}
+
+	log.Error().
+		Int("priority", r.Metadata.Priority).
+		Msg("Invalid priority")
+
+	return pqerr.Wrap(
+		metaPos(ruleNode, docPrio),
+		r.Metadata.Id,
+		r.Metadata.Hash,
+		r.Cre.Id,
+		ErrPriority,
+	)
+}
+
+// metaPos returns the position of a metadata key's value, or of the rule if not found
+func metaPos(ruleNode *yaml.Node, key string) pqerr.Pos {
+	if metaNode, ok := findChild(ruleNode, docMeta); ok {
+		if n, ok := findChild(metaNode, key); ok {
+			return pqerr.Pos{Line: n.Line, Col: n.Column}
+		}
+	}
+	return pqerr.Pos{Line: ruleNode.Line, Col: ruleNode.Column}
+}
+
+// buildSequenceTree processes a rule with a Sequence definition.
+func buildSequenceTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleNode *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+
+	var (
+		seq      = r.Rule.Sequence
+		orderYn  *yaml.Node
+		negateYn *yaml.Node
+		ok       bool
+	)
 
 	orderYn, ok = findChild(ruleNode, docOrder)
 	if !ok {
@@ -390,7 +1113,7 @@ func buildSequenceTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT,
 
 	// Build positive children from seq.Order (non-negated)
 	// Build negative children from seq.Negate (negated)
-	pos, neg, err := buildChildrenGroups(root, termsT, seq.Order, seq.Negate, orderYn, negateYn, termsY)
+	pos, neg, err := buildChildrenGroups(root, termsT, seq.Order, seq.Negate, true, orderYn, negateYn, termsY)
 	if err != nil {
 		return nil, err
 	}
@@ -407,6 +1130,14 @@ func buildSequenceTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT,
 		return nil, err
 	}
 
+	if err := checkNegateWindows(root, negateYn); err != nil {
+		return nil, err
+	}
+
+	if winNode, ok := findChild(ruleNode, docWindow); ok {
+		root.Metadata.WindowPos = pqerr.Pos{Line: winNode.Line, Col: winNode.Column}
+	}
+
 	return root, nil
 }
 
@@ -418,9 +1149,20 @@ func buildSetTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleN
 		matchYn  *yaml.Node
 		negateYn *yaml.Node
 		ok       bool
+		err      error
 	)
 
-	matchYn, ok = findChild(ruleNode, docMatch)
+	if set.Condition != "" {
+		if set, matchYn, err = root.applyCondition(set, termsT, ruleNode); err != nil {
+			return nil, err
+		}
+		negateYn, ok = matchYn, true
+	} else {
+		matchYn, ok = findChild(ruleNode, docMatch)
+		// Negate is optional
+		negateYn, _ = findChild(ruleNode, docNegate)
+	}
+
 	if !ok {
 		return nil, pqerr.Wrap(
 			pqerr.Pos{Line: ruleNode.Line, Col: ruleNode.Column},
@@ -431,10 +1173,7 @@ func buildSetTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleN
 		)
 	}
 
-	// Negate is optional
-	negateYn, _ = findChild(ruleNode, docNegate)
-
-	pos, neg, err := buildChildrenGroups(root, termsT, set.Match, set.Negate, matchYn, negateYn, termsY)
+	pos, neg, err := buildChildrenGroups(root, termsT, set.Match, set.Negate, false, matchYn, negateYn, termsY)
 	if err != nil {
 		return nil, err
 	}
@@ -457,19 +1196,28 @@ func buildSetTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleN
 // buildChildrenGroups is a helper for building positive/negative children
 // in a single pass. The boolean flags specify whether each slice
 // is being treated as negated or not.
-func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, orderYn, negateYn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
+func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, ordered bool, orderYn, negateYn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
+
+	if negates, err = root.resolveAnchors(termsT, matches, negates, negateYn, termsY); err != nil {
+		return nil, nil, err
+	}
 
 	if len(matches) > 0 {
 
-		cPos, err := buildChildren(root, termsT, matches, false, orderYn, termsY)
+		cPos, err := buildChildren(root, termsT, matches, false, ordered, orderYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
+		if ordered {
+			if err = root.resolveStepRefs(termsT, matches, cPos); err != nil {
+				return nil, nil, err
+			}
+		}
 		pos = append(pos, cPos...)
 	}
 
 	if len(negates) > 0 {
-		cNeg, err := buildChildren(root, termsT, negates, true, negateYn, termsY)
+		cNeg, err := buildChildren(root, termsT, negates, true, ordered, negateYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -480,39 +1228,272 @@ func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, neg
 	return pos, neg, nil
 }
 
-func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT, parentNegate bool, yn *yaml.Node, termsY map[string]*yaml.Node) ([]any, error) {
+// resolveAnchors returns a copy of negates where each 'anchor' and 'until' that
+// names a term is resolved to the index of that term in matches. The names may
+// be set on the negate item or on the definition of the term it references.
+// Numeric anchors must be an index of matches. They index the entries of the
+// list, not the occurrences of a counted term: with 'count: 3' on the first
+// entry, anchor 1 is the second entry, as it is without the count.
+func (node *NodeT) resolveAnchors(tm map[string]ParseTermT, matches, negates []ParseTermT, yn *yaml.Node, termsY map[string]*yaml.Node) ([]ParseTermT, error) {
+
+	var out []ParseTermT
+
+	for i, neg := range negates {
+		var (
+			opts   = neg.NegateOpts
+			n      = yn
+			onItem = opts != nil
+		)
+
+		if opts == nil {
+			ref := neg.TermRef
+			if ref == "" {
+				ref = neg.StrValue
+			}
+			if def, ok := tm[ref]; ok {
+				opts, n = def.NegateOpts, termsY[ref]
+			}
+		}
+
+		if opts == nil {
+			continue
+		}
+
+		if opts.AnchorName == "" && opts.Anchor > 0 && int(opts.Anchor) >= len(matches) {
+			log.Error().
+				Uint32("anchor", opts.Anchor).
+				Int("terms", len(matches)).
+				Msg("Negate anchor is not the index of a term")
+			return nil, node.wrapNodeError(itemKeyNode(yn, i, n, onItem, docAnchor), ErrAnchorRange)
+		}
+
+		if opts.AnchorName == "" && opts.Until == "" {
+			continue
+		}
+
+		var (
+			resolved = *opts
+			found    int
+		)
+
+		if opts.AnchorName != "" {
+			if found = termIndex(tm, matches, opts.AnchorName); found < 0 {
+				log.Error().
+					Str("anchor", opts.AnchorName).
+					Msg("Negate anchor does not name a single term")
+				return nil, node.wrapTermError(itemKeyNode(yn, i, n, onItem, docAnchor), ErrAnchorName, opts.AnchorName)
+			}
+			resolved.Anchor = uint32(found)
+		}
+
+		if opts.Until != "" {
+			if found = termIndex(tm, matches, opts.Until); found < 0 {
+				log.Error().
+					Str("until", opts.Until).
+					Msg("Negate until does not name a single term")
+				return nil, node.wrapTermError(itemKeyNode(yn, i, n, onItem, docUntil), ErrUntil, opts.Until)
+			}
+			resolved.UntilIdx = uint32(found)
+		}
+
+		if out == nil {
+			out = slices.Clone(negates)
+		}
+
+		out[i].NegateOpts = &resolved
+	}
+
+	if out == nil {
+		return negates, nil
+	}
+
+	return out, nil
+}
+
+// termName returns the name of the term an entry references, or "" if the entry
+// is inline. A bare value references the term of that name, if there is one.
+func termName(tm map[string]ParseTermT, t ParseTermT) string {
+	if t.TermRef != "" {
+		return t.TermRef
+	}
+	if _, ok := tm[t.StrValue]; ok {
+		return t.StrValue
+	}
+	return ""
+}
+
+// termIndex returns the index of the single entry of terms that names the term, or -1
+func termIndex(tm map[string]ParseTermT, terms []ParseTermT, name string) int {
+
+	var found = -1
+
+	for i, t := range terms {
+		if termName(tm, t) != name {
+			continue
+		}
+		if found >= 0 {
+			return -1
+		}
+		found = i
+	}
+
+	return found
+}
+
+func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT, parentNegate, ordered bool, yn *yaml.Node, termsY map[string]*yaml.Node) ([]any, error) {
 	var (
 		children = make([]any, 0)
 	)
 
-	for _, term := range terms {
+	for i, term := range terms {
 		var (
 			node         any
+			repeat       *RepeatT
+			maxGap       time.Duration
 			resolvedTerm ParseTermT
 			t            = term
 			n            = yn
+			pushed       bool
 			ok           bool
 			err          error
 		)
 
-		if term.StrValue != "" {
+		switch {
+		case term.TermRef != "":
+			// An explicit reference must resolve to a term
+			if hasCondition(term) {
+				return nil, parent.wrapTermError(termRefNode(yn, i), ErrTermRef, term.TermRef)
+			}
+			if _, ok = tm[term.TermRef]; !ok {
+				log.Error().
+					Str("term", term.TermRef).
+					Msg("Term reference not found")
+				return nil, parent.wrapTermError(termRefNode(yn, i), ErrTermNotFound, term.TermRef)
+			}
+			fallthrough
+
+		case term.StrValue != "":
+			var name = term.TermRef
+			if name == "" {
+				name = term.StrValue
+			}
+
 			// If the term is not found in the terms map, then use as str value
-			if resolvedTerm, ok = tm[term.StrValue]; ok {
+			if resolvedTerm, ok = tm[name]; ok {
 				t = resolvedTerm
-				if n, ok = termsY[term.StrValue]; !ok {
+				if n, ok = termsY[name]; !ok {
 					return nil, parent.WrapError(ErrTermNotFound)
 				}
 
 				if term.NegateOpts != nil {
 					t.NegateOpts = term.NegateOpts
 				}
+
+				if term.Repeat != "" {
+					t.Repeat = term.Repeat
+				}
+
+				if term.MaxGap != "" {
+					t.MaxGap = term.MaxGap
+				}
+
+				if term.Optional {
+					t.Optional = true
+				}
+
+				if err = parent.pushTerm(name, n); err != nil {
+					return nil, err
+				}
+				pushed = true
+			} else if parent.opts != nil && parent.opts.strictTermRefs && term.Field == "" {
+				log.Warn().
+					Str("value", term.StrValue).
+					Str("rule_id", parent.Metadata.RuleId).
+					Str("cre_id", parent.Metadata.CreId).
+					Msg("Value does not match a term, treating as a literal string")
+			}
+		}
+
+		if t.ValueSet != "" {
+			if t.Values, err = resolveValueSet(parent, tm, t.ValueSet, itemKeyNode(yn, i, n, term.ValueSet != "", docValSet)); err != nil {
+				return nil, err
+			}
+		}
+
+		// Inline values, groups, promql, aggregates, and resources are positioned at their own list item
+		if !pushed && (isValueTerm(t) || isGroupTerm(t) || t.PromQL != nil || t.Aggregate != nil || t.Resource != nil) {
+			if item, ok := seqItem(yn, i); ok {
+				n = item
 			}
 		}
 
-		if node, err = nodeFromTerm(parent, tm, t, parentNegate, n, termsY); err != nil {
+		if t.Repeat != "" {
+			rn := itemKeyNode(yn, i, n, term.Repeat != "", docRepeat)
+			if !ordered || parentNegate {
+				log.Error().
+					Str("repeat", t.Repeat).
+					Msg("Repeat outside of sequence order")
+				err = parent.wrapNodeError(rn, ErrRepeatScope)
+			} else {
+				repeat, err = parseRepeat(t.Repeat)
+				if err != nil {
+					log.Error().
+						Str("repeat", t.Repeat).
+						Msg("Invalid repeat")
+					err = parent.wrapNodeError(rn, err)
+				}
+			}
+		}
+
+		if t.MaxGap != "" && err == nil {
+			gn := itemKeyNode(yn, i, n, term.MaxGap != "", docMaxGap)
+			maxGap, err = parent.parseMaxGap(t.MaxGap, ordered && !parentNegate && i > 0, gn)
+		}
+
+		if t.CountRange != nil && err == nil {
+			err = parent.checkCountRange(t, ordered && !parentNegate, itemKeyNode(yn, i, n, term.CountRange != nil, docCount))
+		}
+
+		// The first and last steps anchor the sequence and cannot be skipped
+		if t.Optional && err == nil && (!ordered || parentNegate || i == 0 || i == len(terms)-1) {
+			log.Error().
+				Int("step", i).
+				Msg("Optional outside of inner sequence order steps")
+			err = parent.wrapNodeError(itemKeyNode(yn, i, n, term.Optional, docOpt), ErrOptional)
+		}
+
+		if err == nil {
+			node, err = nodeFromTerm(parent, tm, t, parentNegate, n, termsY)
+		}
+
+		if pushed {
+			parent.popTerm()
+		}
+
+		if err != nil {
 			return nil, err
 		}
 
+		if repeat != nil {
+			switch v := node.(type) {
+			case *MatcherT:
+				v.Match.Fields[0].Repeat = repeat
+			case *NodeT:
+				v.Metadata.Repeat = repeat
+			}
+		}
+
+		if maxGap > 0 || t.Optional {
+			switch v := node.(type) {
+			case *MatcherT:
+				v.Match.Fields[0].MaxGap = maxGap
+				v.Match.Fields[0].Optional = t.Optional
+			case *NodeT:
+				v.Metadata.MaxGap = maxGap
+				v.Metadata.Optional = t.Optional
+			}
+		}
+
 		children = append(children, node)
 
 	}
@@ -520,6 +1501,46 @@ func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT,
 	return children, nil
 }
 
+// pushTerm records a term reference on the resolution path of the parent.
+// Nested sequences and sets built from the term inherit the path, so a term
+// that directly or indirectly references itself is reported as a cycle.
+func (parent *NodeT) pushTerm(name string, yn *yaml.Node) error {
+
+	if slices.Contains(parent.termPath, name) {
+		log.Error().
+			Str("term", name).
+			Strs("path", parent.termPath).
+			Msg("Term reference cycle")
+		return parent.wrapTermError(yn, ErrTermCycle, name)
+	}
+
+	if len(parent.termPath) >= maxTermDepth {
+		log.Error().
+			Str("term", name).
+			Int("max_depth", maxTermDepth).
+			Msg("Term references nested too deeply")
+		return parent.wrapTermError(yn, ErrTermDepth, name)
+	}
+
+	parent.termPath = append(parent.termPath, name)
+	return nil
+}
+
+func (parent *NodeT) popTerm() {
+	parent.termPath = parent.termPath[:len(parent.termPath)-1]
+}
+
+func (parent *NodeT) wrapTermError(yn *yaml.Node, err error, name string) error {
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		err,
+		fmt.Sprintf("term=%s", name),
+	)
+}
+
 func nodeFromSeq(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, yn *yaml.Node, termsY map[string]*yaml.Node) (node *NodeT, err error) {
 
 	n, ok := findChild(yn, docSeq)
@@ -570,6 +1591,110 @@ func nodeFromSet(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, y
 	return
 }
 
+// nodeFromGroup builds an 'anyOf' or 'allOf' node. The group has no window of its
+// own; it is evaluated within the window of the enclosing sequence or set. A
+// negated group of conditions is merged into a single matcher instead.
+func nodeFromGroup(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, parentNegate bool, yn *yaml.Node, termsY map[string]*yaml.Node) (any, error) {
+
+	var (
+		typ   = schema.NodeTypeAny
+		terms = term.AnyOf
+		key   = docAnyOf
+	)
+
+	if term.AllOf != nil {
+		typ, terms, key = schema.NodeTypeAll, term.AllOf, docAllOf
+	}
+
+	n, ok := findChild(yn, key)
+	if !ok {
+		n = yn
+	}
+
+	if (term.AnyOf != nil && term.AllOf != nil) || len(terms) < 2 {
+		log.Error().
+			Int("terms", len(terms)).
+			Msg("Invalid group")
+		return nil, parent.wrapNodeError(n, ErrGroup)
+	}
+
+	node, err := parent.initChild(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Children, err = buildChildren(node, termsT, terms, parentNegate, false, n, termsY); err != nil {
+		return nil, err
+	}
+
+	if parentNegate && !slices.ContainsFunc(node.Children, isNode) {
+		return node.negateGroup(typ == schema.NodeTypeAll, term, n)
+	}
+
+	for i, child := range node.Children {
+		if _, ok := child.(*NodeT); ok {
+			continue
+		}
+		item, ok := seqItem(n, i)
+		if !ok {
+			item = n
+		}
+		return nil, node.wrapNodeError(item, ErrGroupTerm)
+	}
+
+	node.Metadata.Type = typ
+
+	if term.NegateOpts != nil {
+		if node.Metadata.NegateOpts, err = negateOpts(term); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+func isNode(child any) bool {
+	_, ok := child.(*NodeT)
+	return ok
+}
+
+// negateGroup merges the negated conditions of a group into one matcher. Any of
+// the conditions suppresses the match, the same as listing them separately,
+// unless all is set. Options on the group apply to conditions without their own.
+func (node *NodeT) negateGroup(all bool, term ParseTermT, yn *yaml.Node) (*MatcherT, error) {
+
+	var (
+		matcher = &MatcherT{NegateAll: all}
+		opts    *NegateOptsT
+		err     error
+	)
+
+	if term.NegateOpts != nil {
+		if opts, err = negateOpts(term); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, child := range node.Children {
+		m := child.(*MatcherT)
+		if len(m.Negate.Fields) > 1 && m.NegateAll != all {
+			return nil, node.wrapNodeError(yn, ErrNegateGroup)
+		}
+		for _, field := range m.Negate.Fields {
+			if field.NegateOpts == nil {
+				field.NegateOpts = opts
+			}
+			matcher.Negate.Fields = append(matcher.Negate.Fields, field)
+		}
+	}
+
+	return matcher, nil
+}
+
+func isGroupTerm(term ParseTermT) bool {
+	return term.AnyOf != nil || term.AllOf != nil
+}
+
 func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, parentNegate bool, yn *yaml.Node, termsY map[string]*yaml.Node) (v any, err error) {
 
 	switch {
@@ -582,8 +1707,17 @@ func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT,
 	case term.PromQL != nil:
 		return nodeFromProm(parent, term, yn)
 
-	case term.StrValue != "" || term.JqValue != "" || term.RegexValue != "":
-		return parseValue(term, parentNegate)
+	case term.Aggregate != nil:
+		return nodeFromAgg(parent, termsT, term, yn, termsY)
+
+	case term.Resource != nil:
+		return nodeFromResource(parent, term, yn)
+
+	case isGroupTerm(term):
+		v, err = nodeFromGroup(parent, termsT, term, parentNegate, yn, termsY)
+
+	case isValueTerm(term):
+		return parseValue(parent, term, parentNegate, yn)
 
 	default:
 		parent.Metadata.Pos = pqerr.Pos{Line: yn.Line, Col: yn.Column}
@@ -593,56 +1727,512 @@ func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT,
 	return
 }
 
-func extractTerms(terms []ParseExtractT) ([]ExtractT, error) {
-	var extracts []ExtractT
-	for _, term := range terms {
+// checkCountRange validates a 'count' range. Ranges are only valid on the
+// conditions of a sequence order.
+func (parent *NodeT) checkCountRange(t ParseTermT, inStep bool, yn *yaml.Node) error {
 
-		if !isValidExtractName(term.Name) {
-			return nil, ErrExtractName
-		}
+	var r = t.CountRange
 
-		extracts = append(extracts, ExtractT{
-			Name:       term.Name,
-			JqValue:    term.JqValue,
-			RegexValue: term.RegexValue,
-		})
+	if !inStep || !isValueTerm(t) || r.Min < 1 || (r.Max != 0 && r.Max < r.Min) {
+		log.Error().
+			Int("min", r.Min).
+			Int("max", r.Max).
+			Msg("Invalid count range")
+		return parent.wrapNodeError(yn, ErrCountRange)
 	}
-	return extracts, nil
+
+	return nil
 }
 
-func negateOpts(term ParseTermT) (*NegateOptsT, error) {
-	var (
-		opts = &NegateOptsT{}
-		err  error
-	)
+// parseMaxGap parses the maximum gap of a sequence step from its previous step.
+// The first step has no previous step, so inStep is false for it.
+func (parent *NodeT) parseMaxGap(s string, inStep bool, yn *yaml.Node) (time.Duration, error) {
 
-	if term.NegateOpts.Window != "" {
-		if opts.Window, err = time.ParseDuration(term.NegateOpts.Window); err != nil {
-			return nil, err
-		}
+	if !inStep {
+		log.Error().
+			Str("max_gap", s).
+			Msg("Max gap outside of sequence order")
+		return 0, parent.wrapNodeError(yn, ErrMaxGap)
 	}
 
-	if term.NegateOpts.Slide != "" {
-		if opts.Slide, err = time.ParseDuration(term.NegateOpts.Slide); err != nil {
-			return nil, err
-		}
+	d, err := parent.parseWindow(s)
+	if err != nil || d <= 0 {
+		log.Error().
+			Str("max_gap", s).
+			Msg("Invalid max gap")
+		return 0, parent.wrapNodeError(yn, ErrMaxGap)
 	}
 
-	opts.Anchor = term.NegateOpts.Anchor
-	opts.Absolute = term.NegateOpts.Absolute
-
-	return opts, nil
+	return d, nil
 }
 
-func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSequenceT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
-	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
-	if err != nil {
-		return nil, parent.WrapError(err)
+// parseRepeat parses a repeat qualifier: "N" (exactly N), "N+" (N or more), or "N-M"
+func parseRepeat(s string) (*RepeatT, error) {
+	var (
+		r       = &RepeatT{}
+		lo, hi  = s, s
+		bounded = true
+		err     error
+	)
+
+	switch {
+	case strings.HasSuffix(s, "+"):
+		lo, bounded = strings.TrimSuffix(s, "+"), false
+	case strings.Contains(s, "-"):
+		lo, hi, _ = strings.Cut(s, "-")
 	}
 
-	pos, neg, err := buildPosNegChildren(node, termsT, seq.Order, seq.Negate, yn, termsY)
-	if err != nil {
-		return nil, err
+	if r.Min, err = strconv.Atoi(lo); err != nil || r.Min < 1 {
+		return nil, ErrRepeat
+	}
+
+	if bounded {
+		if r.Max, err = strconv.Atoi(hi); err != nil || r.Max < r.Min {
+			return nil, ErrRepeat
+		}
+	}
+
+	return r, nil
+}
+
+// resolveValueSet returns the literals of the named value set defined in the terms block
+func resolveValueSet(parent *NodeT, tm map[string]ParseTermT, name string, yn *yaml.Node) ([]string, error) {
+
+	set, ok := tm[name]
+	if !ok || set.Values == nil {
+		log.Error().
+			Str("value_set", name).
+			Msg("Value set not found")
+		return nil, parent.wrapTermError(yn, ErrValueSetNotFound, name)
+	}
+
+	if len(set.Values) == 0 || slices.Contains(set.Values, "") {
+		log.Error().
+			Str("value_set", name).
+			Msg("Value set is empty")
+		return nil, parent.wrapTermError(yn, ErrValueSetEmpty, name)
+	}
+
+	return set.Values, nil
+}
+
+// ValueSetRegex returns a regex matching any of the literal values
+func ValueSetRegex(values []string) string {
+	var quoted = make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	return "(?:" + strings.Join(quoted, "|") + ")"
+}
+
+// matchOpts validates the 'options' of a term. Options that change nothing are dropped.
+func (parent *NodeT) matchOpts(term ParseTermT, yn *yaml.Node) (*MatchOptsT, error) {
+
+	var o = term.Options
+	if o == nil {
+		return nil, nil
+	}
+
+	if (term.StrValue == "" && term.RegexValue == "" && len(term.Values) == 0 && len(term.Regexes) == 0) ||
+		term.JqValue != "" || term.Exists != nil || term.Delimiter != "" || term.Glob != "" ||
+		term.IPCidr != nil || hasCompare(term) {
+		log.Error().
+			Str("field", term.Field).
+			Msg("Match options on a condition that is not a value or regex")
+		on, ok := findChild(yn, docOptions)
+		if !ok {
+			on = yn
+		}
+		return nil, parent.wrapNodeError(on, ErrMatchOpts)
+	}
+
+	opts := &MatchOptsT{
+		CaseInsensitive: o.CaseSensitive != nil && !*o.CaseSensitive,
+		WordBoundary:    o.WordBoundary,
+		Multiline:       o.Multiline,
+	}
+
+	if *opts == (MatchOptsT{}) {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// AnyRegex returns a regex matching any of the regexes
+func AnyRegex(regexes []string) string {
+	var groups = make([]string, 0, len(regexes))
+	for _, r := range regexes {
+		groups = append(groups, "(?:"+r+")")
+	}
+	return "(?:" + strings.Join(groups, "|") + ")"
+}
+
+// valueLists validates the 'strings', 'regexes', or 'valuesFrom' list of a term and
+// removes duplicate values. Strings and resolved values are returned as the literal
+// values of the term.
+func (parent *NodeT) valueLists(term ParseTermT, yn *yaml.Node) ([]string, []string, error) {
+
+	var (
+		key    = docStrings
+		list   = term.Strings
+		lists  = 0
+		reason string
+		err    error
+	)
+
+	for _, set := range []bool{term.Strings != nil, term.Regexes != nil, term.ValuesFrom != ""} {
+		if set {
+			lists++
+		}
+	}
+
+	switch {
+	case lists == 0:
+		return term.Values, nil, nil
+	case term.ValuesFrom != "":
+		key = docValsFrom
+		if list, err = parent.valuesFrom(term, yn); err != nil {
+			return nil, nil, err
+		}
+	case term.Strings == nil:
+		key, list = docRegexes, term.Regexes
+	}
+
+	ln, ok := findChild(yn, key)
+	if !ok {
+		ln = yn
+	}
+
+	switch {
+	case lists > 1:
+		reason = "more than one of 'strings', 'regexes', and 'valuesFrom'"
+	case term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" || term.Exists != nil ||
+		term.ValueSet != "" || len(term.Values) > 0 || term.IPCidr != nil:
+		reason = "combined with another condition"
+	case len(list) == 0 || slices.Contains(list, ""):
+		reason = "empty value"
+	case key == docRegexes:
+		for i, r := range list {
+			var err error
+			if reason, err = parent.opts.checkRegex(r); err != nil {
+				if item, ok := seqItem(ln, i); ok {
+					ln = item
+				}
+				break
+			}
+		}
+	}
+
+	if reason != "" {
+		log.Error().
+			Strs(key, list).
+			Str("reason", reason).
+			Msg("Invalid value list")
+		return nil, nil, pqerr.Wrap(
+			pqerr.Pos{Line: ln.Line, Col: ln.Column},
+			parent.Metadata.RuleId,
+			parent.Metadata.RuleHash,
+			parent.Metadata.CreId,
+			ErrValueList,
+			reason,
+		)
+	}
+
+	var (
+		seen   = make(map[string]bool, len(list))
+		unique = make([]string, 0, len(list))
+	)
+
+	for _, v := range list {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+
+	if key == docRegexes {
+		return nil, unique, nil
+	}
+
+	return unique, nil, nil
+}
+
+// itemKeyNode returns the value node of key, on list item i if the item set the key,
+// otherwise on the resolved term node n. Falls back to the node itself.
+func itemKeyNode(yn *yaml.Node, i int, n *yaml.Node, onItem bool, key string) *yaml.Node {
+	if onItem {
+		if item, ok := seqItem(yn, i); ok {
+			n = item
+		}
+	}
+	if v, ok := findChild(n, key); ok {
+		return v
+	}
+	return n
+}
+
+func (parent *NodeT) wrapNodeError(yn *yaml.Node, err error) error {
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		err,
+	)
+}
+
+// hasCondition reports whether the term defines its own condition
+func hasCondition(term ParseTermT) bool {
+	return term.Sequence != nil || term.Set != nil || term.PromQL != nil || term.Aggregate != nil || term.Resource != nil || isGroupTerm(term) || term.Field != "" ||
+		term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" || term.Exists != nil ||
+		term.ValueSet != "" || len(term.Values) > 0 || term.Strings != nil || term.Regexes != nil || term.ValuesFrom != "" || term.IPCidr != nil || term.Glob != "" || hasCompare(term)
+}
+
+// termRefNode returns the node of the 'term' key of list item i, or the list if not found
+func termRefNode(yn *yaml.Node, i int) *yaml.Node {
+	if item, ok := seqItem(yn, i); ok {
+		if n, ok := findChild(item, docTermRef); ok {
+			return n
+		}
+	}
+	return yn
+}
+
+func isValueTerm(term ParseTermT) bool {
+	return term.Sequence == nil && term.Set == nil && term.PromQL == nil && term.Aggregate == nil && term.Resource == nil && !isGroupTerm(term) &&
+		(term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" || term.Exists != nil ||
+			term.ValueSet != "" || len(term.Values) > 0 || term.Strings != nil || term.Regexes != nil || term.ValuesFrom != "" || term.IPCidr != nil || term.Glob != "" || hasCompare(term))
+}
+
+func extractTerms(terms []ParseExtractT, yn *yaml.Node) ([]ExtractT, error) {
+	var (
+		extracts  []ExtractT
+		extractYn *yaml.Node
+	)
+
+	extractYn, _ = findChild(yn, docExtract)
+
+	for i, term := range terms {
+
+		if !isValidExtractName(term.Name) {
+			return nil, ErrExtractName
+		}
+
+		var (
+			pos        pqerr.Pos
+			transforms []TransformT
+			item, ok   = seqItem(extractYn, i)
+		)
+
+		if ok {
+			pos = pqerr.Pos{Line: item.Line, Col: item.Column}
+			if typeYn, ok := findChild(item, docType); ok {
+				pos = pqerr.Pos{Line: typeYn.Line, Col: typeYn.Column}
+			}
+		}
+
+		if len(term.Transforms) > 0 {
+			xformYn, _ := findChild(item, docXforms)
+			for j, expr := range term.Transforms {
+				t := TransformT{Expr: expr, Pos: pos}
+				if n, ok := seqItem(xformYn, j); ok {
+					t.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+				}
+				transforms = append(transforms, t)
+			}
+		}
+
+		extracts = append(extracts, ExtractT{
+			Name:       term.Name,
+			JqValue:    term.JqValue,
+			RegexValue: term.RegexValue,
+			Type:       term.Type,
+			Transforms: transforms,
+			Pos:        pos,
+		})
+	}
+	return extracts, nil
+}
+
+// groupExtracts appends an extract for each named capture group of a match regex.
+// The extract's regex is the match regex with only that group capturing.
+func (parent *NodeT) groupExtracts(expr string, extracts []ExtractT, yn *yaml.Node) ([]ExtractT, error) {
+
+	// An invalid regex is reported by validateRegexes
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return extracts, nil
+	}
+
+	regexYn, ok := findChild(yn, docRegex)
+	if !ok {
+		regexYn = yn
+	}
+
+	for _, name := range re.CapNames() {
+		if name == "" {
+			continue
+		}
+
+		if !isValidExtractName(name) {
+			log.Error().
+				Str("group", name).
+				Msg("Invalid capture group name")
+			return nil, parent.wrapNodeError(regexYn, ErrExtractName)
+		}
+
+		if slices.ContainsFunc(extracts, func(e ExtractT) bool { return e.Name == name }) {
+			log.Error().
+				Str("group", name).
+				Msg("Capture group collides with extract")
+			return nil, parent.wrapNodeError(regexYn, ErrExtractCollision)
+		}
+
+		extracts = append(extracts, ExtractT{
+			Name:       name,
+			RegexValue: captureOnly(expr, name),
+			Pos:        pqerr.Pos{Line: regexYn.Line, Col: regexYn.Column},
+		})
+	}
+
+	return extracts, nil
+}
+
+// captureOnly rewrites expr so that the group called name is its only capture.
+// Other capture groups become non-capturing; the rest of expr is kept as written.
+func captureOnly(expr, name string) string {
+
+	var (
+		b       strings.Builder
+		inClass bool
+	)
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+
+		switch {
+		case c == '\\' && strings.HasPrefix(expr[i:], `\Q`):
+			end := strings.Index(expr[i:], `\E`)
+			if end < 0 {
+				end = len(expr) - i - 2
+			}
+			b.WriteString(expr[i : i+end+2])
+			i += end + 1
+			continue
+
+		case c == '\\' && i+1 < len(expr):
+			b.WriteString(expr[i : i+2])
+			i++
+			continue
+
+		case inClass && strings.HasPrefix(expr[i:], "[:"):
+			// POSIX classes such as [:alpha:] do not end the enclosing class
+			if end := strings.Index(expr[i:], ":]"); end > 0 {
+				b.WriteString(expr[i : i+end+2])
+				i += end + 1
+				continue
+			}
+
+		case inClass:
+			inClass = c != ']'
+
+		case c == '[':
+			// A ']' first in the class is a literal
+			n := 1
+			if strings.HasPrefix(expr[i+n:], "^") {
+				n++
+			}
+			if strings.HasPrefix(expr[i+n:], "]") {
+				n++
+			}
+			b.WriteString(expr[i : i+n])
+			i += n - 1
+			inClass = true
+			continue
+
+		case c == '(':
+			gname, n, named := groupName(expr[i+1:])
+			switch {
+			case named && gname == name:
+				b.WriteByte('(')
+			case named || !strings.HasPrefix(expr[i+1:], "?"):
+				b.WriteString("(?:")
+			default:
+				b.WriteByte(c)
+			}
+			i += n
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// groupName returns the name of a group opened just before rest and the length of its prefix
+func groupName(rest string) (string, int, bool) {
+	for _, prefix := range []string{"?P<", "?<"} {
+		if after, ok := strings.CutPrefix(rest, prefix); ok {
+			if name, _, ok := strings.Cut(after, ">"); ok {
+				return name, len(prefix) + len(name) + 1, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+func negateOpts(term ParseTermT) (*NegateOptsT, error) {
+	var (
+		opts = &NegateOptsT{}
+		err  error
+	)
+
+	if term.NegateOpts.Window != "" {
+		if opts.Window, err = time.ParseDuration(term.NegateOpts.Window); err != nil {
+			return nil, err
+		}
+	}
+
+	if term.NegateOpts.Slide != "" {
+		if opts.Slide, err = time.ParseDuration(term.NegateOpts.Slide); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.Anchor = term.NegateOpts.Anchor
+	opts.AnchorName = term.NegateOpts.AnchorName
+	opts.Until = term.NegateOpts.Until
+	opts.UntilIdx = term.NegateOpts.UntilIdx
+	opts.Absolute = term.NegateOpts.Absolute
+
+	return opts, nil
+}
+
+// initChild creates a node nested under parent. The child inherits the rule
+// identity, parse options, and term resolution path of its parent.
+func (parent *NodeT) initChild(yn *yaml.Node) (*NodeT, error) {
+	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
+	if err != nil {
+		return nil, parent.WrapError(err)
+	}
+
+	node.opts = parent.opts
+	node.termPath = slices.Clone(parent.termPath)
+
+	return node, nil
+}
+
+func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSequenceT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+	node, err := parent.initChild(yn)
+	if err != nil {
+		return nil, err
+	}
+
+	pos, neg, err := buildPosNegChildren(node, termsT, seq.Order, seq.Negate, true, yn, termsY)
+	if err != nil {
+		return nil, err
 	}
 
 	node.Children = append(node.Children, pos...)
@@ -656,16 +2246,28 @@ func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSe
 		return nil, err
 	}
 
+	negateYn, _ := findChild(yn, docNegate)
+	if err := checkNegateWindows(node, negateYn); err != nil {
+		return nil, err
+	}
+
 	return node, nil
 }
 
 func buildSetNode(parent *NodeT, termsT map[string]ParseTermT, set *ParseSetT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
-	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
+	node, err := parent.initChild(yn)
 	if err != nil {
-		return nil, parent.WrapError(err)
+		return nil, err
+	}
+
+	childYn := yn
+	if set.Condition != "" {
+		if set, childYn, err = node.applyCondition(set, termsT, yn); err != nil {
+			return nil, err
+		}
 	}
 
-	pos, neg, err := buildPosNegChildren(node, termsT, set.Match, set.Negate, yn, termsY)
+	pos, neg, err := buildPosNegChildren(node, termsT, set.Match, set.Negate, false, childYn, termsY)
 	if err != nil {
 		return nil, err
 	}
@@ -686,20 +2288,44 @@ func buildSetNode(parent *NodeT, termsT map[string]ParseTermT, set *ParseSetT, y
 
 // buildPosNegChildren is a helper for building
 // positive and negative children across Sequence and Set
-func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, yn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
+func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, ordered bool, yn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
 
 	pos, neg = []any{}, []any{}
 
+	var listKey = docMatch
+	if ordered {
+		listKey = docOrder
+	}
+
+	matchYn, ok := findChild(yn, listKey)
+	if !ok {
+		matchYn = yn
+	}
+
+	negateYn, ok := findChild(yn, docNegate)
+	if !ok {
+		negateYn = yn
+	}
+
+	if negates, err = node.resolveAnchors(termsT, matches, negates, negateYn, termsY); err != nil {
+		return nil, nil, err
+	}
+
 	if len(matches) > 0 {
-		cPos, err := buildChildren(node, termsT, matches, false, yn, termsY)
+		cPos, err := buildChildren(node, termsT, matches, false, ordered, matchYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
+		if ordered {
+			if err = node.resolveStepRefs(termsT, matches, cPos); err != nil {
+				return nil, nil, err
+			}
+		}
 		pos = append(pos, cPos...)
 	}
 
 	if len(negates) > 0 {
-		cNeg, err := buildChildren(node, termsT, negates, true, yn, termsY)
+		cNeg, err := buildChildren(node, termsT, negates, true, ordered, negateYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -729,13 +2355,45 @@ func nodeFromProm(parent *NodeT, term ParseTermT, yn *yaml.Node) (*NodeT, error)
 		forDuration = &dur
 	}
 
-	if err := PromQLValidator(term.PromQL.Expr); err != nil {
+	node, err := parent.initChild(yn)
+	if err != nil {
 		return nil, err
 	}
 
-	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
+	selectors, err := PromSelectors(term.PromQL.Expr)
 	if err != nil {
-		return nil, parent.WrapError(err)
+		return nil, node.promQLError(yn, term.PromQL.Expr, ErrPromQL, err.Error())
+	}
+
+	// Errors of the validator hook keep their identity
+	if err := PromQLValidator(term.PromQL.Expr); err != nil {
+		return nil, node.promQLError(yn, term.PromQL.Expr, err, "")
+	}
+
+	if term.PromQL.Window != "" {
+		if promNode, ok := findChild(yn, docPromQL); ok {
+			if winNode, ok := findChild(promNode, docWindow); ok {
+				node.Metadata.Pos = pqerr.Pos{Line: winNode.Line, Col: winNode.Column}
+			}
+		}
+		log.Error().
+			Str("window", term.PromQL.Window).
+			Msg("Window specified on promql")
+		return nil, node.WrapError(ErrPromQLWindow)
+	}
+
+	desc := strings.TrimSpace(term.PromQL.Description)
+	if len(desc) > maxDescriptionLen {
+		if promNode, ok := findChild(yn, docPromQL); ok {
+			if descNode, ok := findChild(promNode, docDesc); ok {
+				node.Metadata.Pos = pqerr.Pos{Line: descNode.Line, Col: descNode.Column}
+			}
+		}
+		log.Error().
+			Int("length", len(desc)).
+			Int("max_length", maxDescriptionLen).
+			Msg("PromQL description too long")
+		return nil, node.WrapError(ErrDescription)
 	}
 
 	node.Metadata.Type = schema.NodeTypePromQL
@@ -746,26 +2404,71 @@ func nodeFromProm(parent *NodeT, term ParseTermT, yn *yaml.Node) (*NodeT, error)
 	}
 
 	node.Children = append(node.Children, &PromQLT{
-		Expr:     term.PromQL.Expr,
-		For:      forDuration,
-		Interval: interval,
+		Expr:        term.PromQL.Expr,
+		For:         forDuration,
+		Interval:    interval,
+		Description: desc,
+		Selectors:   selectors,
 	})
 
 	return node, nil
 }
 
-func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
+func parseValue(parent *NodeT, term ParseTermT, negate bool, yn *yaml.Node) (*MatcherT, error) {
 
 	var (
 		err     error
 		matcher = &MatcherT{}
 	)
 
+	if err = validateAnnotations(parent, term.Annotations, yn); err != nil {
+		return nil, err
+	}
+
+	cmp, err := parent.parseCompare(term, yn)
+	if err != nil {
+		return nil, err
+	}
+
+	if term.Values, term.Regexes, err = parent.valueLists(term, yn); err != nil {
+		return nil, err
+	}
+
+	if term.IPCidr, err = parent.parseIPCidr(term, yn); err != nil {
+		return nil, err
+	}
+
+	if err = parent.parseGlob(term, yn); err != nil {
+		return nil, err
+	}
+
+	matchOpts, err := parent.matchOpts(term, yn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = parent.validateRegexes(term, yn); err != nil {
+		return nil, err
+	}
+
 	switch negate {
 	case false:
+		if term.NegateOpts != nil && *term.NegateOpts != (ParseNegateOptsT{}) {
+			log.Error().
+				Str("field", term.Field).
+				Msg("Negate options on match field")
+			return nil, negateOptsError(parent, yn)
+		}
+
 		var extracts []ExtractT
 		if len(term.Extract) > 0 {
-			if extracts, err = extractTerms(term.Extract); err != nil {
+			if extracts, err = extractTerms(term.Extract, yn); err != nil {
+				return nil, err
+			}
+		}
+
+		if term.RegexValue != "" {
+			if extracts, err = parent.groupExtracts(term.RegexValue, extracts, yn); err != nil {
 				return nil, err
 			}
 		}
@@ -775,8 +2478,21 @@ func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
 			StrValue:   term.StrValue,
 			JqValue:    term.JqValue,
 			RegexValue: term.RegexValue,
+			Values:     term.Values,
+			Regexes:    term.Regexes,
+			IPCidr:     term.IPCidr,
+			Glob:       term.Glob,
+			Options:    matchOpts,
+			Exists:     term.Exists,
+			Delimiter:  term.Delimiter,
+			Compare:    cmp,
 			Count:      term.Count,
+			CountRange: newCountRange(term.CountRange),
+			Primary:    term.Primary,
 			Extract:    extracts,
+			Pos:        pqerr.Pos{Line: yn.Line, Col: yn.Column},
+
+			Annotations: term.Annotations,
 		})
 	case true:
 
@@ -795,14 +2511,138 @@ func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
 			StrValue:   term.StrValue,
 			JqValue:    term.JqValue,
 			RegexValue: term.RegexValue,
+			Values:     term.Values,
+			Regexes:    term.Regexes,
+			IPCidr:     term.IPCidr,
+			Glob:       term.Glob,
+			Options:    matchOpts,
+			Exists:     term.Exists,
+			Delimiter:  term.Delimiter,
+			Compare:    cmp,
 			Count:      term.Count,
+			Primary:    term.Primary,
 			NegateOpts: opts,
+			Pos:        pqerr.Pos{Line: yn.Line, Col: yn.Column},
+
+			Annotations: term.Annotations,
 		})
 	}
 
 	return matcher, nil
 }
 
+func newCountRange(r *ParseCountRangeT) *CountRangeT {
+	if r == nil {
+		return nil
+	}
+	return &CountRangeT{Min: r.Min, Max: r.Max}
+}
+
+// checkNegateWindows verifies that negates with a 'window' or 'slide' in a sequence
+// are enclosed by a sequence window. Without one, the negate timing is undefined.
+// A set with a single match anchors the negate on that match and needs no window.
+func checkNegateWindows(node *NodeT, negateYn *yaml.Node) error {
+
+	if node.Metadata.Window > 0 || node.NegIdx < 0 {
+		return nil
+	}
+
+	for i, child := range node.Children[node.NegIdx:] {
+		var opts *NegateOptsT
+
+		switch c := child.(type) {
+		case *NodeT:
+			opts = c.Metadata.NegateOpts
+		case *MatcherT:
+			for _, field := range c.Negate.Fields {
+				if field.NegateOpts != nil {
+					opts = field.NegateOpts
+				}
+			}
+		}
+
+		if opts == nil || (opts.Window == 0 && opts.Slide == 0) {
+			continue
+		}
+
+		log.Error().
+			Dur("negate_window", opts.Window).
+			Dur("negate_slide", opts.Slide).
+			Msg("Negate window without sequence window")
+
+		if n := negateWindowNode(negateYn, i); n != nil {
+			return node.wrapNodeError(n, ErrNegateWindow)
+		}
+		return node.WrapError(ErrNegateWindow)
+	}
+
+	return nil
+}
+
+// negateWindowNode returns the 'window' or 'slide' key of negate item i, falling back
+// to the item or the negate list. Returns nil if the negate list is unknown.
+func negateWindowNode(negateYn *yaml.Node, i int) *yaml.Node {
+	item, ok := seqItem(negateYn, i)
+	if !ok {
+		return negateYn
+	}
+	for _, key := range []string{docWindow, docSlide} {
+		if n, ok := findChild(item, key); ok {
+			return n
+		}
+	}
+	return item
+}
+
+// validateAnnotations checks the annotation keys of a condition, positioning
+// the error at the offending key
+func validateAnnotations(parent *NodeT, annotations map[string]string, yn *yaml.Node) error {
+
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		if validAnnotationKey.MatchString(key) {
+			continue
+		}
+
+		log.Error().
+			Str("key", key).
+			Msg("Invalid annotation key")
+
+		n := yn
+		if annots, ok := findChild(yn, docAnnots); ok {
+			n = annots
+			for i := 0; i+1 < len(annots.Content); i += 2 {
+				if annots.Content[i].Value == key {
+					n = annots.Content[i]
+					break
+				}
+			}
+		}
+
+		return parent.wrapNodeError(n, ErrAnnotationKey)
+	}
+
+	return nil
+}
+
+// negateOptsError positions the error at the first negate option found on the term.
+func negateOptsError(parent *NodeT, yn *yaml.Node) error {
+	pos := pqerr.Pos{Line: yn.Line, Col: yn.Column}
+	for _, key := range []string{docWindow, docSlide, docAnchor, docAbs, docUntil} {
+		if n, ok := findChild(yn, key); ok {
+			pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+			break
+		}
+	}
+
+	return pqerr.Wrap(
+		pos,
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		ErrMatchNegateOpts,
+	)
+}
+
 func ParseCres(data []byte) (map[string]ParseCreT, error) {
 	var (
 		config RulesT
@@ -814,161 +2654,441 @@ func ParseCres(data []byte) (map[string]ParseCreT, error) {
 		return nil, err
 	}
 
-	for _, rule := range config.Rules {
-		cres[rule.Metadata.Hash] = rule.Cre
+	for _, rule := range config.Rules {
+		cres[rule.Metadata.Hash] = rule.Cre
+	}
+
+	return cres, nil
+}
+
+func Parse(data []byte, opts ...ParseOptT) (*TreeT, error) {
+
+	var (
+		config *RulesT
+		err    error
+	)
+
+	if config, err = Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return ParseRules(config, opts)
+}
+
+func Unmarshal(data []byte) (*RulesT, error) {
+
+	var (
+		docMap    *yaml.Node
+		termsNode *yaml.Node
+		config    RulesT
+		root      *yaml.Node
+		ok        bool
+		err       error
+	)
+
+	if config, root, err = _parse(data); err != nil {
+		return nil, err
+	}
+
+	docMap = root.Content[0]
+
+	// Without options, included files cannot be read; see Read
+	if inc, ok := findChild(docMap, docInclude); ok {
+		return nil, pqerr.Wrap(pqerr.Pos{Line: inc.Line, Col: inc.Column}, "", "", "", ErrIncludeParse)
+	}
+
+	config.Root, ok = findChild(docMap, docRules)
+	if !ok {
+		return nil, ErrRulesNotFound
+	}
+
+	termsNode, ok = findChild(docMap, docTerms)
+	if ok {
+		config.TermsY = collectTermsY(termsNode)
+	}
+
+	return &config, nil
+}
+
+func Hash(h string) string {
+	hash := sha1.Sum([]byte(h))
+	return base58.Encode(hash[:])
+}
+
+// HashRule to provide a unique identity for the rule.
+// The hash is based on the rule's content, excluding previous hash calculations.
+
+func HashRule(rule ParseRuleT) (string, error) {
+	rule.Metadata.Hash = "" // Hash is what we are generating here, not semantically important
+	return _hashRule(rule)
+}
+
+// StableHash to provide a unique stable identity for the rule.  It can be used for dupe detection.
+// The hash is based on the rule's content, excluding metadata that is not semantically important.
+
+func StableHash(rule ParseRuleT) (string, error) {
+
+	// Strip out versioning metadata before calculating the stable hash.
+	// The versioning metadata is not semantically important for the rule's content,
+	// so we can safely ignore it for the purpose of hashing.
+	// This is important to ensure that the hash remains consistent across changes
+	// that do not affect the rule's content, such as version bumps or metadata changes.
+
+	// The field rule.Metadata.Id is considered part of the rules identity and should be included in the stable hash.
+	// Rules can change over time having the following properties:
+	// - Metadata.Id: Unique identifier for the rule, which is immutable for the lifetime of the rule.
+	// - Metadata.Hash: A hash of the rule's content, which is regenerated on every semantic change.
+	// - Metadata.Version: A version string that *should* be incremented on changes, but is not semantically important.
+	// - Metadata.Gen: A generation counter that is incremented on every change, but is not semantically important.
+
+	rule.Metadata.Gen = 0      // Gen is bumped on every semantic change, so we don't want it in the hash
+	rule.Metadata.Version = "" // Version may be bumped on change, also not semantically important
+	rule.Metadata.Priority = 0 // Priority orders rules within a bundle, it does not change what the rule matches
+	return HashRule(rule)
+}
+
+// ContentHash extends the StableHash of a rule with the rest of what its tree is
+// built from: its hash, which addresses its nodes, its priority, the shared terms
+// it references, and the annotations and descriptions that the StableHash leaves
+// out. Rules with the same content hash build the same tree.
+func ContentHash(rule ParseRuleT, termsT map[string]ParseTermT) (string, error) {
+
+	stable, err := StableHash(rule)
+	if err != nil {
+		return "", err
+	}
+
+	type unhashedT struct {
+		Annotations map[string]string `json:",omitempty"`
+		Description string            `json:",omitempty"`
+	}
+
+	var (
+		shared   = make(map[string]ParseTermT)
+		unhashed []unhashedT // One per term, in walk order
+	)
+
+	walkRuleTerms(rule, termsT, func(name string, t ParseTermT) {
+		if name != "" {
+			shared[name] = t
+		}
+		u := unhashedT{Annotations: t.Annotations}
+		if t.PromQL != nil {
+			u.Description = t.PromQL.Description
+		}
+		unhashed = append(unhashed, u)
+	})
+
+	// json.Marshal sorts map keys, so the output is deterministic
+	jsonBytes, err := json.Marshal(struct {
+		Stable   string
+		Hash     string
+		Priority int
+		Terms    map[string]ParseTermT
+		Unhashed []unhashedT
+	}{stable, rule.Metadata.Hash, rule.Metadata.Priority, shared, unhashed})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(jsonBytes)
+
+	return base58.Encode(hash[:]), nil
+}
+
+// FindSemanticDuplicates groups rules that are identical apart from their identity.
+// The result maps the StableHash of the rule, computed with its id, name, and cre
+// cleared, to the ids of the rules sharing it in bundle order. Only groups of two
+// or more rules are returned. Unlike the duplicate checks in Read, rules with
+// distinct ids are compared.
+func FindSemanticDuplicates(config *RulesT) map[string][]string {
+
+	var (
+		groups = make(map[string][]string)
+		dupes  = make(map[string][]string)
+	)
+
+	for _, rule := range config.Rules {
+		id := rule.Metadata.Id
+
+		rule.Metadata.Id = ""
+		rule.Metadata.Name = ""
+		rule.Cre = ParseCreT{}
+
+		hash, err := StableHash(rule)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to hash rule")
+			continue
+		}
+
+		groups[hash] = append(groups[hash], id)
+	}
+
+	for hash, ids := range groups {
+		if len(ids) > 1 {
+			dupes[hash] = ids
+		}
+	}
+
+	return dupes
+}
+
+func _hashRule(rule ParseRuleT) (string, error) {
+	// json.Marshal to produce deterministic output
+	jsonBytes, err := json.Marshal(rule)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(jsonBytes)
+
+	return base58.Encode(hash[:]), nil
+}
+
+func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yaml.Node, termsY map[string]*yaml.Node, opts ...ParseOptT) (*TreeT, error) {
+
+	var (
+		o    = parseOpts(opts...)
+		tree = &TreeT{
+			Nodes: make([]*NodeT, 0),
+		}
+		nodes = make([]*NodeT, len(rules)) // Nil for filtered rules
+		spent = make([]time.Duration, len(rules))
+	)
+
+	if o.timing {
+		tree.Timings = make(map[string]time.Duration, len(rules))
+	}
+
+	// Rules are parsed into their own slots and added in order, so the tree does
+	// not depend on the parallelism
+	err := pool.Run(o.parallelism, len(rules), func(_, i int) error {
+		var (
+			rule  = rules[i]
+			start time.Time
+			err   error
+		)
+
+		if o.ruleFilter != nil {
+			if err = o.fillIds(&rule, termsT); err != nil {
+				return err
+			}
+			if !o.ruleFilter(rule) {
+				return nil
+			}
+		}
+
+		if o.timing {
+			start = time.Now()
+		}
+
+		if nodes[i], err = parseRule(i, rule, termsT, rulesRoot, termsY, o); err != nil {
+			return err
+		}
+
+		if o.timing {
+			spent[i] = time.Since(start)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, node := range nodes {
+		if node == nil {
+			continue
+		}
+
+		if o.timing {
+			tree.Timings[node.Metadata.RuleHash] += spent[i]
+		}
+
+		tree.Nodes = append(tree.Nodes, node)
 	}
 
-	return cres, nil
+	return tree, nil
 }
 
-func Parse(data []byte, opts ...ParseOptT) (*TreeT, error) {
+func parseRule(i int, rule ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yaml.Node, termsY map[string]*yaml.Node, o *parseOptsT) (*NodeT, error) {
 
 	var (
-		config *RulesT
-		err    error
+		ruleNode *yaml.Node
+		ok       bool
+		err      error
 	)
 
-	if config, err = Unmarshal(data); err != nil {
+	if ruleNode, ok = seqItem(rulesRoot, i); !ok {
+		log.Error().
+			Int("index", i).
+			Msg("Rule not found")
+		return nil, ErrRuleNotFound
+	}
+
+	if rule, ruleNode, err = o.expandParams(rule, ruleNode); err != nil {
 		return nil, err
 	}
 
-	return ParseRules(config, opts)
+	if err = o.fillIds(&rule, termsT); err != nil {
+		return nil, err
+	}
+
+	node, err := buildTree(termsT, rule, ruleNode, termsY, o)
+	if err != nil || !o.contentHash {
+		return node, err
+	}
+
+	if node.Metadata.ContentHash, err = ContentHash(rule, termsT); err != nil {
+		return nil, node.WrapError(err)
+	}
+
+	return node, nil
 }
 
-func Unmarshal(data []byte) (*RulesT, error) {
+// fillIds generates missing rule ids and hashes when WithGenIds is set. The
+// digests of 'valuesFrom' lists are filled in first, so they are part of the hash.
+func (o *parseOptsT) fillIds(rule *ParseRuleT, termsT map[string]ParseTermT) (err error) {
 
-	var (
-		docMap    *yaml.Node
-		termsNode *yaml.Node
-		config    RulesT
-		root      *yaml.Node
-		ok        bool
-		err       error
-	)
+	rule.ValuesDigests = o.valuesDigests(*rule, termsT)
 
-	if config, root, err = _parse(data); err != nil {
-		return nil, err
+	if !o.genIds {
+		return nil
 	}
 
-	docMap = root.Content[0]
-
-	config.Root, ok = findChild(docMap, docRules)
-	if !ok {
-		return nil, errors.New("rules not found")
+	if rule.Metadata.Id == "" {
+		rule.Metadata.Id = Hash(rule.Cre.Id)
+		log.Warn().
+			Str("rule.Metadata.Id", rule.Metadata.Id).
+			Str("rule.Cre.Id", rule.Cre.Id).
+			Msg("Rule id is empty, generating from cre id")
 	}
 
-	termsNode, ok = findChild(docMap, docTerms)
-	if ok {
-		config.TermsY = collectTermsY(termsNode)
+	if rule.Metadata.Hash == "" {
+		if rule.Metadata.Hash, err = HashRule(*rule); err != nil {
+			return err
+		}
+		log.Warn().
+			Str("rule.Cre.Id", rule.Cre.Id).
+			Str("rule.Metadata.Id", rule.Metadata.Id).
+			Str("rule.Metadata.Hash", rule.Metadata.Hash).
+			Msg("Rule hash is empty, generating from rule data")
 	}
 
-	return &config, nil
+	return nil
 }
 
-func Hash(h string) string {
-	hash := sha1.Sum([]byte(h))
-	return base58.Encode(hash[:])
+// SortByPriority returns the rule roots ordered by descending priority.
+// Rules with equal priority keep their order in the bundle.
+func (t *TreeT) SortByPriority() []*NodeT {
+	nodes := slices.Clone(t.Nodes)
+	slices.SortStableFunc(nodes, func(a, b *NodeT) int {
+		return cmp.Compare(b.Metadata.Priority, a.Metadata.Priority)
+	})
+	return nodes
 }
 
-// HashRule to provide a unique identity for the rule.
-// The hash is based on the rule's content, excluding previous hash calculations.
-
-func HashRule(rule ParseRuleT) (string, error) {
-	rule.Metadata.Hash = "" // Hash is what we are generating here, not semantically important
-	return _hashRule(rule)
+func ParseRules(config *RulesT, opts []ParseOptT) (*TreeT, error) {
+	return parseRules(config.Rules, config.TermsT, config.Root, config.TermsY, opts...)
 }
 
-// StableHash to provide a unique stable identity for the rule.  It can be used for dupe detection.
-// The hash is based on the rule's content, excluding metadata that is not semantically important.
+// ParseRuleById builds only the rule whose id, hash, or cre id matches id.
+// Shared terms are loaded so references still resolve. Returns ErrRuleNotFound if no rule matches.
+func ParseRuleById(data []byte, id string, opts ...ParseOptT) (*NodeT, error) {
 
-func StableHash(rule ParseRuleT) (string, error) {
+	var (
+		config *RulesT
+		o      = parseOpts(opts...)
+		err    error
+	)
 
-	// Strip out versioning metadata before calculating the stable hash.
-	// The versioning metadata is not semantically important for the rule's content,
-	// so we can safely ignore it for the purpose of hashing.
-	// This is important to ensure that the hash remains consistent across changes
-	// that do not affect the rule's content, such as version bumps or metadata changes.
+	if config, err = Unmarshal(data); err != nil {
+		return nil, err
+	}
 
-	// The field rule.Metadata.Id is considered part of the rules identity and should be included in the stable hash.
-	// Rules can change over time having the following properties:
-	// - Metadata.Id: Unique identifier for the rule, which is immutable for the lifetime of the rule.
-	// - Metadata.Hash: A hash of the rule's content, which is regenerated on every semantic change.
-	// - Metadata.Version: A version string that *should* be incremented on changes, but is not semantically important.
-	// - Metadata.Gen: A generation counter that is incremented on every change, but is not semantically important.
+	for i, rule := range config.Rules {
+		if err = o.fillIds(&rule, config.TermsT); err != nil {
+			return nil, err
+		}
 
-	rule.Metadata.Gen = 0      // Gen is bumped on every semantic change, so we don't want it in the hash
-	rule.Metadata.Version = "" // Version may be bumped on change, also not semantically important
-	return HashRule(rule)
-}
+		if id != rule.Metadata.Id && id != rule.Metadata.Hash && id != rule.Cre.Id {
+			continue
+		}
 
-func _hashRule(rule ParseRuleT) (string, error) {
-	// json.Marshal to produce deterministic output
-	jsonBytes, err := json.Marshal(rule)
-	if err != nil {
-		return "", err
+		return parseRule(i, rule, config.TermsT, config.Root, config.TermsY, o)
 	}
 
-	hash := sha256.Sum256(jsonBytes)
+	log.Error().
+		Str("id", id).
+		Msg("Rule not found")
 
-	return base58.Encode(hash[:]), nil
+	return nil, ErrRuleNotFound
 }
 
-func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yaml.Node, termsY map[string]*yaml.Node, opts ...ParseOptT) (*TreeT, error) {
+// RuleResult holds the outcome of parsing a single rule with CompileEach.
+// Exactly one of Node or Err is set.
+type RuleResult struct {
+	CreId string
+	Node  *NodeT
+	Err   error
+}
+
+// CompileEach parses every rule in data independently, so a broken rule does
+// not prevent the others from building. Results are keyed by rule hash, falling
+// back to rule id when the hash is empty. The document and shared terms are
+// decoded once up front; an error there fails the whole bundle.
+func CompileEach(data []byte, opts ...ParseOptT) (map[string]RuleResult, error) {
 
 	var (
-		o    = parseOpts(opts...)
-		tree = &TreeT{
-			Nodes: make([]*NodeT, 0),
-		}
+		config  *RulesT
+		o       = parseOpts(opts...)
+		results = make(map[string]RuleResult)
+		err     error
 	)
 
-	for i, rule := range rules {
+	if config, err = Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range config.Rules {
 		var (
-			node     *NodeT
-			ruleNode *yaml.Node
-			ok       bool
-			err      error
+			res = RuleResult{CreId: rule.Cre.Id}
+			key string
 		)
 
-		if ruleNode, ok = seqItem(rulesRoot, i); !ok {
-			log.Error().
-				Int("index", i).
-				Msg("Rule not found")
-			return nil, ErrRuleNotFound
+		if res.Err = o.fillIds(&rule, config.TermsT); res.Err == nil {
+			if o.ruleFilter != nil && !o.ruleFilter(rule) {
+				continue
+			}
+			res.Node, res.Err = parseRule(i, rule, config.TermsT, config.Root, config.TermsY, o)
 		}
 
-		if o.genIds {
-			if rule.Metadata.Id == "" {
-				rule.Metadata.Id = Hash(rule.Cre.Id)
-				log.Warn().
-					Str("rule.Metadata.Id", rule.Metadata.Id).
-					Str("rule.Cre.Id", rule.Cre.Id).
-					Msg("Rule id is empty, generating from cre id")
-			}
-			if rule.Metadata.Hash == "" {
-				if rule.Metadata.Hash, err = HashRule(rule); err != nil {
-					return nil, err
-				}
-				log.Warn().
-					Str("rule.Cre.Id", rule.Cre.Id).
-					Str("rule.Metadata.Id", rule.Metadata.Id).
-					Str("rule.Metadata.Hash", rule.Metadata.Hash).
-					Msg("Rule hash is empty, generating from rule data")
-			}
+		if key = rule.Metadata.Hash; key == "" {
+			key = rule.Metadata.Id
 		}
 
-		if node, err = buildTree(termsT, rule, ruleNode, termsY); err != nil {
-			return nil, err
+		if _, dup := results[key]; dup {
+			res.Node, res.Err = nil, fmt.Errorf("duplicate id=%s (cre=%s)", key, rule.Cre.Id)
+			log.Error().
+				Int("index", i).
+				Str("key", key).
+				Msg("Duplicate rule in bundle")
+			key = fmt.Sprintf("%s#%d", key, i)
 		}
 
-		tree.Nodes = append(tree.Nodes, node)
-	}
+		if res.Err != nil {
+			res.Node = nil
+			log.Error().
+				Err(res.Err).
+				Str("cre_id", rule.Cre.Id).
+				Msg("Rule failed to compile")
+		}
 
-	return tree, nil
-}
+		results[key] = res
+	}
 
-func ParseRules(config *RulesT, opts []ParseOptT) (*TreeT, error) {
-	return parseRules(config.Rules, config.TermsT, config.Root, config.TermsY, opts...)
+	return results, nil
 }
 
 func findChild(n *yaml.Node, key string) (*yaml.Node, bool) {
@@ -1020,8 +3140,105 @@ func WithGenIds() func(*parseOptsT) {
 	}
 }
 
+// WithTiming records the wall-clock time spent parsing each rule in TreeT.Timings
+func WithTiming() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.timing = true
+	}
+}
+
+// WithStrictTermRefs warns when a bare string value does not match any term and
+// is treated as a literal. Use an explicit 'term:' key for references that must resolve.
+func WithStrictTermRefs() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.strictTermRefs = true
+	}
+}
+
+// WithDedupeIdentical skips a rule that repeats an earlier rule with identical content
+// when reading bundles. Conflicting definitions of the same id are always an error.
+func WithDedupeIdentical() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.dedupeIdentical = true
+	}
+}
+
+// WithRequireVersionFooter makes Read and ReadFiles fail with ErrMissingFooter
+// if a file has no version footer document
+func WithRequireVersionFooter() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.requireFooter = true
+	}
+}
+
+// WithDurationConstants resolves window references of the form $name from constants
+func WithDurationConstants(constants map[string]time.Duration) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.durations = constants
+	}
+}
+
+// WithRuleFilter parses only the rules for which filter returns true. Filters run
+// before the tree of a rule is built, with the ids of the rule filled in when
+// WithGenIds is set, so that one CRE of a large bundle can be compiled without
+// splitting the YAML. See RuleIdFilter and RuleTagFilter.
+func WithRuleFilter(filter func(ParseRuleT) bool) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.ruleFilter = filter
+	}
+}
+
+// WithParallelism parses up to n rules at a time. The tree is the same as a
+// sequential parse: rules keep their order, and when several rules fail, the error
+// of the first one is returned. A ValuesResolverT must be safe for concurrent use.
+func WithParallelism(n int) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.parallelism = n
+	}
+}
+
+// WithContentHash records the ContentHash of each rule in the metadata of its root
+func WithContentHash() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.contentHash = true
+	}
+}
+
+// RuleIdFilter keeps the rules whose id, hash, or cre id is one of ids
+func RuleIdFilter(ids ...string) func(ParseRuleT) bool {
+	return func(rule ParseRuleT) bool {
+		return slices.Contains(ids, rule.Metadata.Id) ||
+			slices.Contains(ids, rule.Metadata.Hash) ||
+			slices.Contains(ids, rule.Cre.Id)
+	}
+}
+
+// RuleTagFilter keeps the rules whose cre has any of tags
+func RuleTagFilter(tags ...string) func(ParseRuleT) bool {
+	return func(rule ParseRuleT) bool {
+		return slices.ContainsFunc(rule.Cre.Tags, func(tag string) bool {
+			return slices.Contains(tags, tag)
+		})
+	}
+}
+
 type parseOptsT struct {
-	genIds bool
+	genIds          bool
+	timing          bool
+	strictTermRefs  bool
+	dedupeIdentical bool
+	requireFooter   bool
+	includeClient   *http.Client
+	includeResolver IncludeResolverT
+	valuesResolver  ValuesResolverT
+	valueLists      map[string]valueListT // Resolved 'valuesFrom' lists by reference
+	valuesMu        sync.Mutex            // Guards valueLists when rules are parsed in parallel
+	params          map[string]string
+	durations       map[string]time.Duration
+	maxRegexProg    int
+	ruleFilter      func(ParseRuleT) bool
+	parallelism     int
+	contentHash     bool
 }
 
 func parseOpts(opts ...ParseOptT) *parseOptsT {
@@ -1035,16 +3252,107 @@ func parseOpts(opts ...ParseOptT) *parseOptsT {
 
 func Read(rdr io.Reader, opts ...ParseOptT) (*RulesT, error) {
 	var (
-		allRules = &RulesT{
+		r = newReader(opts...)
+	)
+
+	if err := r.read(rdr, ""); err != nil {
+		return nil, err
+	}
+
+	return r.rules, nil
+}
+
+// ReadFiles merges the rules and terms of several files into one bundle.
+// Rule id collisions across files are reported with both file locations.
+func ReadFiles(paths []string, opts ...ParseOptT) (*RulesT, error) {
+	var (
+		r = newReader(opts...)
+	)
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.read(f, path)
+		f.Close()
+
+		if err != nil {
+			return nil, pqerr.WithFile(err, path)
+		}
+	}
+
+	if err := r.checkTermsOnly(paths); err != nil {
+		return nil, err
+	}
+
+	return r.rules, nil
+}
+
+type readerT struct {
+	rules     *RulesT
+	dupes     map[string]ruleOriginT
+	included  map[string]bool  // Locations read, directly or included; true once their rules are kept
+	termsOnly map[string]error // Files read without rules, valid only if another file includes them
+	o         *parseOptsT
+}
+
+func newReader(opts ...ParseOptT) *readerT {
+	return &readerT{
+		rules: &RulesT{
 			Rules:  make([]ParseRuleT, 0),
+			Root:   &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"},
 			TermsT: make(map[string]ParseTermT),
 			TermsY: make(map[string]*yaml.Node),
+		},
+		dupes:     make(map[string]ruleOriginT),
+		included:  make(map[string]bool),
+		termsOnly: make(map[string]error),
+		o:         parseOpts(opts...),
+	}
+}
+
+// read reads a file directly. A file already included by an earlier file is not
+// read twice, and needs no rules of its own.
+func (r *readerT) read(rdr io.Reader, file string) error {
+	var (
+		spec     = includeT{Rules: true}
+		included bool
+	)
+
+	if file != "" {
+		key := includeKey(file)
+		rules, ok := r.included[key]
+		if rules {
+			return nil
 		}
-		root    *yaml.Node
-		dupes   = make(map[string]struct{})
-		decoder *yaml.Decoder
-		o       = parseOpts(opts...)
-		ok      bool
+		spec.rulesOnly, included = ok, ok
+		r.included[key] = true
+	}
+
+	return r.readDocs(rdr, file, spec, included)
+}
+
+// checkTermsOnly fails if a file read without a rules section was not included
+// by another file
+func (r *readerT) checkTermsOnly(paths []string) error {
+	for _, path := range paths {
+		if err, ok := r.termsOnly[includeKey(path)]; ok {
+			return pqerr.WithFile(err, path)
+		}
+	}
+	return nil
+}
+
+// readDocs reads every document of rdr. Included files may omit the rules
+// section, and their rules are only kept if spec.Rules is set.
+func (r *readerT) readDocs(rdr io.Reader, file string, spec includeT, included bool) error {
+	var (
+		allRules = r.rules
+		root     *yaml.Node
+		decoder  *yaml.Decoder
+		footer   bool
 	)
 
 	decoder = yaml.NewDecoder(rdr)
@@ -1059,7 +3367,7 @@ LOOP:
 				break LOOP
 			default:
 				log.Error().Err(err).Msg("fail yaml decode")
-				return nil, err
+				return err
 			}
 		}
 		if len(doc.Content) == 0 { // empty document ("---\n")
@@ -1070,14 +3378,22 @@ LOOP:
 
 		if sec, ok := findChild(root, docSection); ok { // key “section” exists?
 			if sec.Kind == yaml.ScalarNode && sec.Value == docVersion {
-				// Entire document is a version footer: ignore it and move on
+				// Entire document is a version footer: record it and move on
+				if !spec.rulesOnly {
+					allRules.Footer = newFooter(root, file)
+					allRules.Footers = append(allRules.Footers, allRules.Footer)
+				}
+				footer = true
 				continue
 			}
 		}
 
-		allRules.Root, ok = findChild(root, docRules)
-		if !ok {
-			return nil, errors.New("rules not found")
+		if _, ok := findChild(root, docRules); !ok && !included {
+			if file == "" {
+				return ErrRulesNotFound
+			}
+			// Another file may include this one for its terms
+			r.termsOnly[includeKey(file)] = pqerr.Wrap(pqerr.Pos{Line: root.Line, Col: root.Column}, "", "", "", ErrRulesNotFound)
 		}
 
 		// 2) walk keys in that mapping ---------------------------------------
@@ -1085,23 +3401,42 @@ LOOP:
 			kNode, vNode := root.Content[i], root.Content[i+1]
 			switch kNode.Value {
 
+			case docInclude:
+				if err := r.include(vNode, file); err != nil {
+					return err
+				}
+
 			case "rules":
+				if !spec.Rules {
+					continue
+				}
 				var rules []ParseRuleT
 				if err := vNode.Decode(&rules); err != nil {
-					return nil, err
+					return err
 				}
-				if !o.genIds {
-					if err := checkDuplicates(rules, dupes); err != nil {
-						return nil, err
+				for j, rule := range rules {
+					item, _ := seqItem(vNode, j)
+					if !r.o.genIds {
+						keep, err := checkDuplicate(rule, ruleOriginT{file: file, node: item}, r.dupes, r.o.dedupeIdentical)
+						if err != nil {
+							return err
+						}
+						if !keep {
+							continue
+						}
 					}
+					allRules.Rules = append(allRules.Rules, rule)
+					allRules.Root.Content = append(allRules.Root.Content, item)
 				}
-				allRules.Rules = append(allRules.Rules, rules...)
 
 			case "terms":
+				if spec.rulesOnly {
+					continue
+				}
 
 				termsTNew, termsYNew, err := parseTermsNode(vNode) // vNode is *yaml.Node for this block
 				if err != nil {
-					return nil, err
+					return err
 				}
 
 				if allRules.TermsT == nil {
@@ -1109,7 +3444,7 @@ LOOP:
 				}
 
 				if err := mergeTerms(allRules.TermsT, allRules.TermsY, termsTNew, termsYNew); err != nil {
-					return nil, err
+					return err
 				}
 			default:
 				// unknown section – ignore or warn
@@ -1117,7 +3452,24 @@ LOOP:
 		}
 	}
 
-	return allRules, nil
+	if r.o.requireFooter && !footer && !included {
+		log.Error().Str("file", file).Msg("Missing version footer")
+		return ErrMissingFooter
+	}
+
+	return nil
+}
+
+// newFooter reads the version declared by a footer document
+func newFooter(root *yaml.Node, file string) *FooterT {
+	footer := &FooterT{
+		File: file,
+		Pos:  pqerr.Pos{Line: root.Line, Col: root.Column},
+	}
+	if v, ok := findChild(root, docVersion); ok && v.Kind == yaml.ScalarNode {
+		footer.Version = v.Value
+	}
+	return footer
 }
 
 func mergeTerms(dst map[string]ParseTermT, dstPos map[string]*yaml.Node, src map[string]ParseTermT, srcPos map[string]*yaml.Node) error {
@@ -1131,16 +3483,69 @@ func mergeTerms(dst map[string]ParseTermT, dstPos map[string]*yaml.Node, src map
 	return nil
 }
 
-func checkDuplicates(rules []ParseRuleT, seen map[string]struct{}) error {
-	for _, r := range rules {
-		for _, id := range []string{r.Metadata.Hash, r.Metadata.Id, r.Cre.Id} {
-			if _, dup := seen[id]; dup {
-				return fmt.Errorf("duplicate id=%s (cre=%s)", id, r.Cre.Id)
-			}
-			seen[id] = struct{}{}
+// ruleOriginT records where a rule was first defined
+type ruleOriginT struct {
+	file string
+	node *yaml.Node
+	hash string // content hash, used to detect identical definitions
+}
+
+func (o ruleOriginT) String() string {
+	var line int
+	if o.node != nil {
+		line = o.node.Line
+	}
+	if o.file == "" {
+		return fmt.Sprintf("line=%d", line)
+	}
+	return fmt.Sprintf("file=%s, line=%d", o.file, line)
+}
+
+// checkDuplicate reports whether the rule should be kept. A rule whose id, hash, or
+// cre id was seen before is an error, unless dedupe is set and both definitions are identical.
+func checkDuplicate(r ParseRuleT, origin ruleOriginT, seen map[string]ruleOriginT, dedupe bool) (bool, error) {
+	var err error
+	if origin.hash, err = HashRule(r); err != nil {
+		return false, err
+	}
+
+	for _, id := range []string{r.Metadata.Hash, r.Metadata.Id, r.Cre.Id} {
+		first, dup := seen[id]
+		if !dup {
+			continue
+		}
+
+		if dedupe && first.hash == origin.hash {
+			log.Warn().
+				Str("id", id).
+				Str("cre_id", r.Cre.Id).
+				Stringer("first", first).
+				Stringer("second", origin).
+				Msg("Skipping identical duplicate rule")
+			return false, nil
+		}
+
+		var pos pqerr.Pos
+		if origin.node != nil {
+			pos = pqerr.Pos{Line: origin.node.Line, Col: origin.node.Column}
 		}
+
+		perr := pqerr.Wrap(
+			pos,
+			r.Metadata.Id,
+			r.Metadata.Hash,
+			r.Cre.Id,
+			ErrDuplicateRule,
+			fmt.Sprintf("id=%s previously defined at %s", id, first),
+		)
+		return false, pqerr.WithFile(perr, origin.file)
 	}
-	return nil
+
+	for _, id := range []string{r.Metadata.Hash, r.Metadata.Id, r.Cre.Id} {
+		seen[id] = origin
+	}
+
+	return true, nil
 }
 
 func parseTermsNode(n *yaml.Node) (map[string]ParseTermT, map[string]*yaml.Node, error) {
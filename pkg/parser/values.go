@@ -0,0 +1,218 @@
+package parser
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrValuesFrom         = errors.New("invalid 'valuesFrom'")
+	ErrValuesFromResolver = errors.New("'valuesFrom' requires WithValuesResolver")
+)
+
+// ValuesResolverT returns the values of a 'valuesFrom' reference, such as
+// file://iocs.txt. Values match as literals, like a 'strings' list.
+type ValuesResolverT func(ref string) ([]string, error)
+
+// WithValuesResolver resolves the 'valuesFrom' references of terms. The values
+// are inlined and the digest of each list is included in the rule hash, so a
+// change to a list changes the hash of the rules that use it.
+func WithValuesResolver(resolver ValuesResolverT) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.valuesResolver = resolver
+		o.valueLists = make(map[string]valueListT)
+	}
+}
+
+// FSValuesResolver reads 'valuesFrom' references from fsys. A reference is a path
+// in fsys with an optional file:// scheme. Files hold one value per line; blank
+// lines and lines starting with '#' are skipped, and values are trimmed.
+func FSValuesResolver(fsys fs.FS) ValuesResolverT {
+	return func(ref string) ([]string, error) {
+
+		f, err := fsys.Open(strings.TrimPrefix(ref, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		var (
+			values  []string
+			scanner = bufio.NewScanner(f)
+		)
+
+		for scanner.Scan() {
+			v := strings.TrimSpace(scanner.Text())
+			if v == "" || strings.HasPrefix(v, "#") {
+				continue
+			}
+			values = append(values, v)
+		}
+
+		return values, scanner.Err()
+	}
+}
+
+type valueListT struct {
+	values []string
+	digest string
+	err    error
+}
+
+// loadValues resolves a 'valuesFrom' reference once per parse
+func (o *parseOptsT) loadValues(ref string) valueListT {
+
+	if o == nil || o.valuesResolver == nil {
+		return valueListT{err: ErrValuesFromResolver}
+	}
+
+	o.valuesMu.Lock()
+	defer o.valuesMu.Unlock()
+
+	if vl, ok := o.valueLists[ref]; ok {
+		return vl
+	}
+
+	var vl valueListT
+	if vl.values, vl.err = o.valuesResolver(ref); vl.err == nil {
+		sum := sha256.Sum256([]byte(strings.Join(vl.values, "\n")))
+		vl.digest = base58.Encode(sum[:])
+	} else {
+		log.Error().Err(vl.err).Str("values_from", ref).Msg("Failed to resolve values")
+	}
+
+	o.valueLists[ref] = vl
+
+	return vl
+}
+
+// valuesDigests returns the digests of the lists referenced by the terms of the
+// rule, including shared terms, keyed by reference. Lists that fail to resolve are
+// left out; the error is reported with its position when the term is built.
+func (o *parseOptsT) valuesDigests(rule ParseRuleT, termsT map[string]ParseTermT) map[string]string {
+
+	if o.valuesResolver == nil {
+		return nil
+	}
+
+	var digests = make(map[string]string)
+
+	walkRuleTerms(rule, termsT, func(_ string, t ParseTermT) {
+		if t.ValuesFrom != "" {
+			if vl := o.loadValues(t.ValuesFrom); vl.err == nil {
+				digests[t.ValuesFrom] = vl.digest
+			}
+		}
+	})
+
+	if len(digests) == 0 {
+		return nil
+	}
+
+	return digests
+}
+
+// walkRuleTerms calls fn for each term of the rule, including the shared terms it
+// references. Shared terms are visited once, with their name.
+func walkRuleTerms(rule ParseRuleT, termsT map[string]ParseTermT, fn func(name string, t ParseTermT)) {
+
+	var (
+		seen = make(map[string]bool)
+		walk func(name string, terms []ParseTermT)
+	)
+
+	walk = func(name string, terms []ParseTermT) {
+		for _, t := range terms {
+			fn(name, t)
+			for _, ref := range []string{t.TermRef, t.StrValue} {
+				if shared, ok := termsT[ref]; ok && !seen[ref] {
+					seen[ref] = true
+					walk(ref, []ParseTermT{shared})
+				}
+			}
+			if t.Set != nil {
+				walk("", t.Set.Match)
+				walk("", t.Set.Negate)
+				walk("", conditionTerms(t.Set.Condition))
+			}
+			if t.Sequence != nil {
+				walk("", t.Sequence.Order)
+				walk("", t.Sequence.Negate)
+			}
+			if t.Aggregate != nil {
+				walk("", t.Aggregate.Match)
+			}
+			walk("", t.AnyOf)
+			walk("", t.AllOf)
+		}
+	}
+
+	walk("", []ParseTermT{{Set: rule.Rule.Set, Sequence: rule.Rule.Sequence}})
+}
+
+// valuesFrom returns the values of the 'valuesFrom' reference of a term
+func (parent *NodeT) valuesFrom(term ParseTermT, yn *yaml.Node) ([]string, error) {
+
+	vl := parent.opts.loadValues(term.ValuesFrom)
+	if vl.err == nil {
+		return vl.values, nil
+	}
+
+	vn, ok := findChild(yn, docValsFrom)
+	if !ok {
+		vn = yn
+	}
+
+	if errors.Is(vl.err, ErrValuesFromResolver) {
+		return nil, parent.wrapNodeError(vn, ErrValuesFromResolver)
+	}
+
+	return nil, pqerr.Wrap(
+		pqerr.Pos{Line: vn.Line, Col: vn.Column},
+		parent.Metadata.RuleId,
+		parent.Metadata.RuleHash,
+		parent.Metadata.CreId,
+		ErrValuesFrom,
+		fmt.Sprintf("ref=%s: %v", term.ValuesFrom, vl.err),
+	)
+}
+
+// conditionTerms returns references to the terms named by a set 'condition'
+func conditionTerms(cond string) []ParseTermT {
+
+	if cond == "" {
+		return nil
+	}
+
+	expr, err := ParseCondition(cond, nil)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		terms []ParseTermT
+		visit func(e *BoolExprT)
+	)
+
+	visit = func(e *BoolExprT) {
+		if e.Op == BoolOpTerm {
+			terms = append(terms, ParseTermT{TermRef: e.Term})
+		}
+		for _, arg := range e.Args {
+			visit(arg)
+		}
+	}
+
+	visit(expr)
+
+	return terms
+}
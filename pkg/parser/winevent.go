@@ -0,0 +1,33 @@
+package parser
+
+import "errors"
+
+var (
+	ErrWinEventField = errors.New("unknown winevent field (must be one of EventID, Channel, Provider, Level, Message, or EventData.<name>)")
+	ErrWinEventID    = errors.New("invalid winevent EventID (must be a number from 0 to 65535)")
+	ErrWinEventLevel = errors.New("invalid winevent Level (use 0-5 or one of critical, error, warning, information, or verbose)")
+)
+
+const (
+	winEventID         = "EventID"
+	winEventLevel      = "Level"
+	winEventDataPrefix = "EventData." // Named values of the event
+)
+
+// Fields of a Windows event; Message is the rendered message
+var winEventFields = map[string]bool{
+	winEventID:    true,
+	"Channel":     true,
+	"Provider":    true,
+	winEventLevel: true,
+	"Message":     true,
+}
+
+// Standard event levels. Zero is LogAlways.
+var winEventLevels = map[string]int{
+	"critical":    1,
+	"error":       2,
+	"warning":     3,
+	"information": 4,
+	"verbose":     5,
+}
@@ -97,3 +97,46 @@ func WithFile(err error, file string) error {
 	}
 	return err
 }
+
+// Severity of a diagnostic. An empty severity is a warning.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+// Diagnostic is a positioned, non-fatal finding about a rule (e.g. a lint warning)
+type Diagnostic struct {
+	Pos      Pos      // line / column
+	RuleId   string   // rule‑ID (may be empty)
+	RuleHash string   // rule‑hash (may be empty)
+	CreId    string   // cre‑ID (may be empty)
+	Code     string   // short, stable identifier for the kind of finding
+	Msg      string   // human readable description
+	File     string   // file name
+	Severity Severity // may be empty
+}
+
+func (d Diagnostic) String() string {
+	meta := fmt.Sprintf("line=%d, col=%d", d.Pos.Line, d.Pos.Col)
+
+	if d.CreId != "" {
+		meta += fmt.Sprintf(", cre_id=%s", d.CreId)
+	}
+	if d.RuleId != "" {
+		meta += fmt.Sprintf(", rule_id=%s", d.RuleId)
+	}
+	if d.RuleHash != "" {
+		meta += fmt.Sprintf(", rule_hash=%s", d.RuleHash)
+	}
+	if d.File != "" {
+		meta += fmt.Sprintf(", file=%s", d.File)
+	}
+	if d.Severity != "" {
+		meta += fmt.Sprintf(", severity=%s", d.Severity)
+	}
+
+	return fmt.Sprintf("code=%s, msg=\"%s\", %s", d.Code, d.Msg, meta)
+}
@@ -0,0 +1,130 @@
+package pqerr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MultiError collects errors from several rules so they can be reported together
+type MultiError struct {
+	Errs []error
+	more int // errors dropped by Limit
+}
+
+// Add appends err, flattening nested MultiErrors. Nil errors are ignored.
+func (m *MultiError) Add(err error) {
+	if err == nil {
+		return
+	}
+	var nested *MultiError
+	if errors.As(err, &nested) && nested != m {
+		m.Errs = append(m.Errs, nested.Errs...)
+		m.more += nested.more
+		return
+	}
+	m.Errs = append(m.Errs, err)
+}
+
+// Len returns the number of errors, including those dropped by Limit
+func (m *MultiError) Len() int {
+	return len(m.Errs) + m.more
+}
+
+// Err returns nil if no errors were collected, otherwise m
+func (m *MultiError) Err() error {
+	if m.Len() == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	var msgs = make([]string, 0, len(m.Errs)+1)
+	for _, err := range m.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	if m.more > 0 {
+		msgs = append(msgs, fmt.Sprintf("and %d more", m.more))
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (m *MultiError) Unwrap() []error { return m.Errs }
+
+// Canonical de-duplicates and sorts the collected errors
+func (m *MultiError) Canonical() *MultiError {
+	m.Dedupe()
+	m.Sort()
+	return m
+}
+
+// Dedupe removes errors with the same code, position and rule hash, keeping the first
+func (m *MultiError) Dedupe() {
+	var (
+		seen = make(map[errKeyT]struct{}, len(m.Errs))
+		errs = m.Errs[:0]
+	)
+
+	for _, err := range m.Errs {
+		k := keyOf(err)
+		if _, dup := seen[k]; dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		errs = append(errs, err)
+	}
+
+	clear(m.Errs[len(errs):])
+	m.Errs = errs
+}
+
+// Sort orders the errors by rule hash, then line, then column. The sort is stable.
+func (m *MultiError) Sort() {
+	sort.SliceStable(m.Errs, func(i, j int) bool {
+		a, b := keyOf(m.Errs[i]), keyOf(m.Errs[j])
+		if a.ruleHash != b.ruleHash {
+			return a.ruleHash < b.ruleHash
+		}
+		if a.pos.Line != b.pos.Line {
+			return a.pos.Line < b.pos.Line
+		}
+		return a.pos.Col < b.pos.Col
+	})
+}
+
+// Limit returns a copy holding at most n errors; the remainder is reported as "and N more"
+func (m *MultiError) Limit(n int) *MultiError {
+	if n < 0 || n >= len(m.Errs) {
+		return &MultiError{Errs: m.Errs[:len(m.Errs):len(m.Errs)], more: m.more}
+	}
+	return &MultiError{
+		Errs: m.Errs[:n:n],
+		more: m.more + len(m.Errs) - n,
+	}
+}
+
+type errKeyT struct {
+	code     string
+	pos      Pos
+	ruleHash string
+}
+
+// keyOf identifies an error by its code (the wrapped sentinel), position and rule hash
+func keyOf(err error) errKeyT {
+	var perr *Error
+	if !errors.As(err, &perr) {
+		return errKeyT{code: err.Error()}
+	}
+
+	k := errKeyT{
+		code:     perr.Msg,
+		pos:      perr.Pos,
+		ruleHash: perr.RuleHash,
+	}
+	if perr.Err != nil {
+		k.code = perr.Err.Error()
+	}
+	return k
+}
@@ -0,0 +1,101 @@
+package pqerr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	errWindow = errors.New("missing window")
+	errTerm   = errors.New("term not found")
+)
+
+func TestMultiErrorDedupe(t *testing.T) {
+
+	var m MultiError
+	m.Add(Wrap(Pos{Line: 10, Col: 5}, "id1", "hashB", "cre1", errWindow))
+	m.Add(Wrap(Pos{Line: 10, Col: 5}, "id1", "hashB", "cre1", errWindow, "child=2"))
+	m.Add(Wrap(Pos{Line: 10, Col: 5}, "id1", "hashA", "cre1", errWindow))
+	m.Add(Wrap(Pos{Line: 12, Col: 5}, "id1", "hashB", "cre1", errWindow))
+	m.Add(Wrap(Pos{Line: 10, Col: 5}, "id1", "hashB", "cre1", errTerm))
+	m.Add(nil)
+
+	m.Dedupe()
+
+	if m.Len() != 4 {
+		t.Fatalf("Expected 4 errors after dedupe, got %d: %v", m.Len(), m.Errs)
+	}
+
+	if strings.Contains(m.Error(), "child=2") {
+		t.Errorf("Expected first duplicate to be kept, got %v", m.Error())
+	}
+}
+
+func TestMultiErrorSort(t *testing.T) {
+
+	var m MultiError
+	m.Add(Wrap(Pos{Line: 3, Col: 1}, "", "hashB", "", errTerm))
+	m.Add(Wrap(Pos{Line: 2, Col: 9}, "", "hashB", "", errTerm))
+	m.Add(Wrap(Pos{Line: 2, Col: 4}, "", "hashB", "", errWindow))
+	m.Add(Wrap(Pos{Line: 7, Col: 1}, "", "hashA", "", errTerm))
+	m.Add(Wrap(Pos{Line: 2, Col: 4}, "", "hashB", "", errTerm))
+
+	m.Sort()
+
+	var expected = []struct {
+		hash string
+		pos  Pos
+		err  error
+	}{
+		{"hashA", Pos{Line: 7, Col: 1}, errTerm},
+		{"hashB", Pos{Line: 2, Col: 4}, errWindow},
+		{"hashB", Pos{Line: 2, Col: 4}, errTerm},
+		{"hashB", Pos{Line: 2, Col: 9}, errTerm},
+		{"hashB", Pos{Line: 3, Col: 1}, errTerm},
+	}
+
+	for i, exp := range expected {
+		perr := m.Errs[i].(*Error)
+		if perr.RuleHash != exp.hash || perr.Pos != exp.pos || perr.Err != exp.err {
+			t.Errorf("errs[%d] = %v, want hash=%s pos=%+v err=%v", i, perr, exp.hash, exp.pos, exp.err)
+		}
+	}
+}
+
+func TestMultiErrorLimit(t *testing.T) {
+
+	var m MultiError
+	for i := range 5 {
+		m.Add(Wrap(Pos{Line: i + 1, Col: 1}, "", "hash", "", errWindow))
+	}
+
+	limited := m.Limit(2)
+	if len(limited.Errs) != 2 || limited.Len() != 5 {
+		t.Fatalf("Expected 2 errors of 5, got %d of %d", len(limited.Errs), limited.Len())
+	}
+
+	if !strings.HasSuffix(limited.Error(), "and 3 more") {
+		t.Errorf("Expected trailer, got %q", limited.Error())
+	}
+
+	if !errors.Is(limited, errWindow) {
+		t.Errorf("Expected limited error to wrap %v", errWindow)
+	}
+
+	// Limiting does not modify the original
+	if len(m.Errs) != 5 || strings.Contains(m.Error(), "more") {
+		t.Errorf("Expected original to be unchanged, got %q", m.Error())
+	}
+
+	var outer MultiError
+	outer.Add(limited)
+	if outer.Len() != 5 || !strings.HasSuffix(outer.Error(), "and 3 more") {
+		t.Errorf("Expected nested limit to carry over, got %q", outer.Error())
+	}
+
+	var empty MultiError
+	if empty.Err() != nil {
+		t.Errorf("Expected nil error when empty")
+	}
+}
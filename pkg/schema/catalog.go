@@ -0,0 +1,37 @@
+package schema
+
+// K8sEventCatalog returns the field catalog of Kubernetes events, for sources that
+// collect them. The type of an event is Normal or Warning. Reasons, if any, are the
+// only reasons allowed. SourceK8sEvent is registered with the catalog of any
+// reason; register it again to restrict them.
+func K8sEventCatalog(reasons ...string) FieldCatalogT {
+
+	c := FieldCatalogT{
+		Fields: []string{
+			"type",
+			"reason",
+			"message",
+			"action",
+			"count",
+			"reportingController",
+			"reportingInstance",
+		},
+		Prefixes: []string{
+			"involvedObject.",
+			"source.",
+			"metadata.",
+		},
+		Values: map[string][]string{
+			"type": {"Normal", "Warning"},
+		},
+		Types: map[string]ExtractTypeT{
+			"count": ExtractTypeInt,
+		},
+	}
+
+	if len(reasons) > 0 {
+		c.Values["reason"] = reasons
+	}
+
+	return c
+}
@@ -15,8 +15,112 @@ const (
 	NodeTypeLogSeq NodeTypeT = "log_seq"
 	NodeTypeLogSet NodeTypeT = "log_set"
 	NodeTypePromQL NodeTypeT = "promql"
+	NodeTypeAny    NodeTypeT = "machine_any" // Fires when any child matches
+	NodeTypeAll    NodeTypeT = "machine_all" // Fires when every child matches within the enclosing window
+	NodeTypeAgg    NodeTypeT = "log_agg"     // Fires when an aggregate of an extract over a window crosses a threshold
+
+	NodeTypeMetricSeq NodeTypeT = "metric_seq" // Fires when promql conditions breach in order within a window
+	NodeTypeTraceSeq  NodeTypeT = "trace_seq"  // A log sequence over the spans of SourceTraces
+	NodeTypeTraceSet  NodeTypeT = "trace_set"  // A log set over the spans of SourceTraces
+	NodeTypeFlowSet   NodeTypeT = "flow_set"   // A set of conditions on the flow records of SourceNetFlow
+
+	NodeTypeK8sResource NodeTypeT = "k8s_resource" // Fires when a field of a Kubernetes object changes state
 )
 
+// SourceTraces is the event source of OpenTelemetry trace spans. Conditions on
+// spans name one of the span fields, such as status.code or attributes.http.route.
+const SourceTraces = "cre.traces"
+
+// SourceJournald is the event source of systemd journal entries. Conditions name
+// journal fields such as MESSAGE, PRIORITY, UNIT, or SYSLOG_IDENTIFIER.
+const SourceJournald = "cre.journald"
+
+// SourceSyslog is the event source of RFC 5424 syslog messages. Conditions name
+// a header field, such as appname or severity, or structured data as sd.<SD-ID>.<param>.
+const SourceSyslog = "cre.syslog"
+
+// SourceWinEvent is the event source of Windows Event Log records, in the JSON form
+// of the event XML. Conditions name EventID, Channel, Provider, Level, Message, or
+// EventData.<name>.
+const SourceWinEvent = "cre.winevent"
+
+// SourceCloudTrail is the event source of AWS CloudTrail records. Conditions name
+// record fields such as eventName, eventSource, or userIdentity.arn.
+const SourceCloudTrail = "cre.cloudtrail"
+
+// SourceContainer is the event source of docker and containerd lifecycle events,
+// such as die, oom, and restart. Conditions name fields such as action or exitCode.
+const SourceContainer = "cre.container"
+
+// SourceNetFlow is the event source of network flow records. Conditions name
+// src_ip, dst_ip, src_port, dst_port, protocol, bytes, or packets.
+const SourceNetFlow = "cre.netflow"
+
+// SourceAlerts is the event source of Alertmanager notifications. Conditions name
+// alertname, severity, status, or a label, or match a label selector.
+const SourceAlerts = "cre.alerts"
+
+// SourceK8sEvent is the event source of Kubernetes events. Conditions name event
+// fields such as type, reason, or involvedObject.kind.
+const SourceK8sEvent = "cre.prequel.k8s"
+
+// SourceK8sResource is the event source of Kubernetes object updates. It is the
+// default source of resource conditions.
+const SourceK8sResource = "cre.k8s.resource"
+
 func (t NodeTypeT) String() string {
 	return string(t)
 }
+
+// ExtractTypeT is the type an extracted value is parsed into. An empty type
+// leaves the value as a raw string.
+type ExtractTypeT string
+
+const (
+	ExtractTypeInt       ExtractTypeT = "int"
+	ExtractTypeFloat     ExtractTypeT = "float"
+	ExtractTypeDuration  ExtractTypeT = "duration"
+	ExtractTypeTimestamp ExtractTypeT = "timestamp"
+	ExtractTypeBool      ExtractTypeT = "bool"
+)
+
+// AggFuncT aggregates the values of an extract over a window
+type AggFuncT string
+
+const (
+	AggSum   AggFuncT = "sum"
+	AggAvg   AggFuncT = "avg"
+	AggMin   AggFuncT = "min"
+	AggMax   AggFuncT = "max"
+	AggCount AggFuncT = "count" // Number of events with the extract
+)
+
+// AggOpT compares an aggregate with its threshold
+type AggOpT string
+
+const (
+	AggGt AggOpT = ">"
+	AggGe AggOpT = ">="
+	AggLt AggOpT = "<"
+	AggLe AggOpT = "<="
+	AggEq AggOpT = "=="
+	AggNe AggOpT = "!="
+)
+
+// TransformOpT normalizes an extracted value before it is cast to its type
+type TransformOpT string
+
+const (
+	TransformLowercase TransformOpT = "lowercase"
+	TransformTrim      TransformOpT = "trim"
+	TransformHash      TransformOpT = "hash"
+	TransformSubstring TransformOpT = "substring" // Args are start and optional end byte offsets
+)
+
+func (t ExtractTypeT) Valid() bool {
+	switch t {
+	case "", ExtractTypeInt, ExtractTypeFloat, ExtractTypeDuration, ExtractTypeTimestamp, ExtractTypeBool:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package schema
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrScopeName   = errors.New("invalid scope name (must be non-empty and not a built-in scope)")
+	ErrScopeParent = errors.New("invalid parent scope (must be registered and not within the scope)")
+)
+
+// Scopes form a tree in which each scope is within its parent: a node is within a
+// cluster, which is within the organization. The default scope is outside the tree.
+var (
+	scopesMu sync.RWMutex
+	scopes   = map[string]string{
+		ScopeOrganization: "",
+		ScopeCluster:      ScopeOrganization,
+		ScopeNode:         ScopeCluster,
+		ScopeDefault:      "",
+	}
+)
+
+// RegisterScope adds a scope within parent, so that embedders can place matchers
+// in scopes of their own such as a region, tenant, or service. An empty parent adds
+// a scope outside the tree. Registering a name again moves it to the new parent.
+func RegisterScope(name, parent string) error {
+
+	if name == "" || builtinScope(name) {
+		return ErrScopeName
+	}
+
+	scopesMu.Lock()
+	defer scopesMu.Unlock()
+
+	if parent != "" {
+		if _, ok := scopes[parent]; !ok {
+			return ErrScopeParent
+		}
+		if slices.Contains(ancestors(parent), name) {
+			return ErrScopeParent
+		}
+	}
+
+	scopes[name] = parent
+
+	return nil
+}
+
+// KnownScope reports whether a scope is built in or registered
+func KnownScope(name string) bool {
+	scopesMu.RLock()
+	defer scopesMu.RUnlock()
+	_, ok := scopes[name]
+	return ok
+}
+
+// ScopeContains reports whether inner is outer or is within it
+func ScopeContains(outer, inner string) bool {
+	scopesMu.RLock()
+	defer scopesMu.RUnlock()
+	return slices.Contains(ancestors(inner), outer)
+}
+
+// CommonScope returns the narrowest scope that contains both a and b. It fails if
+// they are in different trees or either is unknown.
+func CommonScope(a, b string) (string, bool) {
+
+	scopesMu.RLock()
+	defer scopesMu.RUnlock()
+
+	outer := ancestors(b)
+	for _, s := range ancestors(a) {
+		if slices.Contains(outer, s) {
+			return s, true
+		}
+	}
+
+	return "", false
+}
+
+// ancestors returns the scope followed by the scopes it is within, innermost first
+func ancestors(name string) []string {
+
+	var list []string
+
+	for name != "" {
+		parent, ok := scopes[name]
+		if !ok {
+			break
+		}
+		list = append(list, name)
+		name = parent
+	}
+
+	return list
+}
+
+func builtinScope(name string) bool {
+	switch name {
+	case ScopeOrganization, ScopeCluster, ScopeNode, ScopeDefault:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package schema
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrSourceName  = errors.New("source name is empty")
+	ErrSourceScope = errors.New("invalid source scope (must be built in or added with RegisterScope)")
+	ErrSourceBuilt = errors.New("the fields of a built-in source cannot be replaced")
+)
+
+// FieldCatalogT lists the fields that conditions on the events of a source may
+// name. A field is known if it is one of Fields or starts with one of Prefixes,
+// such as "labels.". Sources whose field names follow a rule, such as the upper
+// case names of journal fields, set Match instead, which then decides for fields
+// that are not listed. An empty catalog does not check fields. Values and Types
+// constrain the values of value and strings conditions on a field.
+type FieldCatalogT struct {
+	Fields   []string                `json:"fields,omitempty"`
+	Prefixes []string                `json:"prefixes,omitempty"`
+	Values   map[string][]string     `json:"values,omitempty"` // Allowed values of enumerated fields
+	Types    map[string]ExtractTypeT `json:"types,omitempty"`  // Fields whose values are int, float, or bool
+	Match    func(string) bool       `json:"-"`                // Known fields that are not listed; Prefixes are then completions only
+}
+
+// Known reports whether a condition may name the field
+func (c FieldCatalogT) Known(field string) bool {
+
+	if c.Empty() {
+		return true
+	}
+
+	for _, f := range c.Fields {
+		if f == field {
+			return true
+		}
+	}
+
+	if c.Match != nil {
+		return c.Match(field)
+	}
+
+	for _, prefix := range c.Prefixes {
+		if len(field) > len(prefix) && strings.HasPrefix(field, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c FieldCatalogT) Empty() bool {
+	return len(c.Fields) == 0 && len(c.Prefixes) == 0 && c.Match == nil
+}
+
+// KnownValue reports whether the value is allowed for the field
+func (c FieldCatalogT) KnownValue(field, value string) bool {
+
+	if allowed := c.Values[field]; len(allowed) > 0 && !slices.Contains(allowed, value) {
+		return false
+	}
+
+	var err error
+
+	switch c.Types[field] {
+	case ExtractTypeInt:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case ExtractTypeFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case ExtractTypeBool:
+		_, err = strconv.ParseBool(value)
+	}
+
+	return err == nil
+}
+
+// SuggestField returns the known field closest to an unknown one, for "did you
+// mean" diagnostics
+func (c FieldCatalogT) SuggestField(field string) (string, bool) {
+	return closest(field, c.Fields)
+}
+
+// SuggestValue returns the allowed value of the field closest to an unknown one
+func (c FieldCatalogT) SuggestValue(field, value string) (string, bool) {
+	return closest(value, c.Values[field])
+}
+
+// closest returns the candidate with the smallest edit distance from s, if it is
+// within a third of the length of s. Candidates that differ only in case are closest,
+// then candidates that s abbreviates, such as Warn for Warning.
+func closest(s string, candidates []string) (string, bool) {
+
+	var (
+		best   string
+		prefix string
+		bestD  = max(1, len(s)/3) + 1
+	)
+
+	for _, c := range candidates {
+		switch {
+		case strings.EqualFold(c, s):
+			return c, true
+		case prefix == "" && s != "" && len(c) > len(s) && strings.EqualFold(c[:len(s)], s):
+			prefix = c
+		}
+		if d := editDistance(s, c); d < bestD {
+			best, bestD = c, d
+		}
+	}
+
+	if prefix != "" {
+		return prefix, true
+	}
+
+	return best, best != ""
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+// SourceT is a registered event source
+type SourceT struct {
+	Name   string        `json:"name"`
+	Fields FieldCatalogT `json:"fields"`
+	Scope  string        `json:"scope"` // Scope of the matchers of the source
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]SourceT{
+		SourceTraces:      {Name: SourceTraces, Scope: ScopeCluster},
+		SourceCloudTrail:  {Name: SourceCloudTrail, Scope: ScopeCluster},
+		SourceK8sResource: {Name: SourceK8sResource, Scope: ScopeCluster},
+	}
+
+	// Sources whose fields the parser registers
+	builtinSources = map[string]bool{
+		SourceTraces:     true,
+		SourceJournald:   true,
+		SourceSyslog:     true,
+		SourceWinEvent:   true,
+		SourceCloudTrail: true,
+		SourceContainer:  true,
+		SourceNetFlow:    true,
+		SourceAlerts:     true,
+	}
+)
+
+// RegisterSource adds an event source, so that embedders can check the fields of
+// their own sources and place their matchers without forking. Registering a name
+// again replaces it. The fields of the built-in sources are registered by the
+// parser and cannot be replaced.
+func RegisterSource(name string, fields FieldCatalogT, scope string) error {
+
+	if name == "" {
+		return ErrSourceName
+	}
+
+	if !KnownScope(scope) {
+		return ErrSourceScope
+	}
+
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+
+	if builtinSources[name] && !sources[name].Fields.Empty() {
+		return ErrSourceBuilt
+	}
+
+	sources[name] = SourceT{Name: name, Fields: fields, Scope: scope}
+
+	return nil
+}
+
+// LookupSource returns a registered source
+func LookupSource(name string) (SourceT, bool) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	src, ok := sources[name]
+	return src, ok
+}
+
+// Sources returns the registered sources and their field catalogs, sorted by name,
+// so that editors can offer completions
+func Sources() []SourceT {
+
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+
+	list := make([]SourceT, 0, len(sources))
+	for _, src := range sources {
+		list = append(list, src)
+	}
+
+	slices.SortFunc(list, func(a, b SourceT) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return list
+}
+
+// SourceScope returns the scope of the matchers of a source, or def if the source
+// is not registered
+func SourceScope(name, def string) string {
+	if src, ok := LookupSource(name); ok {
+		return src.Scope
+	}
+	return def
+}
@@ -873,10 +873,6 @@ terms:
       match:
         - field: "reason"
           value: "Killing"
-          window: 10s
-          slide: 1s
-          anchor: 0
-          abs: true
 `
 
 var TestFailTermsSemanticError2 = ` # Line 1 starts here
@@ -1132,3 +1128,3221 @@ rules:
               match:
                 - regex: "io.vertx.core.VertxException: Thread blocked"
 `
+
+var TestSuccessSharedSubSequence = `
+rules:
+  - cre:
+      id: TestSuccessSharedSubSequence1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - shutdownSeq
+          - k8sKilling
+  - cre:
+      id: TestSuccessSharedSubSequence2
+    metadata:
+      id: "Kd3vMx8pQw2RtYz7NbLcHa"
+      hash: "Wq5nPz8kRt3YxMv2LbHcJd"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        match:
+          - shutdownSeq
+          - k8sEvicted
+terms:
+  shutdownSeq:
+    sequence:
+      window: 5s
+      event:
+        source: cre.log.nginx
+        origin: true
+      order:
+        - error message
+        - shutdown
+  k8sKilling:
+    set:
+      event:
+        source: cre.prequel.k8s
+      match:
+        - field: "reason"
+          value: "Killing"
+  k8sEvicted:
+    set:
+      event:
+        source: cre.prequel.k8s
+      match:
+        - field: "reason"
+          value: "Evicted"
+`
+
+var TestFailTermCycle = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermCycle
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - term1
+          - term2
+terms:
+  term1:
+    sequence:
+      window: 10s
+      order:
+        - term2
+        - term1                                                             # references itself
+  term2:
+    set:
+      event:
+        source: cre.prequel.k8s
+      match:
+        - field: "reason"
+          value: "Killing"
+`
+
+var TestFailTermIndirectCycle = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermIndirectCycle
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        match:
+          - term1
+          - term2
+terms:
+  term1:
+    set:
+      window: 10s
+      match:
+        - term2
+        - term3
+  term2:
+    set:
+      event:
+        source: cre.prequel.k8s
+      match:
+        - field: "reason"
+          value: "Killing"
+  term3:
+    sequence:
+      window: 10s
+      order:
+        - term2
+        - term1                                                             # references term1 through term3
+`
+
+var TestSuccessFieldExists = `
+rules:
+  - cre:
+      id: TestSuccessFieldExists
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: "action"
+            exists: true
+          - field: "reportingController"
+            exists: false
+        negate:
+          - field: "reportingInstance"
+            exists: true
+`
+
+var TestFailFieldExistsValue = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFieldExistsValue
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: "action"
+            value: "Binding"
+            exists: false                                                   # cannot combine exists with value
+`
+
+var TestFailFieldExistsNoField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFieldExistsNoField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        match:
+          - exists: true                                                    # exists requires a field
+`
+
+var TestFailFieldExistsRawText = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFieldExistsRawText
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - "request failed"
+          - field: "trace_id"                                               # log lines are raw text
+            exists: false
+`
+
+var TestSuccessRequireSources = `
+rules:
+  - cre:
+      id: TestSuccessRequireSources
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+      requireSources: all
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - set:
+              event:
+                source: cre.log.nginx
+                origin: true
+              match:
+                - shutdown
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "Killing"
+        negate:
+          - set:
+              event:
+                source: cre.log.nginx
+              match:
+                - restart
+`
+
+var TestFailRequireSources = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRequireSources
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+      requireSources: some                                                  # must be any or all
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - shutdown
+`
+
+var TestSuccessShortSeqWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessShortSeqWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 1s                                                          # short for five steps
+        event:
+          source: cre.log.app
+        order:
+          - starting
+          - connecting
+          - value: retrying
+            count: 2
+          - giving up
+`
+
+var TestSuccessPrimaryField = `
+rules:
+  - cre:
+      id: TestSuccessPrimaryField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: "reason"
+            value: "BackOff"
+          - field: "reason"
+            value: "OOMKilled"
+            primary: true
+`
+
+var TestSuccessPrimaryCount = `
+rules:
+  - cre:
+      id: TestSuccessPrimaryCount
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+        order:
+          - value: "Back-off restarting"
+            count: 3
+          - value: "OOMKilled"
+            count: 2
+            primary: true
+          - "Pod deleted"
+`
+
+var TestFailMultiplePrimary = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMultiplePrimary
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: "reason"
+            value: "BackOff"
+            primary: true
+          - field: "reason"
+            value: "OOMKilled"
+            primary: true                                                   # only one primary allowed
+`
+
+var TestFailPrimaryNegate = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailPrimaryNegate
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: "reason"
+            value: "BackOff"
+        negate:
+          - field: "reason"
+            value: "Started"
+            primary: true                                                   # negates cannot be primary
+`
+
+var TestSuccessDescribedPromQL = `
+rules:
+  - cre:
+      id: TestSuccessDescribedPromQL
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 50s
+        match:
+          - promql:
+              event:
+                source: cre.metrics
+                origin: true
+              expr: 'sum(rate(http_requests_total{code=~"5.."}[5m])) by (service) > 10'
+              for: 1m
+              description: |
+                  Sustained 5xx error rate above 10 req/s per service
+          - set:
+              event:
+                source: kafka
+              match:
+                - regex: "io.vertx.core.VertxException: Thread blocked"
+`
+
+var TestSuccessOrderTolerance = `
+rules:
+  - cre:
+      id: TestSuccessOrderTolerance
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        orderTolerance: 2s
+        order:
+          - sequence:
+              window: 10s
+              orderTolerance: 500ms
+              event:
+                source: cre.log.app
+                origin: true
+              order:
+                - starting
+                - stopping
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "Killing"
+`
+
+var TestFailOrderTolerance = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailOrderTolerance
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - sequence:
+              window: 10s
+              orderTolerance: 10s                                           # must be less than window
+              event:
+                source: cre.log.app
+              order:
+                - starting
+                - stopping
+          - stopped
+`
+
+var TestFailNegativeOrderTolerance = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailNegativeOrderTolerance
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - sequence:
+              window: 10s
+              orderTolerance: -1s                                           # must be non-negative
+              event:
+                source: cre.log.app
+              order:
+                - starting
+                - stopping
+          - stopped
+`
+
+var TestFailPromQLWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailPromQLWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 50s
+        match:
+          - highErrorRate
+          - set:
+              event:
+                source: kafka
+              match:
+                - regex: "io.vertx.core.VertxException: Thread blocked"
+terms:
+  highErrorRate:
+    promql:
+      event:
+        source: cre.metrics
+        origin: true
+      expr: 'sum(rate(http_requests_total[5m])) by (service)'
+      window: 5m                                                            # promql uses for/interval
+`
+
+var TestSuccessExpressions = `
+rules:
+  - cre:
+      id: TestSuccessExpressions
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - term1
+          - term2
+terms:
+  term2:
+    set:
+      event:
+        source: cre.prequel.k8s
+      match:
+        - jq: 'select(.reason == "Killing")'
+          extract:
+            - name: pod
+              jq: ".involvedObject.name"
+        - regexes:
+            - "Back-off restarting .+"
+            - "Liveness probe failed"
+      negate:
+        - regex: "Started container (.+)"
+  term1:
+    sequence:
+      window: 10s
+      event:
+        source: cre.log.app
+        origin: true
+      order:
+        - regex: "connection (refused|reset)"
+          extract:
+            - name: host
+              regex: "host=(\\S+)"
+        - plain string value
+        - glob: "*timeout*connect*"
+`
+
+var TestSuccessWindowConstants = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessWindowConstants
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: $long
+        order:
+          - sequence:
+              window: $short
+              event:
+                source: cre.log.app
+                origin: true
+              order:
+                - starting
+                - stopping
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "Killing"
+`
+
+var TestFailMatchNegateOpts = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMatchNegateOpts
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - value: "starting"
+          - field: "reason"
+            value: "Killing"
+            anchor: 1
+`
+
+var TestPartialBundle = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestPartialBundleGood
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - starting
+          - stopping
+  - cre:
+      id: TestPartialBundleBad
+    metadata:
+      id: "5UD1RZxGC5LJQnVpAkV11A"
+      hash: "JjnzCzQ1pWjVmPnXEyoGjR"
+      generation: 1
+    rule:
+      sequence:
+        window: soon
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - starting
+          - stopping
+
+terms:
+  starting:
+    value: "starting"
+  stopping:
+    value: "stopping"
+`
+
+var TestSuccessDelimitedField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessDelimitedField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - field: "level"
+            value: "error"
+            delimiter: " "
+          - field: "msg"
+            regex: "disk (full|failure)"
+            delimiter: " "
+`
+
+var TestFailDelimiter = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailDelimiter
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - field: "level"
+            value: "error"
+            delimiter: ", "
+`
+
+var TestFailDelimitedJq = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailDelimitedJq
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - field: "level"
+            jq: '.level == "error"'
+            delimiter: " "
+`
+
+var TestSuccessPriority = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestPriorityDefault
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+  - cre:
+      id: TestPriorityHighFirst
+    metadata:
+      id: "5UD1RZxGC5LJQnVpAkV11A"
+      hash: "JjnzCzQ1pWjVmPnXEyoGjR"
+      generation: 1
+      priority: 10
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+  - cre:
+      id: TestPriorityLow
+    metadata:
+      id: "Bq8rEaVmVB9xK3H6y5jYUk"
+      hash: "8AzbFh3gJ3CX9NyX2dKvXs"
+      generation: 1
+      priority: 5
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+  - cre:
+      id: TestPriorityHighSecond
+    metadata:
+      id: "Ne1BzV3bTbDuYqeCgm1dQ2"
+      hash: "Hq5aXwJ7t2mZpCk4rYy9Ld"
+      generation: 1
+      priority: 10
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+`
+
+var TestFailPriority = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailPriority
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+      priority: -1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+`
+
+var TestSuccessTermRef = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessTermRef
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - term: oom
+          - oom
+          - oomkilled
+        negate:
+          - term: oom
+            window: 5s
+
+terms:
+  oom:
+    regex: "OOM ?Killed"
+`
+
+var TestFailTermRef = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermRef
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - term: oom
+          - term: oomkilled
+
+terms:
+  oom:
+    regex: "OOM ?Killed"
+`
+
+var TestFailTermRefCondition = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermRefCondition
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - term: oom
+            value: "oom"
+          - "restarting"
+
+terms:
+  oom:
+    regex: "OOM ?Killed"
+`
+
+var TestSuccessNodeWindows = `
+rules:
+  - cre:
+      id: TestSuccessNodeWindows
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 50s
+        match:
+          - promql:
+              event:
+                source: cre.metrics
+                origin: true
+              expr: 'sum(rate(http_requests_total[5m])) by (service)'
+              for: 2m
+          - sequence:
+              window: 10s
+              event:
+                source: cre.log.app
+              order:
+                - starting
+                - stopping
+          - set:
+              event:
+                source: cre.log.kafka
+              match:
+                - regex: "io.vertx.core.VertxException: Thread blocked"
+`
+
+var TestSuccessRepeat = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessRepeat
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - sequence:
+              window: 10s
+              event:
+                source: cre.log.app
+                origin: true
+              order:
+                - "connecting"
+                - value: "retrying"
+                  repeat: "1+"
+                - term: failed
+                  repeat: "2"
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "BackOff"
+            repeat: "2-5"
+
+terms:
+  failed:
+    value: "connection failed"
+`
+
+var TestFailRepeatSyntax = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRepeatSyntax
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - value: "retrying"
+            repeat: "3-1"
+`
+
+var TestFailRepeatSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRepeatSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "connecting"
+          - value: "retrying"
+            repeat: "1+"
+`
+
+var TestFailRepeatNegate = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRepeatNegate
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - "connected"
+        negate:
+          - value: "retrying"
+            repeat: "1+"
+`
+
+var TestSuccessExplain = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessExplain
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "disk full"
+          - field: "level"
+            value: "error"
+          - regex: "timeout after [0-9]+s"
+          - field: "trace_id"
+            exists: true
+          - jq: '.code == 500'
+        negate:
+          - "shutting down"
+`
+
+var TestSuccessExplainValues = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessExplainValues
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - regexes: ["oom-?kill", "out of memory"]
+          - glob: "pod-*.log"
+          - value: "Connection Reset"
+            options:
+              caseSensitive: false
+          - field: level
+            value: "ERROR"
+            options:
+              caseSensitive: false
+          - field: response.latency_ms
+            gt: 500
+          - field: src_ip
+            ipCidr: 10.0.0.0/8
+`
+
+var TestMigrateLegacy = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestMigrateLegacy
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+      require_sources: all
+    rule:
+      sequence:
+        window: 10s
+        order_tolerance: 1s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - value: "starting"
+          - "stopping"
+        negate:
+          - value: "restarting"
+            window: 5s
+            abs: true
+  - cre:
+      id: TestMigrateNeutral
+    metadata:
+      id: "5UD1RZxGC5LJQnVpAkV11A"
+      hash: "JjnzCzQ1pWjVmPnXEyoGjR"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - value: "disk full" # short form
+`
+
+var TestFailSeqFirstStepNoSource = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSeqFirstStepNoSource
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 5m
+        order:
+          - promql:
+              expr: 'sum(rate(http_requests_total{code="500"}[5m])) > 10'
+              for: 1m
+          - set:
+              event:
+                source: cre.log.nginx
+                origin: true
+              match:
+                - "upstream timed out"
+`
+
+var TestFailSeqFirstStepAbsent = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSeqFirstStepAbsent
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.prequel.k8s
+          origin: true
+        order:
+          - field: "action"
+            exists: false
+          - "request failed"
+`
+
+var TestSuccessValueSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessValueSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+          origin: true
+        match:
+          - field: "reason"
+            valueSet: fatal_reasons
+terms:
+  fatal_reasons:
+    - OOMKilled
+    - Error
+    - "Init:Error"
+`
+
+var TestFailValueSetNotFound = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailValueSetNotFound
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+          origin: true
+        match:
+          - field: "reason"
+            valueSet: fatal_reason
+terms:
+  fatal_reasons:
+    - OOMKilled
+`
+
+var TestFailValueSetEmpty = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailValueSetEmpty
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+          origin: true
+        match:
+          - field: "reason"
+            valueSet: fatal_reasons
+terms:
+  fatal_reasons: []
+`
+
+var TestFailNegateWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailNegateWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - term: restart
+          - "ready"
+terms:
+  restart:
+    sequence:
+      order:
+        - "stopping"
+        - "starting"
+      negate:
+        - value: "aborted"
+          slide: 2s
+`
+
+var TestSuccessAnnotations = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessAnnotations
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - value: "disk full"
+            annotations:
+              runbook: https://runbooks.example.com/disk-full
+              team.owner: storage
+          - write_failed
+        negate:
+          - value: "disk cleaned"
+            annotations:
+              runbook: https://runbooks.example.com/disk-cleanup
+terms:
+  write_failed:
+    regex: "write (failed|error)"
+    annotations:
+      runbook: https://runbooks.example.com/write-failed
+`
+
+var TestFailAnnotationKey = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAnnotationKey
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - value: "disk full"
+            annotations:
+              "run book": https://runbooks.example.com/disk-full
+`
+
+var TestSemanticDuplicates = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSemanticDuplicatesOriginal
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - disk_full
+  - cre:
+      id: TestSemanticDuplicatesCopy
+    metadata:
+      id: "5UD1RZxGC5LJQnVpAkV11A"
+      hash: "JjnzCzQ1pWjVmPnXEyoGjR"
+      generation: 3
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - disk_full
+  - cre:
+      id: TestSemanticDuplicatesOther
+    metadata:
+      id: "8AzbFh3gJ3CX9NyX2dKvXs"
+      hash: "Hq5aXwJ7t2mZpCk4rYy9Ld"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.db
+          origin: true
+        match:
+          - disk_full
+terms:
+  disk_full:
+    value: "disk full"
+`
+
+var TestSuccessJSON = `{
+  "rules": [
+    {
+      "cre": {
+        "id": "TestSuccessTermRef"
+      },
+      "metadata": {
+        "id": "J7uRQTGpGMyL1iFpssnBeS",
+        "hash": "rdJLgqYgkEp8jg8Qks1qiq",
+        "generation": 1
+      },
+      "rule": {
+        "sequence": {
+          "window": "10s",
+          "event": {
+            "source": "cre.log.app",
+            "origin": true
+          },
+          "order": [
+            {"term": "oom"},
+            "oom",
+            "oomkilled"
+          ],
+          "negate": [
+            {"term": "oom", "window": "5s"}
+          ]
+        }
+      }
+    }
+  ],
+  "terms": {
+    "oom": {
+      "regex": "OOM ?Killed"
+    }
+  }
+}
+`
+
+var TestFailJSONWindow = `{
+  "rules": [
+    {
+      "cre": {
+        "id": "TestFailJSONWindow"
+      },
+      "metadata": {
+        "id": "J7uRQTGpGMyL1iFpssnBeS",
+        "hash": "rdJLgqYgkEp8jg8Qks1qiq",
+        "generation": 1
+      },
+      "rule": {
+        "set": {
+          "window": "soon",
+          "event": {"source": "cre.log.app", "origin": true},
+          "match": ["disk full", "disk failure"]
+        }
+      }
+    }
+  ]
+}
+`
+
+var TestIncludeMain = `include:
+  - common.yaml
+  - path: shared/rules.yaml
+    rules: true
+rules:
+  - cre:
+      id: TestIncludeMain
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - oom
+`
+
+var TestIncludeCommon = `include:
+  - main.yaml
+terms:
+  oom:
+    regex: "OOM ?Killed"
+  disk_full:
+    value: "disk full"
+`
+
+var TestIncludeShared = `include:
+  - ../common.yaml
+rules:
+  - cre:
+      id: TestIncludeShared
+    metadata:
+      id: "5UD1RZxGC5LJQnVpAkV11A"
+      hash: "JjnzCzQ1pWjVmPnXEyoGjR"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - disk_full
+terms:
+  oom:
+    value: "out of memory"
+`
+
+var TestSuccessParams = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessParams
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    parameters:
+      window: 30s
+      service: postgres
+    rule:
+      sequence:
+        window: ${window}
+        event:
+          source: cre.log.${service}
+          origin: true
+        order:
+          - value: "${service} shutting down"
+          - regex: "${service} (started|ready)"
+`
+
+var TestFailUndefinedParam = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailUndefinedParam
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    parameters:
+      window: 30s
+    rule:
+      sequence:
+        window: ${window}
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - value: "${service} shutting down"
+          - "started"
+`
+
+var TestFailGroupTerm = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailGroupTerm
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        match:
+          - anyOf:
+              - set:
+                  event:
+                    source: cre.log.app
+                    origin: true
+                  match:
+                    - "disk full"
+              - "disk failure"
+`
+
+var TestFailGroupSize = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailGroupSize
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        match:
+          - anyOf:
+              - set:
+                  event:
+                    source: cre.log.app
+                    origin: true
+                  match:
+                    - "disk full"
+`
+
+var TestFailConditionTerm = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailConditionTerm
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        condition: "crash and not restarted"
+terms:
+  crash:
+    set:
+      event:
+        source: cre.log.app
+        origin: true
+      match:
+        - "panic: runtime error"
+`
+
+var TestFailConditionNot = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailConditionNot
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        condition: crash or not restart
+terms:
+  crash:
+    set:
+      event:
+        source: cre.log.app
+        origin: true
+      match:
+        - "panic: runtime error"
+  restart:
+    set:
+      event:
+        source: cre.log.app
+      match:
+        - "graceful restart"
+`
+
+var TestSuccessConditionOr = `
+rules:
+  - cre:
+      id: TestSuccessConditionOr
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        event:
+          source: cre.log.app
+        condition: (panic or fatal or oom) and not restart
+terms:
+  panic: "panic: runtime error"
+  fatal: "fatal error"
+  oom:
+    regex: "out of memory|OOM"
+  restart: "graceful restart"
+`
+
+var TestFailCountDistinctField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCountDistinctField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        window: 5m
+        countDistinct:
+          field: node
+          threshold: 10
+        match:
+          - field: "reason"
+            value: "CrashLoopBackOff"
+            extract:
+              - name: pod
+                jq: ".involvedObject.name"
+`
+
+var TestFailCountDistinctThreshold = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCountDistinctThreshold
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        window: 5m
+        countDistinct:
+          field: pod
+          threshold: 1
+        match:
+          - field: "reason"
+            value: "CrashLoopBackOff"
+            extract:
+              - name: pod
+                jq: ".involvedObject.name"
+`
+
+var TestSuccessMaxGap = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessMaxGap
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 60s
+        order:
+          - sequence:
+              window: 30s
+              event:
+                source: cre.log.app
+                origin: true
+              order:
+                - "connecting"
+                - value: "retrying"
+                  maxGap: 5s
+                - term: failed
+                  maxGap: 2s
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "BackOff"
+            maxGap: 10s
+
+terms:
+  failed:
+    value: "connection failed"
+`
+
+var TestFailMaxGapFirst = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMaxGapFirst
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - value: "connecting"
+            maxGap: 5s
+          - "connected"
+`
+
+var TestFailMaxGapSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMaxGapSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "connecting"
+          - value: "retrying"
+            maxGap: 5s
+`
+
+var TestFailMaxGapDuration = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMaxGapDuration
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - value: "connected"
+            maxGap: soon
+`
+
+var TestSuccessOptional = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessOptional
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 60s
+        order:
+          - sequence:
+              window: 30s
+              event:
+                source: cre.log.app
+                origin: true
+              order:
+                - "connecting"
+                - value: "retrying"
+                  optional: true
+                - "connection failed"
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "Unhealthy"
+            optional: true
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "BackOff"
+`
+
+var TestFailOptionalLast = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailOptionalLast
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - value: "connected"
+            optional: true
+`
+
+var TestFailOptionalSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailOptionalSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "connecting"
+          - value: "retrying"
+            optional: true
+`
+
+var TestSuccessCountRange = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessCountRange
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - value: "retrying"
+            count:
+              min: 2
+              max: 5
+          - failed
+
+terms:
+  failed:
+    value: "connection failed"
+    count: 2
+`
+
+var TestFailCountRangeBounds = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCountRangeBounds
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "connecting"
+          - value: "retrying"
+            count:
+              min: 3
+              max: 1
+`
+
+var TestFailCountRangeSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCountRangeSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "connecting"
+          - value: "retrying"
+            count:
+              min: 2
+`
+
+var TestFailRequireTerms = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRequireTerms
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 60s
+        require: 3
+        match:
+          - set:
+              event:
+                source: cre.log.etcd
+                origin: true
+              match:
+                - "leader changed"
+          - set:
+              event:
+                source: cre.log.apiserver
+              match:
+                - "etcdserver: request timed out"
+`
+
+var TestFailRequireLogSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRequireLogSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 60s
+        require: 1
+        event:
+          source: cre.log.app
+          origin: true
+        match:
+          - "connecting"
+          - "retrying"
+`
+
+var TestFailNegateGroupNested = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailNegateGroupNested
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "Starting rollout"
+          - "Rollout aborted"
+        negate:
+          - allOf:
+              - "Rollout paused"
+              - anyOf:
+                  - "Rollout resumed"
+                  - "Rollout restarted"
+`
+
+var TestFailAnchorName = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAnchorName
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 60s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "Starting rollout"
+          - "Rollout aborted"
+        negate:
+          - value: "Rollout resumed"
+            window: 10s
+            anchor: probe_failed
+`
+
+var TestFailAnchorValue = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAnchorValue
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 60s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - "Starting rollout"
+          - "Rollout aborted"
+        negate:
+          - value: "Rollout resumed"
+            window: 10s
+            anchor: "Starting rollout"                                   # a value, not a term
+`
+
+var TestFailAnchorCount = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAnchorCount
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 60s
+        event:
+          source: cre.log.app
+          origin: true
+        order:
+          - value: "Starting rollout"
+            count: 3
+          - "Rollout aborted"
+        negate:
+          - value: "Rollout resumed"
+            window: 10s
+            anchor: 2                                                    # a counted step is one term
+`
+
+var TestFailNegateUntilName = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailNegateUntilName
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 5m
+        event:
+          source: cre.log.etcd
+          origin: true
+        order:
+          - "lost leader"
+          - "elected leader"
+        negate:
+          - value: "failed to send out heartbeat"
+            until: leader_elected
+`
+
+var TestFailCorrelateOn = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelateOn
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10m
+        correlateOn:
+          - pod
+        match:
+          - set:
+              event:
+                source: cre.prequel.k8s
+                origin: true
+              match:
+                - field: "reason"
+                  value: "OOMKilling"
+                  extract:
+                    - name: pod
+                      jq: ".involvedObject.name"
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "BackOff"
+`
+
+var TestFailCorrelateKeyMapped = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelateKeyMapped
+    metadata:
+      id: "Wd3NpZq8RkT5vLc2Hx7Jmb"
+      hash: "Gs6YbM2tQr9KwF4nXj8Lpc"
+      generation: 1
+    rule:
+      set:
+        window: 10m
+        correlateOn:
+          - key: pod
+            extracts:
+              cre.prequel.k8s: pod_name
+        match:
+          - set:
+              event:
+                source: cre.prequel.k8s
+                origin: true
+              match:
+                - field: "reason"
+                  value: "OOMKilling"
+                  extract:
+                    - name: pod
+                      jq: ".involvedObject.name"
+          - set:
+              event:
+                source: cre.log.app
+              match:
+                - regex: "pod=(\\S+) out of memory"
+                  extract:
+                    - name: pod_name
+                      regex: "pod=(\\S+)"
+`
+
+var TestFailCorrelationWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelationWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        correlationWindow: 10s                                          # must not be less than window
+        correlations:
+          - hostname
+        match:
+          - set:
+              event:
+                source: cre.log.app
+                origin: true
+              match:
+                - "connection refused"
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "NodeNotReady"
+`
+
+var TestFailCorrelationWindowUncorrelated = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelationWindowUncorrelated
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        correlationWindow: 1h                                           # requires correlations
+        match:
+          - set:
+              event:
+                source: cre.log.app
+                origin: true
+              match:
+                - "connection refused"
+          - set:
+              event:
+                source: cre.prequel.k8s
+              match:
+                - field: "reason"
+                  value: "NodeNotReady"
+`
+
+var TestFailExtractType = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailExtractType
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "status=(\\d+)"
+            extract:
+              - name: status
+                regex: "status=(\\d+)"
+                type: integer                                           # not a supported type
+`
+
+var TestSuccessRegexGroups = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessRegexGroups
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "(GET|POST) (?P<path>/\\S+) status=(?P<status>\\d+)"
+            extract:
+              - name: method
+                regex: "(GET|POST)"
+`
+
+var TestFailRegexGroupCollision = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegexGroupCollision
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "status=(?P<status>\\d+)"
+            extract:
+              - name: status
+                jq: ".status"
+`
+
+var TestFailRegexGroupName = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegexGroupName
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "status=(?P<2xx>2\\d\\d)"
+`
+
+var TestSuccessStepRefs = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessStepRefs
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+        order:
+          - term: lease_lost
+          - value: "retrying"
+            count: 2
+          - regex: "lease ${lease_lost.holder} released"
+
+terms:
+  lease_lost:
+    regex: "lost lease (?P<holder>\\S+)"
+`
+
+var TestFailStepRefForward = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailStepRefForward
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+        order:
+          - regex: "lease ${lease_lost.holder} released"
+          - term: lease_lost
+
+terms:
+  lease_lost:
+    regex: "lost lease (?P<holder>\\S+)"
+`
+
+var TestFailStepRefExtract = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailStepRefExtract
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+        order:
+          - term: lease_lost
+          - regex: "lease ${lease_lost.owner} released"
+
+terms:
+  lease_lost:
+    regex: "lost lease (?P<holder>\\S+)"
+`
+
+var TestFailStepRefSet = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailStepRefSet
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - term: lease_lost
+          - regex: "lease ${lease_lost.holder} released"
+
+terms:
+  lease_lost:
+    regex: "lost lease (?P<holder>\\S+)"
+`
+
+var TestFailStepRefNegate = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailStepRefNegate
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.app
+        order:
+          - term: lease_lost
+          - "lease expired"
+        negate:
+          - regex: "lease ${lease_lost.holder} renewed"
+
+terms:
+  lease_lost:
+    regex: "lost lease (?P<holder>\\S+)"
+`
+
+var TestFailExtractTransform = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailExtractTransform
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "user=(\\S+)"
+            extract:
+              - name: user
+                regex: "user=(\\S+)"
+                transforms:
+                  - trim
+                  - substring(8, 2)                                     # end before start
+`
+
+var TestFailAggregateType = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAggregateType
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        match:
+          - aggregate:
+              event:
+                source: cre.log.proxy
+                origin: true
+              match:
+                - regex: "user=(\\S+)"
+                  extract:
+                    - name: user
+                      regex: "user=(\\S+)"
+              expr: "sum(user) > 100 over 5m"                           # sum of an untyped extract
+`
+
+var TestFailAggregateThreshold = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAggregateThreshold
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        match:
+          - aggregate:
+              event:
+                source: cre.log.proxy
+                origin: true
+              match:
+                - regex: "sent (\\d+) bytes"
+                  extract:
+                    - name: bytes
+                      regex: "sent (\\d+) bytes"
+                      type: int
+              expr: "sum(bytes) > 10s over 5m"                          # duration threshold on an int
+`
+
+var TestSuccessFieldCompare = `
+rules:
+  - cre:
+      id: TestSuccessFieldCompare
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - field: response.latency_ms
+            gt: 500
+          - field: status
+            gte: 500
+        negate:
+          - field: retry.attempt
+            eq: 0
+`
+
+var TestFailFieldCompareOps = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFieldCompareOps
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - field: response.latency_ms
+            gt: 500
+            lt: 2000                                                    # one operator only
+`
+
+var TestFailFieldCompareField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFieldCompareField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - field: response..latency_ms
+            lte: 500                                                    # empty path key
+`
+
+var TestSuccessValueList = `
+rules:
+  - cre:
+      id: TestSuccessValueList
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - strings: [OOMKilled, Error, OOMKilled]
+          - regexes:
+              - "exit code \\d+"
+              - "signal (9|15)"
+              - "exit code \\d+"
+`
+
+var TestFailValueListEmpty = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailValueListEmpty
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - strings: []                                                 # empty list
+`
+
+var TestFailValueListRegex = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailValueListRegex
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regexes:
+              - "exit code \\d+"
+              - "signal (9|15"                                          # unbalanced
+`
+
+var TestSuccessValuesFrom = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessValuesFrom
+    metadata:
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.dns
+        match:
+          - field: query
+            valuesFrom: file://iocs.txt
+`
+
+var TestSuccessIPCidr = `
+rules:
+  - cre:
+      id: TestSuccessIPCidr
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.net
+        match:
+          - field: src.ip
+            ipCidr:
+              - 10.0.0.0/8
+              - 192.168.1.77/24
+              - fd00::/8
+          - field: dst_ip
+            ipCidr: 203.0.113.0/24
+`
+
+var TestFailIPCidrBlock = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailIPCidrBlock
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.net
+        match:
+          - field: src_ip
+            ipCidr:
+              - 10.0.0.0/8
+              - 10.0.0.0/33                                             # prefix too long
+`
+
+var TestFailIPCidrField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailIPCidrField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.net
+        match:
+          - ipCidr: 10.0.0.0/8                                          # no field
+`
+
+var TestSuccessGlob = `
+rules:
+  - cre:
+      id: TestSuccessGlob
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - glob: "*timeout*connect*"
+          - glob: "pod-?[!0-9]*.log"
+`
+
+var TestFailGlob = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailGlob
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - glob: "pod-[0-9*"                                           # missing ']'
+`
+
+var TestSuccessMatchOpts = `
+rules:
+  - cre:
+      id: TestSuccessMatchOpts
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - value: "connection reset"
+            options:
+              caseSensitive: false
+          - regex: "^panic: .+"
+            options:
+              multiline: true
+              wordBoundary: true
+          - strings: [oom, killed]
+            options:
+              caseSensitive: false
+              wordBoundary: true
+          - value: "as is"
+            options:
+              caseSensitive: true
+`
+
+var TestFailMatchOpts = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMatchOpts
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - jq: ".level == \"error\""
+            options:                                                    # not a value or regex
+              caseSensitive: false
+`
+
+var TestFailJqSyntax = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailJqSyntax
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - value: "connection reset"
+          - jq: '.level == "error" and'                                 # missing right operand
+`
+
+var TestFailJqFunction = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailJqFunction
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - jq: 'select(.level | lowercase == "error")'                # not a jq function
+`
+
+var TestFailRegex = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegex
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: "status=(\\d+"                                       # missing closing paren
+`
+
+var TestFailRegexExtract = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegexExtract
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - value: "request done"
+            extract:
+              - name: latency
+                regex: "latency=([0-9]+ms"                              # missing closing bracket
+`
+
+var TestFailRegexSize = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegexSize
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - regex: '\w{1,1000}:\d{1,1000}:\s{1,1000}:[a-f]{1,1000}:[g-z]{1,1000}:[A-Z]{1,1000}' # expands into a large program
+`
+
+var TestFailPromQLSyntax = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailPromQLSyntax
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        match:
+          - promql:
+              expr: 'sum(rate(http_requests_total{code="500"[5m])) > 10'  # unclosed label matchers
+              for: 1m
+`
+
+var TestFailMetricSeqWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMetricSeqWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 5m
+        event:
+          source: cre.metrics
+          origin: true
+        order:
+          - promql:
+              expr: 'rate(http_requests_total{code="500"}[5m]) > 10'
+              for: 5m                                                   # holds for the whole window
+          - promql:
+              expr: 'node_memory_MemAvailable_bytes < 1e9'
+`
+
+var TestFailMetricSeqInnerEvent = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMetricSeqInnerEvent
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 10m
+        event:
+          source: cre.metrics
+          origin: true
+        order:
+          - promql:
+              expr: 'rate(http_requests_total{code="500"}[5m]) > 10'
+          - promql:                                                     # the sequence already has an event
+              event:
+                source: cre.metrics
+              expr: 'node_memory_MemAvailable_bytes < 1e9'
+`
+
+var TestFailSpanField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSpanField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.traces
+        match:
+          - field: status.code
+            value: STATUS_CODE_ERROR
+          - field: http.status                                          # not a span field
+            value: "500"
+`
+
+var TestFailCompareDuration = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCompareDuration
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.app
+        match:
+          - field: response.latency
+            gt: 500ms                                                   # durations only compare spans
+`
+
+var TestFailResourceField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailResourceField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        match:
+          - resource:
+              apiVersion: apps/v1
+              kind: Deployment
+              field: replicasAvailable                                  # not a known Deployment field
+              to:
+                eq: 0
+`
+
+var TestFailJournaldField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailJournaldField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.journald
+        match:
+          - field: unit                                                 # journal fields are upper case
+            value: kubelet.service
+`
+
+var TestFailJournaldPriority = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailJournaldPriority
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.journald
+        match:
+          - field: PRIORITY
+            value: error                                                # the level name is err
+`
+
+var TestFailSyslogFacility = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSyslogFacility
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.syslog
+        match:
+          - field: facility
+            value: local8                                               # local0 through local7
+`
+
+var TestFailSyslogField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSyslogField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.syslog
+        match:
+          - field: app_name                                             # rules use appname
+            value: bgpd
+`
+
+var TestFailWinEventID = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailWinEventID
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.winevent
+        match:
+          - field: EventID
+            value: logon-failure                                        # event ids are numbers
+`
+
+var TestFailCloudTrailSource = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCloudTrailSource
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.cloudtrail
+        match:
+          - field: eventSource
+            value: iam                                                  # iam.amazonaws.com
+`
+
+var TestFailContainerAction = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailContainerAction
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.container
+        match:
+          - field: action
+            value: crashed                                              # not a lifecycle action
+`
+
+var TestFailFlowCondition = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailFlowCondition
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.netflow
+        match:
+          - field: dst_ip
+            regex: "^10\\."                                             # use ipCidr
+`
+
+var TestFailAlertSelector = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailAlertSelector
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.alerts
+        match:
+          - field: selector
+            value: 'KubePodCrashLooping{namespace="prod"'                # unclosed selector
+`
+
+var TestSuccessRegisteredSource = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessRegisteredSource
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.test.inventory
+        match:
+          - field: tags.env
+            value: prod
+`
+
+var TestFailRegisteredSource = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRegisteredSource
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.test.inventory
+        match:
+          - field: hostname                                             # not in the catalog
+            value: db-1
+`
+
+var TestFailCatalogValue = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCatalogValue
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.test.k8s
+        match:
+          - field: type
+            value: Warn                                                 # Normal or Warning
+`
+
+var TestFailCatalogField = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCatalogField
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.test.k8s
+        match:
+          - field: reasn                                                # reason
+            value: BackOff
+`
+
+var TestFailK8sEventType = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailK8sEventType
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.prequel.k8s
+        match:
+          - field: type
+            value: Error                                                # Normal or Warning
+`
+
+var TestFailScopeBridge = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailScopeBridge
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:                                                         # cre.cloudtrail is in the cluster scope
+        window: 15m
+        correlations:
+          - hostname
+        order:
+          - set:
+              event:
+                source: cre.cloudtrail
+                origin: true
+              match:
+                - field: eventName
+                  value: ModifyInstanceAttribute
+          - set:
+              event:
+                source: cre.log.sshd
+              match:
+                - Accepted publickey
+`
+
+var TestFailCrossScope = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCrossScope
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 15m
+        order:
+          - set:                                                        # cre.k8s is placed in a scope of its own by the test
+              window: 1m
+              match:
+                - set:
+                    event:
+                      source: cre.k8s
+                      origin: true
+                    match:
+                      - OOMKilled
+                - set:
+                    event:
+                      source: cre.cloudtrail
+                    match:
+                      - field: eventName
+                        value: TerminateInstances
+          - set:
+              event:
+                source: cre.cloudtrail
+              match:
+                - field: eventName
+                  value: RunInstances
+`
+
+var TestFailSetWithoutWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailSetWithoutWindow
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:                                                              # two conditions require a window
+        event:
+          source: cre.log.kafka
+        match:
+          - "Thread blocked"
+          - "Connection reset"
+`
+
+var TestSuccessRuleFilter = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestSuccessRuleFilter-kafka
+      tags:
+        - kafka
+    metadata:
+      id: "Qm4TzV8bHnR2xWc6YpLs3K"
+      hash: "Fd7JkP2wNq9RtB5vXm3ZcH"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - "Thread blocked"
+  - cre:
+      id: TestSuccessRuleFilter-rabbitmq
+      tags:
+        - rabbitmq
+        - queue
+    metadata:
+      id: "Wb6NcR3tLy8KpZ2vHm5QxD"
+      hash: "Ts9GhM4pXr7VkC2nBw6JqF"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.rabbitmq
+        match:
+          - "Mnesia overloaded"
+  - cre:
+      id: TestSuccessRuleFilter-broken
+    metadata:
+      id: "Hp3XvK7mRc2TwN9bLz5QyG"
+      hash: "Jn8FdW2sPk6YtM4xRb9CvL"
+      generation: 1
+    rule:
+      sequence:                                                         # fails unless filtered out
+        window: often
+        event:
+          source: cre.log.kafka
+        order:
+          - "Thread blocked"
+          - "Connection reset"
+`